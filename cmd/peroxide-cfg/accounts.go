@@ -48,6 +48,30 @@ func askPass(prompt string) ([]byte, error) {
 	return b, err
 }
 
+// bringOnline connects the account for the actions working with its messages,
+// which need the server to be stopped.
+func bringOnline(b *bridge.Bridge, accountName, keyName string) (*users.User, error) {
+	user, err := b.Users.GetUser(accountName)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot get user data: %s", err)
+	}
+
+	key, err := askPass("Key")
+	if err != nil {
+		return nil, fmt.Errorf("The key is required to access the messages: %s", err)
+	}
+
+	if keyName == "" {
+		keyName = "main"
+	}
+
+	if err := user.BringOnline(keyName, string(key)); err != nil {
+		return nil, fmt.Errorf("Cannot bring account %s online: %s", accountName, err)
+	}
+
+	return user, nil
+}
+
 func listAccounts(b *bridge.Bridge) {
 	for idx, user := range b.Users.GetUsers() {
 		fmt.Printf("%3d: %s ", idx, user.Username())
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/bridge"
+	"github.com/ljanyst/peroxide/pkg/exporter"
+)
+
+const syncPollInterval = time.Second
+
+func exportMessages(b *bridge.Bridge, accountName, keyName, path, format string) error {
+	if accountName == "" || path == "" {
+		return fmt.Errorf("Account name or export path empty")
+	}
+
+	user, err := bringOnline(b, accountName, keyName)
+	if err != nil {
+		return err
+	}
+
+	store := user.GetStore()
+	if store == nil {
+		return fmt.Errorf("The account %s has no message store", accountName)
+	}
+
+	ex, err := exporter.New(store, path, format)
+	if err != nil {
+		return fmt.Errorf("Cannot start export: %s", err)
+	}
+
+	err = runWithProgress(func(ctx context.Context) error {
+		// The export needs the list of the messages to be complete.
+		for !store.GetStatus().SyncFinished {
+			select {
+			case <-time.After(syncPollInterval):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return ex.Export(ctx)
+	}, func() {
+		if !store.GetStatus().SyncFinished {
+			fmt.Printf("Waiting for the sync to finish...\n")
+			return
+		}
+		progress := ex.GetProgress()
+		fmt.Printf("Written: %d, updated: %d, removed: %d, failed: %d\n",
+			progress.Written, progress.Updated, progress.Removed, progress.Failed)
+	})
+	if err != nil {
+		return fmt.Errorf("Export interrupted, run again to resume: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ljanyst/peroxide/pkg/bridge"
+	"github.com/ljanyst/peroxide/pkg/importer"
+)
+
+func importMessages(b *bridge.Bridge, accountName, keyName, path, address, journal string, workers int) error {
+	if accountName == "" || path == "" {
+		return fmt.Errorf("Account name or import path empty")
+	}
+
+	user, err := bringOnline(b, accountName, keyName)
+	if err != nil {
+		return err
+	}
+
+	if journal == "" {
+		journal = importer.GetJournalPath(path)
+	}
+
+	im, err := importer.New(user.GetClient(), address, journal, workers)
+	if err != nil {
+		return fmt.Errorf("Cannot start import: %s", err)
+	}
+	defer im.Close() //nolint:errcheck
+
+	err = runWithProgress(func(ctx context.Context) error {
+		return im.Import(ctx, path)
+	}, func() {
+		progress := im.GetProgress()
+		fmt.Printf("Imported: %d, skipped: %d, failed: %d\n", progress.Imported, progress.Skipped, progress.Failed)
+	})
+	if err != nil {
+		return fmt.Errorf("Import interrupted, run again to resume: %s", err)
+	}
+
+	return nil
+}
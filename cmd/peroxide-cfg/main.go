@@ -23,17 +23,25 @@ import (
 	"os"
 
 	"github.com/ljanyst/peroxide/pkg/bridge"
+	"github.com/ljanyst/peroxide/pkg/exporter"
+	"github.com/ljanyst/peroxide/pkg/importer"
 	"github.com/ljanyst/peroxide/pkg/logging"
 )
 
 var config = flag.String("config", "/etc/peroxide.conf", "configuration file")
-var action = flag.String("action", "", "one of: gen-x509, list-accounts, delete-account, login-account, add-key, remove-key")
+var action = flag.String("action", "", "one of: gen-x509, list-accounts, delete-account, login-account, add-key, remove-key, import, export")
 var x509Org = flag.String("x509-org", "", "organization name to be used in X509 certificate")
 var x509Cn = flag.String("x509-cn", "", "common name to be used in X509 certificate")
 var x509KeyFile = flag.String("x509-key", "key.pem", "output file for the RSA key")
 var x509CertFile = flag.String("x509-cert", "cert.pem", "output file for the X509 certificate")
 var accountName = flag.String("account-name", "", "account name")
 var keyName = flag.String("key-name", "", "key name")
+var importPath = flag.String("import-path", "", "mbox file or directory of mbox files and Maildirs to import")
+var importAddress = flag.String("import-address", "", "address to import the messages to; the primary one if empty")
+var importJournal = flag.String("import-journal", "", "journal of the imported messages; the import path with the .import-journal suffix if empty")
+var importWorkers = flag.Int("import-workers", importer.DefaultWorkers, "number of batches imported in parallel")
+var exportPath = flag.String("export-path", "", "directory to export the messages to")
+var exportFormat = flag.String("export-format", exporter.FormatMaildir, "format of the export: maildir or mbox")
 var logLevel = flag.String("log-level", "Warning", "account name")
 
 func main() {
@@ -63,6 +71,10 @@ func main() {
 		err = addKey(b, *accountName, *keyName)
 	case "remove-key":
 		err = removeKey(b, *accountName, *keyName)
+	case "import":
+		err = importMessages(b, *accountName, *keyName, *importPath, *importAddress, *importJournal, *importWorkers)
+	case "export":
+		err = exportMessages(b, *accountName, *keyName, *exportPath, *exportFormat)
 	default:
 		done = false
 	}
@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeHandshakeTimeout limits how long a challenge connection may stay open.
+const acmeHandshakeTimeout = time.Minute
+
+// newACMEManager returns a manager obtaining and renewing the certificate of
+// the configured domain using the TLS-ALPN-01 challenge.
+func newACMEManager(s *settings.Settings) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: s.Get(settings.ACMEDirectoryURL)}
+
+	// Test directories, such as Pebble, serve the API with their own CA.
+	if caPath := s.Get(settings.ACMEDirectoryCA); caPath != "" {
+		pem, err := ioutil.ReadFile(caPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read the ACME directory CA")
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates in the ACME directory CA file")
+		}
+
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(s.Get(settings.ACMECacheDir)),
+		HostPolicy: autocert.HostWhitelist(s.Get(settings.ACMEDomain)),
+		Email:      s.Get(settings.ACMEEmail),
+		Client:     client,
+	}, nil
+}
+
+// acmeServerConfig returns a config serving the certificate of the manager.
+// Clients not sending SNI get the certificate of the configured domain.
+func acmeServerConfig(manager *autocert.Manager, domain string) *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				withName := *hello
+				withName.ServerName = domain
+				hello = &withName
+			}
+
+			return manager.GetCertificate(hello)
+		},
+	}
+}
+
+// serveACMEChallenges answers the TLS-ALPN-01 challenges of the ACME server
+// on the given address. The challenge is completed during the handshake, so
+// the connections are closed right after it.
+func serveACMEChallenges(address string, manager *autocert.Manager) {
+	l := log.WithField("address", address)
+
+	listener, err := tls.Listen("tcp", address, manager.TLSConfig())
+	if err != nil {
+		l.WithError(err).Error("Cannot listen for ACME challenges")
+		return
+	}
+
+	l.Info("Serving ACME challenges")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			l.WithError(err).Error("Stopped serving ACME challenges")
+			return
+		}
+
+		go func() {
+			defer conn.Close() //nolint:errcheck
+
+			if err := conn.SetDeadline(time.Now().Add(acmeHandshakeTimeout)); err != nil {
+				return
+			}
+
+			if err := conn.(*tls.Conn).Handshake(); err != nil {
+				l.WithError(err).Debug("ACME challenge handshake failed")
+			}
+		}()
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestACMEDirectory starts a stand-in for a test ACME server, such as
+// Pebble, which serves its directory with a certificate of its own CA.
+func newTestACMEDirectory(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		require.NoError(t, json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   server.URL + "/nonce-plz",
+			"newAccount": server.URL + "/sign-me-up",
+			"newOrder":   server.URL + "/order-plz",
+			"revokeCert": server.URL + "/revoke-cert",
+			"keyChange":  server.URL + "/rollover-account-key",
+		}))
+	}))
+
+	return server
+}
+
+func newTestACMESettings(t *testing.T, values map[string]string) *settings.Settings {
+	data, err := json.Marshal(values)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "settings.yaml")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	return settings.New(path)
+}
+
+func TestACMEDirectoryCA(t *testing.T) {
+	server := newTestACMEDirectory(t)
+	defer server.Close()
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600))
+
+	// Without the CA the directory cannot be trusted.
+	manager, err := newACMEManager(newTestACMESettings(t, map[string]string{
+		settings.ACMEDirectoryURL: server.URL + "/dir",
+	}))
+	require.NoError(t, err)
+
+	_, err = manager.Client.Discover(context.Background())
+	require.Error(t, err)
+
+	manager, err = newACMEManager(newTestACMESettings(t, map[string]string{
+		settings.ACMEDirectoryURL: server.URL + "/dir",
+		settings.ACMEDirectoryCA:  caPath,
+	}))
+	require.NoError(t, err)
+
+	dir, err := manager.Client.Discover(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, server.URL+"/order-plz", dir.OrderURL)
+}
+
+func TestACMEDirectoryCAInvalid(t *testing.T) {
+	noCerts := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(noCerts, []byte("not a certificate"), 0600))
+
+	for _, caPath := range []string{filepath.Join(t.TempDir(), "missing.pem"), noCerts} {
+		_, err := newACMEManager(newTestACMESettings(t, map[string]string{
+			settings.ACMEDirectoryURL: "https://localhost:14000/dir",
+			settings.ACMEDirectoryCA:  caPath,
+		}))
+		require.Error(t, err, caPath)
+	}
+}
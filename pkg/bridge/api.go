@@ -0,0 +1,676 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/exporter"
+	"github.com/ljanyst/peroxide/pkg/importer"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/metrics"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/serverutil"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/ljanyst/peroxide/pkg/users/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	apiTokenSize        = 32
+	pendingLoginTimeout = 10 * time.Minute
+)
+
+var (
+	errAPIUnauthorized  = errors.New("invalid API token")
+	errAPINotFound      = errors.New("no such resource")
+	errAPIBadRequest    = errors.New("malformed request")
+	errAPINoLogin       = errors.New("no such login in progress")
+	errAPIMissingKey    = errors.New("the main key is required to modify an existing user")
+	errAPIMissingFields = errors.New("required fields are missing")
+	errAPITaskRunning   = errors.New("the previous run has not finished yet")
+	errAPINoTask        = errors.New("nothing was started for the user")
+)
+
+// pendingLogin is a login waiting for the 2FA code or the mailbox password.
+type pendingLogin struct {
+	client   pmapi.Client
+	auth     *pmapi.Auth
+	password []byte
+	mainKey  string
+	expires  time.Time
+}
+
+// apiTask is an import or an export started through the API, running in the
+// background.
+type apiTask struct {
+	progress func() interface{}
+	cancel   context.CancelFunc
+	running  bool
+	err      error
+}
+
+// apiServer is the local control API of the running daemon. It exposes the
+// account management of users.Users over HTTP, so that the changes take
+// effect without restarting the daemon. It implements serverutil.Server.
+type apiServer struct {
+	address string
+	port    int
+	token   string
+	users   *users.Users
+
+	connectivity *apiConnectivity
+
+	logins     map[string]*pendingLogin
+	loginsLock sync.Mutex
+
+	imports   map[string]*apiTask
+	exports   map[string]*apiTask
+	tasksLock sync.Mutex
+
+	server     *http.Server
+	controller serverutil.Controller
+}
+
+func newAPIServer(
+	address string,
+	port int,
+	token string,
+	users *users.Users,
+	connectivity *apiConnectivity,
+	eventListener listener.Listener,
+) *apiServer {
+	server := &apiServer{
+		address:      address,
+		port:         port,
+		token:        token,
+		users:        users,
+		connectivity: connectivity,
+		logins:       make(map[string]*pendingLogin),
+		imports:      make(map[string]*apiTask),
+		exports:      make(map[string]*apiTask),
+	}
+
+	server.server = &http.Server{
+		Addr:              server.Address(),
+		Handler:           server,
+		ReadHeaderTimeout: time.Minute,
+	}
+	server.controller = serverutil.NewController(server, eventListener)
+	return server
+}
+
+// loadAPIToken reads the token authenticating the API clients. The token is
+// generated on the first start.
+func loadAPIToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("the API token file %s is empty", path)
+		}
+		return token, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "failed to read the API token")
+	}
+
+	token := hex.EncodeToString(credentials.GenerateKey(apiTokenSize))
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", errors.Wrap(err, "failed to write the API token")
+	}
+
+	log.WithField("path", path).Info("Generated a new API token")
+
+	return token, nil
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const bearer = "Bearer "
+	auth := r.Header.Get("Authorization")
+	authorized := strings.HasPrefix(auth, bearer) &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, bearer)), []byte(s.token)) == 1
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	// The probes are open so that the service managers and load balancers
+	// do not need the token; the state of the users is given only with it.
+	if r.Method == http.MethodGet && len(parts) == 1 && (parts[0] == "health" || parts[0] == "ready") {
+		s.serveHealth(w, parts[0] == "ready", authorized)
+		return
+	}
+
+	if !authorized {
+		writeAPIError(w, http.StatusUnauthorized, errAPIUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "users":
+		s.listUsers(w)
+
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "metrics":
+		metrics.Handler().ServeHTTP(w, r)
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "login":
+		s.login(w, r)
+
+	case r.Method == http.MethodPost && len(parts) == 2 && parts[0] == "login":
+		s.finishLogin(w, r, parts[1])
+
+	case len(parts) >= 2 && parts[0] == "users":
+		user, err := s.users.GetUser(parts[1])
+		if err != nil {
+			writeAPIError(w, http.StatusNotFound, err)
+			return
+		}
+		s.serveUser(w, r, user, parts[2:])
+
+	default:
+		writeAPIError(w, http.StatusNotFound, errAPINotFound)
+	}
+}
+
+func (s *apiServer) serveUser(w http.ResponseWriter, r *http.Request, user *users.User, parts []string) {
+	var err error
+
+	switch {
+	case r.Method == http.MethodDelete && len(parts) == 0:
+		if err = user.Logout(); err == nil {
+			err = s.users.DeleteUser(user.ID(), true)
+		}
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "keys":
+		s.addKey(w, r, user)
+		return
+
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "keys":
+		err = user.RemoveKeySlot(parts[1])
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "logout":
+		err = user.Logout()
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "clear-cache":
+		err = user.ClearCache()
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "rotate-cache-key":
+		err = user.RotateCacheKey()
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "resync":
+		err = user.Resync()
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "import":
+		s.startImport(w, r, user)
+		return
+
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "import":
+		s.getTask(w, s.imports, user)
+		return
+
+	case r.Method == http.MethodDelete && len(parts) == 1 && parts[0] == "import":
+		s.cancelTask(w, s.imports, user)
+		return
+
+	case r.Method == http.MethodPost && len(parts) == 1 && parts[0] == "export":
+		s.startExport(w, r, user)
+		return
+
+	case r.Method == http.MethodGet && len(parts) == 1 && parts[0] == "export":
+		s.getTask(w, s.exports, user)
+		return
+
+	case r.Method == http.MethodDelete && len(parts) == 1 && parts[0] == "export":
+		s.cancelTask(w, s.exports, user)
+		return
+
+	default:
+		writeAPIError(w, http.StatusNotFound, errAPINotFound)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == users.ErrOfflineUser || err == store.ErrCacheKeyRotating {
+			status = http.StatusConflict
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiUser struct {
+	ID        string
+	Username  string
+	Addresses []string
+	KeySlots  []string
+	Connected bool
+	Online    bool
+}
+
+func (s *apiServer) listUsers(w http.ResponseWriter) {
+	res := []apiUser{}
+
+	for _, user := range s.users.GetUsers() {
+		slots, err := user.ListKeySlots()
+		if err != nil {
+			log.WithError(err).WithField("user", user.ID()).Warn("Cannot list key slots")
+		}
+
+		res = append(res, apiUser{
+			ID:        user.ID(),
+			Username:  user.Username(),
+			Addresses: user.GetAddresses(),
+			KeySlots:  slots,
+			Connected: user.IsConnected(),
+			Online:    user.IsOnline(),
+		})
+	}
+
+	writeAPIResponse(w, http.StatusOK, res)
+}
+
+type loginResponse struct {
+	LoginID         string `json:",omitempty"`
+	TwoFactor       bool   `json:",omitempty"`
+	MailboxPassword bool   `json:",omitempty"`
+	Username        string `json:",omitempty"`
+	MainKey         string `json:",omitempty"`
+}
+
+// login starts the login of a new or an existing user. If the account needs
+// the 2FA code or the mailbox password, the login is finished by a request
+// to /login/<LoginID>.
+func (s *apiServer) login(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Username string
+		Password string
+		MainKey  string
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	if req.Username == "" || req.Password == "" {
+		writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+		return
+	}
+
+	if user, _ := s.users.GetUser(req.Username); user != nil {
+		if req.MainKey == "" {
+			writeAPIError(w, http.StatusUnauthorized, errAPIMissingKey)
+			return
+		}
+
+		if err := user.UnlockCredentials("main", req.MainKey); err != nil {
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	client, auth, err := s.users.Login(req.Username, []byte(req.Password))
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	login := &pendingLogin{
+		client:   client,
+		auth:     auth,
+		password: []byte(req.Password),
+		mainKey:  req.MainKey,
+		expires:  time.Now().Add(pendingLoginTimeout),
+	}
+
+	if !auth.HasTwoFactor() && !auth.HasMailboxPassword() {
+		s.completeLogin(w, login, login.password)
+		return
+	}
+
+	loginID := hex.EncodeToString(credentials.GenerateKey(16))
+
+	s.loginsLock.Lock()
+	s.dropExpiredLogins()
+	s.logins[loginID] = login
+	s.loginsLock.Unlock()
+
+	writeAPIResponse(w, http.StatusAccepted, loginResponse{
+		LoginID:         loginID,
+		TwoFactor:       auth.HasTwoFactor(),
+		MailboxPassword: auth.HasMailboxPassword(),
+	})
+}
+
+func (s *apiServer) finishLogin(w http.ResponseWriter, r *http.Request, loginID string) {
+	var req struct {
+		Code            string
+		MailboxPassword string
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	s.loginsLock.Lock()
+	s.dropExpiredLogins()
+	login, ok := s.logins[loginID]
+	delete(s.logins, loginID)
+	s.loginsLock.Unlock()
+
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errAPINoLogin)
+		return
+	}
+
+	if login.auth.HasTwoFactor() {
+		if req.Code == "" {
+			writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+			return
+		}
+
+		if err := login.client.Auth2FA(context.Background(), req.Code); err != nil {
+			writeAPIError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+
+	mailboxPassword := login.password
+	if login.auth.HasMailboxPassword() {
+		if req.MailboxPassword == "" {
+			writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+			return
+		}
+		mailboxPassword = []byte(req.MailboxPassword)
+	}
+
+	s.completeLogin(w, login, mailboxPassword)
+}
+
+func (s *apiServer) completeLogin(w http.ResponseWriter, login *pendingLogin, mailboxPassword []byte) {
+	user, mainKey, err := s.users.FinishRelogin(login.client, login.auth, mailboxPassword, login.mainKey)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err == users.ErrWrongMailboxPassword || err == credentials.ErrUnauthorized {
+			status = http.StatusUnauthorized
+		}
+		writeAPIError(w, status, err)
+		return
+	}
+
+	log.WithField("user", user.ID()).Info("User logged in through the API")
+
+	writeAPIResponse(w, http.StatusOK, loginResponse{
+		Username: user.Username(),
+		MainKey:  mainKey,
+	})
+}
+
+// dropExpiredLogins must be called with the logins lock held.
+func (s *apiServer) dropExpiredLogins() {
+	now := time.Now()
+	for loginID, login := range s.logins {
+		if now.After(login.expires) {
+			delete(s.logins, loginID)
+		}
+	}
+}
+
+func (s *apiServer) addKey(w http.ResponseWriter, r *http.Request, user *users.User) {
+	var req struct {
+		Name    string
+		MainKey string
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	if req.Name == "" || req.MainKey == "" {
+		writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+		return
+	}
+
+	key, err := user.AddKeySlot(req.Name, req.MainKey)
+	if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, struct{ Key string }{key})
+}
+
+// startImport starts the import of an mbox file or a directory of mbox files
+// and Maildirs on the local filesystem. The import runs in the background and
+// its progress is reported at the same path.
+func (s *apiServer) startImport(w http.ResponseWriter, r *http.Request, user *users.User) {
+	var req struct {
+		Path    string
+		Address string
+		Journal string
+		Workers int
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	if req.Path == "" {
+		writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+		return
+	}
+
+	if !user.IsOnline() {
+		writeAPIError(w, http.StatusConflict, users.ErrOfflineUser)
+		return
+	}
+
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	if task, ok := s.imports[user.ID()]; ok && task.running {
+		writeAPIError(w, http.StatusConflict, errAPITaskRunning)
+		return
+	}
+
+	if req.Journal == "" {
+		req.Journal = importer.GetJournalPath(req.Path)
+	}
+
+	im, err := importer.New(user.GetClient(), req.Address, req.Journal, req.Workers)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	task := s.startTask(user, "Import", func(ctx context.Context) error {
+		err := im.Import(ctx, req.Path)
+		if closeErr := im.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, func() interface{} { return im.GetProgress() })
+	s.imports[user.ID()] = task
+
+	writeAPIResponse(w, http.StatusAccepted, getAPITaskResponse(task))
+}
+
+// startExport starts the export of the decrypted messages to a Maildir or an
+// mbox tree on the local filesystem, the same way as startImport.
+func (s *apiServer) startExport(w http.ResponseWriter, r *http.Request, user *users.User) {
+	var req struct {
+		Path   string
+		Format string
+	}
+	if !readAPIRequest(w, r, &req) {
+		return
+	}
+
+	if req.Path == "" {
+		writeAPIError(w, http.StatusBadRequest, errAPIMissingFields)
+		return
+	}
+
+	if !user.IsOnline() || user.GetStore() == nil {
+		writeAPIError(w, http.StatusConflict, users.ErrOfflineUser)
+		return
+	}
+
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	if task, ok := s.exports[user.ID()]; ok && task.running {
+		writeAPIError(w, http.StatusConflict, errAPITaskRunning)
+		return
+	}
+
+	ex, err := exporter.New(user.GetStore(), req.Path, req.Format)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	task := s.startTask(user, "Export", ex.Export, func() interface{} { return ex.GetProgress() })
+	s.exports[user.ID()] = task
+
+	writeAPIResponse(w, http.StatusAccepted, getAPITaskResponse(task))
+}
+
+// startTask runs the task in the background. It is called with tasksLock.
+func (s *apiServer) startTask(
+	user *users.User,
+	name string,
+	run func(context.Context) error,
+	progress func() interface{},
+) *apiTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &apiTask{progress: progress, cancel: cancel, running: true}
+
+	go func() {
+		err := run(ctx)
+		if err != nil {
+			log.WithError(err).WithField("user", user.ID()).Warn(name + " stopped")
+		}
+
+		s.tasksLock.Lock()
+		defer s.tasksLock.Unlock()
+
+		task.running, task.err = false, err
+	}()
+
+	return task
+}
+
+type taskResponse struct {
+	Running  bool
+	Progress interface{}
+	Error    string `json:",omitempty"`
+}
+
+func (s *apiServer) getTask(w http.ResponseWriter, tasks map[string]*apiTask, user *users.User) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	task, ok := tasks[user.ID()]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errAPINoTask)
+		return
+	}
+
+	writeAPIResponse(w, http.StatusOK, getAPITaskResponse(task))
+}
+
+func (s *apiServer) cancelTask(w http.ResponseWriter, tasks map[string]*apiTask, user *users.User) {
+	s.tasksLock.Lock()
+	defer s.tasksLock.Unlock()
+
+	task, ok := tasks[user.ID()]
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, errAPINoTask)
+		return
+	}
+
+	task.cancel()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getAPITaskResponse(task *apiTask) taskResponse {
+	res := taskResponse{
+		Running:  task.running,
+		Progress: task.progress(),
+	}
+	if task.err != nil {
+		res.Error = task.err.Error()
+	}
+	return res
+}
+
+func readAPIRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errAPIBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.WithError(err).Warn("Cannot write API response")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResponse(w, status, struct{ Error string }{err.Error()})
+}
+
+// ListenAndServe will run server and all monitors.
+func (s *apiServer) ListenAndServe() { s.controller.ListenAndServe() }
+
+// Close turns off server and monitors.
+func (s *apiServer) Close() { s.controller.Close() }
+
+// Implements serverutil.Server interface.
+
+func (s *apiServer) Protocol() serverutil.Protocol { return serverutil.HTTP }
+func (s *apiServer) UseSSL() bool                  { return false }
+func (s *apiServer) Address() string               { return fmt.Sprintf("%s:%d", s.address, s.port) }
+func (s *apiServer) TLSConfig() *tls.Config        { return nil }
+
+func (s *apiServer) DebugServer() bool { return false }
+func (s *apiServer) DebugClient() bool { return false }
+
+func (s *apiServer) SetLoggers(localDebug, remoteDebug io.Writer) {}
+
+func (s *apiServer) DisconnectUser(address string) {}
+
+func (s *apiServer) Serve(l net.Listener) error { return s.server.Serve(l) }
+func (s *apiServer) StopServe() error           { return s.server.Close() }
@@ -0,0 +1,78 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAPIToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api-token")
+
+	token, err := loadAPIToken(path)
+	require.NoError(t, err)
+	require.Len(t, token, 2*apiTokenSize)
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	reloaded, err := loadAPIToken(path)
+	require.NoError(t, err)
+	require.Equal(t, token, reloaded)
+}
+
+func TestAPIUnauthorized(t *testing.T) {
+	server := &apiServer{token: "secret"}
+
+	for _, auth := range []string{"", "secret", "Bearer ", "Bearer secret2", "Basic secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/nothing", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestAPIMetrics(t *testing.T) {
+	server := &apiServer{token: "secret"}
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "# TYPE peroxide_api_requests_total counter")
+}
@@ -19,6 +19,7 @@
 package bridge
 
 import (
+	"crypto/tls"
 	"errors"
 	"math/rand"
 	"os"
@@ -28,6 +29,7 @@ import (
 
 	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/cookies"
+	"github.com/ljanyst/peroxide/pkg/dav"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/imap"
 	"github.com/ljanyst/peroxide/pkg/listener"
@@ -50,8 +52,20 @@ var ErrLocalCacheUnavailable = errors.New("local cache is unavailable")
 type Bridge struct {
 	Users *users.Users
 
-	settings *settings.Settings
-	listener listener.Listener
+	settings     *settings.Settings
+	listener     listener.Listener
+	connectivity *apiConnectivity
+	outbox       *smtp.OutboundQueue
+	messageCache cache.Cache
+	builder      *message.Builder
+
+	tls         *tlsConfigStore
+	imapBackend interface {
+		SetOptions(listWorkers int, bccSelf, isAllMailVisible, labelsAsKeywords bool)
+	}
+	smtpBackend interface {
+		SetBCCSelf(bccSelf bool)
+	}
 }
 
 func (b *Bridge) Configure(configFile string) error {
@@ -86,6 +100,22 @@ func (b *Bridge) Configure(configFile string) error {
 
 	cm.SetCookieJar(jar)
 
+	connectivity := newAPIConnectivity()
+	cm.AddConnectionObserver(connectivity)
+
+	// The messages which cannot be sent while the API is unreachable are
+	// kept in the outbound queue, unless the queue directory is empty. A
+	// queue which cannot be opened is not worth refusing to start.
+	var outbox *smtp.OutboundQueue
+	if queueDir := settingsObj.Get(settings.SMTPQueueDir); queueDir != "" {
+		expiry := time.Duration(settingsObj.GetInt(settings.SMTPQueueExpiry)) * time.Hour
+		if outbox, err = smtp.NewOutboundQueue(listener, queueDir, expiry); err != nil {
+			log.WithError(err).Warn("Cannot open the outbound queue, running without it")
+		} else {
+			cm.AddConnectionObserver(outbox)
+		}
+	}
+
 	if settingsObj.GetBool(settings.AllowProxyKey) {
 		cm.AllowProxy()
 	}
@@ -115,47 +145,188 @@ func (b *Bridge) Configure(configFile string) error {
 	b.Users = u
 	b.settings = settingsObj
 	b.listener = listener
+	b.connectivity = connectivity
+	b.outbox = outbox
+	b.messageCache = cache
+	b.builder = builder
 	return nil
 }
 
 func (b *Bridge) Run() error {
-	tlsConfig, err := loadTlsConfig(
-		b.settings.Get(settings.X509Cert),
-		b.settings.Get(settings.X509Key),
-	)
+	var tlsConfig *tls.Config
+	if domain := b.settings.Get(settings.ACMEDomain); domain != "" {
+		manager, err := newACMEManager(b.settings)
+		if err != nil {
+			return err
+		}
+
+		go serveACMEChallenges(b.settings.Get(settings.ACMEChallengeAddress), manager)
+		tlsConfig = acmeServerConfig(manager, domain)
+	} else {
+		tlsStore, err := newTLSConfigStore(
+			b.settings.Get(settings.X509Cert),
+			b.settings.Get(settings.X509Key),
+		)
+		if err != nil {
+			return err
+		}
+
+		go tlsStore.watch(certWatchInterval)
+		tlsConfig = tlsStore.serverConfig()
+		b.tls = tlsStore
+	}
+
+	apiToken, err := loadAPIToken(b.settings.Get(settings.APITokenFile))
 	if err != nil {
 		return err
 	}
 
 	bccSelf := b.settings.GetBool(settings.BCCSelf)
 	isAllMailVisible := b.settings.GetBool(settings.IsAllMailVisible)
-	imapBackend := imap.NewIMAPBackend(b.listener, b.settings, b.Users, bccSelf, isAllMailVisible)
-	smtpBackend := smtp.NewSMTPBackend(b.listener, b.Users, bccSelf)
+	labelsAsKeywords := b.settings.GetBool(settings.LabelsAsKeywords)
+	imapBackend := imap.NewIMAPBackend(b.listener, b.settings, b.Users, bccSelf, isAllMailVisible, labelsAsKeywords, b.outbox)
+	smtpBackend := smtp.NewSMTPBackend(b.listener, b.Users, bccSelf, b.outbox)
 	serverAddress := b.settings.Get(settings.ServerAddress)
 
-	go func() {
-		imapPort := b.settings.GetInt(settings.IMAPPortKey)
-		imap.NewIMAPServer(
-			false, // log client
-			false, // log server
-			serverAddress, imapPort, tlsConfig,
-			imapBackend, b.listener).ListenAndServe()
-	}()
+	b.imapBackend = imapBackend
+	b.smtpBackend = smtpBackend
+
+	allowInsecureAuth := b.settings.GetBool(settings.AllowInsecureAuthKey)
+	allowCompression := b.settings.GetBool(settings.IMAPCompressionKey)
+
+	// Port 0 disables the listener, e.g. to serve only implicit TLS.
+	for _, ports := range []struct {
+		imapPortKey, smtpPortKey string
+		useSSL                   bool
+	}{
+		{settings.IMAPPortKey, settings.SMTPPortKey, false},
+		{settings.IMAPSPortKey, settings.SMTPSPortKey, true},
+	} {
+		if imapPort := b.settings.GetInt(ports.imapPortKey); imapPort != 0 {
+			go imap.NewIMAPServer(
+				false, // log client
+				false, // log server
+				serverAddress, imapPort, ports.useSSL, allowInsecureAuth, allowCompression, tlsConfig,
+				imapBackend, b.listener).ListenAndServe()
+		}
+
+		if smtpPort := b.settings.GetInt(ports.smtpPortKey); smtpPort != 0 {
+			go smtp.NewSMTPServer(
+				false,
+				serverAddress, smtpPort, ports.useSSL, allowInsecureAuth, tlsConfig,
+				smtpBackend, b.listener).ListenAndServe()
+		}
+	}
+
+	if davPort := b.settings.GetInt(settings.DAVPortKey); davPort != 0 {
+		go dav.NewDAVServer(
+			serverAddress, davPort, tlsConfig,
+			b.Users, b.listener).ListenAndServe()
+	}
 
 	go func() {
-		smtpPort := b.settings.GetInt(settings.SMTPPortKey)
-		useSSL := false
-		smtp.NewSMTPServer(
-			false,
-			serverAddress, smtpPort, useSSL, tlsConfig,
-			smtpBackend, b.listener).ListenAndServe()
+		apiPort := b.settings.GetInt(settings.APIPortKey)
+		newAPIServer(
+			b.settings.Get(settings.APIAddress), apiPort, apiToken,
+			b.Users, b.connectivity, b.listener).ListenAndServe()
 	}()
 
+	sdNotify("READY=1")
+	if interval := getWatchdogInterval(); interval != 0 {
+		go b.runWatchdog(interval)
+	}
+
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
-	<-done
 
-	return nil
+	for {
+		select {
+		case <-reload:
+			sdNotify("RELOADING=1")
+			b.reload()
+			sdNotify("READY=1")
+		case <-done:
+			sdNotify("STOPPING=1")
+			return nil
+		}
+	}
+}
+
+// reload re-reads the settings file and applies the changed values to the
+// running components. The values which require a restart are only logged.
+func (b *Bridge) reload() {
+	changed, err := b.settings.Reload()
+	if err != nil {
+		log.WithError(err).Error("Cannot reload settings, keeping the current ones")
+		return
+	}
+
+	if len(changed) == 0 {
+		log.Info("Settings reloaded, nothing changed")
+		return
+	}
+
+	applied := map[string]bool{}
+	apply := func(keys ...string) {
+		for _, key := range keys {
+			applied[key] = true
+		}
+	}
+
+	if b.tls != nil && hasAnyKey(changed, settings.X509Cert, settings.X509Key) {
+		if err := b.tls.reload(
+			b.settings.Get(settings.X509Cert),
+			b.settings.Get(settings.X509Key),
+		); err != nil {
+			log.WithError(err).Error("Cannot reload the TLS certificate, keeping the current one")
+		} else {
+			apply(settings.X509Cert, settings.X509Key)
+		}
+	}
+
+	if hasAnyKey(changed,
+		settings.CacheMinFreeAbsKey, settings.CacheMinFreeRatKey,
+		settings.CacheMaxSizeKey, settings.CacheMaxUserSizeKey,
+		settings.CacheConcurrencyRead, settings.CacheConcurrencyWrite,
+	) && cache.UpdateMessageCache(b.messageCache, b.settings) {
+		apply(
+			settings.CacheMinFreeAbsKey, settings.CacheMinFreeRatKey,
+			settings.CacheMaxSizeKey, settings.CacheMaxUserSizeKey,
+			settings.CacheConcurrencyRead, settings.CacheConcurrencyWrite,
+		)
+	}
+
+	// The stores read the prefetch policy on every pass of the cache watcher.
+	apply(
+		settings.CachePrefetchKey, settings.CachePrefetchAgeKey,
+		settings.CachePrefetchLabels, settings.CachePrefetchSizeKey,
+	)
+
+	b.builder.SetWorkers(
+		b.settings.GetInt(settings.FetchWorkers),
+		b.settings.GetInt(settings.AttachmentWorkers),
+	)
+	apply(settings.FetchWorkers, settings.AttachmentWorkers)
+
+	b.imapBackend.SetOptions(
+		b.settings.GetInt(settings.IMAPWorkers),
+		b.settings.GetBool(settings.BCCSelf),
+		b.settings.GetBool(settings.IsAllMailVisible),
+		b.settings.GetBool(settings.LabelsAsKeywords),
+	)
+	b.smtpBackend.SetBCCSelf(b.settings.GetBool(settings.BCCSelf))
+	apply(settings.IMAPWorkers, settings.BCCSelf, settings.IsAllMailVisible, settings.LabelsAsKeywords)
+
+	for _, key := range changed {
+		if applied[key] {
+			log.WithField("key", key).Info("Setting applied")
+		} else {
+			log.WithField("key", key).Warn("Setting cannot be applied without a restart")
+		}
+	}
 }
 
 // FactoryReset will remove all local cache and settings.
@@ -0,0 +1,202 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/users"
+)
+
+// eventPollStaleAfter is how long an online user may go without a successful
+// event poll before the server stops being ready.
+const eventPollStaleAfter = 5 * time.Minute
+
+// apiConnectivity tracks whether the ProtonMail API is reachable. It observes
+// the connection state of the client manager.
+type apiConnectivity struct {
+	down  bool
+	since time.Time
+	lock  sync.RWMutex
+}
+
+func newAPIConnectivity() *apiConnectivity {
+	return &apiConnectivity{since: time.Now()}
+}
+
+func (c *apiConnectivity) OnDown() {
+	c.set(true)
+	log.Warn("ProtonMail API is unreachable")
+}
+
+func (c *apiConnectivity) OnUp() {
+	c.set(false)
+	log.Info("ProtonMail API is reachable again")
+}
+
+func (c *apiConnectivity) set(down bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.down = down
+	c.since = time.Now()
+}
+
+// get returns whether the API is reachable and since when.
+func (c *apiConnectivity) get() (bool, time.Time) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return !c.down, c.since
+}
+
+type userHealth struct {
+	ID               string
+	Username         string
+	Connected        bool
+	Locked           bool
+	Online           bool
+	SyncRunning      bool
+	SyncFinished     bool
+	EventLoopRunning bool
+	LastEventPoll    *time.Time `json:",omitempty"`
+}
+
+type healthReport struct {
+	Ready          bool
+	APIReachable   bool
+	APIStateSince  time.Time
+	Users          []userHealth
+	NotReadyReason string `json:",omitempty"`
+}
+
+// getHealth returns the state of the API connection and of every user. The
+// server is ready when the API is reachable and the event loops of all the
+// online users keep polling.
+func getHealth(users *users.Users, connectivity *apiConnectivity) healthReport {
+	report := healthReport{Users: []userHealth{}}
+	report.APIReachable, report.APIStateSince = connectivity.get()
+
+	if !report.APIReachable {
+		report.NotReadyReason = "ProtonMail API is unreachable"
+	}
+
+	for _, user := range users.GetUsers() {
+		health := userHealth{
+			ID:        user.ID(),
+			Username:  user.Username(),
+			Connected: user.IsConnected(),
+			Locked:    user.IsLocked(),
+			Online:    user.IsOnline(),
+		}
+
+		if store := user.GetStore(); store != nil {
+			status := store.GetStatus()
+			health.SyncRunning = status.SyncRunning
+			health.SyncFinished = status.SyncFinished
+			health.EventLoopRunning = status.EventLoopRunning
+			if !status.LastEventPoll.IsZero() {
+				health.LastEventPoll = &status.LastEventPoll
+			}
+		}
+
+		if report.NotReadyReason == "" && health.Online {
+			switch {
+			case !health.EventLoopRunning:
+				report.NotReadyReason = fmt.Sprintf("event loop of user %s is not running", health.ID)
+			case health.LastEventPoll == nil || time.Since(*health.LastEventPoll) > eventPollStaleAfter:
+				report.NotReadyReason = fmt.Sprintf("events of user %s were not polled recently", health.ID)
+			}
+		}
+
+		report.Users = append(report.Users, health)
+	}
+
+	report.Ready = report.NotReadyReason == ""
+
+	return report
+}
+
+// summary returns a one line description of the report for the service
+// manager.
+func (report healthReport) summary() string {
+	online := 0
+	for _, user := range report.Users {
+		if user.Online {
+			online++
+		}
+	}
+
+	state := "ready"
+	if !report.Ready {
+		state = "not ready: " + report.NotReadyReason
+	}
+
+	return fmt.Sprintf("%s, %d of %d users online", state, online, len(report.Users))
+}
+
+// healthStatus is the health report without the state of the users, given
+// to the clients without the API token.
+type healthStatus struct {
+	Ready          bool
+	APIReachable   bool
+	APIStateSince  time.Time
+	NotReadyReason string `json:",omitempty"`
+}
+
+// status returns the report without the state of the users. The reasons
+// naming a user are replaced with a general one.
+func (report healthReport) status() healthStatus {
+	status := healthStatus{
+		Ready:         report.Ready,
+		APIReachable:  report.APIReachable,
+		APIStateSince: report.APIStateSince,
+	}
+
+	switch {
+	case report.Ready:
+	case !report.APIReachable:
+		status.NotReadyReason = report.NotReadyReason
+	default:
+		status.NotReadyReason = "events of an online user are not polled"
+	}
+
+	return status
+}
+
+// serveHealth reports the health of the server. The readiness check answers
+// with 503 when the server is not ready. The state of the users is reported
+// only to the authorized clients.
+func (s *apiServer) serveHealth(w http.ResponseWriter, readiness, authorized bool) {
+	report := getHealth(s.users, s.connectivity)
+
+	status := http.StatusOK
+	if readiness && !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+
+	if !authorized {
+		writeAPIResponse(w, status, report.status())
+		return
+	}
+
+	writeAPIResponse(w, status, report)
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/users"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIReadiness(t *testing.T) {
+	connectivity := newAPIConnectivity()
+	server := &apiServer{token: "secret", users: &users.Users{}, connectivity: connectivity}
+
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, get("/ready"))
+
+	connectivity.OnDown()
+	require.Equal(t, http.StatusServiceUnavailable, get("/ready"))
+	require.Equal(t, http.StatusOK, get("/health"))
+
+	connectivity.OnUp()
+	require.Equal(t, http.StatusOK, get("/ready"))
+}
+
+func TestAPIHealthWithoutToken(t *testing.T) {
+	connectivity := newAPIConnectivity()
+	server := &apiServer{token: "secret", users: &users.Users{}, connectivity: connectivity}
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+
+	connectivity.OnDown()
+
+	rec := get("/ready", "")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Contains(t, rec.Body.String(), "unreachable")
+	require.NotContains(t, rec.Body.String(), "Users")
+
+	rec = get("/health", "wrong")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.NotContains(t, rec.Body.String(), "Users")
+
+	require.Contains(t, get("/health", "secret").Body.String(), "Users")
+	require.Equal(t, http.StatusUnauthorized, get("/users", "").Code)
+	require.Equal(t, http.StatusUnauthorized, get("/metrics", "wrong").Code)
+}
+
+func TestHealthStatus(t *testing.T) {
+	report := healthReport{
+		APIReachable:   true,
+		Users:          []userHealth{{ID: "user1", Online: true}},
+		NotReadyReason: "event loop of user user1 is not running",
+	}
+
+	status := report.status()
+	require.False(t, status.Ready)
+	require.NotContains(t, status.NotReadyReason, "user1")
+
+	report = healthReport{Ready: true, APIReachable: true}
+	require.Empty(t, report.status().NotReadyReason)
+}
+
+func TestSDNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close() //nolint:errcheck
+
+	require.NoError(t, os.Setenv("NOTIFY_SOCKET", path))
+	defer os.Unsetenv("NOTIFY_SOCKET") //nolint:errcheck
+
+	sdNotify("READY=1")
+
+	buf := make([]byte, 64)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+}
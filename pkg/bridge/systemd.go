@@ -0,0 +1,79 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends the state to the service manager when peroxide runs as
+// a notify service of systemd. It does nothing otherwise.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	// Sockets in the abstract namespace start with a zero byte.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.WithError(err).Warn("Cannot connect to the service manager")
+		return
+	}
+	defer conn.Close() //nolint:errcheck
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.WithError(err).Warn("Cannot notify the service manager")
+	}
+}
+
+// getWatchdogInterval returns how often the service manager expects the
+// watchdog pings, or zero if the watchdog is disabled.
+func getWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	// Ping twice per period so that a late tick does not trigger a restart.
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runWatchdog pings the watchdog of the service manager along with the
+// health summary. Collecting the health takes the locks of the users and
+// their stores, so a deadlocked server stops pinging and gets restarted.
+func (b *Bridge) runWatchdog(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		report := getHealth(b.Users, b.connectivity)
+		sdNotify("WATCHDOG=1\nSTATUS=" + report.summary())
+	}
+}
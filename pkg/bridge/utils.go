@@ -21,11 +21,17 @@ package bridge
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
+// certWatchInterval is how often the certificate files are checked for
+// changes.
+const certWatchInterval = time.Minute
+
 // GetConfig tries to load TLS config or generate new one which is then returned.
 func loadTlsConfig(certPath, keyPath string) (*tls.Config, error) {
 	c, err := tls.LoadX509KeyPair(certPath, keyPath)
@@ -38,8 +44,13 @@ func loadTlsConfig(certPath, keyPath string) (*tls.Config, error) {
 		return nil, errors.Wrap(err, "Failed to parse the certificate")
 	}
 
+	if time.Now().After(c.Leaf.NotAfter) {
+		return nil, errors.Errorf("The X509 certificate expired on %v", c.Leaf.NotAfter)
+	}
+
+	// The certificate is reloaded when renewed, so only warn about it.
 	if time.Now().Add(31 * 24 * time.Hour).After(c.Leaf.NotAfter) {
-		return nil, errors.Wrap(err, "The X509 certificate is about to expire")
+		log.WithField("notAfter", c.Leaf.NotAfter).Warn("The X509 certificate is about to expire")
 	}
 
 	caCertPool := x509.NewCertPool()
@@ -53,3 +64,124 @@ func loadTlsConfig(certPath, keyPath string) (*tls.Config, error) {
 		ClientCAs:    caCertPool,
 	}, nil
 }
+
+// tlsConfigStore holds the TLS config handed out to new connections so that
+// the certificate can be swapped without restarting the servers.
+type tlsConfigStore struct {
+	config            *tls.Config
+	certPath, keyPath string
+	modTime           time.Time
+	lock              sync.RWMutex
+}
+
+func newTLSConfigStore(certPath, keyPath string) (*tlsConfigStore, error) {
+	store := &tlsConfigStore{}
+
+	if err := store.reload(certPath, keyPath); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// reload loads the certificate and key from the given paths. The current
+// config is kept if they cannot be loaded.
+func (store *tlsConfigStore) reload(certPath, keyPath string) error {
+	modTime, err := getLatestModTime(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	config, err := loadTlsConfig(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.config = config
+	store.certPath = certPath
+	store.keyPath = keyPath
+	store.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the certificate and key if any of the files was
+// modified since they were last loaded.
+func (store *tlsConfigStore) reloadIfChanged() error {
+	store.lock.RLock()
+	certPath, keyPath, loaded := store.certPath, store.keyPath, store.modTime
+	store.lock.RUnlock()
+
+	modTime, err := getLatestModTime(certPath, keyPath)
+	if err != nil {
+		return err
+	}
+
+	if modTime.Equal(loaded) {
+		return nil
+	}
+
+	if err := store.reload(certPath, keyPath); err != nil {
+		return err
+	}
+
+	log.WithField("cert", certPath).Info("TLS certificate reloaded")
+	return nil
+}
+
+// watch keeps reloading the certificate and key whenever they change. Failed
+// attempts, e.g. when only one of the files has been replaced so far, are
+// retried at the next check.
+func (store *tlsConfigStore) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := store.reloadIfChanged(); err != nil {
+			log.WithError(err).Warn("Cannot reload the TLS certificate, keeping the current one")
+		}
+	}
+}
+
+// serverConfig returns a config resolving to the current one at every
+// handshake.
+func (store *tlsConfigStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			store.lock.RLock()
+			defer store.lock.RUnlock()
+
+			return store.config, nil
+		},
+	}
+}
+
+func getLatestModTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func hasAnyKey(keys []string, wanted ...string) bool {
+	for _, key := range keys {
+		for _, w := range wanted {
+			if key == w {
+				return true
+			}
+		}
+	}
+	return false
+}
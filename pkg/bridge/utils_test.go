@@ -0,0 +1,107 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package bridge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCertificate(t *testing.T, certPath, keyPath, name string, notAfter, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+
+	require.NoError(t, os.Chtimes(certPath, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+}
+
+func getServerName(t *testing.T, store *tlsConfigStore) string {
+	config, err := store.serverConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	return config.ServerName
+}
+
+func TestTLSConfigStoreReloadIfChanged(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	modTime := time.Now().Add(-time.Hour)
+	notAfter := time.Now().Add(90 * 24 * time.Hour)
+
+	writeTestCertificate(t, certPath, keyPath, "first", notAfter, modTime)
+
+	store, err := newTLSConfigStore(certPath, keyPath)
+	require.NoError(t, err)
+	require.Equal(t, "first", getServerName(t, store))
+
+	require.NoError(t, store.reloadIfChanged())
+	require.Equal(t, "first", getServerName(t, store))
+
+	// A renewal replacing only the certificate so far keeps the old config.
+	writeTestCertificate(t, certPath, filepath.Join(dir, "other.pem"), "second", notAfter, modTime.Add(time.Minute))
+	require.Error(t, store.reloadIfChanged())
+	require.Equal(t, "first", getServerName(t, store))
+
+	writeTestCertificate(t, certPath, keyPath, "second", notAfter, modTime.Add(2*time.Minute))
+	require.NoError(t, store.reloadIfChanged())
+	require.Equal(t, "second", getServerName(t, store))
+}
+
+func TestLoadTLSConfigExpired(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	// A certificate about to expire is still used.
+	writeTestCertificate(t, certPath, keyPath, "expiring", time.Now().Add(time.Hour), time.Now())
+	_, err := loadTlsConfig(certPath, keyPath)
+	require.NoError(t, err)
+
+	writeTestCertificate(t, certPath, keyPath, "expired", time.Now().Add(-time.Hour), time.Now())
+	_, err = loadTlsConfig(certPath, keyPath)
+	require.Error(t, err)
+}
@@ -38,32 +38,60 @@ func newKeyValueStore(path string) *keyValueStore {
 		path: path,
 		lock: &sync.RWMutex{},
 	}
-	if err := p.load(); err != nil {
+	if err := p.load(nil); err != nil {
 		logrus.WithError(err).Warn("Cannot load preferences file, using defaults")
 	}
 	return p
 }
 
-func (p *keyValueStore) load() error {
-	if p.cache != nil {
-		return nil
-	}
-
+// load reads the preferences file. The given function, if any, fills in the
+// defaults before the loaded values replace the current ones in a single step,
+// so that readers never see a value missing. If the file cannot be read or
+// parsed, the previously loaded values are kept.
+func (p *keyValueStore) load(setDefaults func(*keyValueStore)) error {
 	p.lock.Lock()
-	defer p.lock.Unlock()
-
-	p.cache = map[string]string{}
+	if p.cache == nil {
+		p.cache = map[string]string{}
+	}
+	p.lock.Unlock()
 
 	data, err := ioutil.ReadFile(p.path)
 	if err != nil {
 		return err
 	}
 
-	if len(data) == 0 {
-		return nil
+	next := &keyValueStore{
+		cache: map[string]string{},
+		path:  p.path,
+		lock:  &sync.RWMutex{},
+	}
+	if len(data) != 0 {
+		if err := yaml.Unmarshal(data, &next.cache); err != nil {
+			return err
+		}
+	}
+
+	if setDefaults != nil {
+		setDefaults(next)
 	}
 
-	return yaml.Unmarshal(data, &p.cache)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.cache = next.cache
+	return nil
+}
+
+// snapshot returns a copy of all the values.
+func (p *keyValueStore) snapshot() map[string]string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	values := make(map[string]string, len(p.cache))
+	for key, value := range p.cache {
+		values[key] = value
+	}
+	return values
 }
 
 func (p *keyValueStore) setDefault(key, value string) {
@@ -112,3 +112,27 @@ func checkSavedKeyValueStore(r *require.Assertions, path, expected string) {
 	r.NoError(err)
 	r.Equal(expected, string(data))
 }
+
+func TestKeyValueStoreReload(t *testing.T) {
+	r := require.New(t)
+	path, clean := newTmpFile(r)
+	defer clean()
+
+	r.NoError(ioutil.WriteFile(path, []byte("{\"key\":\"value\"}"), 0o700))
+	pref := newKeyValueStore(path)
+	r.Equal("value", pref.Get("key"))
+
+	r.NoError(ioutil.WriteFile(path, []byte("{\"key\":\"other\"}"), 0o700))
+	r.NoError(pref.load(func(next *keyValueStore) {
+		// The defaults are filled in before the new values are visible.
+		r.Equal("value", pref.Get("key"))
+		next.setDefault("key", "default")
+		next.setDefault("missing", "default")
+	}))
+	r.Equal("other", pref.Get("key"))
+	r.Equal("default", pref.Get("missing"))
+
+	r.NoError(ioutil.WriteFile(path, []byte("{\"key\":\"MISSING_QUOTES"), 0o700))
+	r.Error(pref.load(nil))
+	r.Equal("other", pref.Get("key"))
+}
@@ -20,18 +20,32 @@ package settings
 
 import (
 	"path/filepath"
+	"sort"
 )
 
 // Keys of preferences in JSON file.
 const (
 	APIPortKey            = "UserPortApi"
+	APIAddress            = "APIAddress"
+	APITokenFile          = "APITokenFile"
 	IMAPPortKey           = "UserPortImap"
 	SMTPPortKey           = "UserPortSmtp"
+	IMAPSPortKey          = "UserPortImaps"
+	SMTPSPortKey          = "UserPortSmtps"
+	AllowInsecureAuthKey  = "AllowInsecureAuth"
+	DAVPortKey            = "UserPortDav"
 	AllowProxyKey         = "AllowProxy"
 	CacheEnabledKey       = "CacheEnabled"
 	CacheCompressionKey   = "CacheCompression"
+	CacheCompressorKey    = "CacheCompressor"
 	CacheMinFreeAbsKey    = "CacheMinFreeAbs"
 	CacheMinFreeRatKey    = "CacheMinFreeRat"
+	CacheMaxSizeKey       = "CacheMaxSize"
+	CacheMaxUserSizeKey   = "CacheMaxUserSize"
+	CachePrefetchKey      = "CachePrefetch"
+	CachePrefetchAgeKey   = "CachePrefetchMaxAge"
+	CachePrefetchLabels   = "CachePrefetchLabels"
+	CachePrefetchSizeKey  = "CachePrefetchMaxSize"
 	CacheConcurrencyRead  = "CacheConcurrentRead"
 	CacheConcurrencyWrite = "CacheConcurrentWrite"
 	IMAPWorkers           = "ImapWorkers"
@@ -40,11 +54,21 @@ const (
 	CacheDir              = "CacheDir"
 	X509Key               = "X509Key"
 	X509Cert              = "X509Cert"
+	ACMEDomain            = "ACMEDomain"
+	ACMEEmail             = "ACMEEmail"
+	ACMEDirectoryURL      = "ACMEDirectoryURL"
+	ACMEDirectoryCA       = "ACMEDirectoryCA"
+	ACMECacheDir          = "ACMECacheDir"
+	ACMEChallengeAddress  = "ACMEChallengeAddress"
 	CookieJar             = "CookieJar"
 	ServerAddress         = "ServerAddress"
 	CredentialsStore      = "CredentialsStore"
 	BCCSelf               = "BCCSelf"
 	IsAllMailVisible      = "IsAllMailVisible"
+	LabelsAsKeywords      = "LabelsAsKeywords"
+	IMAPCompressionKey    = "ImapCompression"
+	SMTPQueueDir          = "SMTPQueueDir"
+	SMTPQueueExpiry       = "SMTPQueueExpiry"
 )
 
 type Settings struct {
@@ -61,6 +85,32 @@ func New(settingsPath string) *Settings {
 	return s
 }
 
+// Reload re-reads the settings file and returns the sorted keys whose values
+// changed. If the file cannot be read, the current values are kept.
+func (s *Settings) Reload() ([]string, error) {
+	old := s.snapshot()
+
+	if err := s.load(func(next *keyValueStore) {
+		(&Settings{keyValueStore: next}).setDefaultValues()
+	}); err != nil {
+		return nil, err
+	}
+
+	changed := []string{}
+	for key, value := range s.snapshot() {
+		if old[key] != value {
+			changed = append(changed, key)
+		}
+		delete(old, key)
+	}
+	for key := range old {
+		changed = append(changed, key)
+	}
+	sort.Strings(changed)
+
+	return changed, nil
+}
+
 const (
 	DefaultIMAPPort = "1143"
 	DefaultSMTPPort = "1025"
@@ -71,8 +121,15 @@ func (s *Settings) setDefaultValues() {
 	s.setDefault(AllowProxyKey, "false")
 	s.setDefault(CacheEnabledKey, "true")
 	s.setDefault(CacheCompressionKey, "true")
+	s.setDefault(CacheCompressorKey, "zstd")
 	s.setDefault(CacheMinFreeAbsKey, "250000000")
 	s.setDefault(CacheMinFreeRatKey, "")
+	s.setDefault(CacheMaxSizeKey, "0")
+	s.setDefault(CacheMaxUserSizeKey, "0")
+	s.setDefault(CachePrefetchKey, "true")
+	s.setDefault(CachePrefetchAgeKey, "0")
+	s.setDefault(CachePrefetchLabels, "")
+	s.setDefault(CachePrefetchSizeKey, "0")
 	s.setDefault(CacheConcurrencyRead, "16")
 	s.setDefault(CacheConcurrencyWrite, "16")
 	s.setDefault(IMAPWorkers, "16")
@@ -81,14 +138,30 @@ func (s *Settings) setDefaultValues() {
 	s.setDefault(APIPortKey, DefaultAPIPort)
 	s.setDefault(IMAPPortKey, DefaultIMAPPort)
 	s.setDefault(SMTPPortKey, DefaultSMTPPort)
+	s.setDefault(IMAPSPortKey, "0")
+	s.setDefault(SMTPSPortKey, "0")
+	s.setDefault(AllowInsecureAuthKey, "true")
+	s.setDefault(DAVPortKey, "0")
 	s.setDefault(BCCSelf, "false")
 	s.setDefault(IsAllMailVisible, "true")
+	s.setDefault(LabelsAsKeywords, "false")
+	s.setDefault(IMAPCompressionKey, "true")
+	s.setDefault(SMTPQueueExpiry, "120")
 
 	settingsDir := "/etc/peroxide"
 	s.setDefault(CacheDir, "/var/cache/peroxide/cache")
+	s.setDefault(SMTPQueueDir, "")
 	s.setDefault(X509Key, filepath.Join(settingsDir, "key.pem"))
 	s.setDefault(X509Cert, filepath.Join(settingsDir, "cert.pem"))
+	s.setDefault(ACMEDomain, "")
+	s.setDefault(ACMEEmail, "")
+	s.setDefault(ACMEDirectoryURL, "https://acme-v02.api.letsencrypt.org/directory")
+	s.setDefault(ACMEDirectoryCA, "")
+	s.setDefault(ACMECacheDir, filepath.Join(settingsDir, "acme"))
+	s.setDefault(ACMEChallengeAddress, ":443")
 	s.setDefault(CookieJar, filepath.Join(settingsDir, "cookies.json"))
 	s.setDefault(CredentialsStore, filepath.Join(settingsDir, "credentials.json"))
+	s.setDefault(APITokenFile, filepath.Join(settingsDir, "api-token"))
 	s.setDefault(ServerAddress, "127.0.0.1")
+	s.setDefault(APIAddress, "127.0.0.1")
 }
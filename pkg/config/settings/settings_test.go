@@ -0,0 +1,47 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package settings
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSettingsReload(t *testing.T) {
+	r := require.New(t)
+	path, clean := newTmpFile(r)
+	defer clean()
+
+	r.NoError(ioutil.WriteFile(path, []byte("{\"BCCSelf\":\"true\",\"FetchWorkers\":\"4\"}"), 0o700))
+	s := New(path)
+	r.True(s.GetBool(BCCSelf))
+	r.Equal(4, s.GetInt(FetchWorkers))
+
+	r.NoError(ioutil.WriteFile(path, []byte("{\"BCCSelf\":\"true\",\"SomeKey\":\"8\"}"), 0o700))
+	changed, err := s.Reload()
+	r.NoError(err)
+	r.Equal([]string{FetchWorkers, "SomeKey"}, changed)
+	r.Equal(16, s.GetInt(FetchWorkers))
+	r.Equal("8", s.Get("SomeKey"))
+
+	changed, err = s.Reload()
+	r.NoError(err)
+	r.Empty(changed)
+}
@@ -0,0 +1,560 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-ical"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	calendarsHomeSetPath   = principalPath + "calendars/"
+	calendarEventsPageSize = 100
+	calendarEventsEnd      = 4102444800 // 2100-01-01
+	calendarExtension      = ".ics"
+	calendarProductID      = "-//Peroxide//CalDAV//EN"
+
+	// The events created through CalDAV are fully editable by the owner.
+	calendarEventPermissions = 1
+)
+
+// The properties of an event are split between the parts of a ProtonMail
+// event the same way the ProtonMail clients split them. Every part carries
+// the UID and DTSTAMP; the properties not listed here are encrypted in the
+// shared part.
+var ( //nolint[gochecknoglobals]
+	sharedSignedEventProps = map[string]bool{
+		ical.PropDateTimeStart:  true,
+		ical.PropDateTimeEnd:    true,
+		ical.PropRecurrenceID:   true,
+		ical.PropRecurrenceRule: true,
+		ical.PropExceptionDates: true,
+		ical.PropOrganizer:      true,
+		ical.PropSequence:       true,
+	}
+	calendarSignedEventProps = map[string]bool{
+		ical.PropStatus:       true,
+		ical.PropTransparency: true,
+	}
+)
+
+type calendarIDContextKey struct{}
+
+// withCalendarID passes the ID of the calendar addressed by the request to
+// the backend. The CalDAV handler does not pass the path of the queried
+// calendar to QueryCalendarObjects, so it finds the calendar this way.
+func withCalendarID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(path.Clean(r.URL.Path), path.Clean(calendarsHomeSetPath))
+		if calendarID := strings.Split(strings.TrimPrefix(rel, "/"), "/")[0]; calendarID != "" {
+			r = r.WithContext(context.WithValue(r.Context(), calendarIDContextKey{}, calendarID))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func calendarIDFromContext(ctx context.Context) string {
+	calendarID, _ := ctx.Value(calendarIDContextKey{}).(string)
+	return calendarID
+}
+
+// calendarSession holds the unlocked keys of a calendar together with the
+// calendar member of the user.
+type calendarSession struct {
+	client   pmapi.Client
+	calendar pmapi.Calendar
+	keyRing  *crypto.KeyRing
+	member   *pmapi.CalendarMember
+}
+
+// calendarsBackend implements caldav.Backend on top of the ProtonMail
+// calendars of the user authenticated by the request.
+type calendarsBackend struct{}
+
+func (b *calendarsBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return principalPath, nil
+}
+
+func (b *calendarsBackend) CalendarHomeSetPath(ctx context.Context) (string, error) {
+	return calendarsHomeSetPath, nil
+}
+
+func (b *calendarsBackend) ListCalendars(ctx context.Context) ([]caldav.Calendar, error) {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	calendars, err := client.ListCalendars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]caldav.Calendar, 0, len(calendars))
+	for _, calendar := range calendars {
+		result = append(result, *newCalDAVCalendar(calendar))
+	}
+
+	return result, nil
+}
+
+func (b *calendarsBackend) GetCalendar(ctx context.Context, path string) (*caldav.Calendar, error) {
+	calendarID, err := calendarIDFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	calendar, err := findCalendar(ctx, client, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newCalDAVCalendar(calendar), nil
+}
+
+func (b *calendarsBackend) GetCalendarObject(ctx context.Context, path string, req *caldav.CalendarCompRequest) (*caldav.CalendarObject, error) {
+	calendarID, eventID, err := eventIDFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := openCalendar(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := session.client.GetCalendarEvent(ctx, calendarID, eventID)
+	if err != nil {
+		log.WithError(err).WithField("eventID", eventID).Warn("Cannot get calendar event")
+		return nil, webdav.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	return newCalendarObject(session, event)
+}
+
+func (b *calendarsBackend) ListCalendarObjects(ctx context.Context, path string, req *caldav.CalendarCompRequest) ([]caldav.CalendarObject, error) {
+	calendarID, err := calendarIDFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return listCalendarObjects(ctx, calendarID)
+}
+
+func (b *calendarsBackend) QueryCalendarObjects(ctx context.Context, query *caldav.CalendarQuery) ([]caldav.CalendarObject, error) {
+	objects, err := listCalendarObjects(ctx, calendarIDFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	return caldav.Filter(query, objects)
+}
+
+func listCalendarObjects(ctx context.Context, calendarID string) ([]caldav.CalendarObject, error) {
+	session, err := openCalendar(ctx, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []caldav.CalendarObject
+
+	for _, eventType := range []int{pmapi.CalendarEventPartDay, pmapi.CalendarEventFullDay} {
+		filter := &pmapi.CalendarEventFilter{
+			End:      calendarEventsEnd,
+			Timezone: "UTC",
+			Type:     eventType,
+			PageSize: calendarEventsPageSize,
+		}
+
+		for ; ; filter.Page++ {
+			events, err := session.client.ListCalendarEvents(ctx, session.calendar.ID, filter)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, event := range events {
+				object, err := newCalendarObject(session, event)
+				if err != nil {
+					log.WithError(err).WithField("eventID", event.ID).Warn("Skipping calendar event")
+					continue
+				}
+				objects = append(objects, *object)
+			}
+
+			if len(events) < calendarEventsPageSize {
+				break
+			}
+		}
+	}
+
+	return objects, nil
+}
+
+// PutCalendarObject creates a new event or updates an existing one. As with
+// the contacts, the event is only updated if the object name is an ID of an
+// existing event.
+func (b *calendarsBackend) PutCalendarObject(ctx context.Context, path string, cal *ical.Calendar, opts *caldav.PutCalendarObjectOptions) (string, error) {
+	calendarID, eventID, err := eventIDFromPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := openCalendar(ctx, calendarID)
+	if err != nil {
+		return "", err
+	}
+
+	etag := ""
+	if existing, err := session.client.GetCalendarEvent(ctx, calendarID, eventID); err == nil {
+		etag = calendarEventETag(existing)
+	}
+
+	if opts != nil {
+		if err := checkPreconditions(opts.IfMatch, opts.IfNoneMatch, etag); err != nil {
+			return "", err
+		}
+	}
+
+	shared, calendar, personal, err := newProtonEventParts(cal)
+	if err != nil {
+		return "", webdav.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	content, err := session.client.EncryptAndSignCalendarEvent(session.keyRing, session.member.AddressID, shared, calendar, personal)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to encrypt and sign calendar event")
+	}
+	content.Permissions = calendarEventPermissions
+	content.IsOrganizer = true
+
+	var event pmapi.CalendarEvent
+	if etag != "" {
+		event, err = session.client.UpdateCalendarEvent(ctx, calendarID, session.member.ID, eventID, content)
+	} else {
+		event, err = session.client.CreateCalendarEvent(ctx, calendarID, session.member.ID, content)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return calendarsHomeSetPath + calendarID + "/" + event.ID + calendarExtension, nil
+}
+
+func (b *calendarsBackend) DeleteCalendarObject(ctx context.Context, path string) error {
+	calendarID, eventID, err := eventIDFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	session, err := openCalendar(ctx, calendarID)
+	if err != nil {
+		return err
+	}
+
+	return session.client.DeleteCalendarEvent(ctx, calendarID, session.member.ID, eventID)
+}
+
+func newCalDAVCalendar(calendar pmapi.Calendar) *caldav.Calendar {
+	return &caldav.Calendar{
+		Path:                  calendarsHomeSetPath + calendar.ID + "/",
+		Name:                  calendar.Name,
+		Description:           calendar.Description,
+		SupportedComponentSet: []string{ical.CompEvent},
+	}
+}
+
+// findCalendar returns the calendar specified by calendar ID.
+func findCalendar(ctx context.Context, client pmapi.Client, calendarID string) (pmapi.Calendar, error) {
+	calendars, err := client.ListCalendars(ctx)
+	if err != nil {
+		return pmapi.Calendar{}, err
+	}
+
+	for _, calendar := range calendars {
+		if calendar.ID == calendarID {
+			return calendar, nil
+		}
+	}
+
+	return pmapi.Calendar{}, webdav.NewHTTPError(http.StatusNotFound, errors.New("no such calendar"))
+}
+
+func openCalendar(ctx context.Context, calendarID string) (*calendarSession, error) {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	calendar, err := findCalendar(ctx, client, calendarID)
+	if err != nil {
+		return nil, err
+	}
+
+	bootstrap, err := client.GetCalendarBootstrap(ctx, calendar.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	keyRing, member, err := client.UnlockCalendarKeys(bootstrap)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unlock calendar keys")
+	}
+
+	return &calendarSession{
+		client:   client,
+		calendar: calendar,
+		keyRing:  keyRing,
+		member:   member,
+	}, nil
+}
+
+func calendarIDFromPath(p string) (string, error) {
+	rel := strings.TrimPrefix(path.Clean(p), path.Clean(calendarsHomeSetPath))
+	if !strings.HasPrefix(p, calendarsHomeSetPath) || !strings.HasPrefix(rel, "/") || strings.Count(rel, "/") != 1 {
+		return "", webdav.NewHTTPError(http.StatusNotFound, errors.New("no such calendar"))
+	}
+	return strings.TrimPrefix(rel, "/"), nil
+}
+
+func eventIDFromPath(p string) (calendarID, eventID string, err error) {
+	parts := strings.Split(strings.TrimPrefix(p, calendarsHomeSetPath), "/")
+	if !strings.HasPrefix(p, calendarsHomeSetPath) || len(parts) != 2 ||
+		parts[0] == "" || !strings.HasSuffix(parts[1], calendarExtension) {
+		return "", "", webdav.NewHTTPError(http.StatusNotFound, errors.New("no such calendar object"))
+	}
+	return parts[0], strings.TrimSuffix(parts[1], calendarExtension), nil
+}
+
+// calendarEventETag returns the ETag of the event. As with the contacts, it is
+// derived from the parts as they are stored by the server.
+func calendarEventETag(event pmapi.CalendarEvent) string {
+	hash := sha256.New()
+	_, _ = hash.Write([]byte(event.SharedKeyPacket))
+	_, _ = hash.Write([]byte(event.CalendarKeyPacket))
+	for _, parts := range [][]pmapi.Card{event.SharedEvents, event.CalendarEvents, event.PersonalEvents} {
+		for _, part := range parts {
+			_, _ = hash.Write([]byte(part.Data))
+			_, _ = hash.Write([]byte(part.Signature))
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func newCalendarObject(session *calendarSession, event pmapi.CalendarEvent) (*caldav.CalendarObject, error) {
+	parts, err := session.client.DecryptAndVerifyCalendarEvent(session.keyRing, session.member.AddressID, &event)
+	if err != nil && parts == nil {
+		return nil, errors.Wrap(err, "failed to decrypt calendar event")
+	}
+	if err != nil {
+		log.WithError(err).WithField("eventID", event.ID).Warn("Calendar event verification failed")
+	}
+
+	cal, err := mergeProtonEventParts(parts)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &caldav.CalendarObject{
+		Path: calendarsHomeSetPath + session.calendar.ID + "/" + event.ID + calendarExtension,
+		ETag: calendarEventETag(event),
+		Data: cal,
+	}
+	if event.ModifyTime != 0 {
+		object.ModTime = time.Unix(event.ModifyTime, 0)
+	}
+
+	return object, nil
+}
+
+// mergeProtonEventParts merges the decrypted parts of a ProtonMail event into
+// a calendar with a single event.
+func mergeProtonEventParts(parts []pmapi.Card) (*ical.Calendar, error) {
+	event := ical.NewComponent(ical.CompEvent)
+	timezones := []*ical.Component{}
+	timezoneIDs := map[string]bool{}
+
+	for _, part := range parts {
+		decoded, err := ical.NewDecoder(strings.NewReader(part.Data)).Decode()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode event part")
+		}
+
+		for _, child := range decoded.Children {
+			if child.Name == ical.CompTimezone {
+				if tzid := child.Props.Get(ical.PropTimezoneID); tzid != nil && !timezoneIDs[tzid.Value] {
+					timezoneIDs[tzid.Value] = true
+					timezones = append(timezones, child)
+				}
+				continue
+			}
+			if child.Name != ical.CompEvent {
+				continue
+			}
+			for name, props := range child.Props {
+				if (name == ical.PropUID || name == ical.PropDateTimeStamp) && event.Props.Get(name) != nil {
+					continue
+				}
+				event.Props[name] = append(event.Props[name], props...)
+			}
+			event.Children = append(event.Children, child.Children...)
+		}
+	}
+
+	if event.Props.Get(ical.PropUID) == nil {
+		return nil, errors.New("event has no UID")
+	}
+
+	return newCalendar(event, timezones...), nil
+}
+
+// newProtonEventParts splits the event into the signed and the encrypted and
+// signed shared parts, the signed calendar part and the signed personal part
+// holding the alarms. The time zones the event refers to go with the dates to
+// the signed shared part. The returned parts still need to be encrypted and
+// signed. Recurrence exceptions are stored as separate events by ProtonMail,
+// so only calendars with a single event are accepted.
+func newProtonEventParts(cal *ical.Calendar) (shared, calendar []pmapi.Card, personal *pmapi.Card, err error) {
+	var events, timezones []*ical.Component
+	for _, child := range cal.Children {
+		switch child.Name {
+		case ical.CompEvent:
+			events = append(events, child)
+		case ical.CompTimezone:
+			timezones = append(timezones, child)
+		}
+	}
+	if len(events) != 1 {
+		return nil, nil, nil, errors.New("only calendars with a single event are supported")
+	}
+	event := events[0]
+
+	uid := event.Props.Get(ical.PropUID)
+	if uid == nil || uid.Value == "" {
+		return nil, nil, nil, errors.New("event has no UID")
+	}
+
+	if event.Props.Get(ical.PropDateTimeStamp) == nil {
+		event.Props.SetDateTime(ical.PropDateTimeStamp, time.Now().UTC())
+	}
+
+	newPart := func() *ical.Component {
+		part := ical.NewComponent(ical.CompEvent)
+		part.Props.Set(uid)
+		part.Props.Set(event.Props.Get(ical.PropDateTimeStamp))
+		return part
+	}
+
+	sharedSigned := newPart()
+	sharedEncrypted := newPart()
+	calendarSigned := newPart()
+	personalSigned := newPart()
+
+	for name, props := range event.Props {
+		if name == ical.PropUID || name == ical.PropDateTimeStamp {
+			continue
+		}
+		target := sharedEncrypted
+		switch {
+		case sharedSignedEventProps[name]:
+			target = sharedSigned
+		case calendarSignedEventProps[name]:
+			target = calendarSigned
+		}
+		target.Props[name] = props
+	}
+
+	for _, child := range event.Children {
+		if child.Name == ical.CompAlarm {
+			personalSigned.Children = append(personalSigned.Children, child)
+		}
+	}
+
+	encode := func(part *ical.Component, cardType int, timezones ...*ical.Component) (pmapi.Card, error) {
+		data, err := encodeCalendar(newCalendar(part, timezones...))
+		return pmapi.Card{Type: cardType, Data: data}, err
+	}
+
+	for _, part := range []struct {
+		event     *ical.Component
+		cardType  int
+		timezones []*ical.Component
+	}{
+		{sharedSigned, pmapi.CardSigned, timezones},
+		{sharedEncrypted, pmapi.CardEncrypted | pmapi.CardSigned, nil},
+	} {
+		card, err := encode(part.event, part.cardType, part.timezones...)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		shared = append(shared, card)
+	}
+
+	// The calendar part only makes sense with more than the UID and DTSTAMP.
+	if len(calendarSigned.Props) > 2 {
+		card, err := encode(calendarSigned, pmapi.CardSigned)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		calendar = append(calendar, card)
+	}
+
+	if len(personalSigned.Children) != 0 {
+		card, err := encode(personalSigned, pmapi.CardSigned)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		personal = &card
+	}
+
+	return shared, calendar, personal, nil
+}
+
+// newCalendar returns a calendar with the event and the time zones it uses.
+func newCalendar(event *ical.Component, timezones ...*ical.Component) *ical.Calendar {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, calendarProductID)
+	cal.Children = append(append([]*ical.Component{}, timezones...), event)
+	return cal
+}
+
+func encodeCalendar(cal *ical.Calendar) (string, error) {
+	var buf bytes.Buffer
+	if err := ical.NewEncoder(&buf).Encode(cal); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
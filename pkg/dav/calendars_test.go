@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-ical"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+const testCalendar = "BEGIN:VCALENDAR\r\n" +
+	"VERSION:2.0\r\n" +
+	"PRODID:-//Test//Test//EN\r\n" +
+	"BEGIN:VTIMEZONE\r\n" +
+	"TZID:Europe/Zurich\r\n" +
+	"BEGIN:STANDARD\r\n" +
+	"DTSTART:19701025T030000\r\n" +
+	"RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU\r\n" +
+	"TZOFFSETFROM:+0200\r\n" +
+	"TZOFFSETTO:+0100\r\n" +
+	"END:STANDARD\r\n" +
+	"BEGIN:DAYLIGHT\r\n" +
+	"DTSTART:19700329T020000\r\n" +
+	"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU\r\n" +
+	"TZOFFSETFROM:+0100\r\n" +
+	"TZOFFSETTO:+0200\r\n" +
+	"END:DAYLIGHT\r\n" +
+	"END:VTIMEZONE\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"UID:event-1@example.com\r\n" +
+	"DTSTAMP:20220310T120000Z\r\n" +
+	"DTSTART;TZID=Europe/Zurich:20220311T090000\r\n" +
+	"DTEND;TZID=Europe/Zurich:20220311T100000\r\n" +
+	"SUMMARY:Standup\r\n" +
+	"LOCATION:Room 1\r\n" +
+	"STATUS:CONFIRMED\r\n" +
+	"BEGIN:VALARM\r\n" +
+	"ACTION:DISPLAY\r\n" +
+	"TRIGGER:-PT15M\r\n" +
+	"END:VALARM\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func decodeTestCalendar(t *testing.T, data string) *ical.Calendar {
+	cal, err := ical.NewDecoder(strings.NewReader(data)).Decode()
+	require.NoError(t, err)
+	return cal
+}
+
+func TestNewProtonEventParts(t *testing.T) {
+	shared, calendar, personal, err := newProtonEventParts(decodeTestCalendar(t, testCalendar))
+	require.NoError(t, err)
+
+	require.Len(t, shared, 2)
+	require.Equal(t, pmapi.CardSigned, shared[0].Type)
+	require.Contains(t, shared[0].Data, "UID:event-1@example.com")
+	require.Contains(t, shared[0].Data, "DTSTART;TZID=Europe/Zurich:20220311T090000")
+	require.NotContains(t, shared[0].Data, "SUMMARY")
+	require.Contains(t, shared[0].Data, "TZID:Europe/Zurich")
+
+	require.Equal(t, pmapi.CardEncrypted|pmapi.CardSigned, shared[1].Type)
+	require.Contains(t, shared[1].Data, "UID:event-1@example.com")
+	require.Contains(t, shared[1].Data, "SUMMARY:Standup")
+	require.Contains(t, shared[1].Data, "LOCATION:Room 1")
+	require.NotContains(t, shared[1].Data, "DTSTART")
+	require.NotContains(t, shared[1].Data, "VTIMEZONE")
+
+	require.Len(t, calendar, 1)
+	require.Contains(t, calendar[0].Data, "STATUS:CONFIRMED")
+
+	require.NotNil(t, personal)
+	require.Equal(t, pmapi.CardSigned, personal.Type)
+	require.Contains(t, personal.Data, "BEGIN:VALARM")
+	require.NotContains(t, shared[1].Data, "VALARM")
+}
+
+func TestNewProtonEventPartsSingleEvent(t *testing.T) {
+	cal := decodeTestCalendar(t, testCalendar)
+	cal.Children = append(cal.Children, cal.Children[1])
+
+	_, _, _, err := newProtonEventParts(cal)
+	require.Error(t, err)
+
+	cal.Children = nil
+	_, _, _, err = newProtonEventParts(cal)
+	require.Error(t, err)
+}
+
+func TestMergeProtonEventParts(t *testing.T) {
+	shared, calendar, personal, err := newProtonEventParts(decodeTestCalendar(t, testCalendar))
+	require.NoError(t, err)
+
+	parts := append(append(shared, calendar...), *personal)
+
+	merged, err := mergeProtonEventParts(parts)
+	require.NoError(t, err)
+
+	require.Len(t, merged.Children, 2)
+	require.Equal(t, ical.CompTimezone, merged.Children[0].Name)
+	require.Equal(t, "Europe/Zurich", merged.Children[0].Props.Get(ical.PropTimezoneID).Value)
+	require.Len(t, merged.Children[0].Children, 2)
+
+	event := merged.Children[1]
+	require.Equal(t, ical.CompEvent, event.Name)
+	require.Len(t, event.Props.Values(ical.PropUID), 1)
+	require.Len(t, event.Props.Values(ical.PropDateTimeStamp), 1)
+	require.Equal(t, "Standup", event.Props.Get(ical.PropSummary).Value)
+	require.Equal(t, "CONFIRMED", event.Props.Get(ical.PropStatus).Value)
+	require.Equal(t, "Europe/Zurich", event.Props.Get(ical.PropDateTimeStart).Params.Get(ical.ParamTimezoneID))
+	require.Len(t, event.Children, 1)
+	require.Equal(t, ical.CompAlarm, event.Children[0].Name)
+
+	_, err = encodeCalendar(merged)
+	require.NoError(t, err)
+}
+
+func TestEventIDFromPath(t *testing.T) {
+	calendarID, eventID, err := eventIDFromPath(calendarsHomeSetPath + "cal==/event==.ics")
+	require.NoError(t, err)
+	require.Equal(t, "cal==", calendarID)
+	require.Equal(t, "event==", eventID)
+
+	for _, p := range []string{
+		calendarsHomeSetPath + "event==.ics",
+		calendarsHomeSetPath + "cal==/event==",
+		calendarsHomeSetPath + "/event==.ics",
+		contactsAddressBookPath + "cal==/event==.ics",
+	} {
+		_, _, err := eventIDFromPath(p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestCalendarIDFromPath(t *testing.T) {
+	calendarID, err := calendarIDFromPath(calendarsHomeSetPath + "cal==/")
+	require.NoError(t, err)
+	require.Equal(t, "cal==", calendarID)
+
+	for _, p := range []string{
+		calendarsHomeSetPath,
+		calendarsHomeSetPath + "cal==/event==.ics",
+		contactsAddressBookPath + "cal==/",
+	} {
+		_, err := calendarIDFromPath(p)
+		require.Error(t, err, p)
+	}
+}
+
+func TestWithCalendarID(t *testing.T) {
+	var calendarID string
+	handler := withCalendarID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calendarID = calendarIDFromContext(r.Context())
+	}))
+
+	tests := map[string]string{
+		calendarsHomeSetPath:                    "",
+		calendarsHomeSetPath + "cal==/":         "cal==",
+		calendarsHomeSetPath + "cal==/ev==.ics": "cal==",
+	}
+
+	for p, want := range tests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("PROPFIND", p, nil))
+		require.Equal(t, want, calendarID, p)
+	}
+}
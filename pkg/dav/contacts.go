@@ -0,0 +1,345 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/google/uuid"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	contactsHomeSetPath     = principalPath + "contacts/"
+	contactsAddressBookPath = contactsHomeSetPath + "default/"
+	contactsPageSize        = 50
+	contactExtension        = ".vcf"
+)
+
+// Only these fields are stored in the signed cleartext card so that the
+// server can use the addresses for sending. Everything else is encrypted.
+var cleartextCardFields = map[string]bool{ //nolint[gochecknoglobals]
+	vcard.FieldFormattedName: true,
+	vcard.FieldUID:           true,
+	vcard.FieldEmail:         true,
+}
+
+// contactsBackend implements carddav.Backend on top of the ProtonMail
+// contacts of the user authenticated by the request.
+type contactsBackend struct{}
+
+func (b *contactsBackend) CurrentUserPrincipal(ctx context.Context) (string, error) {
+	return principalPath, nil
+}
+
+func (b *contactsBackend) AddressbookHomeSetPath(ctx context.Context) (string, error) {
+	return contactsHomeSetPath, nil
+}
+
+func (b *contactsBackend) AddressBook(ctx context.Context) (*carddav.AddressBook, error) {
+	return &carddav.AddressBook{
+		Path:        contactsAddressBookPath,
+		Name:        "ProtonMail",
+		Description: "ProtonMail contacts",
+		SupportedAddressData: []carddav.AddressDataType{
+			{ContentType: vcard.MIMEType, Version: "3.0"},
+			{ContentType: vcard.MIMEType, Version: "4.0"},
+		},
+	}, nil
+}
+
+func (b *contactsBackend) GetAddressObject(ctx context.Context, path string, req *carddav.AddressDataRequest) (*carddav.AddressObject, error) {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	contactID, err := contactIDFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	contact, err := client.GetContactByID(ctx, contactID)
+	if err != nil {
+		log.WithError(err).WithField("contactID", contactID).Warn("Cannot get contact")
+		return nil, webdav.NewHTTPError(http.StatusNotFound, err)
+	}
+
+	return newAddressObject(client, contact)
+}
+
+func (b *contactsBackend) ListAddressObjects(ctx context.Context, req *carddav.AddressDataRequest) ([]carddav.AddressObject, error) {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []carddav.AddressObject
+
+	for page := 0; ; page++ {
+		contacts, err := client.GetContactsForExport(ctx, page, contactsPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, contact := range contacts {
+			object, err := newAddressObject(client, contact)
+			if err != nil {
+				log.WithError(err).WithField("contactID", contact.ID).Warn("Skipping contact")
+				continue
+			}
+			objects = append(objects, *object)
+		}
+
+		if len(contacts) < contactsPageSize {
+			break
+		}
+	}
+
+	return objects, nil
+}
+
+func (b *contactsBackend) QueryAddressObjects(ctx context.Context, query *carddav.AddressBookQuery) ([]carddav.AddressObject, error) {
+	objects, err := b.ListAddressObjects(ctx, &query.DataRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	return carddav.Filter(query, objects)
+}
+
+// PutAddressObject creates a new contact or updates an existing one. The
+// client chooses the name of a new object, so the contact is only updated if
+// the object name is an ID of an existing contact.
+func (b *contactsBackend) PutAddressObject(ctx context.Context, path string, card vcard.Card, opts *carddav.PutAddressObjectOptions) (string, error) {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	contactID, err := contactIDFromPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	etag := ""
+	if existing, err := client.GetContactByID(ctx, contactID); err == nil {
+		etag = contactETag(existing)
+	}
+
+	if opts != nil {
+		if err := checkPreconditions(opts.IfMatch, opts.IfNoneMatch, etag); err != nil {
+			return "", err
+		}
+	}
+
+	cards, err := newProtonCards(card)
+	if err != nil {
+		return "", webdav.NewHTTPError(http.StatusBadRequest, err)
+	}
+
+	if cards, err = client.EncryptAndSignCards(cards); err != nil {
+		return "", errors.Wrap(err, "failed to encrypt and sign cards")
+	}
+
+	var contact pmapi.Contact
+	if etag != "" {
+		contact, err = client.UpdateContact(ctx, contactID, cards)
+	} else {
+		contact, err = client.CreateContact(ctx, cards)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return contactsAddressBookPath + contact.ID + contactExtension, nil
+}
+
+func (b *contactsBackend) DeleteAddressObject(ctx context.Context, path string) error {
+	client, err := clientFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	contactID, err := contactIDFromPath(path)
+	if err != nil {
+		return err
+	}
+
+	return client.DeleteContacts(ctx, []string{contactID})
+}
+
+func clientFromContext(ctx context.Context) (pmapi.Client, error) {
+	user, err := userFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return user.GetClient(), nil
+}
+
+func contactIDFromPath(p string) (string, error) {
+	dir, name := path.Split(p)
+	if dir != contactsAddressBookPath || !strings.HasSuffix(name, contactExtension) {
+		return "", webdav.NewHTTPError(http.StatusNotFound, errors.New("no such address object"))
+	}
+	return strings.TrimSuffix(name, contactExtension), nil
+}
+
+// contactETag returns the ETag of the contact. It is derived from the cards as
+// they are stored by the server, which change every time the contact is
+// updated.
+func contactETag(contact pmapi.Contact) string {
+	hash := sha256.New()
+	for _, card := range contact.Cards {
+		_, _ = hash.Write([]byte(card.Data))
+		_, _ = hash.Write([]byte(card.Signature))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func newAddressObject(client pmapi.Client, contact pmapi.Contact) (*carddav.AddressObject, error) {
+	var cards []pmapi.Card
+	for _, card := range contact.Cards {
+		decrypted, err := client.DecryptAndVerifyCards([]pmapi.Card{card})
+		if err != nil && decrypted == nil {
+			return nil, errors.Wrap(err, "failed to decrypt card")
+		}
+		if err != nil {
+			log.WithError(err).WithField("contactID", contact.ID).Warn("Card verification failed")
+		}
+		cards = append(cards, decrypted...)
+	}
+
+	card, err := mergeProtonCards(cards)
+	if err != nil {
+		return nil, err
+	}
+
+	object := &carddav.AddressObject{
+		Path: contactsAddressBookPath + contact.ID + contactExtension,
+		ETag: contactETag(contact),
+		Card: card,
+	}
+	if contact.ModifyTime != 0 {
+		object.ModTime = time.Unix(contact.ModifyTime, 0)
+	}
+
+	return object, nil
+}
+
+// mergeProtonCards merges the decrypted cards of a ProtonMail contact into a
+// single vCard.
+func mergeProtonCards(cards []pmapi.Card) (vcard.Card, error) {
+	merged := make(vcard.Card)
+
+	for _, card := range cards {
+		decoded, err := vcard.NewDecoder(strings.NewReader(card.Data)).Decode()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode card")
+		}
+
+		for key, fields := range decoded {
+			if key == vcard.FieldVersion && merged.Get(key) != nil {
+				continue
+			}
+			for _, field := range fields {
+				merged.Add(key, field)
+			}
+		}
+	}
+
+	if merged.Get(vcard.FieldVersion) == nil {
+		merged.SetValue(vcard.FieldVersion, "4.0")
+	}
+
+	return merged, nil
+}
+
+// newProtonCards splits the vCard into the signed cleartext card and the
+// encrypted and signed card, the way the ProtonMail clients store contacts.
+// The returned cards still need to be encrypted and signed.
+func newProtonCards(card vcard.Card) ([]pmapi.Card, error) {
+	vcard.ToV4(card)
+
+	if card.Value(vcard.FieldUID) == "" {
+		card.SetValue(vcard.FieldUID, "proton-peroxide-"+uuid.New().String())
+	}
+
+	if card.Value(vcard.FieldFormattedName) == "" {
+		name := card.PreferredValue(vcard.FieldEmail)
+		if n := card.Name(); n != nil {
+			name = strings.TrimSpace(n.GivenName + " " + n.FamilyName)
+		}
+		if name == "" {
+			return nil, errors.New("contact has neither name nor email")
+		}
+		card.SetValue(vcard.FieldFormattedName, name)
+	}
+
+	cleartext := make(vcard.Card)
+	encrypted := make(vcard.Card)
+
+	for key, fields := range card {
+		if key == vcard.FieldVersion {
+			continue
+		}
+		target := encrypted
+		if cleartextCardFields[key] {
+			target = cleartext
+		}
+		for _, field := range fields {
+			target.Add(key, field)
+		}
+	}
+
+	var cards []pmapi.Card
+
+	for _, part := range []struct {
+		card     vcard.Card
+		cardType int
+	}{
+		{cleartext, pmapi.CardSigned},
+		{encrypted, pmapi.CardEncrypted | pmapi.CardSigned},
+	} {
+		if len(part.card) == 0 {
+			continue
+		}
+
+		part.card.SetValue(vcard.FieldVersion, "4.0")
+
+		var buf bytes.Buffer
+		if err := vcard.NewEncoder(&buf).Encode(part.card); err != nil {
+			return nil, err
+		}
+
+		cards = append(cards, pmapi.Card{Type: part.cardType, Data: buf.String()})
+	}
+
+	return cards, nil
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-vcard"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+const testVCard = "BEGIN:VCARD\r\n" +
+	"VERSION:3.0\r\n" +
+	"N:Doe;Jane;;;\r\n" +
+	"item1.EMAIL;TYPE=INTERNET:jane@pm.me\r\n" +
+	"TEL;TYPE=CELL:+1 555 0100\r\n" +
+	"NOTE:Met at the conference\r\n" +
+	"END:VCARD\r\n"
+
+func TestNewProtonCards(t *testing.T) {
+	card, err := vcard.NewDecoder(strings.NewReader(testVCard)).Decode()
+	require.NoError(t, err)
+
+	cards, err := newProtonCards(card)
+	require.NoError(t, err)
+	require.Len(t, cards, 2)
+
+	require.Equal(t, pmapi.CardSigned, cards[0].Type)
+	require.Contains(t, cards[0].Data, "VERSION:4.0")
+	require.Contains(t, cards[0].Data, "FN:Jane Doe")
+	require.Contains(t, cards[0].Data, "item1.EMAIL")
+	require.Contains(t, cards[0].Data, "UID:proton-peroxide-")
+	require.NotContains(t, cards[0].Data, "TEL")
+	require.NotContains(t, cards[0].Data, "NOTE")
+
+	require.Equal(t, pmapi.CardEncrypted|pmapi.CardSigned, cards[1].Type)
+	require.Contains(t, cards[1].Data, "VERSION:4.0")
+	require.Contains(t, cards[1].Data, "TEL")
+	require.Contains(t, cards[1].Data, "NOTE:Met at the conference")
+	require.NotContains(t, cards[1].Data, "EMAIL")
+}
+
+func TestNewProtonCardsNeedsNameOrEmail(t *testing.T) {
+	card := make(vcard.Card)
+	card.SetValue(vcard.FieldVersion, "4.0")
+	card.SetValue(vcard.FieldNote, "nobody")
+
+	_, err := newProtonCards(card)
+	require.Error(t, err)
+}
+
+func TestMergeProtonCards(t *testing.T) {
+	card, err := vcard.NewDecoder(strings.NewReader(testVCard)).Decode()
+	require.NoError(t, err)
+
+	cards, err := newProtonCards(card)
+	require.NoError(t, err)
+
+	merged, err := mergeProtonCards(cards)
+	require.NoError(t, err)
+
+	require.Len(t, merged[vcard.FieldVersion], 1)
+	require.Equal(t, "4.0", merged.Value(vcard.FieldVersion))
+	require.Equal(t, "Jane Doe", merged.Value(vcard.FieldFormattedName))
+	require.Equal(t, "jane@pm.me", merged.Value(vcard.FieldEmail))
+	require.Equal(t, "item1", merged.Get(vcard.FieldEmail).Group)
+	require.Equal(t, "Met at the conference", merged.Value(vcard.FieldNote))
+}
+
+func TestContactIDFromPath(t *testing.T) {
+	id, err := contactIDFromPath(contactsAddressBookPath + "abc==.vcf")
+	require.NoError(t, err)
+	require.Equal(t, "abc==", id)
+
+	_, err = contactIDFromPath(contactsHomeSetPath + "abc==.vcf")
+	require.Error(t, err)
+
+	_, err = contactIDFromPath(contactsAddressBookPath + "abc==")
+	require.Error(t, err)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dav provides the CardDAV and CalDAV server exposing the user's
+// contacts and calendars.
+package dav
+
+import (
+	"net/http"
+
+	"github.com/emersion/go-webdav"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("pkg", "dav") //nolint[gochecknoglobals]
+
+var errPreconditionFailed = errors.New("precondition failed") //nolint[gochecknoglobals]
+
+// checkPreconditions checks the If-Match and If-None-Match headers of a PUT
+// request against the current ETag of the object, which is empty when the
+// object does not exist.
+func checkPreconditions(ifMatch, ifNoneMatch webdav.ConditionalMatch, etag string) error {
+	exists := etag != ""
+
+	if ifMatch.IsSet() {
+		if !exists {
+			return webdav.NewHTTPError(http.StatusPreconditionFailed, errPreconditionFailed)
+		}
+		if !ifMatch.IsWildcard() {
+			want, err := ifMatch.ETag()
+			if err != nil {
+				return webdav.NewHTTPError(http.StatusBadRequest, err)
+			}
+			if want != etag {
+				return webdav.NewHTTPError(http.StatusPreconditionFailed, errPreconditionFailed)
+			}
+		}
+	}
+
+	if ifNoneMatch.IsSet() && exists {
+		if ifNoneMatch.IsWildcard() {
+			return webdav.NewHTTPError(http.StatusPreconditionFailed, errPreconditionFailed)
+		}
+		want, err := ifNoneMatch.ETag()
+		if err != nil {
+			return webdav.NewHTTPError(http.StatusBadRequest, err)
+		}
+		if want == etag {
+			return webdav.NewHTTPError(http.StatusPreconditionFailed, errPreconditionFailed)
+		}
+	}
+
+	return nil
+}
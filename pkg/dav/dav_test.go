@@ -0,0 +1,60 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-webdav"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckPreconditions(t *testing.T) {
+	for _, tc := range []struct {
+		ifMatch, ifNoneMatch webdav.ConditionalMatch
+		etag                 string
+		wantStatus           int
+	}{
+		{"", "", "", 0},
+		{"", "", "abc", 0},
+		{"*", "", "abc", 0},
+		{"*", "", "", http.StatusPreconditionFailed},
+		{`"abc"`, "", "abc", 0},
+		{`"abc"`, "", "def", http.StatusPreconditionFailed},
+		{`"abc"`, "", "", http.StatusPreconditionFailed},
+		{"abc", "", "abc", http.StatusBadRequest},
+		{"", "*", "", 0},
+		{"", "*", "abc", http.StatusPreconditionFailed},
+		{"", `"abc"`, "abc", http.StatusPreconditionFailed},
+		{"", `"abc"`, "def", 0},
+		{"", `"abc"`, "", 0},
+	} {
+		err := checkPreconditions(tc.ifMatch, tc.ifNoneMatch, tc.etag)
+		if tc.wantStatus == 0 {
+			require.NoError(t, err, tc)
+			continue
+		}
+
+		// The HTTP error of go-webdav starts with the status code.
+		require.Error(t, err, tc)
+		require.True(t, strings.HasPrefix(err.Error(), strconv.Itoa(tc.wantStatus)+" "), err.Error())
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package dav
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-webdav"
+	"github.com/emersion/go-webdav/caldav"
+	"github.com/emersion/go-webdav/carddav"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/serverutil"
+	"github.com/ljanyst/peroxide/pkg/users"
+)
+
+// The CardDAV and CalDAV handlers find the type of the resource by the depth
+// of its path, so both home sets live under the shared principal.
+const principalPath = "/me/"
+
+type userContextKey struct{}
+
+// Server is the DAV server. It implements serverutil.Server.
+type Server struct {
+	address string
+	port    int
+	tls     *tls.Config
+	users   *users.Users
+
+	server     *http.Server
+	controller serverutil.Controller
+}
+
+// NewDAVServer returns a DAV server configured with the given options. The
+// server always uses TLS because the clients authenticate with basic auth.
+func NewDAVServer(
+	address string,
+	port int,
+	tls *tls.Config,
+	users *users.Users,
+	eventListener listener.Listener,
+) *Server {
+	server := &Server{
+		address: address,
+		port:    port,
+		tls:     tls,
+		users:   users,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(contactsHomeSetPath, &carddav.Handler{Backend: &contactsBackend{}})
+	mux.Handle(calendarsHomeSetPath, withCalendarID(&caldav.Handler{Backend: &calendarsBackend{}}))
+	mux.Handle("/.well-known/carddav", http.RedirectHandler(principalPath, http.StatusPermanentRedirect))
+	mux.Handle("/.well-known/caldav", http.RedirectHandler(principalPath, http.StatusPermanentRedirect))
+	mux.HandleFunc("/", servePrincipal)
+
+	server.server = &http.Server{
+		Addr:              server.Address(),
+		Handler:           server.authenticate(mux),
+		TLSConfig:         tls,
+		ReadHeaderTimeout: time.Minute,
+	}
+	server.controller = serverutil.NewController(server, eventListener)
+	return server
+}
+
+// authenticate checks the basic auth credentials of every request the same
+// way the IMAP and SMTP servers check them and passes the user to the handler
+// in the request context.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="peroxide"`)
+			http.Error(w, "authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		username, slot := users.DecodeLogin(strings.ToLower(username))
+
+		user, err := s.users.GetUser(username)
+		if err != nil {
+			log.Warn("Cannot get user: ", err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="peroxide"`)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if err := user.BringOnline(slot, password); err != nil {
+			log.WithError(err).Error("Could not bring the user online")
+			w.Header().Set("WWW-Authenticate", `Basic realm="peroxide"`)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if err := user.CheckCredentials(slot, password); err != nil {
+			log.WithError(err).Error("Could not check bridge password")
+			// Slow down the clients retrying with bad credentials.
+			time.Sleep(10 * time.Second)
+			w.Header().Set("WWW-Authenticate", `Basic realm="peroxide"`)
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), userContextKey{}, user)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// servePrincipal answers the requests outside of the home sets, including
+// the principal itself, so that the clients configured with the server root
+// can discover both the address book and the calendars.
+func servePrincipal(w http.ResponseWriter, r *http.Request) {
+	webdav.ServePrincipal(w, r, &webdav.ServePrincipalOptions{
+		CurrentUserPrincipalPath: principalPath,
+		HomeSets: []webdav.BackendSuppliedHomeSet{
+			carddav.NewAddressBookHomeSet(contactsHomeSetPath),
+			caldav.NewCalendarHomeSet(calendarsHomeSetPath),
+		},
+		Capabilities: []webdav.Capability{
+			carddav.CapabilityAddressBook,
+			caldav.CapabilityCalendar,
+		},
+	})
+}
+
+func userFromContext(ctx context.Context) (*users.User, error) {
+	user, ok := ctx.Value(userContextKey{}).(*users.User)
+	if !ok {
+		return nil, webdav.NewHTTPError(http.StatusUnauthorized, nil)
+	}
+	return user, nil
+}
+
+// ListenAndServe will run server and all monitors.
+func (s *Server) ListenAndServe() { s.controller.ListenAndServe() }
+
+// Close turns off server and monitors.
+func (s *Server) Close() { s.controller.Close() }
+
+// Implements serverutil.Server interface.
+
+func (Server) Protocol() serverutil.Protocol { return serverutil.HTTP }
+func (s *Server) UseSSL() bool               { return true }
+func (s *Server) Address() string            { return fmt.Sprintf("%s:%d", s.address, s.port) }
+func (s *Server) TLSConfig() *tls.Config     { return s.tls }
+
+func (s *Server) DebugServer() bool { return false }
+func (s *Server) DebugClient() bool { return false }
+
+func (s *Server) SetLoggers(localDebug, remoteDebug io.Writer) {}
+
+// DisconnectUser does nothing because every request is authenticated on its
+// own, so a logged out user cannot make any further requests.
+func (s *Server) DisconnectUser(address string) {}
+
+func (s *Server) Serve(l net.Listener) error { return s.server.Serve(l) }
+func (s *Server) StopServe() error           { return s.server.Close() }
@@ -25,6 +25,7 @@ import (
 // Constants of events used by the event listener in bridge.
 const (
 	CloseConnectionEvent = "closeConnection"
+	OutboxChangedEvent   = "outboxChanged"
 )
 
 // SetupEvents specific to event type and data.
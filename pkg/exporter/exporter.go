@@ -0,0 +1,455 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package exporter writes the decrypted messages of an account to a Maildir or
+// an mbox tree. The later runs write only what changed since the previous one.
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// The formats of the export.
+const (
+	FormatMaildir = "maildir"
+	FormatMbox    = "mbox"
+)
+
+const (
+	stateFileName = ".peroxide-export.json"
+	forwardedFlag = "$Forwarded"
+)
+
+var log = logrus.WithField("pkg", "exporter") //nolint:gochecknoglobals
+
+var (
+	errUnknownFormat = errors.New("unknown export format")
+	errNotSynced     = errors.New("the account is not synced yet")
+)
+
+// Progress tells how many messages were written, updated (only their flags
+// changed), removed and failed in this run.
+type Progress struct {
+	Written int
+	Updated int
+	Removed int
+	Failed  int
+}
+
+// mailbox is the part of the store mailbox the export needs.
+type mailbox interface {
+	Name() string
+	UIDValidity() uint32
+	GetHighestModSeq() (uint64, error)
+	GetAPIIDsFromUIDRange(start, stop uint32) ([]string, error)
+	GetAPIIDsChangedSince(apiIDs []string, modSeq uint64) ([]string, error)
+	getMessage(apiID string) (*pmapi.Message, error)
+	getLiteral(apiID string) ([]byte, error)
+}
+
+type storeMailbox struct {
+	*store.Mailbox
+}
+
+func (mbox storeMailbox) getMessage(apiID string) (*pmapi.Message, error) {
+	msg, err := mbox.GetMessage(apiID)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Message(), nil
+}
+
+func (mbox storeMailbox) getLiteral(apiID string) ([]byte, error) {
+	msg, err := mbox.GetMessage(apiID)
+	if err != nil {
+		return nil, err
+	}
+	return msg.GetRFC822()
+}
+
+// exportState is what the previous run exported, saved in the export
+// directory.
+type exportState struct {
+	Format    string
+	EventID   string
+	Mailboxes map[string]*mailboxState
+}
+
+// mailboxState is the exported mailbox. Files maps the message IDs to the
+// names of their files in the Maildir; in the mbox, the names are empty.
+type mailboxState struct {
+	Path        string
+	UIDValidity uint32
+	ModSeq      uint64
+	Files       map[string]string
+}
+
+// Exporter exports all mailboxes of the store to the directory. All Mail is
+// left out, as all its messages are in the other mailboxes too.
+type Exporter struct {
+	store  *store.Store
+	dir    string
+	format string
+	state  *exportState
+
+	progress     Progress
+	progressLock sync.Mutex
+}
+
+// New returns the exporter of the store to the directory in the format. The
+// directory is created if it does not exist.
+func New(store *store.Store, dir, format string) (*Exporter, error) {
+	if format == "" {
+		format = FormatMaildir
+	}
+	if format != FormatMaildir && format != FormatMbox {
+		return nil, errUnknownFormat
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	state, err := loadState(dir, format)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Exporter{
+		store:  store,
+		dir:    dir,
+		format: format,
+		state:  state,
+	}, nil
+}
+
+func loadState(dir, format string) (*exportState, error) {
+	state := &exportState{Format: format, Mailboxes: map[string]*mailboxState{}}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, stateFileName)) //nolint:gosec
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, errors.Wrap(err, "cannot read the export state")
+	}
+
+	if state.Format != format {
+		return nil, errors.Errorf("the directory contains an export in the %v format", state.Format)
+	}
+
+	return state, nil
+}
+
+func (ex *Exporter) saveState() error {
+	b, err := json.Marshal(ex.state)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ex.dir, stateFileName)
+	if err := ioutil.WriteFile(path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// GetProgress returns how far the export got.
+func (ex *Exporter) GetProgress() Progress {
+	ex.progressLock.Lock()
+	defer ex.progressLock.Unlock()
+
+	return ex.progress
+}
+
+func (ex *Exporter) updateProgress(update func(*Progress)) {
+	ex.progressLock.Lock()
+	defer ex.progressLock.Unlock()
+
+	update(&ex.progress)
+}
+
+// Export writes the messages which changed since the last run. Nothing is
+// done if the store processed no event since then. When the context is
+// cancelled, the export stops after the current message and can be
+// continued later.
+func (ex *Exporter) Export(ctx context.Context) error {
+	if !ex.store.GetStatus().SyncFinished {
+		return errNotSynced
+	}
+
+	mailboxes, err := ex.getMailboxes()
+	if err != nil {
+		return err
+	}
+
+	return ex.export(ctx, ex.store.GetEventID(), mailboxes)
+}
+
+// getMailboxes returns the mailboxes of the store by their state keys. With
+// more than one address in the store, the paths start with the address.
+func (ex *Exporter) getMailboxes() (map[string]mailbox, error) {
+	addrs, err := ex.store.GetAddressInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	storeAddrs := []*store.Address{}
+	for _, addr := range addrs {
+		if storeAddr, err := ex.store.GetAddress(addr.AddressID); err == nil {
+			storeAddrs = append(storeAddrs, storeAddr)
+		}
+	}
+
+	mailboxes := map[string]mailbox{}
+	for _, storeAddr := range storeAddrs {
+		for _, storeMbox := range storeAddr.ListMailboxes() {
+			if storeMbox.LabelID() == pmapi.AllMailLabel {
+				continue
+			}
+
+			key := storeMbox.LabelID()
+			if len(storeAddrs) > 1 {
+				key = storeAddr.AddressString() + "/" + key
+			}
+			mailboxes[key] = storeMailbox{storeMbox}
+		}
+	}
+
+	return mailboxes, nil
+}
+
+func (ex *Exporter) export(ctx context.Context, eventID string, mailboxes map[string]mailbox) error {
+	if eventID != "" && eventID == ex.state.EventID {
+		return nil
+	}
+
+	ex.state.EventID = ""
+	failed := false
+
+	// The removed mailboxes first, so that a new mailbox of the same name
+	// does not find the files of the old one.
+	for key, mboxState := range ex.state.Mailboxes {
+		mbox, ok := mailboxes[key]
+		if ok && ex.getPath(key, mbox) == mboxState.Path && mbox.UIDValidity() == mboxState.UIDValidity {
+			continue
+		}
+		if err := ex.removeMailbox(mboxState); err != nil {
+			return err
+		}
+		delete(ex.state.Mailboxes, key)
+		if err := ex.saveState(); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(mailboxes))
+	for key := range mailboxes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ok, err := ex.exportMailbox(ctx, key, mailboxes[key])
+		if saveErr := ex.saveState(); err == nil {
+			err = saveErr
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			failed = true
+		}
+	}
+
+	if !failed {
+		ex.state.EventID = eventID
+	}
+
+	return ex.saveState()
+}
+
+// getPath returns the path of the mailbox relative to the export directory.
+func (ex *Exporter) getPath(key string, mbox mailbox) string {
+	parts := strings.Split(mbox.Name(), store.PathDelimiter)
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		parts = append([]string{key[:i]}, parts...)
+	}
+
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			parts[i] = "_"
+		}
+	}
+
+	path := filepath.Join(parts...)
+	if ex.format == FormatMbox {
+		path += ".mbox"
+	}
+	return path
+}
+
+// exportMailbox writes the messages of the mailbox which are new or changed
+// since the last run and removes those which are not in the mailbox anymore.
+// It returns false if some messages failed.
+func (ex *Exporter) exportMailbox(ctx context.Context, key string, mbox mailbox) (bool, error) {
+	mboxState, ok := ex.state.Mailboxes[key]
+	if !ok {
+		mboxState = &mailboxState{
+			Path:        ex.getPath(key, mbox),
+			UIDValidity: mbox.UIDValidity(),
+			Files:       map[string]string{},
+		}
+		ex.state.Mailboxes[key] = mboxState
+	}
+
+	modSeq, err := mbox.GetHighestModSeq()
+	if err != nil {
+		return false, err
+	}
+	if ok && modSeq == mboxState.ModSeq {
+		return true, nil
+	}
+
+	apiIDs, err := mbox.GetAPIIDsFromUIDRange(1, 0)
+	if err != nil {
+		return false, err
+	}
+
+	changedIDs, err := mbox.GetAPIIDsChangedSince(apiIDs, mboxState.ModSeq)
+	if err != nil {
+		return false, err
+	}
+
+	changed := map[string]bool{}
+	for _, apiID := range changedIDs {
+		changed[apiID] = true
+	}
+
+	present := map[string]bool{}
+	for _, apiID := range apiIDs {
+		present[apiID] = true
+	}
+
+	removed := []string{}
+	for apiID := range mboxState.Files {
+		if !present[apiID] {
+			removed = append(removed, apiID)
+		}
+	}
+
+	log.WithField("mailbox", mbox.Name()).
+		WithField("messages", len(apiIDs)).
+		WithField("changed", len(changedIDs)).
+		WithField("removed", len(removed)).
+		Info("Exporting mailbox")
+
+	w := &mailboxWriter{
+		ex:      ex,
+		mbox:    mbox,
+		state:   mboxState,
+		path:    filepath.Join(ex.dir, mboxState.Path),
+		ok:      true,
+		changed: changed,
+	}
+
+	if ex.format == FormatMaildir {
+		err = w.writeMaildir(ctx, apiIDs, removed)
+	} else {
+		err = w.writeMbox(ctx, apiIDs, removed)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if w.ok {
+		mboxState.ModSeq = modSeq
+	}
+
+	return w.ok, nil
+}
+
+func (ex *Exporter) removeMailbox(mboxState *mailboxState) error {
+	path := filepath.Join(ex.dir, mboxState.Path)
+
+	ex.updateProgress(func(p *Progress) { p.Removed += len(mboxState.Files) })
+
+	if ex.format == FormatMbox {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// The Maildirs of the submailboxes are inside, so only the message
+	// directories are removed.
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.RemoveAll(filepath.Join(path, sub)); err != nil {
+			return err
+		}
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", path).Debug("Mailbox directory not removed")
+	}
+
+	return nil
+}
+
+// mailboxWriter writes the messages of one mailbox.
+type mailboxWriter struct {
+	ex      *Exporter
+	mbox    mailbox
+	state   *mailboxState
+	path    string
+	ok      bool
+	changed map[string]bool
+}
+
+// getFlags returns the IMAP flags of the message and the forwarded flag.
+func getFlags(msg *pmapi.Message) []string {
+	flags := message.GetFlags(msg)
+	if msg.Has(pmapi.FlagForwarded) {
+		flags = append(flags, forwardedFlag)
+	}
+	return flags
+}
+
+func (w *mailboxWriter) fail(apiID string, err error) {
+	log.WithError(err).
+		WithField("mailbox", w.mbox.Name()).
+		WithField("msgID", apiID).
+		Warn("Cannot export message")
+	w.ok = false
+	w.ex.updateProgress(func(p *Progress) { p.Failed++ })
+}
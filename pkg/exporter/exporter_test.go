@@ -0,0 +1,210 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+type testMailbox struct {
+	name    string
+	modSeq  uint64
+	apiIDs  []string
+	modSeqs map[string]uint64
+	msgs    map[string]*pmapi.Message
+}
+
+func newTestMailbox(name string) *testMailbox {
+	return &testMailbox{
+		name:    name,
+		modSeq:  1,
+		modSeqs: map[string]uint64{},
+		msgs:    map[string]*pmapi.Message{},
+	}
+}
+
+func (mbox *testMailbox) add(msg *pmapi.Message) {
+	mbox.apiIDs = append(mbox.apiIDs, msg.ID)
+	mbox.msgs[msg.ID] = msg
+	mbox.modSeq++
+	mbox.modSeqs[msg.ID] = mbox.modSeq
+}
+
+func (mbox *testMailbox) update(apiID string, fn func(*pmapi.Message)) {
+	fn(mbox.msgs[apiID])
+	mbox.modSeq++
+	mbox.modSeqs[apiID] = mbox.modSeq
+}
+
+func (mbox *testMailbox) remove(apiID string) {
+	for i, id := range mbox.apiIDs {
+		if id == apiID {
+			mbox.apiIDs = append(mbox.apiIDs[:i], mbox.apiIDs[i+1:]...)
+			break
+		}
+	}
+	mbox.modSeq++
+}
+
+func (mbox *testMailbox) Name() string                      { return mbox.name }
+func (mbox *testMailbox) UIDValidity() uint32               { return 1 }
+func (mbox *testMailbox) GetHighestModSeq() (uint64, error) { return mbox.modSeq, nil }
+
+func (mbox *testMailbox) GetAPIIDsFromUIDRange(start, stop uint32) ([]string, error) {
+	return append([]string{}, mbox.apiIDs...), nil
+}
+
+func (mbox *testMailbox) GetAPIIDsChangedSince(apiIDs []string, modSeq uint64) ([]string, error) {
+	changed := []string{}
+	for _, apiID := range apiIDs {
+		if mbox.modSeqs[apiID] > modSeq {
+			changed = append(changed, apiID)
+		}
+	}
+	return changed, nil
+}
+
+func (mbox *testMailbox) getMessage(apiID string) (*pmapi.Message, error) {
+	return mbox.msgs[apiID], nil
+}
+
+func (mbox *testMailbox) getLiteral(apiID string) ([]byte, error) {
+	return []byte("Subject: " + apiID + "\r\n\r\nFrom the body\r\n"), nil
+}
+
+func newTestMessage(id string, unread bool, labelIDs ...string) *pmapi.Message {
+	return &pmapi.Message{
+		ID:       id,
+		Time:     1500000000,
+		Unread:   pmapi.Boolean(unread),
+		Flags:    pmapi.FlagReceived,
+		Sender:   &mail.Address{Address: "sender@pm.me"},
+		LabelIDs: labelIDs,
+	}
+}
+
+func newTestExporter(t *testing.T, dir, format string) *Exporter {
+	state, err := loadState(dir, format)
+	require.NoError(t, err)
+	return &Exporter{dir: dir, format: format, state: state}
+}
+
+func listDir(t *testing.T, path string) []string {
+	files, err := ioutil.ReadDir(path)
+	require.NoError(t, err)
+
+	names := []string{}
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names
+}
+
+func TestExportMaildir(t *testing.T) {
+	dir := t.TempDir()
+	cur := filepath.Join(dir, "Folders", "Work", "cur")
+
+	mbox := newTestMailbox("Folders/Work")
+	mbox.add(newTestMessage("a/1=", true))
+	mbox.add(newTestMessage("b", false, pmapi.StarredLabel))
+	mailboxes := map[string]mailbox{"work": mbox}
+
+	ex := newTestExporter(t, dir, FormatMaildir)
+	require.NoError(t, ex.export(context.Background(), "1", mailboxes))
+	require.Equal(t, Progress{Written: 2}, ex.GetProgress())
+	require.Equal(t, []string{"1500000000.a_1.peroxide:2,", "1500000000.b.peroxide:2,FS"}, listDir(t, cur))
+
+	literal, err := ioutil.ReadFile(filepath.Join(cur, "1500000000.b.peroxide:2,FS"))
+	require.NoError(t, err)
+	require.Equal(t, "Subject: b\r\n\r\nFrom the body\r\n", string(literal))
+
+	// Without a new event, nothing is looked at.
+	mbox.update("a/1=", func(msg *pmapi.Message) { msg.Unread = false })
+
+	ex = newTestExporter(t, dir, FormatMaildir)
+	require.NoError(t, ex.export(context.Background(), "1", mailboxes))
+	require.Equal(t, Progress{}, ex.GetProgress())
+
+	mbox.update("a/1=", func(msg *pmapi.Message) { msg.Flags |= pmapi.FlagReplied | pmapi.FlagForwarded })
+	mbox.remove("b")
+	mbox.add(newTestMessage("c", true))
+
+	ex = newTestExporter(t, dir, FormatMaildir)
+	require.NoError(t, ex.export(context.Background(), "2", mailboxes))
+	require.Equal(t, Progress{Written: 1, Updated: 1, Removed: 1}, ex.GetProgress())
+	require.Equal(t, []string{"1500000000.a_1.peroxide:2,PRS", "1500000000.c.peroxide:2,"}, listDir(t, cur))
+
+	// The removed mailbox is removed from the export too.
+	ex = newTestExporter(t, dir, FormatMaildir)
+	require.NoError(t, ex.export(context.Background(), "3", map[string]mailbox{}))
+	require.Equal(t, Progress{Removed: 2}, ex.GetProgress())
+	_, err = os.Stat(filepath.Join(dir, "Folders", "Work"))
+	require.True(t, os.IsNotExist(err))
+
+	_, err = loadState(dir, FormatMbox)
+	require.Error(t, err)
+}
+
+func TestExportMbox(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "INBOX.mbox")
+
+	mbox := newTestMailbox("INBOX")
+	mbox.add(newTestMessage("a", true))
+	mailboxes := map[string]mailbox{"inbox": mbox}
+
+	ex := newTestExporter(t, dir, FormatMbox)
+	require.NoError(t, ex.export(context.Background(), "1", mailboxes))
+
+	mbox.add(newTestMessage("b", false, pmapi.StarredLabel))
+
+	ex = newTestExporter(t, dir, FormatMbox)
+	require.NoError(t, ex.export(context.Background(), "2", mailboxes))
+	require.Equal(t, Progress{Written: 1}, ex.GetProgress())
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"From sender@pm.me Fri Jul 14 02:40:00 2017\n"+
+		"Status: O\n"+
+		"Subject: a\n\n>From the body\n\n"+
+		"From sender@pm.me Fri Jul 14 02:40:00 2017\n"+
+		"Status: RO\n"+
+		"X-Status: F\n"+
+		"Subject: b\n\n>From the body\n\n", string(content))
+
+	// A changed message makes the mbox written again.
+	mbox.update("a", func(msg *pmapi.Message) { msg.Unread = false })
+	mbox.remove("b")
+
+	ex = newTestExporter(t, dir, FormatMbox)
+	require.NoError(t, ex.export(context.Background(), "3", mailboxes))
+	require.Equal(t, Progress{Updated: 1, Removed: 1}, ex.GetProgress())
+
+	content, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "From sender@pm.me Fri Jul 14 02:40:00 2017\nStatus: RO\nSubject: a\n\n>From the body\n\n", string(content))
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// writeMaildir writes the new messages to the cur directory of the Maildir
+// and renames the files of the messages whose flags changed. Only the drafts
+// are written again, as the other messages cannot change.
+func (w *mailboxWriter) writeMaildir(ctx context.Context, apiIDs, removed []string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(w.path, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	for _, apiID := range removed {
+		if err := os.Remove(filepath.Join(w.path, "cur", w.state.Files[apiID])); err != nil && !os.IsNotExist(err) {
+			w.fail(apiID, err)
+			continue
+		}
+		delete(w.state.Files, apiID)
+		w.ex.updateProgress(func(p *Progress) { p.Removed++ })
+	}
+
+	for _, apiID := range apiIDs {
+		oldName, exported := w.state.Files[apiID]
+		if exported && !w.changed[apiID] {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		msg, err := w.mbox.getMessage(apiID)
+		if err != nil {
+			w.fail(apiID, err)
+			continue
+		}
+
+		name := getMaildirName(msg)
+
+		if exported && !msg.IsDraft() {
+			if name != oldName {
+				if err := os.Rename(filepath.Join(w.path, "cur", oldName), filepath.Join(w.path, "cur", name)); err != nil {
+					w.fail(apiID, err)
+					continue
+				}
+				w.ex.updateProgress(func(p *Progress) { p.Updated++ })
+			}
+			w.state.Files[apiID] = name
+			continue
+		}
+
+		if err := w.writeMaildirMessage(apiID, name); err != nil {
+			w.fail(apiID, err)
+			continue
+		}
+
+		if exported && name != oldName {
+			if err := os.Remove(filepath.Join(w.path, "cur", oldName)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+
+		w.state.Files[apiID] = name
+		w.ex.updateProgress(func(p *Progress) { p.Written++ })
+	}
+
+	return nil
+}
+
+// writeMaildirMessage writes the message to tmp and moves it to cur, so that
+// the readers of the Maildir never see a partial message.
+func (w *mailboxWriter) writeMaildirMessage(apiID, name string) error {
+	literal, err := w.mbox.getLiteral(apiID)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(w.path, "tmp", name)
+	if err := ioutil.WriteFile(tmp, literal, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(w.path, "cur", name))
+}
+
+// getMaildirName returns the name of the message file: the time of the
+// message, the message ID and the flags in the info part.
+func getMaildirName(msg *pmapi.Message) string {
+	id := strings.NewReplacer("/", "_", "+", "-", "=", "").Replace(msg.ID)
+	return fmt.Sprintf("%d.%s.peroxide:2,%s", msg.Time, id, getMaildirInfo(getFlags(msg)))
+}
+
+// getMaildirInfo returns the Maildir flags, which must be in ASCII order.
+func getMaildirInfo(flags []string) string {
+	info := []string{}
+	for _, flag := range flags {
+		switch flag {
+		case imap.DraftFlag:
+			info = append(info, "D")
+		case imap.FlaggedFlag:
+			info = append(info, "F")
+		case forwardedFlag:
+			info = append(info, "P")
+		case imap.AnsweredFlag:
+			info = append(info, "R")
+		case imap.SeenFlag:
+			info = append(info, "S")
+		}
+	}
+	sort.Strings(info)
+	return strings.Join(info, "")
+}
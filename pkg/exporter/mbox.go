@@ -0,0 +1,190 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+var mboxFromLine = regexp.MustCompile(`(?m)^(>*From )`) //nolint:gochecknoglobals
+
+// writeMbox appends the new messages to the mbox. If some messages were
+// removed or changed, the mbox is written again instead.
+func (w *mailboxWriter) writeMbox(ctx context.Context, apiIDs, removed []string) error {
+	if err := os.MkdirAll(filepath.Dir(w.path), 0700); err != nil {
+		return err
+	}
+
+	rewrite := len(removed) > 0
+	for _, apiID := range apiIDs {
+		if _, exported := w.state.Files[apiID]; exported && w.changed[apiID] {
+			rewrite = true
+		}
+	}
+	if rewrite {
+		return w.rewriteMbox(ctx, apiIDs, removed)
+	}
+
+	f, err := os.OpenFile(w.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	for _, apiID := range apiIDs {
+		if _, exported := w.state.Files[apiID]; exported {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := w.getMboxEntry(apiID)
+		if err != nil {
+			w.fail(apiID, err)
+			continue
+		}
+
+		if _, err := f.Write(entry); err != nil {
+			return err
+		}
+
+		w.state.Files[apiID] = ""
+		w.ex.updateProgress(func(p *Progress) { p.Written++ })
+	}
+
+	return f.Close()
+}
+
+// rewriteMbox writes all messages of the mailbox to a new mbox which then
+// replaces the old one.
+func (w *mailboxWriter) rewriteMbox(ctx context.Context, apiIDs, removed []string) (err error) {
+	tmp := w.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		if err != nil {
+			_ = os.Remove(tmp)
+		}
+	}()
+
+	files := map[string]string{}
+	written, updated := 0, 0
+
+	for _, apiID := range apiIDs {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		entry, err := w.getMboxEntry(apiID)
+		if err != nil {
+			w.fail(apiID, err)
+			continue
+		}
+
+		if _, err := f.Write(entry); err != nil {
+			return err
+		}
+
+		if _, exported := w.state.Files[apiID]; !exported {
+			written++
+		} else if w.changed[apiID] {
+			updated++
+		}
+		files[apiID] = ""
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+
+	w.state.Files = files
+	w.ex.updateProgress(func(p *Progress) {
+		p.Written += written
+		p.Updated += updated
+		p.Removed += len(removed)
+	})
+
+	return nil
+}
+
+// getMboxEntry returns the message in the mboxrd format with the flags in the
+// Status and X-Status headers.
+func (w *mailboxWriter) getMboxEntry(apiID string) ([]byte, error) {
+	msg, err := w.mbox.getMessage(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	literal, err := w.mbox.getLiteral(apiID)
+	if err != nil {
+		return nil, err
+	}
+
+	sender := "MAILER-DAEMON"
+	if msg.Sender != nil && msg.Sender.Address != "" {
+		sender = msg.Sender.Address
+	}
+
+	status, xStatus := "O", ""
+	for _, flag := range getFlags(msg) {
+		switch flag {
+		case imap.SeenFlag:
+			status = "RO"
+		case imap.AnsweredFlag:
+			xStatus += "A"
+		case imap.FlaggedFlag:
+			xStatus += "F"
+		case imap.DraftFlag:
+			xStatus += "T"
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From %s %s\n", sender, time.Unix(msg.Time, 0).UTC().Format(time.ANSIC))
+	fmt.Fprintf(buf, "Status: %s\n", status)
+	if xStatus != "" {
+		fmt.Fprintf(buf, "X-Status: %s\n", xStatus)
+	}
+
+	literal = bytes.ReplaceAll(literal, []byte("\r\n"), []byte("\n"))
+	buf.Write(mboxFromLine.ReplaceAll(literal, []byte(">$1")))
+	if !bytes.HasSuffix(literal, []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	return buf.Bytes(), nil
+}
@@ -40,12 +40,22 @@ import (
 
 	"github.com/emersion/go-imap"
 	goIMAPBackend "github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
 	"github.com/ljanyst/peroxide/pkg/config/settings"
 	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/metrics"
+	"github.com/ljanyst/peroxide/pkg/smtp"
 	"github.com/ljanyst/peroxide/pkg/users"
 )
 
+//nolint:gochecknoglobals
+var connections = metrics.NewGaugeVec(
+	"peroxide_imap_connections",
+	"Number of logged in IMAP connections.",
+	"user",
+)
+
 type imapBackend struct {
 	usersMgr         *users.Users
 	updates          *imapUpdates
@@ -53,6 +63,8 @@ type imapBackend struct {
 	listWorkers      int
 	bccSelf          bool
 	isAllMailVisible bool
+	labelsAsKeywords bool
+	optionsLock      sync.RWMutex
 
 	users       map[string]*imapUser
 	usersLocker sync.Locker
@@ -60,6 +72,8 @@ type imapBackend struct {
 	imapCache     map[string]map[string]string
 	imapCachePath string
 	imapCacheLock *sync.RWMutex
+
+	outbox *smtp.OutboundQueue
 }
 
 // NewIMAPBackend returns struct implementing go-imap/backend interface.
@@ -69,6 +83,8 @@ func NewIMAPBackend(
 	users *users.Users,
 	bccSelf bool,
 	isAllMailVisible bool,
+	labelsAsKeywords bool,
+	outbox *smtp.OutboundQueue,
 ) *imapBackend { //nolint[golint]
 
 	imapWorkers := setting.GetInt(settings.IMAPWorkers)
@@ -88,9 +104,15 @@ func NewIMAPBackend(
 
 		bccSelf:          bccSelf,
 		isAllMailVisible: isAllMailVisible,
+		labelsAsKeywords: labelsAsKeywords,
+
+		outbox: outbox,
 	}
 
 	go backend.monitorDisconnectedUsers()
+	if outbox != nil {
+		go backend.monitorOutbox()
+	}
 
 	return backend
 }
@@ -163,6 +185,7 @@ func (ib *imapBackend) Login(_ *imap.ConnInfo, username, password string) (goIMA
 		log.WithError(err).Warn("Cannot get user")
 		return nil, err
 	}
+	connections.Inc(imapUser.storeUser.UserID())
 
 	if err := imapUser.user.CheckCredentials(slot, password); err != nil {
 		log.WithError(err).Errorf("Could not check bridge password: %s %s", username, slot)
@@ -186,11 +209,59 @@ func (ib *imapBackend) Login(_ *imap.ConnInfo, username, password string) (goIMA
 	return imapUser, nil
 }
 
-// Updates returns a channel of updates for IMAP IDLE extension.
+// SetOptions changes the tunables of a running backend. They take effect for
+// the subsequent commands of the connected clients.
+func (ib *imapBackend) SetOptions(listWorkers int, bccSelf, isAllMailVisible, labelsAsKeywords bool) {
+	ib.optionsLock.Lock()
+	defer ib.optionsLock.Unlock()
+
+	ib.listWorkers = listWorkers
+	ib.bccSelf = bccSelf
+	ib.isAllMailVisible = isAllMailVisible
+	ib.labelsAsKeywords = labelsAsKeywords
+}
+
+func (ib *imapBackend) getListWorkers() int {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.listWorkers
+}
+
+func (ib *imapBackend) isBCCSelf() bool {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.bccSelf
+}
+
+func (ib *imapBackend) isAllMailShown() bool {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.isAllMailVisible
+}
+
+func (ib *imapBackend) areLabelsKeywords() bool {
+	ib.optionsLock.RLock()
+	defer ib.optionsLock.RUnlock()
+
+	return ib.labelsAsKeywords
+}
+
+// Updates returns a channel of updates for IMAP IDLE extension. Nothing is
+// sent over it: the updates are dispatched to the connections of the servers
+// by imapUpdates. It only tells the go-imap server that the backend sends the
+// updates on its own.
 func (ib *imapBackend) Updates() <-chan goIMAPBackend.Update {
 	return ib.updates.chout
 }
 
+// addServer makes the connections of the server receive the updates.
+func (ib *imapBackend) addServer(server *imapserver.Server) {
+	ib.updates.addServer(server)
+}
+
 func (ib *imapBackend) CreateMessageLimit() *uint32 {
 	return nil
 }
@@ -206,3 +277,26 @@ func (ib *imapBackend) monitorDisconnectedUsers() {
 		ib.deleteUser(address)
 	}
 }
+
+// monitorOutbox tells the connected users about the messages added to or
+// removed from their Outbox.
+func (ib *imapBackend) monitorOutbox() {
+	ch := make(chan string)
+	ib.eventListener.Add(events.OutboxChangedEvent, ch)
+
+	for userID := range ch {
+		// In combined mode, all the addresses share the same user.
+		ib.usersLocker.Lock()
+		users := map[*imapUser]bool{}
+		for _, user := range ib.users {
+			if user.storeUser.UserID() == userID {
+				users[user] = true
+			}
+		}
+		ib.usersLocker.Unlock()
+
+		for user := range users {
+			user.updateOutbox()
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"strings"
+	"sync"
+
+	goIMAPBackend "github.com/emersion/go-imap/backend"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+)
+
+// clientProfile switches on the quirks which only some clients need.
+type clientProfile struct {
+	// appleMailJunk marks the spam with the $Junk keyword of Apple Mail.
+	appleMailJunk bool
+
+	// thunderbirdJunk marks the spam with the Junk keyword of Thunderbird,
+	// and the other messages with its NonJunk keyword.
+	thunderbirdJunk bool
+}
+
+//nolint:gochecknoglobals
+var (
+	// unidentifiedProfile is used for the clients which do not send ID.
+	// They get all the quirks, as they did before the profiles existed.
+	unidentifiedProfile = &clientProfile{appleMailJunk: true, thunderbirdJunk: true}
+
+	appleMailProfile   = &clientProfile{appleMailJunk: true}
+	thunderbirdProfile = &clientProfile{thunderbirdJunk: true}
+
+	// clientProfiles maps the lowercase prefixes of the client names sent
+	// by ID to their profiles.
+	clientProfiles = []struct {
+		namePrefix string
+		profile    *clientProfile
+	}{
+		{"mac os x mail", appleMailProfile},
+		{"macos mail", appleMailProfile},
+		{"iphone mail", appleMailProfile},
+		{"ipad mail", appleMailProfile},
+		{"thunderbird", thunderbirdProfile},
+		{"betterbird", thunderbirdProfile},
+	}
+)
+
+// getClientProfile returns the profile of the client with the given name.
+// The identified clients which are not known need no quirks.
+func getClientProfile(name string) *clientProfile {
+	name = strings.ToLower(name)
+	for _, p := range clientProfiles {
+		if strings.HasPrefix(name, p.namePrefix) {
+			return p.profile
+		}
+	}
+	return &clientProfile{}
+}
+
+// getJunkFlags returns the junk flags the client uses for a message with the
+// given labels.
+func (p *clientProfile) getJunkFlags(labelIDs []string) []string {
+	isSpam := false
+	for _, labelID := range labelIDs {
+		if labelID == pmapi.SpamLabel {
+			isSpam = true
+		}
+	}
+
+	flags := []string{}
+	if p.appleMailJunk && isSpam {
+		flags = append(flags, message.AppleMailJunkFlag)
+	}
+	if p.thunderbirdJunk {
+		if isSpam {
+			flags = append(flags, message.ThunderbirdJunkFlag)
+		} else {
+			flags = append(flags, message.ThunderbirdNonJunkFlag)
+		}
+	}
+	return flags
+}
+
+// getJunkFlagNames returns all the junk flags the client uses.
+func (p *clientProfile) getJunkFlagNames() []string {
+	flags := []string{}
+	if p.appleMailJunk {
+		flags = append(flags, message.AppleMailJunkFlag)
+	}
+	if p.thunderbirdJunk {
+		flags = append(flags, message.ThunderbirdJunkFlag, message.ThunderbirdNonJunkFlag)
+	}
+	return flags
+}
+
+// isJunkFlag returns whether the flag set by the client marks the spam.
+func (p *clientProfile) isJunkFlag(flag string) bool {
+	return (p.appleMailJunk && strings.EqualFold(flag, message.AppleMailJunkFlag)) ||
+		(p.thunderbirdJunk && strings.EqualFold(flag, message.ThunderbirdJunkFlag))
+}
+
+// imapClient is the client of a connection as it identified itself by ID.
+type imapClient struct {
+	lock    sync.RWMutex
+	name    string
+	version string
+	profile *clientProfile
+}
+
+func newIMAPClient() *imapClient {
+	return &imapClient{profile: unidentifiedProfile}
+}
+
+// setID records the identification sent by the client and switches to its
+// profile.
+func (c *imapClient) setID(id map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.name = id["name"]
+	c.version = id["version"]
+	c.profile = getClientProfile(c.name)
+}
+
+// getProfile returns the profile of the client. The connections without a
+// client get the profile of the unidentified clients.
+func (c *imapClient) getProfile() *clientProfile {
+	if c == nil {
+		return unidentifiedProfile
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.profile
+}
+
+// clientUser is the user of a single connection. The mailboxes it returns
+// follow the profile of the client of the connection.
+type clientUser struct {
+	*imapUser
+
+	imapClient *imapClient
+}
+
+func newClientUser(user *imapUser, client *imapClient) *clientUser {
+	return &clientUser{imapUser: user, imapClient: client}
+}
+
+// ListMailboxes returns a list of mailboxes belonging to this user.
+func (cu *clientUser) ListMailboxes(showOnlySubcribed bool) ([]goIMAPBackend.Mailbox, error) {
+	return cu.listMailboxes(showOnlySubcribed, cu.imapClient)
+}
+
+// GetMailbox returns a mailbox.
+func (cu *clientUser) GetMailbox(name string) (goIMAPBackend.Mailbox, error) {
+	return cu.getMailbox(name, cu.imapClient)
+}
+
+// getClientFlags returns the flags of the message with the given labels which
+// depend on the client: its junk flags and the keywords of the labels.
+func (im *imapMailbox) getClientFlags(labelIDs []string) []string {
+	return append(im.client.getProfile().getJunkFlags(labelIDs), im.getLabelKeywords(labelIDs)...)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetClientProfile(t *testing.T) {
+	for name, want := range map[string]*clientProfile{
+		"Mac OS X Mail": appleMailProfile,
+		"iPhone Mail":   appleMailProfile,
+		"Thunderbird":   thunderbirdProfile,
+		"thunderbird":   thunderbirdProfile,
+		"Betterbird":    thunderbirdProfile,
+		"K-9 Mail":      {},
+		"":              {},
+	} {
+		require.Equal(t, want, getClientProfile(name), name)
+	}
+}
+
+func TestClientJunkFlags(t *testing.T) {
+	spam := []string{pmapi.SpamLabel}
+	inbox := []string{pmapi.InboxLabel}
+
+	var unidentified *imapClient
+	require.Equal(t, []string{"$Junk", "Junk"}, unidentified.getProfile().getJunkFlags(spam))
+	require.Equal(t, []string{"NonJunk"}, unidentified.getProfile().getJunkFlags(inbox))
+
+	client := newIMAPClient()
+	client.setID(map[string]string{"name": "Mac OS X Mail", "version": "16.0"})
+	require.Equal(t, []string{"$Junk"}, client.getProfile().getJunkFlags(spam))
+	require.Equal(t, []string{}, client.getProfile().getJunkFlags(inbox))
+	require.True(t, client.getProfile().isJunkFlag("$junk"))
+	require.False(t, client.getProfile().isJunkFlag("junk"))
+
+	client.setID(map[string]string{"name": "Thunderbird"})
+	require.Equal(t, []string{"Junk"}, client.getProfile().getJunkFlags(spam))
+	require.Equal(t, []string{"Junk", "NonJunk"}, client.getProfile().getJunkFlagNames())
+	require.True(t, client.getProfile().isJunkFlag("junk"))
+
+	client.setID(map[string]string{"name": "Evolution"})
+	require.Equal(t, []string{}, client.getProfile().getJunkFlags(spam))
+	require.False(t, client.getProfile().isJunkFlag("$junk"))
+}
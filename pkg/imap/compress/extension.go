@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package compress implements the COMPRESS=DEFLATE extension of RFC4978.
+//
+// The compression can be started only after the authentication, so that
+// the credentials and the TLS negotiation are never compressed.
+package compress
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+// Capability extension identifiers.
+const (
+	Deflate    = "DEFLATE"
+	Capability = "COMPRESS=" + Deflate
+	name       = "COMPRESS"
+	activeCode = "COMPRESSIONACTIVE"
+)
+
+// deflateConn compresses everything written to the connection and
+// decompresses everything read from it. Every write is flushed so that the
+// client receives whole responses.
+type deflateConn struct {
+	net.Conn
+
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func newDeflateConn(c net.Conn) (*deflateConn, error) {
+	w, err := flate.NewWriter(c, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deflateConn{Conn: c, r: flate.NewReader(c), w: w}, nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *deflateConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *deflateConn) Close() error {
+	_ = c.r.Close()
+	_ = c.w.Close()
+	return c.Conn.Close()
+}
+
+// Command is the COMPRESS command of RFC4978.
+type Command struct {
+	Mechanism string
+
+	ext *extension
+}
+
+func (cmd *Command) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("COMPRESS expects a single mechanism")
+	}
+
+	mechanism, ok := fields[0].(string)
+	if !ok {
+		return errors.New("compression mechanism must be an atom")
+	}
+
+	cmd.Mechanism = strings.ToUpper(mechanism)
+	if cmd.Mechanism != Deflate {
+		return errors.New("unsupported compression mechanism: " + mechanism)
+	}
+
+	return nil
+}
+
+func (cmd *Command) Handle(conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.State&imap.AuthenticatedState == 0 {
+		return server.ErrNotAuthenticated
+	}
+
+	if cmd.ext.isActive(ctx) {
+		return server.ErrStatusResp(&imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: activeCode,
+			Info: "Compression is already active",
+		})
+	}
+
+	return nil
+}
+
+// Upgrade starts the compression once the OK response has been sent
+// uncompressed.
+func (cmd *Command) Upgrade(conn server.Conn) error {
+	err := conn.Upgrade(func(c net.Conn) (net.Conn, error) {
+		conn.WaitReady()
+		return newDeflateConn(c)
+	})
+	if err != nil {
+		return err
+	}
+
+	cmd.ext.activate(conn.Context())
+	return nil
+}
+
+type extension struct {
+	lock   sync.Mutex
+	active map[*server.Context]bool
+}
+
+// NewExtension of COMPRESS=DEFLATE.
+func NewExtension() server.Extension {
+	return &extension{active: map[*server.Context]bool{}}
+}
+
+func (ext *extension) isActive(ctx *server.Context) bool {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	return ext.active[ctx]
+}
+
+// activate remembers that the connection is compressed until it is closed.
+func (ext *extension) activate(ctx *server.Context) {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	ext.active[ctx] = true
+
+	go func() {
+		<-ctx.LoggedOut
+
+		ext.lock.Lock()
+		defer ext.lock.Unlock()
+
+		delete(ext.active, ctx)
+	}()
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{Capability}
+	}
+	return nil
+}
+
+func (ext *extension) Command(cmd string) server.HandlerFactory {
+	if cmd != name {
+		return nil
+	}
+
+	return func() server.Handler { return &Command{ext: ext} }
+}
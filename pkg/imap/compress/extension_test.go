@@ -0,0 +1,121 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	w       io.Writer
+	scanner *bufio.Scanner
+}
+
+func newTestClient(t *testing.T) *testClient {
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Enable(NewExtension())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	c := &testClient{t: t, conn: conn, w: conn, scanner: bufio.NewScanner(conn)}
+	require.True(t, c.scanner.Scan(), "missing greeting")
+	return c
+}
+
+// cmd sends the command and returns the untagged responses and the tagged
+// status response.
+func (c *testClient) cmd(tag, command string) ([]string, string) {
+	_, err := fmt.Fprintf(c.w, "%s %s\r\n", tag, command)
+	require.NoError(c.t, err)
+	if w, ok := c.w.(*flate.Writer); ok {
+		require.NoError(c.t, w.Flush())
+	}
+
+	var lines []string
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.HasPrefix(line, tag+" ") {
+			return lines, line
+		}
+		lines = append(lines, line)
+	}
+
+	require.Fail(c.t, "connection closed", "%v", c.scanner.Err())
+	return nil, ""
+}
+
+func (c *testClient) compress() {
+	w, err := flate.NewWriter(c.conn, flate.DefaultCompression)
+	require.NoError(c.t, err)
+
+	c.w = w
+	c.scanner = bufio.NewScanner(flate.NewReader(c.conn))
+}
+
+func TestCompress(t *testing.T) {
+	c := newTestClient(t)
+
+	lines, _ := c.cmd("a", "CAPABILITY")
+	require.NotContains(t, lines[0], Capability)
+
+	_, status := c.cmd("b", "COMPRESS DEFLATE")
+	require.True(t, strings.HasPrefix(status, "b NO"), status)
+
+	_, status = c.cmd("c", "LOGIN username password")
+	require.True(t, strings.HasPrefix(status, "c OK"), status)
+
+	lines, _ = c.cmd("d", "CAPABILITY")
+	require.Contains(t, lines[0], " "+Capability)
+
+	_, status = c.cmd("e", "COMPRESS LZW")
+	require.True(t, strings.HasPrefix(status, "e BAD"), status)
+
+	_, status = c.cmd("f", "COMPRESS DEFLATE")
+	require.True(t, strings.HasPrefix(status, "f OK"), status)
+	c.compress()
+
+	lines, status = c.cmd("g", "SELECT INBOX")
+	require.True(t, strings.HasPrefix(status, "g OK"), status)
+	require.Contains(t, lines, "* 1 EXISTS")
+
+	_, status = c.cmd("h", "COMPRESS DEFLATE")
+	require.Equal(t, "h NO [COMPRESSIONACTIVE] Compression is already active", status)
+
+	lines, status = c.cmd("i", "FETCH 1 (BODY.PEEK[])")
+	require.True(t, strings.HasPrefix(status, "i OK"), status)
+	require.Contains(t, strings.Join(lines, "\n"), "Hi there :))")
+}
@@ -0,0 +1,515 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package condstore
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+)
+
+// Enable is the ENABLE command of RFC5161. Only CONDSTORE and QRESYNC can be
+// enabled, other capabilities are ignored.
+type Enable struct {
+	Capabilities []string
+}
+
+func (cmd *Enable) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("missing capability")
+	}
+
+	for _, f := range fields {
+		capability, ok := f.(string)
+		if !ok {
+			return errors.New("capability must be an atom")
+		}
+		cmd.Capabilities = append(cmd.Capabilities, strings.ToUpper(capability))
+	}
+	return nil
+}
+
+func (cmd *Enable) Handle(conn server.Conn) error {
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	var condstore, qresync bool
+	fields := []interface{}{imap.RawString(enabled)}
+	for _, capability := range cmd.Capabilities {
+		switch capability {
+		case Capability:
+			condstore = true
+		case QResyncCapability:
+			qresync = true
+		default:
+			continue
+		}
+		fields = append(fields, imap.RawString(capability))
+	}
+
+	enable(conn, condstore, qresync)
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUIDs   *imap.SeqSet
+}
+
+func parseQResyncParams(f interface{}) (*qresyncParams, error) {
+	fields, ok := f.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, errors.New("QRESYNC parameters must be a list of UIDVALIDITY and mod-sequence")
+	}
+
+	var params qresyncParams
+	var err error
+	if params.uidValidity, err = imap.ParseNumber(fields[0]); err != nil {
+		return nil, err
+	}
+	if params.modSeq, err = parseModSeq(fields[1]); err != nil {
+		return nil, err
+	}
+
+	// The known UIDs are optional and so is the sequence match data list
+	// following them.
+	if len(fields) > 2 {
+		if uids, ok := fields[2].(string); ok {
+			if params.knownUIDs, err = imap.ParseSeqSet(uids); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &params, nil
+}
+
+// Select handles SELECT and EXAMINE with the CONDSTORE and QRESYNC
+// parameters and reports the highest mod-sequence of the mailbox.
+type Select struct {
+	server.Select
+
+	condstore bool
+	qresync   *qresyncParams
+}
+
+func (cmd *Select) Parse(fields []interface{}) error {
+	if err := cmd.Select.Parse(fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("SELECT parameters must be a list")
+	}
+
+	for i := 0; i < len(params); i++ {
+		name, _ := params[i].(string)
+		switch strings.ToUpper(name) {
+		case Capability:
+			cmd.condstore = true
+		case QResyncCapability:
+			i++
+			if i == len(params) {
+				return errors.New("missing QRESYNC parameters")
+			}
+			var err error
+			if cmd.qresync, err = parseQResyncParams(params[i]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown SELECT parameter %v", params[i])
+		}
+	}
+
+	return nil
+}
+
+func (cmd *Select) Handle(conn server.Conn) error {
+	if cmd.qresync != nil && !QResyncEnabled(conn) {
+		return errors.New("QRESYNC is not enabled")
+	}
+	enable(conn, cmd.condstore, false)
+
+	// On success, the go-imap handler returns the tagged OK response as an
+	// error, so the untagged responses below are sent before it.
+	res := cmd.Select.Handle(conn)
+	if _, ok := res.(*imap.ErrStatusResp); !ok {
+		return res
+	}
+
+	mbox, ok := conn.Context().Mailbox.(Mailbox)
+	if !ok {
+		if err := conn.WriteResp(&imap.StatusResp{
+			Type: imap.StatusRespOk,
+			Code: codeNoModSeq,
+			Info: noModSeqInfo,
+		}); err != nil {
+			return err
+		}
+		return res
+	}
+
+	modSeq, err := mbox.HighestModSeq()
+	if err != nil {
+		return err
+	}
+
+	if err := conn.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeHighest,
+		Arguments: []interface{}{formatModSeq(modSeq)},
+		Info:      highestModInfo,
+	}); err != nil {
+		return err
+	}
+
+	if cmd.qresync != nil {
+		if err := cmd.resync(conn, mbox); err != nil {
+			return err
+		}
+	}
+
+	return res
+}
+
+// resync sends the changes since the state known to the client: the UIDs of
+// the expunged messages and the flags of the changed ones. If the UIDVALIDITY
+// does not match, the client has to synchronise from scratch, so there is
+// nothing to send.
+func (cmd *Select) resync(conn server.Conn, mbox Mailbox) error {
+	status, err := mbox.Status([]imap.StatusItem{imap.StatusUidValidity})
+	if err != nil {
+		return err
+	}
+	if status.UidValidity != cmd.qresync.uidValidity {
+		return nil
+	}
+
+	uids := cmd.qresync.knownUIDs
+	if uids == nil {
+		uids = &imap.SeqSet{}
+		uids.AddRange(1, 0)
+	}
+
+	vanishedUIDs, err := mbox.VanishedSince(uids, cmd.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteResp(&Vanished{UIDs: vanishedUIDs, Earlier: true}); err != nil {
+		return err
+	}
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, FetchModSeq}
+	return listMessages(conn, mbox, true, uids, items, cmd.qresync.modSeq)
+}
+
+// Status enables CONDSTORE when the client asks for the highest
+// mod-sequence. The item itself is filled in by the backend.
+type Status struct {
+	server.Status
+}
+
+func (cmd *Status) Handle(conn server.Conn) error {
+	for _, item := range cmd.Items {
+		if item == StatusHighestModSeq {
+			enable(conn, true, false)
+		}
+	}
+	return cmd.Status.Handle(conn)
+}
+
+// Fetch handles FETCH with the CHANGEDSINCE and VANISHED modifiers and adds
+// the MODSEQ item to the responses once CONDSTORE is enabled.
+type Fetch struct {
+	server.Fetch
+
+	ChangedSince uint64
+	Vanished     bool
+}
+
+func (cmd *Fetch) Parse(fields []interface{}) error {
+	if len(fields) < 3 {
+		return cmd.Fetch.Parse(fields)
+	}
+	if err := cmd.Fetch.Parse(fields[:2]); err != nil {
+		return err
+	}
+
+	modifiers, ok := fields[2].([]interface{})
+	if !ok {
+		return errors.New("FETCH modifiers must be a list")
+	}
+
+	for i := 0; i < len(modifiers); i++ {
+		name, _ := modifiers[i].(string)
+		switch strings.ToUpper(name) {
+		case changedSince:
+			i++
+			if i == len(modifiers) {
+				return errors.New("missing CHANGEDSINCE mod-sequence")
+			}
+			var err error
+			if cmd.ChangedSince, err = parseModSeq(modifiers[i]); err != nil {
+				return err
+			}
+		case vanished:
+			cmd.Vanished = true
+		default:
+			return fmt.Errorf("unknown FETCH modifier %v", modifiers[i])
+		}
+	}
+
+	if cmd.Vanished && cmd.ChangedSince == 0 {
+		return errors.New("VANISHED requires CHANGEDSINCE")
+	}
+
+	return nil
+}
+
+func (cmd *Fetch) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	if cmd.Vanished {
+		if !uid {
+			return errors.New("VANISHED is allowed only in UID FETCH")
+		}
+		if !QResyncEnabled(conn) {
+			return errors.New("QRESYNC is not enabled")
+		}
+	}
+
+	if cmd.ChangedSince > 0 || hasItem(cmd.Items, FetchModSeq) {
+		enable(conn, true, false)
+	}
+
+	mbox, ok := ctx.Mailbox.(Mailbox)
+	if !ok && cmd.ChangedSince > 0 {
+		return errors.New("mailbox does not support mod-sequences")
+	}
+	if !ok || !Enabled(conn) {
+		if uid {
+			return cmd.Fetch.UidHandle(conn)
+		}
+		return cmd.Fetch.Handle(conn)
+	}
+
+	if !hasItem(cmd.Items, FetchModSeq) {
+		cmd.Items = append(cmd.Items, FetchModSeq)
+	}
+
+	if cmd.Vanished {
+		vanishedUIDs, err := mbox.VanishedSince(cmd.SeqSet, cmd.ChangedSince)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&Vanished{UIDs: vanishedUIDs, Earlier: true}); err != nil {
+			return err
+		}
+	}
+
+	return listMessages(conn, mbox, uid, cmd.SeqSet, cmd.Items, cmd.ChangedSince)
+}
+
+func (cmd *Fetch) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *Fetch) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	if !hasItem(cmd.Items, imap.FetchUid) {
+		cmd.Items = append(cmd.Items, imap.FetchUid)
+	}
+	return cmd.handle(true, conn)
+}
+
+// Store handles STORE with the UNCHANGEDSINCE modifier. It also marks the
+// connection silent while the flags of a STORE with the .SILENT suffix are
+// changed, see Silent.
+type Store struct {
+	server.Store
+
+	UnchangedSince    uint64
+	HasUnchangedSince bool
+}
+
+func (cmd *Store) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if err := cmd.parseModifiers(modifiers); err != nil {
+				return err
+			}
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+
+	return cmd.Store.Parse(fields)
+}
+
+func (cmd *Store) parseModifiers(modifiers []interface{}) error {
+	for i := 0; i < len(modifiers); i++ {
+		name, _ := modifiers[i].(string)
+		switch strings.ToUpper(name) {
+		case unchangedSince:
+			i++
+			if i == len(modifiers) {
+				return errors.New("missing UNCHANGEDSINCE mod-sequence")
+			}
+			var err error
+			if cmd.UnchangedSince, err = parseModSeq(modifiers[i]); err != nil {
+				return err
+			}
+			cmd.HasUnchangedSince = true
+		default:
+			return fmt.Errorf("unknown STORE modifier %v", modifiers[i])
+		}
+	}
+
+	return nil
+}
+
+func (cmd *Store) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+	if ctx.MailboxReadOnly {
+		return server.ErrMailboxReadOnly
+	}
+
+	_, silent, err := imap.ParseFlagsOp(cmd.Item)
+	if err != nil {
+		return err
+	}
+
+	var modified *imap.SeqSet
+	if cmd.HasUnchangedSince {
+		enable(conn, true, false)
+
+		mbox, ok := ctx.Mailbox.(Mailbox)
+		if !ok {
+			return errors.New("mailbox does not support mod-sequences")
+		}
+
+		if cmd.SeqSet, modified, err = cmd.splitByModSeq(mbox, uid); err != nil {
+			return err
+		}
+	}
+
+	if cmd.SeqSet != nil {
+		setSilent(conn, silent)
+		if uid {
+			err = cmd.Store.UidHandle(conn)
+		} else {
+			err = cmd.Store.Handle(conn)
+		}
+		setSilent(conn, false)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if modified == nil {
+		return nil
+	}
+
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      codeModified,
+		Arguments: []interface{}{modified},
+		Info:      modifiedInfo,
+	}}
+}
+
+// splitByModSeq splits the messages of the command into the ones not changed
+// since the UNCHANGEDSINCE mod-sequence and the modified ones. The sets
+// contain the UIDs or the sequence numbers, like the command, and are nil if
+// empty.
+func (cmd *Store) splitByModSeq(mbox Mailbox, uid bool) (unchanged, modified *imap.SeqSet, err error) {
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessagesChangedSince(uid, cmd.SeqSet, []imap.FetchItem{imap.FetchUid, FetchModSeq}, 0, ch)
+	}()
+
+	for msg := range ch {
+		id := msg.SeqNum
+		if uid {
+			id = msg.Uid
+		}
+
+		if modSeq, ok := GetModSeq(msg); ok && modSeq <= cmd.UnchangedSince {
+			if unchanged == nil {
+				unchanged = &imap.SeqSet{}
+			}
+			unchanged.AddNum(id)
+		} else {
+			if modified == nil {
+				modified = &imap.SeqSet{}
+			}
+			modified.AddNum(id)
+		}
+	}
+
+	if err := <-done; err != nil {
+		return nil, nil, err
+	}
+
+	return unchanged, modified, nil
+}
+
+func (cmd *Store) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *Store) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	return cmd.handle(true, conn)
+}
+
+// listMessages writes the FETCH responses the same way the go-imap handler
+// does.
+func listMessages(conn server.Conn, mbox Mailbox, uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64) error {
+	ch := make(chan *imap.Message)
+	res := &responses.Fetch{Messages: ch}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.WriteResp(res)
+		// Make sure to drain the message channel.
+		for range ch {
+		}
+	}()
+
+	if err := mbox.ListMessagesChangedSince(uid, seqSet, items, changedSince, ch); err != nil {
+		return err
+	}
+
+	return <-done
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package condstore DOES NOT implement full RFC7162!
+//
+// Excluded parts are:
+//   - Sequence match data of SELECT with QRESYNC: the known UIDs are used
+//     directly
+//   - The MODSEQ search criterion matches the mod-sequences of the messages,
+//     the metadata item entry names are ignored
+//
+// The API has no conditional update, so STORE with the UNCHANGEDSINCE
+// modifier checks the mod-sequences locally right before changing the flags.
+// The MODSEQ search criterion is handled by the esearch package, which
+// implements the SEARCH command.
+//
+// Otherwise the standard RFC7162 is followed, together with the ENABLE
+// command of RFC5161 which is needed to enable QRESYNC.
+package condstore
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// Capability extension identifiers.
+const (
+	Capability        = "CONDSTORE"
+	QResyncCapability = "QRESYNC"
+	enableCapability  = "ENABLE"
+)
+
+const (
+	// FetchModSeq is the fetch item with the mod-sequence of a message.
+	FetchModSeq imap.FetchItem = "MODSEQ"
+	// StatusHighestModSeq is the status item with the highest mod-sequence
+	// of a mailbox.
+	StatusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+
+	changedSince   = "CHANGEDSINCE"
+	unchangedSince = "UNCHANGEDSINCE"
+	vanished       = "VANISHED"
+	enabled        = "ENABLED"
+	codeHighest    = "HIGHESTMODSEQ"
+	codeNoModSeq   = "NOMODSEQ"
+	codeModified   = "MODIFIED"
+	earlierTag     = "EARLIER"
+	highestModInfo = "Highest"
+	noModSeqInfo   = "Sorry, this mailbox format doesn't support modsequences"
+	modifiedInfo   = "Conditional STORE failed"
+)
+
+// Mailbox is a mailbox keeping the mod-sequences of its messages.
+type Mailbox interface {
+	backend.Mailbox
+
+	// HighestModSeq returns the mod-sequence of the latest change of the
+	// mailbox.
+	HighestModSeq() (uint64, error)
+
+	// ListMessagesChangedSince works like ListMessages but returns only the
+	// messages with mod-sequence greater than changedSince.
+	ListMessagesChangedSince(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error
+
+	// VanishedSince returns the UIDs from uidSet of the messages expunged
+	// after the mod-sequence modSeq.
+	VanishedSince(uidSet *imap.SeqSet, modSeq uint64) ([]uint32, error)
+}
+
+// conn remembers which of the extensions the client has enabled.
+type conn struct {
+	server.Conn
+
+	lock               sync.Mutex
+	condstore, qresync bool
+	silent             bool
+}
+
+func (c *conn) enable(condstore, qresync bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.condstore = c.condstore || condstore || qresync
+	c.qresync = c.qresync || qresync
+}
+
+func (c *conn) isEnabled() (condstore, qresync bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.condstore, c.qresync
+}
+
+func (c *conn) setSilent(silent bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.silent = silent
+}
+
+func (c *conn) isSilent() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.silent && !c.condstore
+}
+
+// Enabled returns whether the client has enabled CONDSTORE, i.e. whether the
+// FETCH responses sent to it must contain the MODSEQ item.
+func Enabled(c server.Conn) bool {
+	if c, ok := c.(*conn); ok {
+		condstore, _ := c.isEnabled()
+		return condstore
+	}
+	return false
+}
+
+// QResyncEnabled returns whether the client has enabled QRESYNC, i.e. whether
+// the expunged messages must be reported to it by VANISHED responses.
+func QResyncEnabled(c server.Conn) bool {
+	if c, ok := c.(*conn); ok {
+		_, qresync := c.isEnabled()
+		return qresync
+	}
+	return false
+}
+
+// Silent returns whether the client is in the middle of a STORE with the
+// .SILENT suffix, i.e. whether the changes of the flags must not be sent to
+// it. Once CONDSTORE is enabled, they are sent anyway, as RFC7162 requires
+// the FETCH responses with the new mod-sequences.
+func Silent(c server.Conn) bool {
+	if c, ok := c.(*conn); ok {
+		return c.isSilent()
+	}
+	return false
+}
+
+// EnableCondstore enables CONDSTORE for the client, as the commands using
+// the mod-sequences do.
+func EnableCondstore(c server.Conn) {
+	enable(c, true, false)
+}
+
+func setSilent(c server.Conn, silent bool) {
+	if c, ok := c.(*conn); ok {
+		c.setSilent(silent)
+	}
+}
+
+func enable(c server.Conn, condstore, qresync bool) {
+	if c, ok := c.(*conn); ok {
+		c.enable(condstore, qresync)
+	}
+}
+
+// SetModSeq fills in the MODSEQ item of the message.
+func SetModSeq(msg *imap.Message, modSeq uint64) {
+	msg.Items[FetchModSeq] = []interface{}{formatModSeq(modSeq)}
+}
+
+// SetHighestModSeq fills in the HIGHESTMODSEQ item of the mailbox status.
+func SetHighestModSeq(status *imap.MailboxStatus, modSeq uint64) {
+	status.ItemsLocker.Lock()
+	defer status.ItemsLocker.Unlock()
+
+	status.Items[StatusHighestModSeq] = formatModSeq(modSeq)
+}
+
+// The mod-sequences are 63-bit numbers which the go-imap writer cannot
+// format.
+func formatModSeq(modSeq uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
+
+// GetModSeq returns the mod-sequence filled in the MODSEQ item of the
+// message.
+func GetModSeq(msg *imap.Message) (uint64, bool) {
+	fields, ok := msg.Items[FetchModSeq].([]interface{})
+	if !ok || len(fields) == 0 {
+		return 0, false
+	}
+
+	s, ok := fields[0].(imap.RawString)
+	if !ok {
+		return 0, false
+	}
+
+	modSeq, err := strconv.ParseUint(string(s), 10, 63)
+	return modSeq, err == nil
+}
+
+func parseModSeq(f interface{}) (uint64, error) {
+	s, ok := f.(string)
+	if !ok {
+		return 0, errors.New("mod-sequence must be a number")
+	}
+	return strconv.ParseUint(s, 10, 63)
+}
+
+// Vanished is the VANISHED response with the UIDs of expunged messages.
+type Vanished struct {
+	UIDs    []uint32
+	Earlier bool
+}
+
+func (r *Vanished) WriteTo(w *imap.Writer) error {
+	if len(r.UIDs) == 0 {
+		return nil
+	}
+
+	uids := &imap.SeqSet{}
+	uids.AddNum(r.UIDs...)
+
+	fields := []interface{}{imap.RawString(vanished)}
+	if r.Earlier {
+		fields = append(fields, []interface{}{imap.RawString(earlierTag)})
+	}
+	fields = append(fields, uids)
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+type extension struct{}
+
+// NewExtension of CONDSTORE and QRESYNC.
+func NewExtension() server.Extension {
+	return &extension{}
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{Capability, QResyncCapability, enableCapability}
+	}
+	return nil
+}
+
+func (ext *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case enableCapability:
+		return func() server.Handler { return &Enable{} }
+	case "SELECT":
+		return func() server.Handler { return &Select{} }
+	case "EXAMINE":
+		return func() server.Handler {
+			hdlr := &Select{}
+			hdlr.ReadOnly = true
+			return hdlr
+		}
+	case "STATUS":
+		return func() server.Handler { return &Status{} }
+	case "FETCH":
+		return func() server.Handler { return &Fetch{} }
+	case "STORE":
+		return func() server.Handler { return &Store{} }
+	}
+
+	return nil
+}
+
+func (ext *extension) NewConn(c server.Conn) server.Conn {
+	return &conn{Conn: c}
+}
+
+func hasItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if strings.EqualFold(string(i), string(item)) {
+			return true
+		}
+	}
+	return false
+}
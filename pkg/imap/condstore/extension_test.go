@@ -0,0 +1,252 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package condstore
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+const highestModSeq = 10
+
+// testUser and testMailbox add the mod-sequences to the go-imap memory
+// backend: all messages have changed at the highest mod-sequence and the UIDs
+// 3 and 4 have been expunged at it.
+type testBackend struct {
+	backend.Backend
+}
+
+func (b *testBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &testUser{User: user}, nil
+}
+
+type testUser struct {
+	backend.User
+}
+
+func (u *testUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &testMailbox{Mailbox: mbox}, nil
+}
+
+type testMailbox struct {
+	backend.Mailbox
+}
+
+func (mbox *testMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := mbox.Mailbox.Status(items)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		if item == StatusHighestModSeq {
+			SetHighestModSeq(status, highestModSeq)
+		}
+	}
+	return status, nil
+}
+
+func (mbox *testMailbox) HighestModSeq() (uint64, error) {
+	return highestModSeq, nil
+}
+
+func (mbox *testMailbox) VanishedSince(uidSet *imap.SeqSet, modSeq uint64) ([]uint32, error) {
+	vanished := []uint32{}
+	for _, uid := range []uint32{3, 4} {
+		if uidSet.Contains(uid) && modSeq < highestModSeq {
+			vanished = append(vanished, uid)
+		}
+	}
+	return vanished, nil
+}
+
+func (mbox *testMailbox) ListMessagesChangedSince(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	if changedSince >= highestModSeq {
+		return nil
+	}
+
+	memoryItems := []imap.FetchItem{}
+	for _, item := range items {
+		if item != FetchModSeq {
+			memoryItems = append(memoryItems, item)
+		}
+	}
+
+	memoryCh := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessages(uid, seqSet, memoryItems, memoryCh)
+	}()
+
+	for msg := range memoryCh {
+		SetModSeq(msg, highestModSeq)
+		ch <- msg
+	}
+
+	return <-done
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+
+	// tagged is the tagged response of the last command.
+	tagged string
+}
+
+func newTestClient(t *testing.T) *testClient {
+	s := server.New(&testBackend{Backend: memory.New()})
+	s.AllowInsecureAuth = true
+	s.Enable(NewExtension())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	c := &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+	require.True(t, c.scanner.Scan(), "missing greeting")
+	return c
+}
+
+// cmd sends the command and returns the untagged responses.
+func (c *testClient) cmd(tag, command string) []string {
+	_, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+	require.NoError(c.t, err)
+
+	var lines []string
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.HasPrefix(line, tag+" ") {
+			require.True(c.t, strings.HasPrefix(line, tag+" OK"), line)
+			c.tagged = line
+			return lines
+		}
+		lines = append(lines, line)
+	}
+
+	require.Fail(c.t, "connection closed")
+	return nil
+}
+
+func requireLine(t *testing.T, lines []string, contains ...string) {
+	for _, line := range lines {
+		found := true
+		for _, s := range contains {
+			found = found && strings.Contains(line, s)
+		}
+		if found {
+			return
+		}
+	}
+	require.Fail(t, "missing response", "%v not in %v", contains, lines)
+}
+
+func TestSelectReportsHighestModSeq(t *testing.T) {
+	c := newTestClient(t)
+	c.cmd("a", "LOGIN username password")
+
+	requireLine(t, c.cmd("b", "SELECT INBOX"), "* OK [HIGHESTMODSEQ 10]")
+
+	// CONDSTORE is not enabled yet.
+	lines := c.cmd("c", "FETCH 1 (FLAGS)")
+	require.Len(t, lines, 1)
+	require.NotContains(t, lines[0], "MODSEQ")
+
+	requireLine(t, c.cmd("d", "STATUS INBOX (HIGHESTMODSEQ)"), "HIGHESTMODSEQ 10")
+
+	// STATUS with HIGHESTMODSEQ has enabled CONDSTORE.
+	requireLine(t, c.cmd("e", "FETCH 1 (FLAGS)"), "* 1 FETCH", "MODSEQ (10)")
+}
+
+func TestFetchChangedSince(t *testing.T) {
+	c := newTestClient(t)
+	c.cmd("a", "LOGIN username password")
+	c.cmd("b", "SELECT INBOX")
+
+	requireLine(t, c.cmd("c", "FETCH 1:* (FLAGS) (CHANGEDSINCE 5)"), "* 1 FETCH", "MODSEQ (10)")
+	require.Empty(t, c.cmd("d", "FETCH 1:* (FLAGS) (CHANGEDSINCE 10)"))
+}
+
+func TestQResync(t *testing.T) {
+	c := newTestClient(t)
+	c.cmd("a", "LOGIN username password")
+
+	requireLine(t, c.cmd("b", "ENABLE QRESYNC FOO"), "* ENABLED QRESYNC")
+
+	lines := c.cmd("c", "SELECT INBOX (QRESYNC (1 5))")
+	requireLine(t, lines, "* VANISHED (EARLIER) 3:4")
+	requireLine(t, lines, "* 1 FETCH", "UID 6", "MODSEQ (10)")
+
+	// The client's UIDVALIDITY is outdated, it must synchronise from scratch.
+	lines = c.cmd("d", "SELECT INBOX (QRESYNC (2 5))")
+	require.NotContains(t, strings.Join(lines, "\n"), "VANISHED")
+
+	lines = c.cmd("e", "UID FETCH 1:3 (FLAGS) (CHANGEDSINCE 5 VANISHED)")
+	require.Equal(t, []string{"* VANISHED (EARLIER) 3"}, lines)
+}
+
+func TestStoreUnchangedSince(t *testing.T) {
+	c := newTestClient(t)
+	c.cmd("a", "LOGIN username password")
+	c.cmd("b", "SELECT INBOX")
+
+	// The message has changed since, so the flags are kept.
+	c.cmd("c", "STORE 1 (UNCHANGEDSINCE 5) +FLAGS (\\Flagged)")
+	require.Contains(t, c.tagged, "[MODIFIED 1]")
+	lines := c.cmd("d", "FETCH 1 (FLAGS)")
+	require.NotContains(t, strings.Join(lines, "\n"), "\\Flagged")
+
+	c.cmd("e", "UID STORE 1:* (UNCHANGEDSINCE 10) +FLAGS (\\Flagged)")
+	require.NotContains(t, c.tagged, "MODIFIED")
+	requireLine(t, c.cmd("f", "FETCH 1 (FLAGS)"), "\\Flagged", "MODSEQ (10)")
+}
+
+func TestSilent(t *testing.T) {
+	c := &conn{}
+	require.False(t, Silent(c))
+
+	setSilent(c, true)
+	require.True(t, Silent(c))
+
+	// The clients with CONDSTORE get the new mod-sequences anyway.
+	EnableCondstore(c)
+	require.False(t, Silent(c))
+}
@@ -0,0 +1,358 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package esearch
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
+)
+
+const (
+	returnKey      = "RETURN"
+	savedResultKey = "$"
+)
+
+//nolint:gochecknoglobals
+var (
+	// searchKeyArgs are the numbers of the arguments of the search keys.
+	searchKeyArgs = map[string]int{
+		"BCC": 1, "BEFORE": 1, "BODY": 1, "CC": 1, "CHARSET": 1, "FROM": 1,
+		"KEYWORD": 1, "LARGER": 1, "ON": 1, "SENTBEFORE": 1, "SENTON": 1,
+		"SENTSINCE": 1, "SINCE": 1, "SMALLER": 1, "SUBJECT": 1, "TEXT": 1,
+		"TO": 1, "UNKEYWORD": 1, "HEADER": 2,
+	}
+)
+
+// replaceSavedResult replaces the references to the saved result in the
+// search criteria by the saved UIDs. Each reference becomes a criterion of
+// its own, so that it doesn't override another UID key, and a criterion
+// matching nothing if no message is saved. It returns whether there was any
+// reference.
+func replaceSavedResult(fields []interface{}, uids *imap.SeqSet) ([]interface{}, bool) {
+	replacement := []interface{}{"NOT", "ALL"}
+	if uids != nil {
+		replacement = []interface{}{"OR", uidKey, uids.String(), uidKey, uids.String()}
+	}
+
+	replaced := []interface{}{}
+	found := false
+	for i := 0; i < len(fields); i++ {
+		if list, ok := fields[i].([]interface{}); ok {
+			list, listFound := replaceSavedResult(list, uids)
+			replaced = append(replaced, list)
+			found = found || listFound
+			continue
+		}
+
+		key, _ := fields[i].(string)
+		key = strings.ToUpper(key)
+		switch {
+		case key == savedResultKey:
+			replaced = append(replaced, replacement)
+			found = true
+		case key == uidKey && i+1 < len(fields) && fields[i+1] == savedResultKey:
+			replaced = append(replaced, replacement)
+			found = true
+			i++
+		default:
+			n := searchKeyArgs[key]
+			if i+n >= len(fields) {
+				n = len(fields) - i - 1
+			}
+			replaced = append(replaced, fields[i:i+n+1]...)
+			i += n
+		}
+	}
+
+	return replaced, found
+}
+
+// SearchCommand is the SEARCH command with the result options of RFC4731 and
+// the saved result of RFC5182.
+type SearchCommand struct {
+	// Return is nil for the SEARCH command of RFC3501.
+	Return []ReturnOption
+
+	ext    *extension
+	fields []interface{}
+	search *server.Search
+
+	// modSeq is whether the criteria contain the MODSEQ criterion of
+	// RFC7162.
+	modSeq bool
+}
+
+func (cmd *SearchCommand) Parse(fields []interface{}) error {
+	if len(fields) != 0 {
+		if key, ok := fields[0].(string); ok && strings.EqualFold(key, returnKey) {
+			if len(fields) < 2 {
+				return errors.New("missing result options")
+			}
+			if err := cmd.parseReturn(fields[1]); err != nil {
+				return err
+			}
+			fields = fields[2:]
+		}
+	}
+
+	_, modSeq, err := replaceModSeq(fields, nil)
+	if err != nil {
+		return err
+	}
+
+	// The criteria referencing the saved result or the mod-sequences are
+	// parsed once these are known.
+	if _, found := replaceSavedResult(fields, nil); found || modSeq {
+		cmd.fields = fields
+		cmd.modSeq = modSeq
+		return nil
+	}
+
+	cmd.search = &server.Search{}
+	return cmd.search.Parse(fields)
+}
+
+func (cmd *SearchCommand) parseReturn(f interface{}) error {
+	list, ok := f.([]interface{})
+	if !ok {
+		return errors.New("result options must be a list")
+	}
+
+	cmd.Return = []ReturnOption{}
+	for _, f := range list {
+		option, ok := f.(string)
+		if !ok {
+			return errors.New("result option must be an atom")
+		}
+
+		switch o := ReturnOption(strings.ToUpper(option)); o {
+		case ReturnMin, ReturnMax, ReturnAll, ReturnCount, ReturnSave:
+			cmd.Return = append(cmd.Return, o)
+		default:
+			return errors.New("unknown result option: " + option)
+		}
+	}
+
+	// An empty list asks for all the messages.
+	if len(cmd.Return) == 0 {
+		cmd.Return = []ReturnOption{ReturnAll}
+	}
+
+	return nil
+}
+
+func (cmd *SearchCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *SearchCommand) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	return cmd.handle(true, conn)
+}
+
+func (cmd *SearchCommand) handle(uid bool, conn server.Conn) error {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return server.ErrNoMailboxSelected
+	}
+
+	var modSeqs []modSeqMessage
+	if cmd.search == nil {
+		fields := cmd.fields
+
+		if _, found := replaceSavedResult(fields, nil); found {
+			uids, err := cmd.ext.getSavedSet(conn, true)
+			if err != nil {
+				return err
+			}
+			fields, _ = replaceSavedResult(fields, uids)
+		}
+
+		if cmd.modSeq {
+			condstore.EnableCondstore(conn)
+
+			mbox, ok := ctx.Mailbox.(condstore.Mailbox)
+			if !ok {
+				return errors.New("mailbox does not support mod-sequences")
+			}
+
+			var err error
+			if modSeqs, err = listModSeqs(mbox); err != nil {
+				return err
+			}
+			if fields, _, err = replaceModSeq(fields, modSeqs); err != nil {
+				return err
+			}
+		}
+
+		cmd.search = &server.Search{}
+		if err := cmd.search.Parse(fields); err != nil {
+			return err
+		}
+	}
+
+	ids, err := ctx.Mailbox.SearchMessages(uid, cmd.search.Criteria)
+
+	if hasOption(cmd.Return, ReturnSave) {
+		// A failed search empties the saved result.
+		if err != nil {
+			cmd.ext.save(ctx, nil)
+			return err
+		}
+		if err := cmd.save(conn, uid, ids); err != nil {
+			return err
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var modSeq uint64
+	if cmd.modSeq {
+		modSeq = getHighestModSeq(modSeqs, uid, ids)
+	}
+
+	if cmd.Return == nil {
+		if cmd.modSeq {
+			return conn.WriteResp(&modSeqSearchResponse{Ids: ids, ModSeq: modSeq})
+		}
+		return conn.WriteResp(&responses.Search{Ids: ids})
+	}
+
+	if len(cmd.Return) == 1 && cmd.Return[0] == ReturnSave {
+		return nil
+	}
+
+	return conn.WriteResp(&Response{Uid: uid, Options: cmd.Return, Ids: ids, ModSeq: modSeq})
+}
+
+// save saves the UIDs of the found messages. If only the lowest or the
+// highest message is returned, only those are saved.
+func (cmd *SearchCommand) save(conn server.Conn, uid bool, ids []uint32) error {
+	ctx := conn.Context()
+
+	if (hasOption(cmd.Return, ReturnMin) || hasOption(cmd.Return, ReturnMax)) &&
+		!hasOption(cmd.Return, ReturnAll) && !hasOption(cmd.Return, ReturnCount) && len(ids) != 0 {
+		lowest, highest := ids[0], ids[0]
+		for _, id := range ids {
+			if id < lowest {
+				lowest = id
+			}
+			if id > highest {
+				highest = id
+			}
+		}
+
+		ids = []uint32{}
+		if hasOption(cmd.Return, ReturnMin) {
+			ids = append(ids, lowest)
+		}
+		if hasOption(cmd.Return, ReturnMax) && highest != lowest {
+			ids = append(ids, highest)
+		}
+	}
+
+	if !uid && len(ids) != 0 {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(ids...)
+
+		var err error
+		if ids, err = ctx.Mailbox.SearchMessages(true, &imap.SearchCriteria{SeqNum: seqSet}); err != nil {
+			cmd.ext.save(ctx, nil)
+			return err
+		}
+	}
+
+	cmd.ext.save(ctx, ids)
+	return nil
+}
+
+// savedResultCommand accepts the saved result in place of the sequence set
+// which is the first argument of the command, and passes the command on to
+// the handler which would be used without this extension.
+type savedResultCommand struct {
+	ext     *extension
+	next    server.HandlerFactory
+	fields  []interface{}
+	handler server.Handler
+}
+
+func (cmd *savedResultCommand) Parse(fields []interface{}) error {
+	if len(fields) != 0 && fields[0] == savedResultKey {
+		cmd.fields = fields
+		return nil
+	}
+
+	cmd.handler = cmd.next()
+	return cmd.handler.Parse(fields)
+}
+
+func (cmd *savedResultCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *savedResultCommand) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	return cmd.handle(true, conn)
+}
+
+func (cmd *savedResultCommand) handle(uid bool, conn server.Conn) error {
+	if cmd.handler == nil {
+		set, err := cmd.ext.getSavedSet(conn, uid)
+		if err != nil {
+			return err
+		}
+
+		// There is nothing to do for no messages.
+		if set == nil {
+			return nil
+		}
+
+		fields := append([]interface{}{set.String()}, cmd.fields[1:]...)
+		cmd.handler = cmd.next()
+		if err := cmd.handler.Parse(fields); err != nil {
+			return err
+		}
+	}
+
+	if !uid {
+		return cmd.handler.Handle(conn)
+	}
+
+	uidHandler, ok := cmd.handler.(server.UidHandler)
+	if !ok {
+		return errors.New("command unsupported with UID")
+	}
+	return uidHandler.UidHandle(conn)
+}
+
+// resetCommand empties the saved result before leaving the selected mailbox.
+type resetCommand struct {
+	server.Handler
+
+	ext *extension
+}
+
+func (cmd *resetCommand) Handle(conn server.Conn) error {
+	cmd.ext.reset(conn.Context())
+	return cmd.Handler.Handle(conn)
+}
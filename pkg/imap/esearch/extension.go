@@ -0,0 +1,267 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package esearch implements the ESEARCH extension of RFC4731 and the
+// SEARCHRES extension of RFC5182.
+//
+// The saved search result is kept as the UIDs of the messages, so that it
+// stays valid when some of them are expunged, and it is converted to
+// sequence numbers for the commands without UID.
+//
+// The ESEARCH responses carry no TAG correlator, because go-imap doesn't pass
+// the command tag to the handlers. The commands are handled one by one, so
+// the responses still follow their command.
+package esearch
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// Capability extension identifiers.
+const (
+	Capability          = "ESEARCH"
+	SearchResCapability = "SEARCHRES"
+	esearchName         = "ESEARCH"
+	searchName          = "SEARCH"
+	uidKey              = "UID"
+)
+
+// ReturnOption is a result option of the extended SEARCH command.
+type ReturnOption string
+
+// The supported result options.
+const (
+	ReturnMin   ReturnOption = "MIN"
+	ReturnMax   ReturnOption = "MAX"
+	ReturnAll   ReturnOption = "ALL"
+	ReturnCount ReturnOption = "COUNT"
+	ReturnSave  ReturnOption = "SAVE"
+)
+
+func hasOption(options []ReturnOption, option ReturnOption) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Response is the ESEARCH response with the requested data about the found
+// messages. MIN, MAX and ALL are left out when nothing is found. The highest
+// mod-sequence of the found messages is added, if set, for the searches with
+// the MODSEQ criterion.
+type Response struct {
+	Uid     bool //nolint:revive,stylecheck
+	Options []ReturnOption
+	Ids     []uint32
+	ModSeq  uint64
+}
+
+func (r *Response) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(esearchName)}
+	if r.Uid {
+		fields = append(fields, imap.RawString(uidKey))
+	}
+
+	ids := append([]uint32{}, r.Ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, option := range r.Options {
+		switch option {
+		case ReturnMin:
+			if len(ids) != 0 {
+				fields = append(fields, imap.RawString(option), ids[0])
+			}
+		case ReturnMax:
+			if len(ids) != 0 {
+				fields = append(fields, imap.RawString(option), ids[len(ids)-1])
+			}
+		case ReturnAll:
+			if len(ids) != 0 {
+				set := new(imap.SeqSet)
+				set.AddNum(ids...)
+				fields = append(fields, imap.RawString(option), set)
+			}
+		case ReturnCount:
+			fields = append(fields, imap.RawString(option), uint32(len(ids)))
+		case ReturnSave:
+		}
+	}
+
+	if r.ModSeq != 0 && len(ids) != 0 {
+		fields = append(fields, imap.RawString(modSeqKey), formatModSeq(r.ModSeq))
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// savedResult is the search result saved by the client, valid only in the
+// mailbox where it was saved.
+type savedResult struct {
+	mailbox backend.Mailbox
+	uids    []uint32
+}
+
+type extension struct {
+	lock  sync.Mutex
+	saved map[*server.Context]*savedResult
+
+	next []server.Extension
+}
+
+// NewExtension of ESEARCH and SEARCHRES. The saved result can be referenced
+// by FETCH, STORE, COPY, MOVE and UID EXPUNGE, and it is emptied by SELECT,
+// EXAMINE, CLOSE and UNSELECT. These commands are handled by the first of the
+// next extensions knowing them, or by the go-imap server, so the extension
+// must be enabled before the next extensions.
+func NewExtension(next ...server.Extension) server.Extension {
+	return &extension{
+		saved: map[*server.Context]*savedResult{},
+		next:  next,
+	}
+}
+
+// save replaces the saved result of the connection, it is forgotten when the
+// connection is closed.
+func (ext *extension) save(ctx *server.Context, uids []uint32) {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	if _, ok := ext.saved[ctx]; !ok {
+		go func() {
+			<-ctx.LoggedOut
+
+			ext.lock.Lock()
+			defer ext.lock.Unlock()
+
+			delete(ext.saved, ctx)
+		}()
+	}
+
+	ext.saved[ctx] = &savedResult{mailbox: ctx.Mailbox, uids: uids}
+}
+
+// reset empties the saved result of the connection.
+func (ext *extension) reset(ctx *server.Context) {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	if _, ok := ext.saved[ctx]; ok {
+		ext.saved[ctx] = &savedResult{}
+	}
+}
+
+// getSaved returns the UIDs of the saved result.
+func (ext *extension) getSaved(ctx *server.Context) []uint32 {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	saved, ok := ext.saved[ctx]
+	if !ok || saved.mailbox != ctx.Mailbox {
+		return nil
+	}
+	return saved.uids
+}
+
+// getSavedSet returns the saved messages as UIDs, or as sequence numbers if
+// uid is false. The set is nil if no message is saved.
+func (ext *extension) getSavedSet(conn server.Conn, uid bool) (*imap.SeqSet, error) {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return nil, server.ErrNoMailboxSelected
+	}
+
+	ids := ext.getSaved(ctx)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	set := new(imap.SeqSet)
+	set.AddNum(ids...)
+	if uid {
+		return set, nil
+	}
+
+	seqNums, err := ctx.Mailbox.SearchMessages(false, &imap.SearchCriteria{Uid: set})
+	if err != nil || len(seqNums) == 0 {
+		return nil, err
+	}
+
+	set = new(imap.SeqSet)
+	set.AddNum(seqNums...)
+	return set, nil
+}
+
+//nolint:gochecknoglobals
+var builtinCommands = map[string]server.HandlerFactory{
+	"FETCH":   func() server.Handler { return &server.Fetch{} },
+	"STORE":   func() server.Handler { return &server.Store{} },
+	"COPY":    func() server.Handler { return &server.Copy{} },
+	"EXPUNGE": func() server.Handler { return &server.Expunge{} },
+	"SELECT":  func() server.Handler { return &server.Select{} },
+	"EXAMINE": func() server.Handler {
+		hdlr := &server.Select{}
+		hdlr.ReadOnly = true
+		return hdlr
+	},
+	"CLOSE": func() server.Handler { return &server.Close{} },
+}
+
+// getNext returns the handler of the command which would be used without
+// this extension.
+func (ext *extension) getNext(name string) server.HandlerFactory {
+	for _, next := range ext.next {
+		if factory := next.Command(name); factory != nil {
+			return factory
+		}
+	}
+	return builtinCommands[name]
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{Capability, SearchResCapability}
+	}
+	return nil
+}
+
+func (ext *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case searchName:
+		return func() server.Handler { return &SearchCommand{ext: ext} }
+	case "FETCH", "STORE", "COPY", "MOVE", "EXPUNGE":
+		next := ext.getNext(name)
+		if next == nil {
+			return nil
+		}
+		return func() server.Handler { return &savedResultCommand{ext: ext, next: next} }
+	case "SELECT", "EXAMINE", "CLOSE", "UNSELECT":
+		next := ext.getNext(name)
+		if next == nil {
+			return nil
+		}
+		return func() server.Handler { return &resetCommand{Handler: next(), ext: ext} }
+	}
+
+	return nil
+}
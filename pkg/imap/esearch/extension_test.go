@@ -0,0 +1,203 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package esearch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+func readFields(t *testing.T, args string) []interface{} {
+	fields, err := imap.NewReader(bufio.NewReader(strings.NewReader(args + "\r\n"))).ReadLine()
+	require.NoError(t, err)
+	return fields
+}
+
+func TestParseSearch(t *testing.T) {
+	cmd := &SearchCommand{}
+	require.NoError(t, cmd.Parse(readFields(t, "RETURN (min COUNT) CHARSET UTF-8 UNSEEN")))
+	require.Equal(t, []ReturnOption{ReturnMin, ReturnCount}, cmd.Return)
+	require.Equal(t, []string{imap.SeenFlag}, cmd.search.Criteria.WithoutFlags)
+
+	cmd = &SearchCommand{}
+	require.NoError(t, cmd.Parse(readFields(t, "RETURN () ALL")))
+	require.Equal(t, []ReturnOption{ReturnAll}, cmd.Return)
+
+	cmd = &SearchCommand{}
+	require.NoError(t, cmd.Parse(readFields(t, "UNSEEN")))
+	require.Nil(t, cmd.Return)
+
+	for _, args := range []string{
+		"RETURN",
+		"RETURN MIN ALL",
+		"RETURN (PARTIAL) ALL",
+		"RETURN (MIN) UNKNOWN",
+	} {
+		require.Error(t, (&SearchCommand{}).Parse(readFields(t, args)), args)
+	}
+}
+
+func TestReplaceSavedResult(t *testing.T) {
+	uids := new(imap.SeqSet)
+	uids.AddRange(2, 4)
+
+	fields, found := replaceSavedResult(readFields(t, `$ SUBJECT $ NOT UID $ (HEADER X-Spam $ UID 1:3)`), uids)
+	require.True(t, found)
+	require.Equal(t, []interface{}{
+		[]interface{}{"OR", "UID", "2:4", "UID", "2:4"},
+		"SUBJECT", "$",
+		"NOT", []interface{}{"OR", "UID", "2:4", "UID", "2:4"},
+		[]interface{}{"HEADER", "X-Spam", "$", "UID", "1:3"},
+	}, fields)
+
+	fields, found = replaceSavedResult(readFields(t, `UID $`), nil)
+	require.True(t, found)
+	require.Equal(t, []interface{}{[]interface{}{"NOT", "ALL"}}, fields)
+
+	_, found = replaceSavedResult(readFields(t, `SUBJECT $ UNSEEN`), nil)
+	require.False(t, found)
+}
+
+func TestReplaceModSeq(t *testing.T) {
+	msgs := []modSeqMessage{
+		{seqNum: 1, uid: 6, modSeq: 3},
+		{seqNum: 2, uid: 7, modSeq: 8},
+		{seqNum: 3, uid: 8, modSeq: 5},
+	}
+
+	fields, found, err := replaceModSeq(readFields(t, `MODSEQ 5 SUBJECT MODSEQ (UNSEEN MODSEQ "/flags/\\draft" all 9)`), msgs)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, []interface{}{
+		[]interface{}{"UID", "7:8"},
+		"SUBJECT", "MODSEQ",
+		[]interface{}{"UNSEEN", []interface{}{"NOT", "ALL"}},
+	}, fields)
+
+	_, found, err = replaceModSeq(readFields(t, `SUBJECT MODSEQ UNSEEN`), nil)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	_, _, err = replaceModSeq(readFields(t, `MODSEQ`), nil)
+	require.Error(t, err)
+
+	require.Equal(t, uint64(5), getHighestModSeq(msgs, false, []uint32{1, 3}))
+	require.Equal(t, uint64(8), getHighestModSeq(msgs, true, []uint32{6, 7}))
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+// newTestClient selects the INBOX of the go-imap memory backend with the
+// UIDs 6 to 10. The messages 2, 4 and 5 (UIDs 7, 9 and 10) are unseen.
+func newTestClient(t *testing.T) *testClient {
+	be := memory.New()
+	user, err := be.Login(nil, "username", "password")
+	require.NoError(t, err)
+	mbox, err := user.GetMailbox(imap.InboxName)
+	require.NoError(t, err)
+	for _, flags := range [][]string{nil, {imap.SeenFlag}, nil, {imap.FlaggedFlag}} {
+		require.NoError(t, mbox.CreateMessage(flags, time.Now(), bytes.NewBufferString("Subject: test\r\n\r\n")))
+	}
+
+	s := server.New(be)
+	s.AllowInsecureAuth = true
+	s.Enable(NewExtension())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	c := &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+	require.True(t, c.scanner.Scan(), "missing greeting")
+
+	c.cmd("a", "LOGIN username password")
+	c.cmd("b", "SELECT INBOX")
+	return c
+}
+
+// cmd sends the command and returns the untagged responses.
+func (c *testClient) cmd(tag, command string) []string {
+	_, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+	require.NoError(c.t, err)
+
+	var lines []string
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.HasPrefix(line, tag+" ") {
+			require.True(c.t, strings.HasPrefix(line, tag+" OK"), line)
+			return lines
+		}
+		lines = append(lines, line)
+	}
+
+	require.Fail(c.t, "connection closed")
+	return nil
+}
+
+func TestSearchReturn(t *testing.T) {
+	c := newTestClient(t)
+
+	require.Contains(t, c.cmd("c", "CAPABILITY")[0], " ESEARCH SEARCHRES")
+
+	require.Equal(t, []string{"* SEARCH 2 4 5"}, c.cmd("d", "SEARCH UNSEEN"))
+	require.Equal(t, []string{"* ESEARCH MIN 2 MAX 5 COUNT 3 ALL 2,4:5"}, c.cmd("e", "SEARCH RETURN (MIN MAX COUNT ALL) UNSEEN"))
+	require.Equal(t, []string{"* ESEARCH UID ALL 7,9:10"}, c.cmd("f", "UID SEARCH RETURN () UNSEEN"))
+	require.Equal(t, []string{"* ESEARCH COUNT 0"}, c.cmd("g", "SEARCH RETURN (MIN COUNT ALL) DELETED"))
+}
+
+func TestSearchSave(t *testing.T) {
+	c := newTestClient(t)
+
+	require.Empty(t, c.cmd("c", "SEARCH RETURN (SAVE) UNSEEN"))
+	require.Equal(t, []string{
+		"* 2 FETCH (UID 7)",
+		"* 4 FETCH (UID 9)",
+		"* 5 FETCH (UID 10)",
+	}, c.cmd("d", "FETCH $ (UID)"))
+
+	c.cmd("e", `UID STORE $ +FLAGS.SILENT (\Seen)`)
+	require.Equal(t, []string{"* SEARCH"}, c.cmd("f", "SEARCH UNSEEN"))
+	require.Equal(t, []string{"* SEARCH 9 10"}, c.cmd("g", "UID SEARCH UID 8:* $"))
+
+	// Only the highest message is saved.
+	require.Equal(t, []string{"* ESEARCH MAX 5"}, c.cmd("h", "SEARCH RETURN (MAX SAVE) ALL"))
+	require.Equal(t, []string{"* 5 FETCH (UID 10)"}, c.cmd("i", "UID FETCH $ (UID)"))
+
+	// Selecting the same mailbox again empties the saved result.
+	c.cmd("j", "SELECT INBOX")
+	require.Empty(t, c.cmd("k", "FETCH $ (UID)"))
+	require.Equal(t, []string{"* SEARCH"}, c.cmd("l", "SEARCH $"))
+}
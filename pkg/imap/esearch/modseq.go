@@ -0,0 +1,182 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package esearch
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
+)
+
+const modSeqKey = "MODSEQ"
+
+// modSeqMessage is the mod-sequence of a message.
+type modSeqMessage struct {
+	seqNum, uid uint32
+	modSeq      uint64
+}
+
+// listModSeqs returns the mod-sequences of all messages of the mailbox.
+func listModSeqs(mbox condstore.Mailbox) ([]modSeqMessage, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(1, 0)
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mbox.ListMessagesChangedSince(true, seqSet, []imap.FetchItem{imap.FetchUid, condstore.FetchModSeq}, 0, ch)
+	}()
+
+	msgs := []modSeqMessage{}
+	for msg := range ch {
+		modSeq, _ := condstore.GetModSeq(msg)
+		msgs = append(msgs, modSeqMessage{seqNum: msg.SeqNum, uid: msg.Uid, modSeq: modSeq})
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return msgs, nil
+}
+
+// replaceModSeq replaces the MODSEQ search criteria of RFC7162, which the
+// go-imap parser doesn't know, by the UIDs of the messages with the same or
+// a greater mod-sequence. The entry name and type of the criterion are
+// skipped. The criteria match nothing if msgs is nil. It returns whether
+// there was any MODSEQ criterion.
+func replaceModSeq(fields []interface{}, msgs []modSeqMessage) ([]interface{}, bool, error) {
+	replaced := []interface{}{}
+	found := false
+	for i := 0; i < len(fields); i++ {
+		if list, ok := fields[i].([]interface{}); ok {
+			list, listFound, err := replaceModSeq(list, msgs)
+			if err != nil {
+				return nil, false, err
+			}
+			replaced = append(replaced, list)
+			found = found || listFound
+			continue
+		}
+
+		key, _ := fields[i].(string)
+		key = strings.ToUpper(key)
+		if key != modSeqKey {
+			n := searchKeyArgs[key]
+			if i+n >= len(fields) {
+				n = len(fields) - i - 1
+			}
+			replaced = append(replaced, fields[i:i+n+1]...)
+			i += n
+			continue
+		}
+
+		// The optional entry name and type precede the mod-sequence.
+		i++
+		if i < len(fields) && !isNumber(fields[i]) {
+			i += 2
+		}
+		if i >= len(fields) {
+			return nil, false, errors.New("missing MODSEQ mod-sequence")
+		}
+
+		s, _ := fields[i].(string)
+		modSeq, err := strconv.ParseUint(s, 10, 63)
+		if err != nil {
+			return nil, false, err
+		}
+
+		replaced = append(replaced, getModSeqCriterion(msgs, modSeq))
+		found = true
+	}
+
+	return replaced, found, nil
+}
+
+func isNumber(f interface{}) bool {
+	s, ok := f.(string)
+	if !ok {
+		return false
+	}
+	_, err := strconv.ParseUint(s, 10, 63)
+	return err == nil
+}
+
+func getModSeqCriterion(msgs []modSeqMessage, modSeq uint64) []interface{} {
+	uids := new(imap.SeqSet)
+	for _, msg := range msgs {
+		if msg.modSeq >= modSeq {
+			uids.AddNum(msg.uid)
+		}
+	}
+
+	if uids.Empty() {
+		return []interface{}{"NOT", "ALL"}
+	}
+	return []interface{}{uidKey, uids.String()}
+}
+
+// getHighestModSeq returns the highest mod-sequence of the found messages.
+func getHighestModSeq(msgs []modSeqMessage, uid bool, ids []uint32) uint64 {
+	found := map[uint32]bool{}
+	for _, id := range ids {
+		found[id] = true
+	}
+
+	var highest uint64
+	for _, msg := range msgs {
+		id := msg.seqNum
+		if uid {
+			id = msg.uid
+		}
+		if found[id] && msg.modSeq > highest {
+			highest = msg.modSeq
+		}
+	}
+
+	return highest
+}
+
+// modSeqSearchResponse is the SEARCH response of RFC3501 with the highest
+// mod-sequence of the found messages.
+type modSeqSearchResponse struct {
+	Ids    []uint32
+	ModSeq uint64
+}
+
+func (r *modSeqSearchResponse) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(searchName)}
+	for _, id := range r.Ids {
+		fields = append(fields, id)
+	}
+
+	if len(r.Ids) != 0 {
+		fields = append(fields, []interface{}{imap.RawString(modSeqKey), formatModSeq(r.ModSeq)})
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// The mod-sequences are 63-bit numbers which the go-imap writer cannot
+// format.
+func formatModSeq(modSeq uint64) imap.RawString {
+	return imap.RawString(strconv.FormatUint(modSeq, 10))
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/ljanyst/peroxide/pkg/store"
+)
+
+// Capability extension identifiers.
+const (
+	idCapability        = "ID"
+	namespaceCapability = "NAMESPACE"
+	idName              = "ID"
+	namespaceName       = "NAMESPACE"
+	loginName           = "LOGIN"
+	authenticateName    = "AUTHENTICATE"
+)
+
+// IDCommand is the ID command of RFC2971. The client tells its name and
+// version, which select its profile.
+type IDCommand struct {
+	ID map[string]string
+
+	ext *idExtension
+}
+
+func (cmd *IDCommand) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("ID expects a single parameter list or NIL")
+	}
+
+	cmd.ID = map[string]string{}
+	if fields[0] == nil {
+		return nil
+	}
+
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list)%2 != 0 {
+		return errors.New("ID parameters must be a list of field and value pairs")
+	}
+
+	for i := 0; i < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+		if list[i+1] == nil {
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		cmd.ID[strings.ToLower(key)] = value
+	}
+
+	return nil
+}
+
+func (cmd *IDCommand) Handle(conn imapserver.Conn) error {
+	if len(cmd.ID) != 0 {
+		log.WithField("name", cmd.ID["name"]).
+			WithField("version", cmd.ID["version"]).
+			Info("IMAP client identified")
+		cmd.ext.getClient(conn.Context()).setID(cmd.ID)
+	}
+
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString(idName),
+		[]interface{}{"name", "peroxide"},
+	}))
+}
+
+// NamespaceCommand is the NAMESPACE command of RFC2342. All the mailboxes are
+// personal; the folders and the labels are announced as namespaces of their
+// own so that the clients know where to create them.
+type NamespaceCommand struct{}
+
+func (cmd *NamespaceCommand) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (cmd *NamespaceCommand) Handle(conn imapserver.Conn) error {
+	if conn.Context().State&imap.AuthenticatedState == 0 {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	personal := []interface{}{
+		[]interface{}{"", store.PathDelimiter},
+		[]interface{}{store.UserFoldersPrefix, store.PathDelimiter},
+		[]interface{}{store.UserLabelsPrefix, store.PathDelimiter},
+	}
+
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString(namespaceName), personal, nil, nil,
+	}))
+}
+
+// authCommand makes the user logged in by LOGIN or AUTHENTICATE follow the
+// profile of the client of the connection.
+type authCommand struct {
+	imapserver.Handler
+
+	ext *idExtension
+}
+
+func (cmd *authCommand) Handle(conn imapserver.Conn) error {
+	err := cmd.Handler.Handle(conn)
+
+	ctx := conn.Context()
+	if user, ok := ctx.User.(*imapUser); ok {
+		ctx.User = newClientUser(user, cmd.ext.getClient(ctx))
+	}
+
+	return err
+}
+
+// idExtension implements the ID and NAMESPACE commands and keeps the clients
+// of the connections.
+type idExtension struct {
+	lock    sync.Mutex
+	clients map[*imapserver.Context]*imapClient
+}
+
+func newIDExtension() imapserver.Extension {
+	return &idExtension{clients: map[*imapserver.Context]*imapClient{}}
+}
+
+// getClient returns the client of the connection. It is kept until the
+// connection is closed.
+func (ext *idExtension) getClient(ctx *imapserver.Context) *imapClient {
+	ext.lock.Lock()
+	defer ext.lock.Unlock()
+
+	if client, ok := ext.clients[ctx]; ok {
+		return client
+	}
+
+	client := newIMAPClient()
+	ext.clients[ctx] = client
+
+	go func() {
+		<-ctx.LoggedOut
+
+		ext.lock.Lock()
+		defer ext.lock.Unlock()
+
+		delete(ext.clients, ctx)
+	}()
+
+	return client
+}
+
+func (ext *idExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{idCapability, namespaceCapability}
+	}
+	return []string{idCapability}
+}
+
+func (ext *idExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case idName:
+		return func() imapserver.Handler { return &IDCommand{ext: ext} }
+	case namespaceName:
+		return func() imapserver.Handler { return &NamespaceCommand{} }
+	case loginName:
+		return func() imapserver.Handler { return &authCommand{Handler: &imapserver.Login{}, ext: ext} }
+	case authenticateName:
+		return func() imapserver.Handler { return &authCommand{Handler: &imapserver.Authenticate{}, ext: ext} }
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap/backend/memory"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIDAndNamespace(t *testing.T) {
+	s := imapserver.New(memory.New())
+	s.AllowInsecureAuth = true
+	s.Enable(newIDExtension())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	scanner := bufio.NewScanner(conn)
+	require.True(t, scanner.Scan(), "missing greeting")
+
+	cmd := func(tag, command string) ([]string, string) {
+		_, err := fmt.Fprintf(conn, "%s %s\r\n", tag, command)
+		require.NoError(t, err)
+
+		var lines []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, tag+" ") {
+				return lines, line
+			}
+			lines = append(lines, line)
+		}
+		require.Fail(t, "connection closed", "%v", scanner.Err())
+		return nil, ""
+	}
+
+	lines, _ := cmd("a", "CAPABILITY")
+	require.Contains(t, lines[0], " ID")
+	require.NotContains(t, lines[0], "NAMESPACE")
+
+	lines, status := cmd("b", `ID ("name" "Thunderbird" "version" "115.0" "os" NIL)`)
+	require.True(t, strings.HasPrefix(status, "b OK"), status)
+	require.Equal(t, []string{`* ID ("name" "peroxide")`}, lines)
+
+	_, status = cmd("c", "ID NIL")
+	require.True(t, strings.HasPrefix(status, "c OK"), status)
+
+	_, status = cmd("d", `ID ("name")`)
+	require.True(t, strings.HasPrefix(status, "d BAD"), status)
+
+	_, status = cmd("e", "NAMESPACE")
+	require.True(t, strings.HasPrefix(status, "e NO"), status)
+
+	_, status = cmd("f", "LOGIN username password")
+	require.True(t, strings.HasPrefix(status, "f OK"), status)
+
+	lines, status = cmd("g", "NAMESPACE")
+	require.True(t, strings.HasPrefix(status, "g OK"), status)
+	require.Equal(t, []string{`* NAMESPACE (("" "/") ("Folders/" "/") ("Labels/" "/")) NIL NIL`}, lines)
+}
@@ -0,0 +1,421 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package listextended
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+const (
+	returnKey   = "RETURN"
+	useKey      = "USE"
+	useAttrCode = "USEATTR"
+)
+
+func parseMailboxName(field interface{}) (string, error) {
+	name, err := imap.ParseString(field)
+	if err != nil {
+		return "", err
+	}
+
+	name, err = utf7.Encoding.NewDecoder().String(name)
+	if err != nil {
+		return "", err
+	}
+
+	return imap.CanonicalMailboxName(name), nil
+}
+
+func hasOption(options []ListOption, option ListOption) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// ListCommand is the LIST command of RFC5258 with the selection and return
+// options.
+type ListCommand struct {
+	Selection   []ListOption
+	Reference   string
+	Patterns    []string
+	Return      []ListOption
+	StatusItems []imap.StatusItem
+}
+
+func (cmd *ListCommand) Parse(fields []interface{}) error {
+	if len(fields) != 0 {
+		if list, ok := fields[0].([]interface{}); ok {
+			if err := cmd.parseSelection(list); err != nil {
+				return err
+			}
+			fields = fields[1:]
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("missing reference or mailbox pattern")
+	}
+
+	var err error
+	if cmd.Reference, err = parseMailboxName(fields[0]); err != nil {
+		return err
+	}
+
+	if list, ok := fields[1].([]interface{}); ok {
+		if len(list) == 0 {
+			return errors.New("mailbox patterns must be a non-empty list")
+		}
+		for _, f := range list {
+			pattern, err := parseMailboxName(f)
+			if err != nil {
+				return err
+			}
+			cmd.Patterns = append(cmd.Patterns, pattern)
+		}
+	} else {
+		pattern, err := parseMailboxName(fields[1])
+		if err != nil {
+			return err
+		}
+		cmd.Patterns = []string{pattern}
+	}
+
+	fields = fields[2:]
+	if len(fields) == 0 {
+		return nil
+	}
+
+	if key, ok := fields[0].(string); !ok || !strings.EqualFold(key, returnKey) || len(fields) != 2 {
+		return errors.New("unexpected arguments after mailbox pattern")
+	}
+
+	list, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("return options must be a list")
+	}
+	return cmd.parseReturn(list)
+}
+
+func (cmd *ListCommand) parseSelection(list []interface{}) error {
+	for _, f := range list {
+		option, ok := f.(string)
+		if !ok {
+			return errors.New("selection option must be an atom")
+		}
+
+		switch o := ListOption(strings.ToUpper(option)); o {
+		case OptionSubscribed, OptionRemote, OptionRecursiveMatch, OptionSpecialUse:
+			cmd.Selection = append(cmd.Selection, o)
+		default:
+			return errors.New("unknown selection option: " + option)
+		}
+	}
+
+	// RECURSIVEMATCH only modifies the selection by other options.
+	if hasOption(cmd.Selection, OptionRecursiveMatch) &&
+		!hasOption(cmd.Selection, OptionSubscribed) &&
+		!hasOption(cmd.Selection, OptionSpecialUse) {
+		return errors.New("RECURSIVEMATCH requires another selection option")
+	}
+
+	return nil
+}
+
+func (cmd *ListCommand) parseReturn(list []interface{}) error {
+	for i := 0; i < len(list); i++ {
+		option, ok := list[i].(string)
+		if !ok {
+			return errors.New("return option must be an atom")
+		}
+
+		o := ListOption(strings.ToUpper(option))
+		switch o {
+		case OptionSubscribed, OptionChildren, OptionSpecialUse:
+		case OptionStatus:
+			i++
+			if i == len(list) {
+				return errors.New("missing status items")
+			}
+			items, ok := list[i].([]interface{})
+			if !ok || len(items) == 0 {
+				return errors.New("status items must be a non-empty list")
+			}
+			for _, f := range items {
+				item, ok := f.(string)
+				if !ok {
+					return errors.New("status item must be an atom")
+				}
+				cmd.StatusItems = append(cmd.StatusItems, imap.StatusItem(strings.ToUpper(item)))
+			}
+		default:
+			return errors.New("unknown return option: " + option)
+		}
+
+		cmd.Return = append(cmd.Return, o)
+	}
+
+	return nil
+}
+
+// isExtended returns whether the command uses any extended syntax. The plain
+// LIST command, including the request for the hierarchy delimiter, is left to
+// the default handler.
+func (cmd *ListCommand) isExtended() bool {
+	return len(cmd.Selection) != 0 ||
+		len(cmd.Return) != 0 ||
+		len(cmd.Patterns) != 1
+}
+
+// isSelected returns whether the mailbox matches all the selection options.
+func (cmd *ListCommand) isSelected(info *imap.MailboxInfo, subscribed map[string]bool) bool {
+	if hasOption(cmd.Selection, OptionSubscribed) && !subscribed[info.Name] {
+		return false
+	}
+
+	if hasOption(cmd.Selection, OptionSpecialUse) && !hasSpecialUseAttr(info) {
+		return false
+	}
+
+	return true
+}
+
+func (cmd *ListCommand) matchesPatterns(info *imap.MailboxInfo) bool {
+	for _, pattern := range cmd.Patterns {
+		if info.Match(cmd.Reference, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// getChildInfo returns the selection options matched by the children of the
+// mailbox, as reported by RECURSIVEMATCH.
+func (cmd *ListCommand) getChildInfo() []ListOption {
+	childInfo := []ListOption{}
+	for _, option := range cmd.Selection {
+		if option == OptionSubscribed || option == OptionSpecialUse {
+			childInfo = append(childInfo, option)
+		}
+	}
+	return childInfo
+}
+
+func hasSpecialUseAttr(info *imap.MailboxInfo) bool {
+	for _, attr := range info.Attributes {
+		if IsSpecialUseAttr(attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttr(info *imap.MailboxInfo, attr string) bool {
+	for _, a := range info.Attributes {
+		if strings.EqualFold(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isChild(parent, child *imap.MailboxInfo) bool {
+	return parent.Delimiter != "" && strings.HasPrefix(child.Name, parent.Name+parent.Delimiter)
+}
+
+type listEntry struct {
+	mbox backend.Mailbox
+	info *imap.MailboxInfo
+}
+
+func (cmd *ListCommand) Handle(conn server.Conn) error {
+	if !cmd.isExtended() {
+		list := &server.List{List: commands.List{Reference: cmd.Reference, Mailbox: cmd.Patterns[0]}}
+		return list.Handle(conn)
+	}
+
+	ctx := conn.Context()
+	if ctx.User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	mailboxes, err := ctx.User.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	entries := []*listEntry{}
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &listEntry{mbox: mbox, info: info})
+	}
+
+	subscribed := map[string]bool{}
+	if hasOption(cmd.Selection, OptionSubscribed) || hasOption(cmd.Return, OptionSubscribed) {
+		subscribedMailboxes, err := ctx.User.ListMailboxes(true)
+		if err != nil {
+			return err
+		}
+		for _, mbox := range subscribedMailboxes {
+			subscribed[mbox.Name()] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if !cmd.matchesPatterns(entry.info) {
+			continue
+		}
+
+		res := &ListResponse{Info: cmd.getInfo(entry, entries, subscribed)}
+		if !cmd.isSelected(entry.info, subscribed) {
+			if !hasOption(cmd.Selection, OptionRecursiveMatch) || !cmd.hasSelectedChild(entry, entries, subscribed) {
+				continue
+			}
+			res.ChildInfo = cmd.getChildInfo()
+		}
+
+		if err := conn.WriteResp(res); err != nil {
+			return err
+		}
+
+		if !hasOption(cmd.Return, OptionStatus) || hasAttr(entry.info, imap.NoSelectAttr) {
+			continue
+		}
+
+		status, err := entry.mbox.Status(cmd.StatusItems)
+		if err != nil {
+			return err
+		}
+		if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cmd *ListCommand) hasSelectedChild(parent *listEntry, entries []*listEntry, subscribed map[string]bool) bool {
+	for _, entry := range entries {
+		if isChild(parent.info, entry.info) && cmd.isSelected(entry.info, subscribed) {
+			return true
+		}
+	}
+	return false
+}
+
+// getInfo returns the mailbox info with the attributes requested by the
+// selection and return options.
+func (cmd *ListCommand) getInfo(entry *listEntry, entries []*listEntry, subscribed map[string]bool) *imap.MailboxInfo {
+	info := &imap.MailboxInfo{
+		Attributes: append([]string{}, entry.info.Attributes...),
+		Delimiter:  entry.info.Delimiter,
+		Name:       entry.info.Name,
+	}
+
+	if subscribed[info.Name] {
+		info.Attributes = append(info.Attributes, SubscribedAttr)
+	}
+
+	if hasOption(cmd.Return, OptionChildren) &&
+		!hasAttr(info, imap.HasChildrenAttr) &&
+		!hasAttr(info, imap.HasNoChildrenAttr) {
+		attr := imap.HasNoChildrenAttr
+		for _, other := range entries {
+			if isChild(info, other.info) {
+				attr = imap.HasChildrenAttr
+				break
+			}
+		}
+		info.Attributes = append(info.Attributes, attr)
+	}
+
+	return info
+}
+
+// CreateCommand is the CREATE command with the USE parameter of RFC6154.
+type CreateCommand struct {
+	server.Create
+	Use []string
+}
+
+func (cmd *CreateCommand) Parse(fields []interface{}) error {
+	if err := cmd.Create.Parse(fields); err != nil {
+		return err
+	}
+
+	if len(fields) < 2 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok || len(params)%2 != 0 {
+		return errors.New("create parameters must be a list of pairs")
+	}
+
+	for i := 0; i < len(params); i += 2 {
+		key, ok := params[i].(string)
+		if !ok || !strings.EqualFold(key, useKey) {
+			return errors.New("unknown create parameter")
+		}
+
+		attrs, ok := params[i+1].([]interface{})
+		if !ok {
+			return errors.New("special-use attributes must be a list")
+		}
+		for _, f := range attrs {
+			attr, ok := f.(string)
+			if !ok {
+				return errors.New("special-use attribute must be an atom")
+			}
+			cmd.Use = append(cmd.Use, attr)
+		}
+	}
+
+	return nil
+}
+
+// Handle refuses to create mailboxes with a special use. The special-use
+// mailboxes are given by the backend and cannot be added.
+func (cmd *CreateCommand) Handle(conn server.Conn) error {
+	if len(cmd.Use) == 0 {
+		return cmd.Create.Handle(conn)
+	}
+
+	if conn.Context().User == nil {
+		return server.ErrNotAuthenticated
+	}
+
+	return server.ErrStatusResp(&imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: useAttrCode,
+		Info: "Special-use mailboxes cannot be created",
+	})
+}
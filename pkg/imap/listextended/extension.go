@@ -0,0 +1,119 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package listextended implements the LIST-EXTENDED extension of RFC5258,
+// the LIST-STATUS extension of RFC5819 and the SPECIAL-USE extension of
+// RFC6154.
+//
+// The special-use attributes are provided by the mailbox info of the backend,
+// the extension only selects the mailboxes and writes the responses. The
+// special-use mailboxes are given by the account, so CREATE-SPECIAL-USE is not
+// offered, but the CREATE commands with the USE parameter are refused rather
+// than creating plain mailboxes.
+package listextended
+
+import (
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+// Capability extension identifiers.
+const (
+	ListExtendedCapability = "LIST-EXTENDED"
+	ListStatusCapability   = "LIST-STATUS"
+	SpecialUseCapability   = "SPECIAL-USE"
+	listName               = "LIST"
+	createName             = "CREATE"
+)
+
+// ListOption is a selection or a return option of RFC5258.
+type ListOption string
+
+// The supported selection and return options.
+const (
+	OptionSubscribed     ListOption = "SUBSCRIBED"
+	OptionRemote         ListOption = "REMOTE"
+	OptionRecursiveMatch ListOption = "RECURSIVEMATCH"
+	OptionSpecialUse     ListOption = "SPECIAL-USE"
+	OptionChildren       ListOption = "CHILDREN"
+	OptionStatus         ListOption = "STATUS"
+)
+
+// SubscribedAttr is the mailbox attribute of the subscribed mailboxes.
+const SubscribedAttr = "\\Subscribed"
+
+//nolint:gochecknoglobals
+var specialUseAttrs = map[string]bool{
+	imap.AllAttr:     true,
+	imap.ArchiveAttr: true,
+	imap.DraftsAttr:  true,
+	imap.FlaggedAttr: true,
+	imap.JunkAttr:    true,
+	imap.SentAttr:    true,
+	imap.TrashAttr:   true,
+}
+
+// IsSpecialUseAttr returns whether attr is one of the special-use attributes
+// of RFC6154.
+func IsSpecialUseAttr(attr string) bool {
+	return specialUseAttrs[attr]
+}
+
+// ListResponse is the LIST response with the extended data of RFC5258.
+// ChildInfo lists the selection options matched by the children of a mailbox
+// which doesn't match them itself.
+type ListResponse struct {
+	Info      *imap.MailboxInfo
+	ChildInfo []ListOption
+}
+
+func (r *ListResponse) WriteTo(w *imap.Writer) error {
+	fields := append([]interface{}{imap.RawString(listName)}, r.Info.Format()...)
+	if len(r.ChildInfo) != 0 {
+		childInfo := []interface{}{}
+		for _, option := range r.ChildInfo {
+			childInfo = append(childInfo, string(option))
+		}
+		fields = append(fields, []interface{}{"CHILDINFO", childInfo})
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+type extension struct{}
+
+// NewExtension of LIST-EXTENDED, LIST-STATUS and SPECIAL-USE.
+func NewExtension() server.Extension {
+	return &extension{}
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{ListExtendedCapability, ListStatusCapability, SpecialUseCapability}
+	}
+	return nil
+}
+
+func (ext *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case listName:
+		return func() server.Handler { return &ListCommand{} }
+	case createName:
+		return func() server.Handler { return &CreateCommand{} }
+	}
+
+	return nil
+}
@@ -0,0 +1,239 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package listextended
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/server"
+	"github.com/stretchr/testify/require"
+)
+
+// testUser and testMailbox add the attributes to the go-imap memory backend:
+// the Sent mailbox has the special use and the Folders mailbox is not
+// selectable.
+type testBackend struct {
+	backend.Backend
+}
+
+func (b *testBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &testUser{User: user}, nil
+}
+
+type testUser struct {
+	backend.User
+}
+
+func (u *testUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes, err := u.User.ListMailboxes(subscribed)
+	if err != nil {
+		return nil, err
+	}
+	for i, mbox := range mailboxes {
+		mailboxes[i] = &testMailbox{Mailbox: mbox}
+	}
+	return mailboxes, nil
+}
+
+type testMailbox struct {
+	backend.Mailbox
+}
+
+func (mbox *testMailbox) Info() (*imap.MailboxInfo, error) {
+	info, err := mbox.Mailbox.Info()
+	if err != nil {
+		return nil, err
+	}
+	switch info.Name {
+	case "Sent":
+		info.Attributes = append(info.Attributes, imap.SentAttr)
+	case "Folders":
+		info.Attributes = append(info.Attributes, imap.NoSelectAttr)
+	}
+	return info, nil
+}
+
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	scanner *bufio.Scanner
+}
+
+func newTestClient(t *testing.T) *testClient {
+	s := server.New(&testBackend{Backend: memory.New()})
+	s.AllowInsecureAuth = true
+	s.Enable(NewExtension())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = s.Close() })
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	c := &testClient{t: t, conn: conn, scanner: bufio.NewScanner(conn)}
+	require.True(t, c.scanner.Scan(), "missing greeting")
+
+	c.cmd("a", "LOGIN username password")
+	for _, name := range []string{"Sent", "Folders", "Folders/Work", "Folders/Home"} {
+		c.cmd("b", "CREATE "+name)
+	}
+	c.cmd("c", "SUBSCRIBE Folders/Work")
+	return c
+}
+
+// cmd sends the command and returns the untagged responses and the tagged
+// status response.
+func (c *testClient) cmd(tag, command string) []string {
+	lines, status := c.cmdStatus(tag, command)
+	require.True(c.t, strings.HasPrefix(status, tag+" OK"), status)
+	return lines
+}
+
+func (c *testClient) cmdStatus(tag, command string) ([]string, string) {
+	_, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+	require.NoError(c.t, err)
+
+	var lines []string
+	for c.scanner.Scan() {
+		line := c.scanner.Text()
+		if strings.HasPrefix(line, tag+" ") {
+			return lines, line
+		}
+		lines = append(lines, line)
+	}
+
+	require.Fail(c.t, "connection closed")
+	return nil, ""
+}
+
+func TestParseList(t *testing.T) {
+	readFields := func(args string) []interface{} {
+		fields, err := imap.NewReader(bufio.NewReader(strings.NewReader(args + "\r\n"))).ReadLine()
+		require.NoError(t, err)
+		return fields
+	}
+
+	cmd := &ListCommand{}
+	require.NoError(t, cmd.Parse(readFields(`(subscribed RECURSIVEMATCH) "" ("INBOX" "Folders/%") RETURN (CHILDREN STATUS (MESSAGES unseen))`)))
+	require.Equal(t, []ListOption{OptionSubscribed, OptionRecursiveMatch}, cmd.Selection)
+	require.Equal(t, []string{imap.InboxName, "Folders/%"}, cmd.Patterns)
+	require.Equal(t, []ListOption{OptionChildren, OptionStatus}, cmd.Return)
+	require.Equal(t, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen}, cmd.StatusItems)
+
+	cmd = &ListCommand{}
+	require.NoError(t, cmd.Parse(readFields(`"" *`)))
+	require.False(t, cmd.isExtended())
+
+	for _, args := range []string{
+		`""`,
+		`(RECURSIVEMATCH) "" *`,
+		`(REMOTE RECURSIVEMATCH) "" *`,
+		`(UNKNOWN) "" *`,
+		`"" ()`,
+		`"" * (CHILDREN)`,
+		`"" * RETURN (UNKNOWN)`,
+		`"" * RETURN (STATUS)`,
+		`"" * RETURN (STATUS ())`,
+	} {
+		require.Error(t, (&ListCommand{}).Parse(readFields(args)), args)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	c := newTestClient(t)
+
+	lines := c.cmd("d", "CAPABILITY")
+	require.Len(t, lines, 1)
+	for _, capability := range []string{"LIST-EXTENDED", "LIST-STATUS", "SPECIAL-USE"} {
+		require.Contains(t, lines[0], " "+capability)
+	}
+	require.NotContains(t, lines[0], "CREATE-SPECIAL-USE")
+}
+
+func TestListPlain(t *testing.T) {
+	c := newTestClient(t)
+
+	require.Equal(t, []string{`* LIST (\Noselect) "/" "/"`}, c.cmd("d", `LIST "" ""`))
+	require.ElementsMatch(t, []string{`* LIST () "/" "Folders/Home"`, `* LIST () "/" "Folders/Work"`}, c.cmd("e", `LIST "" Folders/%`))
+}
+
+func TestListSpecialUse(t *testing.T) {
+	c := newTestClient(t)
+
+	require.Equal(t, []string{`* LIST (\Sent) "/" "Sent"`}, c.cmd("d", `LIST (SPECIAL-USE) "" *`))
+	require.Contains(t, c.cmd("e", `LIST "" * RETURN (SPECIAL-USE)`), `* LIST (\Sent) "/" "Sent"`)
+}
+
+func TestListSubscribedAndChildren(t *testing.T) {
+	c := newTestClient(t)
+
+	require.ElementsMatch(t, []string{
+		`* LIST (\Noselect \HasChildren) "/" "Folders"`,
+		`* LIST (\HasNoChildren) "/" "Folders/Home"`,
+		`* LIST (\Subscribed \HasNoChildren) "/" "Folders/Work"`,
+	}, c.cmd("d", `LIST "" ("Folders" "Folders/*") RETURN (SUBSCRIBED CHILDREN)`))
+
+	require.Equal(t, []string{`* LIST (\Subscribed) "/" "Folders/Work"`}, c.cmd("e", `LIST (SUBSCRIBED) "" *`))
+
+	require.Equal(t, []string{
+		`* LIST (\Noselect) "/" "Folders" ("CHILDINFO" ("SUBSCRIBED"))`,
+	}, c.cmd("f", `LIST (SUBSCRIBED RECURSIVEMATCH) "" %`))
+}
+
+func TestListStatus(t *testing.T) {
+	c := newTestClient(t)
+
+	lines := c.cmd("d", `LIST "" (INBOX Folders) RETURN (STATUS (MESSAGES))`)
+	require.Len(t, lines, 3)
+
+	// The STATUS follows the LIST of its mailbox, the Folders mailbox is
+	// not selectable.
+	if lines[0] != `* LIST () "/" INBOX` {
+		require.Equal(t, `* LIST (\Noselect) "/" "Folders"`, lines[0])
+		lines = lines[1:]
+	}
+	require.Equal(t, `* LIST () "/" INBOX`, lines[0])
+	require.Equal(t, `* STATUS INBOX (MESSAGES 1)`, lines[1])
+}
+
+func TestCreateSpecialUse(t *testing.T) {
+	c := newTestClient(t)
+
+	_, status := c.cmdStatus("d", `CREATE Drafts (USE (\Drafts))`)
+	require.Equal(t, `d NO [USEATTR] Special-use mailboxes cannot be created`, status)
+	require.Empty(t, c.cmd("e", `LIST "" Drafts`))
+
+	c.cmd("f", `CREATE Drafts`)
+	require.Len(t, c.cmd("g", `LIST "" Drafts`), 1)
+
+	_, status = c.cmdStatus("h", `CREATE Other (UNKNOWN (\Drafts))`)
+	require.True(t, strings.HasPrefix(status, "h BAD"), status)
+}
@@ -22,15 +22,16 @@ import (
 	"time"
 
 	"github.com/emersion/go-imap"
-	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/sirupsen/logrus"
 )
 
 type imapMailbox struct {
-	user *imapUser
-	name string
+	user   *imapUser
+	client *imapClient
+	name   string
 
 	log *logrus.Entry
 
@@ -40,10 +41,11 @@ type imapMailbox struct {
 }
 
 // newIMAPMailbox returns struct implementing go-imap/mailbox interface.
-func newIMAPMailbox(user *imapUser, storeMailbox *store.Mailbox) *imapMailbox {
+func newIMAPMailbox(user *imapUser, client *imapClient, storeMailbox *store.Mailbox) *imapMailbox {
 	return &imapMailbox{
-		user: user,
-		name: storeMailbox.Name(),
+		user:   user,
+		client: client,
+		name:   storeMailbox.Name(),
 
 		log: log.
 			WithField("addressID", user.storeAddress.AddressID()).
@@ -132,12 +134,17 @@ func (im *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, err
 		imap.FlaggedFlag, strings.ToUpper(imap.FlaggedFlag),
 		imap.DeletedFlag, strings.ToUpper(imap.DeletedFlag),
 		imap.DraftFlag, strings.ToUpper(imap.DraftFlag),
-		message.AppleMailJunkFlag,
-		message.ThunderbirdJunkFlag,
-		message.ThunderbirdNonJunkFlag,
 	}
+	status.Flags = append(status.Flags, im.client.getProfile().getJunkFlagNames()...)
 	status.PermanentFlags = append([]string{}, status.Flags...)
 
+	if im.user.backend.areLabelsKeywords() {
+		for _, storeMailbox := range im.getLabelMailboxes() {
+			status.Flags = append(status.Flags, labelKeyword(storeMailbox.Name()))
+		}
+		status.PermanentFlags = append(append([]string{}, status.Flags...), imap.TryCreateFlag)
+	}
+
 	dbTotal, dbUnread, dbUnreadSeqNum, err := im.storeMailbox.GetCounts()
 	l.WithFields(logrus.Fields{
 		"total":        dbTotal,
@@ -155,9 +162,42 @@ func (im *imapMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, err
 		return nil, err
 	}
 
+	for _, item := range items {
+		if item == condstore.StatusHighestModSeq {
+			modSeq, err := im.HighestModSeq()
+			if err != nil {
+				return nil, err
+			}
+			condstore.SetHighestModSeq(status, modSeq)
+		}
+	}
+
 	return status, nil
 }
 
+// HighestModSeq returns the mod-sequence of the latest change in this
+// mailbox.
+func (im *imapMailbox) HighestModSeq() (uint64, error) {
+	return im.storeMailbox.GetHighestModSeq()
+}
+
+// VanishedSince returns the UIDs from uidSet of the messages expunged from
+// this mailbox after the mod-sequence modSeq.
+func (im *imapMailbox) VanishedSince(uidSet *imap.SeqSet, modSeq uint64) ([]uint32, error) {
+	uids, err := im.storeMailbox.GetUIDsVanishedSince(modSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	vanished := []uint32{}
+	for _, uid := range uids {
+		if uidSet.Contains(uid) {
+			vanished = append(vanished, uid)
+		}
+	}
+	return vanished, nil
+}
+
 // SetSubscribed adds or removes the mailbox to the server's set of "active"
 // or "subscribed" mailboxes.
 func (im *imapMailbox) SetSubscribed(subscribed bool) error {
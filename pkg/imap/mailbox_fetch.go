@@ -21,6 +21,7 @@ import (
 	"bytes"
 
 	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
 	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/pkg/errors"
@@ -53,7 +54,7 @@ func (im *imapMailbox) getMessage(storeMessage *store.Message, items []imap.Fetc
 				return nil, err
 			}
 		case imap.FetchFlags:
-			msg.Flags = message.GetFlags(m)
+			msg.Flags = im.getMessageFlags(m)
 			if storeMessage.IsMarkedDeleted() {
 				msg.Flags = append(msg.Flags, imap.DeletedFlag)
 			}
@@ -72,6 +73,12 @@ func (im *imapMailbox) getMessage(storeMessage *store.Message, items []imap.Fetc
 			if msg.Uid, err = storeMessage.UID(); err != nil {
 				return nil, err
 			}
+		case condstore.FetchModSeq:
+			modSeq, err := storeMessage.ModSeq()
+			if err != nil {
+				return nil, err
+			}
+			condstore.SetModSeq(msg, modSeq)
 		case imap.FetchAll, imap.FetchFast, imap.FetchFull, imap.FetchRFC822, imap.FetchRFC822Header, imap.FetchRFC822Text:
 			fallthrough // this is list of defined items by go-imap, but items can be also sections generated from requests
 		default:
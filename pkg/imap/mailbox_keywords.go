@@ -0,0 +1,152 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+)
+
+// labelKeyword returns the IMAP keyword of the label mailbox. Keywords are
+// atoms, so the spaces, the special and the non-ASCII characters of the label
+// name are replaced with underscores.
+func labelKeyword(mailboxName string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune(`(){%*"\]`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimPrefix(mailboxName, store.UserLabelsPrefix))
+}
+
+// isLabelKeyword returns whether the flag set by a client stands for a label.
+// The system flags, the junk flags, and the keywords starting with $ which the
+// clients use for their own purposes (e.g. $Forwarded or $MDNSent) do not.
+func isLabelKeyword(flag string) bool {
+	if strings.HasPrefix(flag, "\\") || strings.HasPrefix(flag, "$") {
+		return false
+	}
+
+	switch strings.ToLower(flag) {
+	case strings.ToLower(message.ThunderbirdJunkFlag), strings.ToLower(message.ThunderbirdNonJunkFlag), "nojunk":
+		return false
+	}
+
+	return true
+}
+
+// getLabelMailboxes returns the mailboxes of the labels of this address.
+func (im *imapMailbox) getLabelMailboxes() []*store.Mailbox {
+	labels := []*store.Mailbox{}
+	for _, storeMailbox := range im.storeAddress.ListMailboxes() {
+		if storeMailbox.IsLabel() {
+			labels = append(labels, storeMailbox)
+		}
+	}
+	return labels
+}
+
+// getLabelKeywords returns the keywords of the given labels, or nothing if
+// the labels are not exposed as keywords.
+func (im *imapMailbox) getLabelKeywords(labelIDs []string) []string {
+	if !im.user.backend.areLabelsKeywords() {
+		return nil
+	}
+
+	keywords := []string{}
+	for _, storeMailbox := range im.getLabelMailboxes() {
+		for _, labelID := range labelIDs {
+			if storeMailbox.LabelID() == labelID {
+				keywords = append(keywords, labelKeyword(storeMailbox.Name()))
+			}
+		}
+	}
+	return keywords
+}
+
+// getMessageFlags returns the flags of the message including the junk flags of
+// the client and the keywords of its labels.
+func (im *imapMailbox) getMessageFlags(m *pmapi.Message) []string {
+	return append(message.GetFlags(m), im.getClientFlags(m.LabelIDs)...)
+}
+
+// getKeywordLabel returns the mailbox of the label with the given keyword, or
+// nil if there is none. Keywords are case-insensitive.
+func (im *imapMailbox) getKeywordLabel(keyword string) *store.Mailbox {
+	for _, storeMailbox := range im.getLabelMailboxes() {
+		if strings.EqualFold(labelKeyword(storeMailbox.Name()), keyword) {
+			return storeMailbox
+		}
+	}
+	return nil
+}
+
+// updateLabelKeyword labels or unlabels the messages with the label of the
+// keyword. The label is created when it is added and does not exist yet.
+func (im *imapMailbox) updateLabelKeyword(operation imap.FlagsOp, messageIDs []string, keyword string) error {
+	storeMailbox := im.getKeywordLabel(keyword)
+
+	switch operation { //nolint[exhaustive] imap.SetFlags is processed by im.setFlags
+	case imap.AddFlags:
+		if storeMailbox == nil {
+			var err error
+			if storeMailbox, err = im.storeAddress.CreateLabel(keyword); err != nil {
+				return err
+			}
+		}
+		return storeMailbox.LabelMessages(messageIDs)
+	case imap.RemoveFlags:
+		if storeMailbox == nil {
+			return nil
+		}
+		return storeMailbox.UnlabelMessages(messageIDs)
+	}
+
+	return nil
+}
+
+// unlabelMissingKeywords unlabels the messages with the labels whose keywords
+// are not among the given ones, so that replacing the flags of the messages
+// also removes the keywords left out.
+func (im *imapMailbox) unlabelMissingKeywords(messageIDs, keywords []string) error {
+	for _, storeMailbox := range im.getLabelMailboxes() {
+		keyword := labelKeyword(storeMailbox.Name())
+		if !isLabelKeyword(keyword) || containsKeyword(keywords, keyword) {
+			continue
+		}
+		if err := storeMailbox.UnlabelMessages(messageIDs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// containsKeyword returns whether the keyword is among the given ones.
+// Keywords are case-insensitive.
+func containsKeyword(keywords []string, keyword string) bool {
+	for _, k := range keywords {
+		if strings.EqualFold(k, keyword) {
+			return true
+		}
+	}
+	return false
+}
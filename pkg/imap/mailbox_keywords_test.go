@@ -0,0 +1,62 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabelKeyword(t *testing.T) {
+	for name, want := range map[string]string{
+		"Labels/Work":           "Work",
+		"Labels/To do (urgent)": "To_do__urgent_",
+		`Labels/a"b\c]d*e%f{g`:  "a_b_c_d_e_f_g",
+		"Labels/Práce":          "Pr_ce",
+		"Labels/a/b":            "a/b",
+	} {
+		require.Equal(t, want, labelKeyword(name), name)
+	}
+}
+
+func TestIsLabelKeyword(t *testing.T) {
+	for flag, want := range map[string]bool{
+		"work":        true,
+		"$label1":     false,
+		"$forwarded":  false,
+		`\seen`:       false,
+		`\answered`:   false,
+		"junk":        false,
+		"nonjunk":     false,
+		"nojunk":      false,
+		"Junk":        false,
+		"to_do_later": true,
+	} {
+		require.Equal(t, want, isLabelKeyword(flag), flag)
+	}
+}
+
+func TestContainsKeyword(t *testing.T) {
+	keywords := []string{"work", "To_Do"}
+
+	require.True(t, containsKeyword(keywords, "work"))
+	require.True(t, containsKeyword(keywords, "to_do"))
+	require.False(t, containsKeyword(keywords, "home"))
+	require.False(t, containsKeyword(nil, "work"))
+}
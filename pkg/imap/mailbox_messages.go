@@ -22,13 +22,12 @@ import (
 	"net/mail"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/ljanyst/peroxide/pkg/imap/uidplus"
-	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/parallel"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -72,17 +71,23 @@ func (im *imapMailbox) setFlags(messageIDs, flags []string) error { //nolint
 	flagged := false
 	deleted := false
 	spam := false
+	keywords := []string{}
+	profile := im.client.getProfile()
 
 	for _, f := range flags {
-		switch f {
-		case imap.SeenFlag:
+		switch {
+		case f == imap.SeenFlag:
 			seen = true
-		case imap.FlaggedFlag:
+		case f == imap.FlaggedFlag:
 			flagged = true
-		case imap.DeletedFlag:
+		case f == imap.DeletedFlag:
 			deleted = true
-		case message.AppleMailJunkFlag, message.ThunderbirdJunkFlag:
+		case profile.isJunkFlag(f):
 			spam = true
+		default:
+			if im.user.backend.areLabelsKeywords() && isLabelKeyword(f) {
+				keywords = append(keywords, f)
+			}
 		}
 	}
 
@@ -131,19 +136,33 @@ func (im *imapMailbox) setFlags(messageIDs, flags []string) error { //nolint
 		}
 	}
 
-	return nil
+	if !im.user.backend.areLabelsKeywords() {
+		return nil
+	}
+
+	for _, keyword := range keywords {
+		if err := im.updateLabelKeyword(imap.AddFlags, messageIDs, keyword); err != nil {
+			return err
+		}
+	}
+
+	return im.unlabelMissingKeywords(messageIDs, keywords)
 }
 
 func (im *imapMailbox) addOrRemoveFlags(operation imap.FlagsOp, messageIDs, flags []string) error { //nolint[funlen]
+	profile := im.client.getProfile()
+
 	for _, f := range flags {
-		// Adding flag 'nojunk' is equivalent to removing flag 'junk'
+		isJunk := profile.isJunkFlag(f)
+
+		// Adding flag 'nojunk' is equivalent to removing the junk flag
 		if (operation == imap.AddFlags) && (f == "nojunk") {
 			operation = imap.RemoveFlags
-			f = "junk"
+			isJunk = true
 		}
 
-		switch f {
-		case imap.SeenFlag:
+		switch {
+		case f == imap.SeenFlag:
 			switch operation { //nolint[exhaustive] imap.SetFlags is processed by im.setFlags
 			case imap.AddFlags:
 				if err := im.storeMailbox.MarkMessagesRead(messageIDs); err != nil {
@@ -154,7 +173,7 @@ func (im *imapMailbox) addOrRemoveFlags(operation imap.FlagsOp, messageIDs, flag
 					return err
 				}
 			}
-		case imap.FlaggedFlag:
+		case f == imap.FlaggedFlag:
 			switch operation { //nolint[exhaustive] imap.SetFlag is processed by im.setFlags
 			case imap.AddFlags:
 				if err := im.storeMailbox.MarkMessagesStarred(messageIDs); err != nil {
@@ -165,7 +184,7 @@ func (im *imapMailbox) addOrRemoveFlags(operation imap.FlagsOp, messageIDs, flag
 					return err
 				}
 			}
-		case imap.DeletedFlag:
+		case f == imap.DeletedFlag:
 			switch operation { //nolint[exhaustive] imap.SetFlag is processed by im.setFlags
 			case imap.AddFlags:
 				if err := im.storeMailbox.MarkMessagesDeleted(messageIDs); err != nil {
@@ -176,9 +195,9 @@ func (im *imapMailbox) addOrRemoveFlags(operation imap.FlagsOp, messageIDs, flag
 					return err
 				}
 			}
-		case imap.AnsweredFlag, imap.DraftFlag, imap.RecentFlag:
+		case f == imap.AnsweredFlag, f == imap.DraftFlag, f == imap.RecentFlag:
 			// Not supported.
-		case strings.ToLower(message.AppleMailJunkFlag), strings.ToLower(message.ThunderbirdJunkFlag):
+		case isJunk:
 			spamMailbox, err := im.storeAddress.GetMailbox("Spam")
 			if err != nil {
 				return err
@@ -211,6 +230,12 @@ func (im *imapMailbox) addOrRemoveFlags(operation imap.FlagsOp, messageIDs, flag
 					}
 				}
 			}
+		default:
+			if im.user.backend.areLabelsKeywords() && isLabelKeyword(f) {
+				if err := im.updateLabelKeyword(operation, messageIDs, f); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
@@ -323,192 +348,88 @@ func (im *imapMailbox) labelMessages(uid bool, seqSet *imap.SeqSet, targetLabel
 
 // SearchMessages searches messages. The returned list must contain UIDs if
 // uid is set to true, or sequence numbers otherwise.
-func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria) (ids []uint32, err error) { //nolint[gocyclo]
-	if criteria.Or != nil {
-		return nil, errors.New("unsupported search query")
+func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria) (ids []uint32, err error) {
+	candidates, err := im.searchCandidates(criteria)
+	if err != nil {
+		return nil, err
 	}
 
-	if criteria.Body != nil || criteria.Text != nil {
-		log.Warn("Body and Text criteria not applied")
-	}
+	return getCandidateIDs(isUID, candidates)
+}
 
-	var apiIDs []string
-	if criteria.SeqNum != nil {
-		apiIDs, err = im.apiIDsFromSeqSet(false, criteria.SeqNum)
-	} else {
-		apiIDs, err = im.storeMailbox.GetAPIIDsFromSequenceRange(1, 0)
+// searchCandidates returns the messages matching the criteria in the order
+// of their sequence numbers.
+func (im *imapMailbox) searchCandidates(criteria *imap.SearchCriteria) ([]*searchCandidate, error) {
+	apiIDs, err := im.storeMailbox.GetAPIIDsFromSequenceRange(1, 0)
+	if err != nil || len(apiIDs) == 0 {
+		return nil, err
 	}
-	if err != nil {
+
+	// The largest UID is needed to resolve "*" in UID sets.
+	var maxUID uint32
+	if lastMessage, err := im.storeMailbox.GetMessage(apiIDs[len(apiIDs)-1]); err != nil {
+		return nil, err
+	} else if maxUID, err = lastMessage.UID(); err != nil {
 		return nil, err
 	}
 
+	// The top-level sequence and UID sets restrict all the other keys, so
+	// the messages outside of them do not need to be loaded at all.
+	var inUIDSet map[string]bool
 	if criteria.Uid != nil {
-		apiIDsByUID, err := im.apiIDsFromSeqSet(true, criteria.Uid)
-		if err != nil {
+		if inUIDSet, err = im.apiIDsFromUIDSet(criteria.Uid); err != nil {
 			return nil, err
 		}
-		apiIDs = arrayIntersection(apiIDs, apiIDsByUID)
 	}
 
-	for _, apiID := range apiIDs {
-		// Get message.
-		storeMessage, err := im.storeMailbox.GetMessage(apiID)
-		if err != nil {
-			log.Warnf("search messages: cannot get message %q from db: %v", apiID, err)
-			continue
-		}
-		m := storeMessage.Message()
-
-		// Filter by time.
-		if !criteria.Before.IsZero() {
-			if truncated := criteria.Before.Truncate(24 * time.Hour); m.Time > truncated.Unix() {
-				continue
-			}
-		}
-		if !criteria.Since.IsZero() {
-			if truncated := criteria.Since.Truncate(24 * time.Hour); m.Time < truncated.Unix() {
-				continue
-			}
-		}
-
-		// In order to speed up search it is not needed to always
-		// retrieve the fully cached header.
-		header := storeMessage.GetMIMEHeaderFast()
-
-		if !criteria.SentBefore.IsZero() || !criteria.SentSince.IsZero() {
-			t, err := mail.Header(header).Date()
-			if err != nil || t.IsZero() {
-				t = time.Unix(m.Time, 0)
-			}
-			if !criteria.SentBefore.IsZero() {
-				if truncated := criteria.SentBefore.Truncate(24 * time.Hour); t.Unix() > truncated.Unix() {
-					continue
-				}
-			}
-			if !criteria.SentSince.IsZero() {
-				if truncated := criteria.SentSince.Truncate(24 * time.Hour); t.Unix() < truncated.Unix() {
-					continue
-				}
-			}
-		}
+	candidates := []*searchCandidate{}
+	for i, apiID := range apiIDs {
+		seqNum := uint32(i + 1)
 
-		// Filter by headers.
-		headerMatch := true
-		for criteriaKey, criteriaValues := range criteria.Header {
-			for _, criteriaValue := range criteriaValues {
-				if criteriaValue == "" {
-					continue
-				}
-				switch criteriaKey {
-				case "Subject":
-					headerMatch = strings.Contains(strings.ToLower(m.Subject), strings.ToLower(criteriaValue))
-				case "From":
-					headerMatch = addressMatch([]*mail.Address{m.Sender}, criteriaValue)
-				case "To":
-					headerMatch = addressMatch(m.ToList, criteriaValue)
-				case "Cc":
-					headerMatch = addressMatch(m.CCList, criteriaValue)
-				case "Bcc":
-					headerMatch = addressMatch(m.BCCList, criteriaValue)
-				default:
-					if messageValue := header.Get(criteriaKey); messageValue == "" {
-						headerMatch = false // Field is not in header.
-					} else if !strings.Contains(strings.ToLower(messageValue), strings.ToLower(criteriaValue)) {
-						headerMatch = false // Field is in header but value not matched (case insensitive).
-					}
-				}
-				if !headerMatch {
-					break
-				}
-			}
-			if !headerMatch {
-				break
-			}
-		}
-		if !headerMatch {
+		if criteria.SeqNum != nil && !seqSetContains(criteria.SeqNum, seqNum, uint32(len(apiIDs))) {
 			continue
 		}
-
-		// Filter by flags.
-		messageFlagsMap := make(map[string]bool)
-		if isStringInList(m.LabelIDs, pmapi.StarredLabel) {
-			messageFlagsMap[imap.FlaggedFlag] = true
-		}
-		if !m.Unread {
-			messageFlagsMap[imap.SeenFlag] = true
-		}
-		if m.Has(pmapi.FlagReplied) || m.Has(pmapi.FlagRepliedAll) {
-			messageFlagsMap[imap.AnsweredFlag] = true
-		}
-		if m.Has(pmapi.FlagSent) || m.Has(pmapi.FlagReceived) {
-			messageFlagsMap[imap.DraftFlag] = true
-		}
-		if !m.Has(pmapi.FlagOpened) {
-			messageFlagsMap[imap.RecentFlag] = true
-		}
-		if storeMessage.IsMarkedDeleted() {
-			messageFlagsMap[imap.DeletedFlag] = true
+		if inUIDSet != nil && !inUIDSet[apiID] {
+			continue
 		}
 
-		flagMatch := true
-		for _, flag := range criteria.WithFlags {
-			if !messageFlagsMap[flag] {
-				flagMatch = false
-				break
-			}
-		}
-		for _, flag := range criteria.WithoutFlags {
-			if messageFlagsMap[flag] {
-				flagMatch = false
-				break
-			}
-		}
-		if !flagMatch {
+		storeMessage, err := im.storeMailbox.GetMessage(apiID)
+		if err != nil {
+			log.Warnf("search messages: cannot get message %q from db: %v", apiID, err)
 			continue
 		}
 
-		// Filter by size (only if size was already calculated).
-		size, err := storeMessage.GetRFC822Size()
+		candidate := newSearchCandidate(storeMessage, seqNum, uint32(len(apiIDs)), maxUID)
+		candidate.clientFlags = im.getClientFlags
+
+		match, err := matchSearchCriteria(candidate, criteria)
 		if err != nil {
-			return nil, err
+			return nil, errors.Wrapf(err, "cannot match message %q", apiID)
 		}
-
-		if size > 0 {
-			if criteria.Larger != 0 && int64(size) <= int64(criteria.Larger) {
-				continue
-			}
-			if criteria.Smaller != 0 && int64(size) >= int64(criteria.Smaller) {
-				continue
-			}
+		if match {
+			candidates = append(candidates, candidate)
 		}
+	}
 
-		// Add the ID to response.
-		var id uint32
-		if isUID {
-			id, err = storeMessage.UID()
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			id, err = storeMessage.SequenceNumber()
-			if err != nil {
-				return nil, err
-			}
+	return candidates, nil
+}
+
+// getCandidateIDs returns the UIDs of the candidates if isUID is set to true,
+// or their sequence numbers otherwise.
+func getCandidateIDs(isUID bool, candidates []*searchCandidate) (ids []uint32, err error) {
+	for _, candidate := range candidates {
+		if !isUID {
+			ids = append(ids, candidate.seqNum)
+			continue
 		}
-		ids = append(ids, id)
-	}
 
-	toRemove := []uint32{}
-	for _, negativeCriteria := range criteria.Not {
-		negIds, err := im.SearchMessages(isUID, negativeCriteria)
+		uid, err := candidate.getUID()
 		if err != nil {
 			return nil, err
 		}
-		toRemove = arrayUnion(toRemove, negIds)
+		ids = append(ids, uid)
 	}
 
-	ids = arrayDifference(ids, toRemove)
-
 	return ids, nil
 }
 
@@ -519,11 +440,19 @@ func (im *imapMailbox) SearchMessages(isUID bool, criteria *imap.SearchCriteria)
 // Messages must be sent to msgResponse. When the function returns, msgResponse must be closed.
 func (im *imapMailbox) ListMessages(isUID bool, seqSet *imap.SeqSet, items []imap.FetchItem, msgResponse chan<- *imap.Message) error {
 	return im.logCommand(func() error {
-		return im.listMessages(isUID, seqSet, items, msgResponse)
+		return im.listMessages(isUID, seqSet, items, 0, msgResponse)
 	}, "FETCH", isUID, seqSet, items)
 }
 
-func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []imap.FetchItem, msgResponse chan<- *imap.Message) (err error) { //nolint[funlen]
+// ListMessagesChangedSince works like ListMessages but skips the messages
+// which have not changed after the mod-sequence changedSince.
+func (im *imapMailbox) ListMessagesChangedSince(isUID bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, msgResponse chan<- *imap.Message) error {
+	return im.logCommand(func() error {
+		return im.listMessages(isUID, seqSet, items, changedSince, msgResponse)
+	}, "FETCH", isUID, seqSet, items, changedSince)
+}
+
+func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []imap.FetchItem, changedSince uint64, msgResponse chan<- *imap.Message) (err error) { //nolint[funlen]
 	defer func() {
 		close(msgResponse)
 		if err != nil {
@@ -533,7 +462,7 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 
 	// We always report the sent folder as empty in the BCC self mode because
 	// the sent messages will appear in different folders
-	if im.user.backend.bccSelf && im.storeMailbox.LabelID() == pmapi.SentLabel {
+	if im.user.backend.isBCCSelf() && im.storeMailbox.LabelID() == pmapi.SentLabel {
 		return nil
 	}
 
@@ -557,6 +486,14 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 		return err
 	}
 
+	if changedSince > 0 {
+		if apiIDs, err = im.storeMailbox.GetAPIIDsChangedSince(apiIDs, changedSince); err != nil {
+			err = fmt.Errorf("list messages changed since: %v", err)
+			l.WithField("modSeq", changedSince).Error(err)
+			return err
+		}
+	}
+
 	input := make([]interface{}, len(apiIDs))
 	for i, apiID := range apiIDs {
 		input[i] = apiID
@@ -602,7 +539,7 @@ func (im *imapMailbox) listMessages(isUID bool, seqSet *imap.SeqSet, items []ima
 		return nil
 	}
 
-	err = parallel.RunParallel(im.user.backend.listWorkers, input, processCallback, collectCallback)
+	err = parallel.RunParallel(im.user.backend.getListWorkers(), input, processCallback, collectCallback)
 	if err != nil {
 		return err
 	}
@@ -638,58 +575,46 @@ func (im *imapMailbox) apiIDsFromSeqSet(uid bool, seqSet *imap.SeqSet) ([]string
 	return apiIDs, nil
 }
 
-func arrayIntersection(a, b []string) (c []string) {
-	m := make(map[string]bool)
-	for _, item := range a {
-		m[item] = true
-	}
-	for _, item := range b {
-		if _, ok := m[item]; ok {
-			c = append(c, item)
+// apiIDsFromUIDSet returns the API IDs of the messages in the UID set. Unlike
+// apiIDsFromSeqSet, it resolves "*:n" as "n:*".
+func (im *imapMailbox) apiIDsFromUIDSet(seqSet *imap.SeqSet) (map[string]bool, error) {
+	apiIDs := map[string]bool{}
+	for _, seq := range seqSet.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 && stop != 0 {
+			start, stop = stop, 0
 		}
-	}
-	return
-}
 
-func arrayUnion(a, b []uint32) (c []uint32) {
-	m := make(map[uint32]bool)
-	for _, item := range a {
-		m[item] = true
-	}
-	for _, item := range b {
-		m[item] = true
-	}
-	for item, _ := range m {
-		c = append(c, item)
+		newAPIIDs, err := im.storeMailbox.GetAPIIDsFromUIDRange(start, stop)
+		if err != nil {
+			return nil, err
+		}
+		for _, apiID := range newAPIIDs {
+			apiIDs[apiID] = true
+		}
 	}
-	return
+	return apiIDs, nil
 }
 
-func arrayDifference(a, b []uint32) (c []uint32) {
-	m := make(map[uint32]bool)
-	for _, item := range a {
-		m[item] = true
-	}
-	for _, item := range b {
-		delete(m, item)
-	}
-	for item, _ := range m {
-		c = append(c, item)
+func textMatch(text *store.IndexedText, body, all []string) bool {
+	for _, criteria := range body {
+		if !text.ContainsBody(criteria) {
+			return false
+		}
 	}
-	return
-}
-
-func isStringInList(list []string, s string) bool {
-	for _, v := range list {
-		if v == s {
-			return true
+	for _, criteria := range all {
+		if !text.ContainsText(criteria) {
+			return false
 		}
 	}
-	return false
+	return true
 }
 
 func addressMatch(addresses []*mail.Address, criteria string) bool {
 	for _, addr := range addresses {
+		if addr == nil {
+			continue
+		}
 		if strings.Contains(strings.ToLower(addr.String()), strings.ToLower(criteria)) {
 			return true
 		}
@@ -0,0 +1,284 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"time"
+
+	imap "github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+	"github.com/ljanyst/peroxide/pkg/smtp"
+	"github.com/ljanyst/peroxide/pkg/store"
+)
+
+const outboxMailboxName = "Outbox"
+
+var errOutboxReadOnly = errors.New("Outbox is read-only")
+
+// The mailbox showing the messages waiting in the outbound queue until the
+// API is reachable again. The messages leave it once they are sent or
+// bounced, so it can only be read.
+type imapOutboxMailbox struct {
+	user   *imapUser
+	outbox *smtp.OutboundQueue
+}
+
+func newOutboxMailbox(user *imapUser) *imapOutboxMailbox {
+	return &imapOutboxMailbox{user: user, outbox: user.backend.outbox}
+}
+
+func (m *imapOutboxMailbox) Name() string {
+	return outboxMailboxName
+}
+
+func (m *imapOutboxMailbox) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.NoInferiorsAttr},
+		Delimiter:  store.PathDelimiter,
+		Name:       outboxMailboxName,
+	}, nil
+}
+
+func (m *imapOutboxMailbox) getMessages() ([]*smtp.QueuedMessage, error) {
+	msgs, err := m.outbox.List(m.user.storeUser.UserID(), m.user.getOutboxAddressID(), m.user.client().KeyRingForAddressID)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []uint32{}
+	for _, msg := range msgs {
+		uids = append(uids, msg.UID)
+	}
+	m.user.setOutboxUIDs(uids)
+
+	return msgs, nil
+}
+
+func (m *imapOutboxMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	msgs, err := m.getMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	status := imap.NewMailboxStatus(outboxMailboxName, items)
+	status.ReadOnly = true
+	status.Flags = []string{imap.SeenFlag}
+	status.PermanentFlags = []string{}
+	status.Messages = uint32(len(msgs))
+	status.UidValidity = m.outbox.UIDValidity()
+	status.UidNext = m.outbox.UIDNext()
+
+	return status, nil
+}
+
+func (m *imapOutboxMailbox) SetSubscribed(_ bool) error {
+	return nil
+}
+
+func (m *imapOutboxMailbox) Check() error {
+	return nil
+}
+
+func (m *imapOutboxMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	msgs, err := m.getMessages()
+	if err != nil {
+		return err
+	}
+
+	for i, msg := range msgs {
+		seqNum := uint32(i + 1)
+
+		id := seqNum
+		if uid {
+			id = msg.UID
+		}
+		if !seqSet.Contains(id) {
+			continue
+		}
+
+		fetched, err := fetchQueuedMessage(seqNum, msg, items)
+		if err != nil {
+			return err
+		}
+		ch <- fetched
+	}
+
+	return nil
+}
+
+func fetchQueuedMessage(seqNum uint32, msg *smtp.QueuedMessage, items []imap.FetchItem) (*imap.Message, error) {
+	headerAndBody := func() (textproto.Header, *bufio.Reader, error) {
+		body := bufio.NewReader(bytes.NewReader(msg.Literal))
+		header, err := textproto.ReadHeader(body)
+		return header, body, err
+	}
+
+	fetched := imap.NewMessage(seqNum, items)
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			if fetched.Envelope, err = backendutil.FetchEnvelope(header); err != nil {
+				return nil, err
+			}
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			if fetched.BodyStructure, err = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure); err != nil {
+				return nil, err
+			}
+		case imap.FetchFlags:
+			fetched.Flags = []string{imap.SeenFlag}
+		case imap.FetchInternalDate:
+			fetched.InternalDate = msg.Queued
+		case imap.FetchRFC822Size:
+			fetched.Size = uint32(len(msg.Literal))
+		case imap.FetchUid:
+			fetched.Uid = msg.UID
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			header, body, err := headerAndBody()
+			if err != nil {
+				return nil, err
+			}
+			literal, err := backendutil.FetchBodySection(header, body, section)
+			if err != nil {
+				return nil, err
+			}
+			fetched.Body[section] = literal
+		}
+	}
+
+	return fetched, nil
+}
+
+func (m *imapOutboxMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	msgs, err := m.getMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []uint32{}
+	for i, msg := range msgs {
+		seqNum := uint32(i + 1)
+
+		entity, err := message.Read(bytes.NewReader(msg.Literal))
+		if err != nil {
+			continue
+		}
+
+		ok, err := backendutil.Match(entity, seqNum, msg.UID, msg.Queued, []string{imap.SeenFlag}, criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, msg.UID)
+		} else {
+			ids = append(ids, seqNum)
+		}
+	}
+
+	return ids, nil
+}
+
+func (m *imapOutboxMailbox) CreateMessage(_ []string, _ time.Time, _ imap.Literal) error {
+	return errOutboxReadOnly
+}
+
+func (m *imapOutboxMailbox) UpdateMessagesFlags(_ bool, _ *imap.SeqSet, _ imap.FlagsOp, _ []string) error {
+	return errOutboxReadOnly
+}
+
+func (m *imapOutboxMailbox) CopyMessages(_ bool, _ *imap.SeqSet, _ string) error {
+	return errOutboxReadOnly
+}
+
+func (m *imapOutboxMailbox) Expunge() error {
+	return errOutboxReadOnly
+}
+
+// getOutboxAddressID returns the address whose messages are shown in the
+// Outbox. In combined mode, the Outbox shows the messages of all addresses.
+func (iu *imapUser) getOutboxAddressID() string {
+	if iu.storeUser.IsCombinedMode() {
+		return ""
+	}
+	return iu.storeAddress.AddressID()
+}
+
+func (iu *imapUser) setOutboxUIDs(uids []uint32) {
+	iu.outboxLock.Lock()
+	defer iu.outboxLock.Unlock()
+
+	iu.outboxUIDs = uids
+}
+
+// updateOutbox tells the clients which have the Outbox selected about the
+// messages which left the queue and about the count of the queued ones.
+func (iu *imapUser) updateOutbox() {
+	uids, err := iu.backend.outbox.UIDs(iu.storeUser.UserID(), iu.getOutboxAddressID())
+	if err != nil {
+		log.WithError(err).Error("Cannot list the outbound queue")
+		return
+	}
+
+	iu.outboxLock.Lock()
+	known := iu.outboxUIDs
+	iu.outboxUIDs = uids
+	iu.outboxLock.Unlock()
+
+	address := iu.storeAddress.AddressString()
+	for _, seqNum := range getExpungedSeqNums(known, uids) {
+		iu.backend.updates.DeleteMessage(address, outboxMailboxName, known[seqNum-1], seqNum)
+	}
+	iu.backend.updates.MailboxStatus(address, outboxMailboxName, uint32(len(uids)), 0, 0)
+}
+
+// getExpungedSeqNums returns the sequence numbers of the known UIDs which are
+// not current anymore, from the highest, so that expunging one after another
+// does not shift the rest.
+func getExpungedSeqNums(known, current []uint32) []uint32 {
+	isCurrent := map[uint32]bool{}
+	for _, uid := range current {
+		isCurrent[uid] = true
+	}
+
+	seqNums := []uint32{}
+	for i := len(known) - 1; i >= 0; i-- {
+		if !isCurrent[known[i]] {
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+	return seqNums
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/smtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetExpungedSeqNums(t *testing.T) {
+	require.Equal(t, []uint32{4, 2}, getExpungedSeqNums([]uint32{3, 5, 7, 9}, []uint32{3, 7, 10}))
+	require.Equal(t, []uint32{}, getExpungedSeqNums([]uint32{3, 5}, []uint32{3, 5, 6}))
+	require.Equal(t, []uint32{}, getExpungedSeqNums(nil, []uint32{1}))
+}
+
+func TestFetchQueuedMessage(t *testing.T) {
+	queued := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	msg := &smtp.QueuedMessage{
+		UID:     7,
+		Queued:  queued,
+		Literal: []byte("From: sender@pm.me\r\nTo: rcpt@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"),
+	}
+
+	section, err := imap.ParseBodySectionName("BODY.PEEK[TEXT]")
+	require.NoError(t, err)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchFlags, imap.FetchInternalDate, imap.FetchRFC822Size, imap.FetchEnvelope, section.FetchItem()}
+	fetched, err := fetchQueuedMessage(2, msg, items)
+	require.NoError(t, err)
+
+	require.Equal(t, uint32(2), fetched.SeqNum)
+	require.Equal(t, uint32(7), fetched.Uid)
+	require.Equal(t, []string{imap.SeenFlag}, fetched.Flags)
+	require.Equal(t, queued, fetched.InternalDate)
+	require.Equal(t, uint32(len(msg.Literal)), fetched.Size)
+	require.Equal(t, "Hello", fetched.Envelope.Subject)
+
+	require.Len(t, fetched.Body, 1)
+	for _, literal := range fetched.Body {
+		text, err := ioutil.ReadAll(literal)
+		require.NoError(t, err)
+		require.Equal(t, "Hello\r\n", string(text))
+	}
+}
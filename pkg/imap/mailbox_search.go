@@ -0,0 +1,315 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+)
+
+// searchableMessage is the part of the store message needed to evaluate
+// search criteria.
+type searchableMessage interface {
+	UID() (uint32, error)
+	Message() *pmapi.Message
+	IsMarkedDeleted() bool
+	GetMIMEHeaderFast() textproto.MIMEHeader
+	GetRFC822Size() (uint32, error)
+	GetIndexedText() (*store.IndexedText, error)
+}
+
+// searchCandidate is a message matched against the search criteria. The
+// values needed by the criteria are computed lazily and kept, so that keys
+// repeated in several OR and NOT branches are evaluated only once.
+type searchCandidate struct {
+	msg    searchableMessage
+	seqNum uint32
+
+	// Largest sequence number and UID in the mailbox, used for "*".
+	maxSeqNum uint32
+	maxUID    uint32
+
+	// clientFlags returns the junk flags of the client and the keywords of
+	// the labels of the message, if they are exposed.
+	clientFlags func(labelIDs []string) []string
+
+	uid    *uint32
+	size   *uint32
+	flags  map[string]bool
+	header textproto.MIMEHeader
+	text   *store.IndexedText
+}
+
+func newSearchCandidate(msg searchableMessage, seqNum, maxSeqNum, maxUID uint32) *searchCandidate {
+	return &searchCandidate{
+		msg:       msg,
+		seqNum:    seqNum,
+		maxSeqNum: maxSeqNum,
+		maxUID:    maxUID,
+	}
+}
+
+func (c *searchCandidate) getUID() (uint32, error) {
+	if c.uid == nil {
+		uid, err := c.msg.UID()
+		if err != nil {
+			return 0, err
+		}
+		c.uid = &uid
+	}
+	return *c.uid, nil
+}
+
+func (c *searchCandidate) getSize() (uint32, error) {
+	if c.size == nil {
+		size, err := c.msg.GetRFC822Size()
+		if err != nil {
+			return 0, err
+		}
+		c.size = &size
+	}
+	return *c.size, nil
+}
+
+// getFlags returns the lowercase flags of the message. They are the same as
+// returned by FETCH. \Recent is never set, as the mailboxes report no recent
+// messages, so RECENT and NEW match nothing and OLD matches everything.
+func (c *searchCandidate) getFlags() map[string]bool {
+	if c.flags == nil {
+		m := c.msg.Message()
+		c.flags = make(map[string]bool)
+		for _, flag := range message.GetFlags(m) {
+			c.flags[strings.ToLower(flag)] = true
+		}
+		if c.clientFlags != nil {
+			for _, flag := range c.clientFlags(m.LabelIDs) {
+				c.flags[strings.ToLower(flag)] = true
+			}
+		}
+		if c.msg.IsMarkedDeleted() {
+			c.flags[strings.ToLower(imap.DeletedFlag)] = true
+		}
+	}
+	return c.flags
+}
+
+// getHeader returns the header of the message. In order to speed up search
+// it is not needed to always retrieve the fully cached header.
+func (c *searchCandidate) getHeader() textproto.MIMEHeader {
+	if c.header == nil {
+		c.header = c.msg.GetMIMEHeaderFast()
+	}
+	return c.header
+}
+
+// getSentDate returns the date from the header of the message, or the
+// internal date if the header has none.
+func (c *searchCandidate) getSentDate() time.Time {
+	t, err := mail.Header(c.getHeader()).Date()
+	if err != nil || t.IsZero() {
+		t = time.Unix(c.msg.Message().Time, 0)
+	}
+	return t
+}
+
+func (c *searchCandidate) getText() (*store.IndexedText, error) {
+	if c.text == nil {
+		text, err := c.msg.GetIndexedText()
+		if err != nil {
+			return nil, err
+		}
+		c.text = text
+	}
+	return c.text, nil
+}
+
+// matchSearchCriteria returns whether the candidate matches all the keys of
+// the criteria, including the NOT and OR subtrees.
+func matchSearchCriteria(c *searchCandidate, criteria *imap.SearchCriteria) (bool, error) { //nolint[gocyclo]
+	if criteria.SeqNum != nil && !seqSetContains(criteria.SeqNum, c.seqNum, c.maxSeqNum) {
+		return false, nil
+	}
+
+	if criteria.Uid != nil {
+		uid, err := c.getUID()
+		if err != nil {
+			return false, err
+		}
+		if !seqSetContains(criteria.Uid, uid, c.maxUID) {
+			return false, nil
+		}
+	}
+
+	if !flagsMatch(c.getFlags(), criteria.WithFlags, criteria.WithoutFlags) {
+		return false, nil
+	}
+
+	m := c.msg.Message()
+
+	if !dateMatch(time.Unix(m.Time, 0), criteria.Since, criteria.Before) {
+		return false, nil
+	}
+
+	if !criteria.SentBefore.IsZero() || !criteria.SentSince.IsZero() {
+		if !dateMatch(c.getSentDate(), criteria.SentSince, criteria.SentBefore) {
+			return false, nil
+		}
+	}
+
+	for key, values := range criteria.Header {
+		for _, value := range values {
+			if !headerMatch(m, c.getHeader(), key, value) {
+				return false, nil
+			}
+		}
+	}
+
+	if criteria.Larger != 0 || criteria.Smaller != 0 {
+		size, err := c.getSize()
+		if err != nil {
+			return false, err
+		}
+		if criteria.Larger != 0 && size <= criteria.Larger {
+			return false, nil
+		}
+		if criteria.Smaller != 0 && size >= criteria.Smaller {
+			return false, nil
+		}
+	}
+
+	for _, not := range criteria.Not {
+		match, err := matchSearchCriteria(c, not)
+		if err != nil {
+			return false, err
+		}
+		if match {
+			return false, nil
+		}
+	}
+
+	for _, or := range criteria.Or {
+		match, err := matchSearchCriteria(c, or[0])
+		if err != nil {
+			return false, err
+		}
+		if !match {
+			if match, err = matchSearchCriteria(c, or[1]); err != nil {
+				return false, err
+			}
+		}
+		if !match {
+			return false, nil
+		}
+	}
+
+	// Body and text are checked last because messages which are not in the
+	// search index yet need to be fetched and indexed.
+	if len(criteria.Body) != 0 || len(criteria.Text) != 0 {
+		text, err := c.getText()
+		if err != nil {
+			return false, err
+		}
+		if !textMatch(text, criteria.Body, criteria.Text) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// seqSetContains returns whether the number is in the set. Unlike
+// imap.SeqSet.Contains, "*" is resolved to the largest number in the mailbox.
+func seqSetContains(seqSet *imap.SeqSet, num, max uint32) bool {
+	for _, seq := range seqSet.Set {
+		start, stop := seq.Start, seq.Stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if start <= num && num <= stop {
+			return true
+		}
+	}
+	return false
+}
+
+func flagsMatch(flags map[string]bool, with, without []string) bool {
+	for _, flag := range with {
+		if !flags[strings.ToLower(flag)] {
+			return false
+		}
+	}
+	for _, flag := range without {
+		if flags[strings.ToLower(flag)] {
+			return false
+		}
+	}
+	return true
+}
+
+// dateMatch compares the date ignoring the time and timezone. The since date
+// is inclusive and the before date is exclusive; zero dates are not checked.
+func dateMatch(t, since, before time.Time) bool {
+	day := t.UTC().Truncate(24 * time.Hour)
+	if !since.IsZero() && day.Before(since.Truncate(24*time.Hour)) {
+		return false
+	}
+	if !before.IsZero() && !day.Before(before.Truncate(24*time.Hour)) {
+		return false
+	}
+	return true
+}
+
+func headerMatch(m *pmapi.Message, header textproto.MIMEHeader, key, value string) bool {
+	switch key {
+	case "Subject":
+		return strings.Contains(strings.ToLower(m.Subject), strings.ToLower(value))
+	case "From":
+		return value == "" || addressMatch([]*mail.Address{m.Sender}, value)
+	case "To":
+		return value == "" || addressMatch(m.ToList, value)
+	case "Cc":
+		return value == "" || addressMatch(m.CCList, value)
+	case "Bcc":
+		return value == "" || addressMatch(m.BCCList, value)
+	}
+
+	// Empty value matches all messages which have the field in the header.
+	messageValues, ok := header[key]
+	if !ok {
+		return false
+	}
+	for _, messageValue := range messageValues {
+		if strings.Contains(strings.ToLower(messageValue), strings.ToLower(value)) {
+			return true
+		}
+	}
+	return false
+}
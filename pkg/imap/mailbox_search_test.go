@@ -0,0 +1,166 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"bufio"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/store"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSearchMessage struct {
+	uid      uint32
+	msg      *pmapi.Message
+	deleted  bool
+	size     uint32
+	body     string
+	header   textproto.MIMEHeader
+	textRead int
+}
+
+func (m *fakeSearchMessage) UID() (uint32, error)    { return m.uid, nil }
+func (m *fakeSearchMessage) Message() *pmapi.Message { return m.msg }
+func (m *fakeSearchMessage) IsMarkedDeleted() bool   { return m.deleted }
+
+func (m *fakeSearchMessage) GetMIMEHeaderFast() textproto.MIMEHeader {
+	header := textproto.MIMEHeader{"X-Tag": {"tag-" + m.msg.ID}}
+	for key, values := range m.header {
+		header[key] = values
+	}
+	return header
+}
+
+func (m *fakeSearchMessage) GetRFC822Size() (uint32, error) { return m.size, nil }
+
+func (m *fakeSearchMessage) GetIndexedText() (*store.IndexedText, error) {
+	m.textRead++
+	return &store.IndexedText{Header: "Subject: " + m.msg.Subject + "\n", Body: m.body}, nil
+}
+
+func newFakeSearchMessages() []*fakeSearchMessage {
+	day := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+
+	return []*fakeSearchMessage{
+		{
+			uid: 3, size: 100, body: "lunch on friday",
+			msg: &pmapi.Message{
+				ID: "a", Subject: "Lunch", Time: day, Flags: pmapi.FlagReceived | pmapi.FlagOpened,
+				Sender:   &mail.Address{Address: "alice@pm.me"},
+				LabelIDs: []string{pmapi.InboxLabel, pmapi.StarredLabel},
+			},
+		},
+		{
+			uid: 5, size: 2000, body: "the report is attached", deleted: true,
+			msg: &pmapi.Message{
+				ID: "b", Subject: "Report", Time: day + 86400, Flags: pmapi.FlagReceived, Unread: true,
+				Sender:   &mail.Address{Address: "bob@pm.me"},
+				LabelIDs: []string{pmapi.InboxLabel},
+			},
+		},
+		{
+			uid: 8, size: 500, body: "spam spam spam",
+			msg: &pmapi.Message{
+				ID: "c", Subject: "Offer", Time: day + 2*86400, Flags: pmapi.FlagReceived | pmapi.FlagOpened,
+				Sender:   &mail.Address{Address: "carol@example.com"},
+				LabelIDs: []string{pmapi.SpamLabel},
+			},
+		},
+	}
+}
+
+func search(t *testing.T, messages []*fakeSearchMessage, query string) (ids []string) {
+	criteria := imap.NewSearchCriteria()
+
+	fields, err := imap.NewReader(bufio.NewReader(strings.NewReader("(" + query + ")\r\n"))).ReadLine()
+	require.NoError(t, err)
+	require.NoError(t, criteria.ParseWithCharset(fields[0].([]interface{}), nil))
+
+	for i, m := range messages {
+		candidate := newSearchCandidate(m, uint32(i+1), uint32(len(messages)), messages[len(messages)-1].uid)
+		candidate.clientFlags = unidentifiedProfile.getJunkFlags
+		match, err := matchSearchCriteria(candidate, criteria)
+		require.NoError(t, err)
+		if match {
+			ids = append(ids, m.msg.ID)
+		}
+	}
+
+	return ids
+}
+
+func TestSearchCriteria(t *testing.T) {
+	messages := newFakeSearchMessages()
+
+	tests := map[string][]string{
+		`ALL`:                           {"a", "b", "c"},
+		`2:*`:                           {"b", "c"},
+		`*`:                             {"c"},
+		`UID 4:*`:                       {"b", "c"},
+		`UID 9:*`:                       {"c"},
+		`SEEN`:                          {"a", "c"},
+		`UNSEEN`:                        {"b"},
+		`RECENT`:                        nil,
+		`NEW`:                           nil,
+		`OLD`:                           {"a", "b", "c"},
+		`FLAGGED`:                       {"a"},
+		`DELETED`:                       {"b"},
+		`KEYWORD $junk`:                 {"c"},
+		`NOT KEYWORD NonJunk`:           {"c"},
+		`FROM bob`:                      {"b"},
+		`OR FROM alice FROM carol`:      {"a", "c"},
+		`NOT FROM alice`:                {"b", "c"},
+		`NOT (FROM alice SEEN)`:         {"b", "c"},
+		`NOT OR FROM alice FROM bob`:    {"c"},
+		`OR (SEEN NOT FLAGGED) DELETED`: {"b", "c"},
+		`OR OR FROM alice FROM bob SUBJECT offer`: {"a", "b", "c"},
+		`ON 11-Mar-2022`:             {"b"},
+		`SINCE 11-Mar-2022`:          {"b", "c"},
+		`BEFORE 11-Mar-2022`:         {"a"},
+		`NOT BEFORE 11-Mar-2022`:     {"b", "c"},
+		`LARGER 400 SMALLER 1000`:    {"c"},
+		`OR LARGER 1000 SMALLER 200`: {"a", "b"},
+		`HEADER X-Tag tag-b`:         {"b"},
+		`HEADER X-Tag ""`:            {"a", "b", "c"},
+		`HEADER X-Missing ""`:        nil,
+		`BODY report`:                {"b"},
+		`OR BODY friday TEXT offer`:  {"a", "c"},
+		`NOT TEXT spam`:              {"a", "b"},
+	}
+
+	for query, want := range tests {
+		require.Equal(t, want, search(t, messages, query), query)
+	}
+}
+
+func TestSearchCriteriaReadsTextOnce(t *testing.T) {
+	messages := newFakeSearchMessages()
+
+	search(t, messages, `OR BODY friday (NOT BODY lunch TEXT report)`)
+
+	for _, m := range messages {
+		require.Equal(t, 1, m.textRead, m.msg.ID)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"net/mail"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/imap/sortthread"
+)
+
+const subjectBlob = `\[[^\[\]]*\]\s*`
+
+//nolint:gochecknoglobals
+var (
+	subjectTrailer = regexp.MustCompile(`(?i)(\s|\(fwd\))+$`)
+	subjectLeader  = regexp.MustCompile(`(?i)^(` + subjectBlob + `)*(re|fwd?)\s*(` + subjectBlob + `)?:\s*`)
+	subjectBlobRE  = regexp.MustCompile(`^` + subjectBlob)
+	subjectFwd     = regexp.MustCompile(`(?i)^\[fwd:(.*)\]$`)
+)
+
+// SortMessages returns the messages matching the search criteria sorted as
+// described in RFC 5256. The messages which are equal for all sort criteria
+// are kept in the mailbox order.
+func (im *imapMailbox) SortMessages(isUID bool, sortCriteria []sortthread.SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	var ids []uint32
+	err := im.logCommand(func() error {
+		candidates, err := im.searchCandidates(searchCriteria)
+		if err != nil {
+			return err
+		}
+		if err := sortCandidates(candidates, sortCriteria); err != nil {
+			return err
+		}
+		ids, err = getCandidateIDs(isUID, candidates)
+		return err
+	}, "SORT", isUID, sortCriteria)
+	return ids, err
+}
+
+// sortKey is the value of a message for one sort criterion. Numbers and
+// strings are compared, only one of them is set.
+type sortKey struct {
+	num int64
+	str string
+}
+
+func compareSortKeys(a, b sortKey) int {
+	switch {
+	case a.num < b.num:
+		return -1
+	case a.num > b.num:
+		return 1
+	}
+	return strings.Compare(a.str, b.str)
+}
+
+func sortCandidates(candidates []*searchCandidate, criteria []sortthread.SortCriterion) error {
+	keys := make(map[*searchCandidate][]sortKey, len(candidates))
+	for _, candidate := range candidates {
+		for _, criterion := range criteria {
+			key, err := getSortKey(candidate, criterion.Field)
+			if err != nil {
+				return err
+			}
+			keys[candidate] = append(keys[candidate], key)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		for k, criterion := range criteria {
+			cmp := compareSortKeys(keys[candidates[i]][k], keys[candidates[j]][k])
+			if criterion.Reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+
+	return nil
+}
+
+func getSortKey(c *searchCandidate, field sortthread.SortField) (sortKey, error) {
+	m := c.msg.Message()
+
+	switch field {
+	case sortthread.SortArrival:
+		return sortKey{num: m.Time}, nil
+	case sortthread.SortDate:
+		return sortKey{num: c.getSentDate().Unix()}, nil
+	case sortthread.SortFrom:
+		return sortKey{str: getSortAddress([]*mail.Address{m.Sender})}, nil
+	case sortthread.SortTo:
+		return sortKey{str: getSortAddress(m.ToList)}, nil
+	case sortthread.SortCc:
+		return sortKey{str: getSortAddress(m.CCList)}, nil
+	case sortthread.SortSize:
+		size, err := c.getSize()
+		return sortKey{num: int64(size)}, err
+	case sortthread.SortSubject:
+		subject, _ := getBaseSubject(m.Subject)
+		return sortKey{str: subject}, nil
+	}
+
+	return sortKey{}, nil
+}
+
+// getSortAddress returns the lowercase local part of the first address.
+func getSortAddress(addresses []*mail.Address) string {
+	for _, address := range addresses {
+		if address == nil {
+			continue
+		}
+		mailbox := address.Address
+		if at := strings.LastIndex(mailbox, "@"); at >= 0 {
+			mailbox = mailbox[:at]
+		}
+		return strings.ToLower(mailbox)
+	}
+	return ""
+}
+
+// getBaseSubject extracts the base subject as described in RFC 5256 section
+// 2.1, in lowercase so that it can be compared. It also returns whether the
+// subject is of a reply or a forward.
+func getBaseSubject(subject string) (base string, isReplyOrForward bool) {
+	base = strings.Join(strings.Fields(subject), " ")
+
+	for {
+		if loc := subjectTrailer.FindStringIndex(base); loc != nil {
+			isReplyOrForward = isReplyOrForward || strings.Contains(strings.ToLower(base[loc[0]:]), "(fwd)")
+			base = base[:loc[0]]
+		}
+
+		for {
+			base = strings.TrimLeft(base, " ")
+			if loc := subjectLeader.FindStringIndex(base); loc != nil {
+				base = base[loc[1]:]
+				isReplyOrForward = true
+				continue
+			}
+			if loc := subjectBlobRE.FindStringIndex(base); loc != nil && loc[1] < len(base) {
+				base = base[loc[1]:]
+				continue
+			}
+			break
+		}
+
+		if match := subjectFwd.FindStringSubmatch(base); match != nil {
+			base = match[1]
+			isReplyOrForward = true
+			continue
+		}
+
+		return strings.ToLower(base), isReplyOrForward
+	}
+}
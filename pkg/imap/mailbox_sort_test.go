@@ -0,0 +1,93 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"net/textproto"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/imap/sortthread"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBaseSubject(t *testing.T) {
+	for subject, want := range map[string]struct {
+		base    string
+		isReply bool
+	}{
+		"Lunch":                          {"lunch", false},
+		"  Lunch   on\tFriday ":          {"lunch on friday", false},
+		"Re: Lunch":                      {"lunch", true},
+		"RE: re[2]: Lunch":               {"lunch", true},
+		"Fwd: [list] Re: Lunch (fwd)":    {"lunch", true},
+		"Lunch (FWD) ":                   {"lunch", true},
+		"[fwd: Re: Lunch]":               {"lunch", true},
+		"[PATCH] Fix the build":          {"fix the build", false},
+		"[PATCH 1/2] [v2] Fix the build": {"fix the build", false},
+		"[announce]":                     {"[announce]", false},
+		"Reply needed":                   {"reply needed", false},
+		"":                               {"", false},
+	} {
+		base, isReply := getBaseSubject(subject)
+		require.Equal(t, want.base, base, subject)
+		require.Equal(t, want.isReply, isReply, subject)
+	}
+}
+
+func newCandidates(messages []*fakeSearchMessage) []*searchCandidate {
+	candidates := []*searchCandidate{}
+	for i, m := range messages {
+		candidates = append(candidates, newSearchCandidate(m, uint32(i+1), uint32(len(messages)), messages[len(messages)-1].uid))
+	}
+	return candidates
+}
+
+func sortIDs(t *testing.T, messages []*fakeSearchMessage, criteria ...sortthread.SortCriterion) []string {
+	candidates := newCandidates(messages)
+	require.NoError(t, sortCandidates(candidates, criteria))
+
+	ids := []string{}
+	for _, candidate := range candidates {
+		ids = append(ids, candidate.msg.Message().ID)
+	}
+	return ids
+}
+
+func TestSortCandidates(t *testing.T) {
+	messages := newFakeSearchMessages()
+
+	// Message c was sent before the others but delivered last.
+	messages[2].header = textproto.MIMEHeader{"Date": {"Tue, 01 Mar 2022 10:00:00 +0000"}}
+
+	for _, tc := range []struct {
+		criteria []sortthread.SortCriterion
+		want     []string
+	}{
+		{[]sortthread.SortCriterion{{Field: sortthread.SortArrival}}, []string{"a", "b", "c"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortArrival, Reverse: true}}, []string{"c", "b", "a"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortDate}}, []string{"c", "a", "b"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortSize}}, []string{"a", "c", "b"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortFrom, Reverse: true}}, []string{"c", "b", "a"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortSubject}}, []string{"a", "c", "b"}},
+		// All messages are equal, the mailbox order is kept.
+		{[]sortthread.SortCriterion{{Field: sortthread.SortTo}}, []string{"a", "b", "c"}},
+		{[]sortthread.SortCriterion{{Field: sortthread.SortCc, Reverse: true}, {Field: sortthread.SortSize, Reverse: true}}, []string{"b", "c", "a"}},
+	} {
+		require.Equal(t, tc.want, sortIDs(t, messages, tc.criteria...), tc.criteria)
+	}
+}
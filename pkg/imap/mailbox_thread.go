@@ -0,0 +1,353 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/imap/sortthread"
+)
+
+//nolint:gochecknoglobals
+var messageIDRE = regexp.MustCompile(`<[^<>]+>`)
+
+// ThreadMessages returns the threads of the messages matching the search
+// criteria built by the given algorithm of RFC 5256.
+func (im *imapMailbox) ThreadMessages(isUID bool, algorithm sortthread.ThreadAlgorithm, searchCriteria *imap.SearchCriteria) ([]*sortthread.Thread, error) {
+	var threads []*sortthread.Thread
+	err := im.logCommand(func() error {
+		candidates, err := im.searchCandidates(searchCriteria)
+		if err != nil {
+			return err
+		}
+
+		var roots []*threadContainer
+		switch algorithm {
+		case sortthread.OrderedSubject:
+			roots = threadByOrderedSubject(candidates)
+		case sortthread.References:
+			roots = threadByReferences(candidates)
+		}
+
+		threads, err = getThreads(isUID, roots)
+		return err
+	}, "THREAD", isUID, algorithm)
+	return threads, err
+}
+
+// threadContainer is a node of a thread. The dummy containers, standing for
+// the messages which are referenced but not in the mailbox, have no
+// candidate.
+type threadContainer struct {
+	candidate *searchCandidate
+	parent    *threadContainer
+	children  []*threadContainer
+}
+
+func (tc *threadContainer) isDummy() bool {
+	return tc.candidate == nil
+}
+
+// getFirst returns the candidate of the container, or of its first child for
+// dummy containers.
+func (tc *threadContainer) getFirst() *searchCandidate {
+	for tc.isDummy() && len(tc.children) != 0 {
+		tc = tc.children[0]
+	}
+	return tc.candidate
+}
+
+func (tc *threadContainer) addChild(child *threadContainer) {
+	child.parent = tc
+	tc.children = append(tc.children, child)
+}
+
+func (tc *threadContainer) removeChild(child *threadContainer) {
+	for i, c := range tc.children {
+		if c == child {
+			tc.children = append(tc.children[:i:i], tc.children[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+}
+
+// hasDescendant returns whether other is the container or one of its
+// descendants.
+func (tc *threadContainer) hasDescendant(other *threadContainer) bool {
+	for ; other != nil; other = other.parent {
+		if other == tc {
+			return true
+		}
+	}
+	return false
+}
+
+// sortThreadContainers sorts the containers and all their descendants by the
+// sent date, keeping the mailbox order for the same dates.
+func sortThreadContainers(containers []*threadContainer) {
+	for _, tc := range containers {
+		sortThreadContainers(tc.children)
+	}
+
+	sort.SliceStable(containers, func(i, j int) bool {
+		a, b := containers[i].getFirst(), containers[j].getFirst()
+		if a == nil || b == nil {
+			return b != nil
+		}
+		dateA, dateB := a.getSentDate(), b.getSentDate()
+		if !dateA.Equal(dateB) {
+			return dateA.Before(dateB)
+		}
+		return a.seqNum < b.seqNum
+	})
+}
+
+// threadByOrderedSubject groups the messages with the same base subject.
+// The first message of the group is the parent of all the others.
+func threadByOrderedSubject(candidates []*searchCandidate) []*threadContainer {
+	subjects := []string{}
+	groups := map[string][]*threadContainer{}
+	for _, candidate := range candidates {
+		subject, _ := getBaseSubject(candidate.msg.Message().Subject)
+		if _, ok := groups[subject]; !ok {
+			subjects = append(subjects, subject)
+		}
+		groups[subject] = append(groups[subject], &threadContainer{candidate: candidate})
+	}
+
+	roots := []*threadContainer{}
+	for _, subject := range subjects {
+		members := groups[subject]
+		sortThreadContainers(members)
+		for _, member := range members[1:] {
+			members[0].addChild(member)
+		}
+		roots = append(roots, members[0])
+	}
+
+	sortThreadContainers(roots)
+	return roots
+}
+
+// getReferences returns the message IDs from References, or the first one
+// from In-Reply-To if there are no References.
+func getReferences(c *searchCandidate) []string {
+	header := c.getHeader()
+	if references := messageIDRE.FindAllString(header.Get("References"), -1); len(references) != 0 {
+		return references
+	}
+	if inReplyTo := messageIDRE.FindString(header.Get("In-Reply-To")); inReplyTo != "" {
+		return []string{inReplyTo}
+	}
+	return nil
+}
+
+// threadByReferences implements the REFERENCES algorithm of RFC 5256,
+// section 4, which builds the threads from the References and In-Reply-To
+// header fields and merges the threads with the same base subject.
+func threadByReferences(candidates []*searchCandidate) []*threadContainer { //nolint[funlen]
+	// Step 1: link the messages to their references.
+	containers := []*threadContainer{}
+	byID := map[string]*threadContainer{}
+	getContainer := func(id string) *threadContainer {
+		tc, ok := byID[id]
+		if !ok {
+			tc = &threadContainer{}
+			byID[id] = tc
+			containers = append(containers, tc)
+		}
+		return tc
+	}
+
+	for _, candidate := range candidates {
+		// Messages without a Message-ID or with a duplicate one are
+		// treated as having a unique one.
+		var tc *threadContainer
+		if id := messageIDRE.FindString(candidate.getHeader().Get("Message-Id")); id != "" {
+			tc = getContainer(id)
+		}
+		if tc == nil || !tc.isDummy() {
+			tc = &threadContainer{}
+			containers = append(containers, tc)
+		}
+		tc.candidate = candidate
+
+		var parent *threadContainer
+		for _, reference := range getReferences(candidate) {
+			ref := getContainer(reference)
+			if parent != nil && ref.parent == nil && !ref.hasDescendant(parent) {
+				parent.addChild(ref)
+			}
+			parent = ref
+		}
+
+		if tc.parent != nil {
+			tc.parent.removeChild(tc)
+		}
+		if parent != nil && !tc.hasDescendant(parent) {
+			parent.addChild(tc)
+		}
+	}
+
+	// Step 2: gather the root set.
+	roots := []*threadContainer{}
+	for _, tc := range containers {
+		if tc.parent == nil {
+			roots = append(roots, tc)
+		}
+	}
+
+	// Step 4: prune the dummy containers.
+	roots = pruneThreadContainers(nil, roots)
+	sortThreadContainers(roots)
+
+	// Step 5: group the root set by the base subject.
+	roots = mergeThreadsBySubject(roots)
+
+	// Step 6: sort the threads.
+	sortThreadContainers(roots)
+	return roots
+}
+
+// pruneThreadContainers removes the dummy containers without children and
+// replaces the other dummy containers with their children, unless that would
+// make several children roots.
+func pruneThreadContainers(parent *threadContainer, containers []*threadContainer) []*threadContainer {
+	pruned := []*threadContainer{}
+	for _, tc := range containers {
+		tc.children = pruneThreadContainers(tc, tc.children)
+
+		if tc.isDummy() && (parent != nil || len(tc.children) <= 1) {
+			for _, child := range tc.children {
+				child.parent = parent
+			}
+			pruned = append(pruned, tc.children...)
+			continue
+		}
+
+		pruned = append(pruned, tc)
+	}
+	return pruned
+}
+
+// mergeThreadsBySubject merges the threads whose roots have the same base
+// subject, as described in step 5 of the REFERENCES algorithm.
+func mergeThreadsBySubject(roots []*threadContainer) []*threadContainer { //nolint[funlen]
+	getSubject := func(tc *threadContainer) (string, bool) {
+		if first := tc.getFirst(); first != nil {
+			return getBaseSubject(first.msg.Message().Subject)
+		}
+		return "", false
+	}
+	isReply := func(tc *threadContainer) bool {
+		if tc.isDummy() {
+			return false
+		}
+		_, isReply := getBaseSubject(tc.candidate.msg.Message().Subject)
+		return isReply
+	}
+
+	subjects := map[string]*threadContainer{}
+	for _, root := range roots {
+		subject, _ := getSubject(root)
+		if subject == "" {
+			continue
+		}
+		old, ok := subjects[subject]
+		if !ok || (!old.isDummy() && (root.isDummy() || (isReply(old) && !isReply(root)))) {
+			subjects[subject] = root
+		}
+	}
+
+	merged := []*threadContainer{}
+	removed := map[*threadContainer]bool{}
+	replaced := map[*threadContainer]*threadContainer{}
+
+	for _, root := range roots {
+		if removed[root] || replaced[root] != nil {
+			continue
+		}
+
+		subject, _ := getSubject(root)
+		other, ok := subjects[subject]
+		if subject == "" || !ok || other == root {
+			continue
+		}
+
+		switch {
+		case other.isDummy() && root.isDummy():
+			for _, child := range root.children {
+				other.addChild(child)
+			}
+			root.children = nil
+		case other.isDummy():
+			other.addChild(root)
+		case root.isDummy():
+			root.addChild(other)
+			removed[other] = true
+			subjects[subject] = root
+			continue
+		case !isReply(other) && isReply(root):
+			other.addChild(root)
+		default:
+			dummy := &threadContainer{}
+			replaced[other] = dummy
+			dummy.addChild(other)
+			dummy.addChild(root)
+			subjects[subject] = dummy
+		}
+		removed[root] = true
+	}
+
+	for _, root := range roots {
+		if removed[root] {
+			continue
+		}
+		if dummy, ok := replaced[root]; ok {
+			root = dummy
+		}
+		merged = append(merged, root)
+	}
+	return merged
+}
+
+// getThreads converts the containers to the threads of UIDs if isUID is set
+// to true, or of sequence numbers otherwise.
+func getThreads(isUID bool, containers []*threadContainer) ([]*sortthread.Thread, error) {
+	threads := []*sortthread.Thread{}
+	for _, tc := range containers {
+		thread := &sortthread.Thread{}
+		if !tc.isDummy() {
+			ids, err := getCandidateIDs(isUID, []*searchCandidate{tc.candidate})
+			if err != nil {
+				return nil, err
+			}
+			thread.Num = ids[0]
+		}
+
+		var err error
+		if thread.Children, err = getThreads(isUID, tc.children); err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, nil
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package imap
+
+import (
+	"bytes"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/imap/sortthread"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func newFakeThreadMessages() []*fakeSearchMessage {
+	day := time.Date(2022, 3, 10, 12, 0, 0, 0, time.UTC).Unix()
+
+	messages := []*fakeSearchMessage{}
+	for i, m := range []struct {
+		subject string
+		header  textproto.MIMEHeader
+	}{
+		{"Plan", textproto.MIMEHeader{"Message-Id": {"<1@pm.me>"}}},
+		{"Re: Plan", textproto.MIMEHeader{"Message-Id": {"<2@pm.me>"}, "References": {"<1@pm.me>"}}},
+		{"Re: Plan", textproto.MIMEHeader{"Message-Id": {"<3@pm.me>"}, "In-Reply-To": {"<1@pm.me> (Alice)"}}},
+		{"Re: Plan", textproto.MIMEHeader{"Message-Id": {"<4@pm.me>"}, "References": {"<1@pm.me>\r\n <2@pm.me>"}}},
+		{"Lunch", textproto.MIMEHeader{"Message-Id": {"<5@pm.me>"}, "References": {"<missing@pm.me>"}}},
+		{"Re: Lunch", textproto.MIMEHeader{"Message-Id": {"<6@pm.me>"}, "References": {"<missing@pm.me>"}}},
+		{"Other", nil},
+		{"Re: Other", textproto.MIMEHeader{"Message-Id": {"<5@pm.me>"}}},
+	} {
+		messages = append(messages, &fakeSearchMessage{
+			uid:    uint32(10 + i),
+			header: m.header,
+			msg: &pmapi.Message{
+				ID:      string(rune('a' + i)),
+				Subject: m.subject,
+				Time:    day + int64(i)*3600,
+			},
+		})
+	}
+
+	// The first reply was delivered last.
+	messages[1].msg.Time = day + 24*3600
+
+	return messages
+}
+
+func formatThreads(t *testing.T, roots []*threadContainer, isUID bool) string {
+	threads, err := getThreads(isUID, roots)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	require.NoError(t, (&sortthread.ThreadResponse{Threads: threads}).WriteTo(imap.NewWriter(&b)))
+	return b.String()
+}
+
+func TestThreadByOrderedSubject(t *testing.T) {
+	roots := threadByOrderedSubject(newCandidates(newFakeThreadMessages()))
+
+	require.Equal(t, "* THREAD (1 (3)(4)(2))(5 6)(7 8)\r\n", formatThreads(t, roots, false))
+	require.Equal(t, "* THREAD (10 (12)(13)(11))(14 15)(16 17)\r\n", formatThreads(t, roots, true))
+}
+
+func TestThreadByReferences(t *testing.T) {
+	roots := threadByReferences(newCandidates(newFakeThreadMessages()))
+
+	// Message 8 has a duplicate Message-ID and no references, it is joined
+	// to message 7 by the subject.
+	require.Equal(t, "* THREAD (1 (3)(2 4))((5)(6))(7 8)\r\n", formatThreads(t, roots, false))
+}
+
+func TestThreadByReferencesLoop(t *testing.T) {
+	messages := newFakeThreadMessages()[:2]
+	messages[0].header["References"] = []string{"<2@pm.me>"}
+
+	roots := threadByReferences(newCandidates(messages))
+
+	require.Equal(t, "* THREAD (2 1)\r\n", formatThreads(t, roots, false))
+}
+
+func TestThreadNoMessages(t *testing.T) {
+	require.Equal(t, "* THREAD\r\n", formatThreads(t, threadByReferences(nil), false))
+}
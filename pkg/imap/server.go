@@ -33,7 +33,12 @@ import (
 	"github.com/emersion/go-imap/backend"
 	imapserver "github.com/emersion/go-imap/server"
 	"github.com/emersion/go-sasl"
+	"github.com/ljanyst/peroxide/pkg/imap/compress"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
+	"github.com/ljanyst/peroxide/pkg/imap/esearch"
 	"github.com/ljanyst/peroxide/pkg/imap/idle"
+	"github.com/ljanyst/peroxide/pkg/imap/listextended"
+	"github.com/ljanyst/peroxide/pkg/imap/sortthread"
 	"github.com/ljanyst/peroxide/pkg/imap/uidplus"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/serverutil"
@@ -43,6 +48,7 @@ import (
 type Server struct {
 	debugClient bool
 	debugServer bool
+	useSSL      bool
 	address     string
 	port        int
 
@@ -50,11 +56,23 @@ type Server struct {
 	controller serverutil.Controller
 }
 
+// serverUpdater is a backend sending the updates to the connections of the
+// servers by itself.
+type serverUpdater interface {
+	addServer(*imapserver.Server)
+}
+
 // NewIMAPServer constructs a new IMAP server configured with the given options.
+// With useSSL, the server speaks TLS from the start (IMAPS), otherwise it
+// offers STARTTLS. Unless allowInsecureAuth is set, clients must switch to TLS
+// before they can log in.
 func NewIMAPServer(
 	debugClient, debugServer bool,
 	address string,
 	port int,
+	useSSL bool,
+	allowInsecureAuth bool,
+	allowCompression bool,
 	tls *tls.Config,
 	imapBackend backend.Backend,
 	eventListener listener.Listener,
@@ -62,19 +80,23 @@ func NewIMAPServer(
 	server := &Server{
 		debugClient: debugClient,
 		debugServer: debugServer,
+		useSSL:      useSSL,
 		address:     address,
 		port:        port,
 	}
 
-	server.server = newGoIMAPServer(tls, imapBackend, server.Address())
+	server.server = newGoIMAPServer(tls, allowInsecureAuth, allowCompression, imapBackend, server.Address())
+	if updater, ok := imapBackend.(serverUpdater); ok {
+		updater.addServer(server.server)
+	}
 	server.controller = serverutil.NewController(server, eventListener)
 	return server
 }
 
-func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *imapserver.Server {
+func newGoIMAPServer(tls *tls.Config, allowInsecureAuth, allowCompression bool, backend backend.Backend, address string) *imapserver.Server {
 	server := imapserver.New(backend)
 	server.TLSConfig = tls
-	server.AllowInsecureAuth = true
+	server.AllowInsecureAuth = allowInsecureAuth
 	server.ErrorLog = serverutil.NewServerErrorLogger(serverutil.IMAP)
 	server.AutoLogout = 30 * time.Minute
 	server.Addr = address
@@ -93,15 +115,32 @@ func newGoIMAPServer(tls *tls.Config, backend backend.Backend, address string) *
 		})
 	})
 
+	moveExtension := imapmove.NewExtension()
+	unselectExtension := imapunselect.NewExtension()
+	uidplusExtension := uidplus.NewExtension()
+	condstoreExtension := condstore.NewExtension()
+
 	server.Enable(
+		// The saved search result is passed on to the commands of the
+		// extensions enabled after it.
+		esearch.NewExtension(moveExtension, unselectExtension, uidplusExtension, condstoreExtension),
 		idle.NewExtension(),
-		imapmove.NewExtension(),
+		moveExtension,
 		imapquota.NewExtension(),
 		imapappendlimit.NewExtension(),
-		imapunselect.NewExtension(),
-		uidplus.NewExtension(),
+		unselectExtension,
+		uidplusExtension,
+		condstoreExtension,
+		sortthread.NewExtension(),
+		listextended.NewExtension(),
+		newIDExtension(),
 	)
 
+	// Phones on metered links download the headers and bodies compressed.
+	if allowCompression {
+		server.Enable(compress.NewExtension())
+	}
+
 	return server
 }
 
@@ -114,7 +153,7 @@ func (s *Server) Close() { s.controller.Close() }
 // Implements serverutil.Server interface.
 
 func (Server) Protocol() serverutil.Protocol { return serverutil.IMAP }
-func (s *Server) UseSSL() bool               { return false }
+func (s *Server) UseSSL() bool               { return s.useSSL }
 func (s *Server) Address() string            { return fmt.Sprintf("%s:%d", s.address, s.port) }
 func (s *Server) TLSConfig() *tls.Config     { return s.server.TLSConfig }
 
@@ -0,0 +1,185 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package sortthread
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/server"
+)
+
+// parseSearchCriteria parses the charset and the search criteria which
+// follow the sort criteria or the threading algorithm.
+func parseSearchCriteria(fields []interface{}) (*imap.SearchCriteria, error) {
+	if len(fields) < 2 {
+		return nil, errors.New("missing charset or search criteria")
+	}
+
+	charset, ok := fields[0].(string)
+	if !ok {
+		return nil, errors.New("charset must be a string")
+	}
+
+	var charsetReader func(io.Reader) io.Reader
+	charset = strings.ToLower(charset)
+	if charset != "utf-8" && charset != "us-ascii" {
+		charsetReader = func(r io.Reader) io.Reader {
+			r, _ = imap.CharsetReader(charset, r)
+			return r
+		}
+	}
+
+	criteria := new(imap.SearchCriteria)
+	if err := criteria.ParseWithCharset(fields[1:], charsetReader); err != nil {
+		return nil, err
+	}
+	return criteria, nil
+}
+
+func getMailbox(conn server.Conn) (Mailbox, error) {
+	ctx := conn.Context()
+	if ctx.Mailbox == nil {
+		return nil, server.ErrNoMailboxSelected
+	}
+
+	mbox, ok := ctx.Mailbox.(Mailbox)
+	if !ok {
+		return nil, errors.New("sorting and threading are not supported by this mailbox")
+	}
+	return mbox, nil
+}
+
+// SortCommand is the SORT command of RFC5256.
+type SortCommand struct {
+	SortCriteria   []SortCriterion
+	SearchCriteria *imap.SearchCriteria
+}
+
+func (cmd *SortCommand) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("missing sort criteria")
+	}
+
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("sort criteria must be a non-empty list")
+	}
+
+	reverse := false
+	for _, f := range list {
+		key, ok := f.(string)
+		if !ok {
+			return errors.New("sort key must be an atom")
+		}
+
+		field := SortField(strings.ToUpper(key))
+		switch field {
+		case reverseKey:
+			reverse = true
+			continue
+		case SortArrival, SortCc, SortDate, SortFrom, SortSize, SortSubject, SortTo:
+		default:
+			return errors.New("unknown sort key: " + key)
+		}
+
+		cmd.SortCriteria = append(cmd.SortCriteria, SortCriterion{Field: field, Reverse: reverse})
+		reverse = false
+	}
+	if reverse {
+		return errors.New("missing sort key after REVERSE")
+	}
+
+	var err error
+	cmd.SearchCriteria, err = parseSearchCriteria(fields[1:])
+	return err
+}
+
+func (cmd *SortCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *SortCommand) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	return cmd.handle(true, conn)
+}
+
+func (cmd *SortCommand) handle(uid bool, conn server.Conn) error {
+	mbox, err := getMailbox(conn)
+	if err != nil {
+		return err
+	}
+
+	nums, err := mbox.SortMessages(uid, cmd.SortCriteria, cmd.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&SortResponse{Nums: nums})
+}
+
+// ThreadCommand is the THREAD command of RFC5256.
+type ThreadCommand struct {
+	Algorithm      ThreadAlgorithm
+	SearchCriteria *imap.SearchCriteria
+}
+
+func (cmd *ThreadCommand) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("missing threading algorithm")
+	}
+
+	algorithm, ok := fields[0].(string)
+	if !ok {
+		return errors.New("threading algorithm must be an atom")
+	}
+
+	cmd.Algorithm = ThreadAlgorithm(strings.ToUpper(algorithm))
+	switch cmd.Algorithm {
+	case OrderedSubject, References:
+	default:
+		return errors.New("unknown threading algorithm: " + algorithm)
+	}
+
+	var err error
+	cmd.SearchCriteria, err = parseSearchCriteria(fields[1:])
+	return err
+}
+
+func (cmd *ThreadCommand) Handle(conn server.Conn) error {
+	return cmd.handle(false, conn)
+}
+
+func (cmd *ThreadCommand) UidHandle(conn server.Conn) error { //nolint:revive,stylecheck
+	return cmd.handle(true, conn)
+}
+
+func (cmd *ThreadCommand) handle(uid bool, conn server.Conn) error {
+	mbox, err := getMailbox(conn)
+	if err != nil {
+		return err
+	}
+
+	threads, err := mbox.ThreadMessages(uid, cmd.Algorithm, cmd.SearchCriteria)
+	if err != nil {
+		return err
+	}
+
+	return conn.WriteResp(&ThreadResponse{Threads: threads})
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+// Package sortthread implements the SORT and THREAD extensions of RFC5256
+// with the ORDEREDSUBJECT and REFERENCES threading algorithms.
+//
+// The messages are sorted and threaded by the mailbox, the extension only
+// parses the commands and writes the responses.
+package sortthread
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/server"
+)
+
+// Capability extension identifiers.
+const (
+	SortCapability                 = "SORT"
+	ThreadOrderedSubjectCapability = "THREAD=" + string(OrderedSubject)
+	ThreadReferencesCapability     = "THREAD=" + string(References)
+	sortName                       = "SORT"
+	threadName                     = "THREAD"
+	reverseKey                     = "REVERSE"
+)
+
+// SortField is the sort key of RFC5256.
+type SortField string
+
+// The supported sort keys.
+const (
+	SortArrival SortField = "ARRIVAL"
+	SortCc      SortField = "CC"
+	SortDate    SortField = "DATE"
+	SortFrom    SortField = "FROM"
+	SortSize    SortField = "SIZE"
+	SortSubject SortField = "SUBJECT"
+	SortTo      SortField = "TO"
+)
+
+// SortCriterion is a sort key, optionally in the reverse order.
+type SortCriterion struct {
+	Field   SortField
+	Reverse bool
+}
+
+// ThreadAlgorithm is the threading algorithm of RFC5256.
+type ThreadAlgorithm string
+
+// The supported threading algorithms.
+const (
+	OrderedSubject ThreadAlgorithm = "ORDEREDSUBJECT"
+	References     ThreadAlgorithm = "REFERENCES"
+)
+
+// Thread is a message and its replies. The Num of the dummy messages, which
+// stand for the missing parents of several replies, is zero.
+type Thread struct {
+	Num      uint32
+	Children []*Thread
+}
+
+// format returns the thread as the parenthesized list of RFC5256. A message
+// with a single reply is followed by the reply directly, several replies are
+// nested lists.
+func (t *Thread) format() string {
+	members := []string{}
+	node := t
+	for node.Num != 0 {
+		members = append(members, strconv.FormatUint(uint64(node.Num), 10))
+		if len(node.Children) != 1 {
+			break
+		}
+		node = node.Children[0]
+	}
+
+	nested := ""
+	for _, child := range node.Children {
+		nested += child.format()
+	}
+	if nested != "" {
+		members = append(members, nested)
+	}
+
+	return "(" + strings.Join(members, " ") + ")"
+}
+
+// Mailbox is a mailbox which can sort and thread its messages.
+type Mailbox interface {
+	backend.Mailbox
+
+	// SortMessages returns the messages matching searchCriteria sorted by
+	// sortCriteria. The returned list must contain UIDs if uid is set to
+	// true, or sequence numbers otherwise.
+	SortMessages(uid bool, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error)
+
+	// ThreadMessages returns the threads of the messages matching
+	// searchCriteria. The threads must contain UIDs if uid is set to true,
+	// or sequence numbers otherwise.
+	ThreadMessages(uid bool, algorithm ThreadAlgorithm, searchCriteria *imap.SearchCriteria) ([]*Thread, error)
+}
+
+// SortResponse is the SORT response with the sorted messages.
+type SortResponse struct {
+	Nums []uint32
+}
+
+func (r *SortResponse) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(sortName)}
+	for _, num := range r.Nums {
+		fields = append(fields, num)
+	}
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+// ThreadResponse is the THREAD response with the threads of messages.
+type ThreadResponse struct {
+	Threads []*Thread
+}
+
+func (r *ThreadResponse) WriteTo(w *imap.Writer) error {
+	fields := []interface{}{imap.RawString(threadName)}
+
+	threads := ""
+	for _, thread := range r.Threads {
+		threads += thread.format()
+	}
+	if threads != "" {
+		fields = append(fields, imap.RawString(threads))
+	}
+
+	return imap.NewUntaggedResp(fields).WriteTo(w)
+}
+
+type extension struct{}
+
+// NewExtension of SORT and THREAD.
+func NewExtension() server.Extension {
+	return &extension{}
+}
+
+func (ext *extension) Capabilities(c server.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{SortCapability, ThreadOrderedSubjectCapability, ThreadReferencesCapability}
+	}
+	return nil
+}
+
+func (ext *extension) Command(name string) server.HandlerFactory {
+	switch name {
+	case sortName:
+		return func() server.Handler { return &SortCommand{} }
+	case threadName:
+		return func() server.Handler { return &ThreadCommand{} }
+	}
+
+	return nil
+}
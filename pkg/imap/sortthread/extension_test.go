@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package sortthread
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+)
+
+func readFields(t *testing.T, args string) []interface{} {
+	fields, err := imap.NewReader(bufio.NewReader(strings.NewReader(args + "\r\n"))).ReadLine()
+	require.NoError(t, err)
+	return fields
+}
+
+func TestParseSort(t *testing.T) {
+	cmd := &SortCommand{}
+	require.NoError(t, cmd.Parse(readFields(t, "(REVERSE date subject) UTF-8 SINCE 1-Feb-1994 UNSEEN")))
+
+	require.Equal(t, []SortCriterion{
+		{Field: SortDate, Reverse: true},
+		{Field: SortSubject},
+	}, cmd.SortCriteria)
+	require.False(t, cmd.SearchCriteria.Since.IsZero())
+	require.Equal(t, []string{imap.SeenFlag}, cmd.SearchCriteria.WithoutFlags)
+
+	for _, args := range []string{
+		"",
+		"() UTF-8 ALL",
+		"(REVERSE) UTF-8 ALL",
+		"(DATE REVERSE) UTF-8 ALL",
+		"(DISPLAYFROM) UTF-8 ALL",
+		"DATE UTF-8 ALL",
+		"(DATE) UTF-8",
+	} {
+		require.Error(t, (&SortCommand{}).Parse(readFields(t, args)), args)
+	}
+}
+
+func TestParseThread(t *testing.T) {
+	cmd := &ThreadCommand{}
+	require.NoError(t, cmd.Parse(readFields(t, "references US-ASCII ALL")))
+	require.Equal(t, References, cmd.Algorithm)
+
+	require.NoError(t, cmd.Parse(readFields(t, "ORDEREDSUBJECT UTF-8 UID 1:*")))
+	require.Equal(t, OrderedSubject, cmd.Algorithm)
+	require.NotNil(t, cmd.SearchCriteria.Uid)
+
+	for _, args := range []string{
+		"",
+		"REFS UTF-8 ALL",
+		"REFERENCES UTF-8",
+	} {
+		require.Error(t, (&ThreadCommand{}).Parse(readFields(t, args)), args)
+	}
+}
+
+func TestWriteResponses(t *testing.T) {
+	for _, tc := range []struct {
+		res  imap.WriterTo
+		want string
+	}{
+		{&SortResponse{}, "* SORT\r\n"},
+		{&SortResponse{Nums: []uint32{5, 3, 4}}, "* SORT 5 3 4\r\n"},
+		{&ThreadResponse{}, "* THREAD\r\n"},
+		// Example from RFC5256 section 4.
+		{&ThreadResponse{Threads: []*Thread{
+			{Num: 2},
+			{Num: 3, Children: []*Thread{{Num: 6, Children: []*Thread{
+				{Num: 4, Children: []*Thread{{Num: 23}}},
+				{Num: 44, Children: []*Thread{{Num: 7, Children: []*Thread{{Num: 96}}}}},
+			}}}},
+		}}, "* THREAD (2)(3 6 (4 23)(44 7 96))\r\n"},
+		// Dummy parent of several replies.
+		{&ThreadResponse{Threads: []*Thread{
+			{Children: []*Thread{{Num: 3}, {Num: 5}}},
+		}}, "* THREAD ((3)(5))\r\n"},
+	} {
+		var b bytes.Buffer
+		require.NoError(t, tc.res.WriteTo(imap.NewWriter(&b)))
+		require.Equal(t, tc.want, b.String())
+	}
+}
@@ -24,6 +24,9 @@ import (
 
 	imap "github.com/emersion/go-imap"
 	goIMAPBackend "github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/ljanyst/peroxide/pkg/imap/condstore"
 	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store"
@@ -42,10 +45,38 @@ type updateHelper struct {
 	expiration time.Time
 }
 
+// messageUpdate is the go-imap message update carrying also the mod-sequence
+// of the message for the clients which have enabled CONDSTORE and the labels
+// of the message for the mailboxes exposing them as keywords.
+type messageUpdate struct {
+	goIMAPBackend.MessageUpdate
+	modSeq   uint64
+	labelIDs []string
+}
+
+// expungeUpdate is the go-imap expunge update carrying also the UID of the
+// message for the clients which have enabled QRESYNC.
+type expungeUpdate struct {
+	goIMAPBackend.ExpungeUpdate
+	uid uint32
+}
+
+// updateResponse closes done once the response is written to the client.
+type updateResponse struct {
+	imap.WriterTo
+	done chan struct{}
+}
+
+func (r *updateResponse) WriteTo(w *imap.Writer) error {
+	defer close(r.done)
+	return r.WriterTo.WriteTo(w)
+}
+
 type imapUpdates struct {
 	lock            sync.Locker
 	blocking        map[string]bool
 	delayedExpunges map[string][]chan struct{}
+	servers         []*imapserver.Server
 	chout           chan goIMAPBackend.Update
 	chin            chan updateHelper
 }
@@ -68,17 +99,133 @@ func newIMAPUpdates() *imapUpdates {
 				continue
 			}
 
-			select {
-			case iu.chout <- upd.data:
-			case <-time.After(1 * time.Second):
-				log.Warn("IMAP update could not be sent (timeout)")
-			}
+			iu.dispatch(upd.data)
 		}
 	}()
 
 	return iu
 }
 
+// addServer makes the connections of the server receive the updates.
+func (iu *imapUpdates) addServer(server *imapserver.Server) {
+	iu.lock.Lock()
+	defer iu.lock.Unlock()
+
+	iu.servers = append(iu.servers, server)
+}
+
+// dispatch sends the update to the matching connections of all servers. It
+// does what the go-imap server does with the updates of the backend, except
+// that the response is made for each connection separately, following the
+// extensions the client has enabled. The responses are sent once the lock of
+// the connections of the server is released.
+func (iu *imapUpdates) dispatch(update goIMAPBackend.Update) {
+	iu.lock.Lock()
+	servers := append([]*imapserver.Server{}, iu.servers...)
+	iu.lock.Unlock()
+
+	type target struct {
+		ctx *imapserver.Context
+		res imap.WriterTo
+	}
+
+	targets := []target{}
+	for _, server := range servers {
+		server.ForEachConn(func(conn imapserver.Conn) {
+			ctx := conn.Context()
+			if update.Username() != "" && (ctx.User == nil || ctx.User.Username() != update.Username()) {
+				return
+			}
+			if update.Mailbox() != "" && (ctx.Mailbox == nil || ctx.Mailbox.Name() != update.Mailbox()) {
+				return
+			}
+
+			// Like go-imap, do not report the flags changed by a silent STORE.
+			if _, ok := update.(*messageUpdate); ok && condstore.Silent(conn) {
+				return
+			}
+
+			var clientFlags func([]string) []string
+			if mbox, ok := ctx.Mailbox.(*imapMailbox); ok {
+				clientFlags = mbox.getClientFlags
+			}
+
+			if res := getUpdateResponse(update, condstore.Enabled(conn), condstore.QResyncEnabled(conn), clientFlags); res != nil {
+				targets = append(targets, target{ctx: ctx, res: res})
+			}
+		})
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			done := make(chan struct{})
+			t.ctx.Responses <- &updateResponse{WriterTo: t.res, done: done}
+			<-done
+		}(t)
+	}
+
+	go func() {
+		wg.Wait()
+		close(update.Done())
+	}()
+}
+
+// getUpdateResponse returns the response to the update for a connection with
+// the given extensions enabled. The clientFlags, if set, returns the junk
+// flags of the client and the keywords of the labels of the message.
+func getUpdateResponse(
+	update goIMAPBackend.Update,
+	condstoreEnabled, qresyncEnabled bool,
+	clientFlags func([]string) []string,
+) imap.WriterTo {
+	switch update := update.(type) {
+	case *goIMAPBackend.StatusUpdate:
+		return update.StatusResp
+	case *goIMAPBackend.MailboxUpdate:
+		return &responses.Select{Mailbox: update.MailboxStatus}
+	case *goIMAPBackend.MailboxInfoUpdate:
+		ch := make(chan *imap.MailboxInfo, 1)
+		ch <- update.MailboxInfo
+		close(ch)
+		return &responses.List{Mailboxes: ch}
+	case *messageUpdate:
+		msg := update.Message
+		if condstoreEnabled || clientFlags != nil {
+			items := []imap.FetchItem{imap.FetchFlags, imap.FetchUid}
+			if condstoreEnabled {
+				items = append(items, condstore.FetchModSeq)
+			}
+			msg = imap.NewMessage(msg.SeqNum, items)
+			msg.Flags = update.Message.Flags
+			if clientFlags != nil {
+				msg.Flags = append(append([]string{}, msg.Flags...), clientFlags(update.labelIDs)...)
+			}
+			msg.Uid = update.Message.Uid
+			if condstoreEnabled {
+				condstore.SetModSeq(msg, update.modSeq)
+			}
+		}
+		ch := make(chan *imap.Message, 1)
+		ch <- msg
+		close(ch)
+		return &responses.Fetch{Messages: ch}
+	case *expungeUpdate:
+		if qresyncEnabled {
+			return &condstore.Vanished{UIDs: []uint32{update.uid}}
+		}
+		ch := make(chan uint32, 1)
+		ch <- update.SeqNum
+		close(ch)
+		return &responses.Expunge{SeqNums: ch}
+	}
+
+	log.Errorf("Unhandled IMAP update: %T", update)
+	return nil
+}
+
 func (iu *imapUpdates) block(address, mailboxName string, op operation) {
 	iu.lock.Lock()
 	defer iu.lock.Unlock()
@@ -151,7 +298,7 @@ func (iu *imapUpdates) Notice(address, notice string) {
 
 func (iu *imapUpdates) UpdateMessage(
 	address, mailboxName string,
-	uid, sequenceNumber uint32,
+	uid, sequenceNumber uint32, modSeq uint64,
 	msg *pmapi.Message, hasDeletedFlag bool,
 ) {
 	log.WithFields(logrus.Fields{
@@ -159,10 +306,11 @@ func (iu *imapUpdates) UpdateMessage(
 		"mailbox": mailboxName,
 		"seqNum":  sequenceNumber,
 		"uid":     uid,
+		"modSeq":  modSeq,
 		"flags":   message.GetFlags(msg),
 		"deleted": hasDeletedFlag,
 	}).Trace("IDLE update")
-	update := new(goIMAPBackend.MessageUpdate)
+	update := &messageUpdate{modSeq: modSeq, labelIDs: msg.LabelIDs}
 	update.Update = goIMAPBackend.NewUpdate(address, mailboxName)
 	update.Message = imap.NewMessage(sequenceNumber, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
 	update.Message.Flags = message.GetFlags(msg)
@@ -173,13 +321,14 @@ func (iu *imapUpdates) UpdateMessage(
 	iu.sendIMAPUpdate(update, iu.isBlocking(address, mailboxName, operationUpdateMessage))
 }
 
-func (iu *imapUpdates) DeleteMessage(address, mailboxName string, sequenceNumber uint32) {
+func (iu *imapUpdates) DeleteMessage(address, mailboxName string, uid, sequenceNumber uint32) {
 	log.WithFields(logrus.Fields{
 		"address": address,
 		"mailbox": mailboxName,
 		"seqNum":  sequenceNumber,
+		"uid":     uid,
 	}).Trace("IDLE delete")
-	update := new(goIMAPBackend.ExpungeUpdate)
+	update := &expungeUpdate{uid: uid}
 	update.Update = goIMAPBackend.NewUpdate(address, mailboxName)
 	update.SeqNum = sequenceNumber
 	iu.sendIMAPUpdate(update, iu.isBlocking(address, mailboxName, operationDeleteMessage))
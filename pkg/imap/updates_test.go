@@ -18,9 +18,12 @@
 package imap
 
 import (
+	"bytes"
 	"testing"
 	"time"
 
+	"github.com/emersion/go-imap"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/stretchr/testify/require"
 )
 
@@ -58,3 +61,34 @@ func TestUpdatesCannotDelete(t *testing.T) {
 
 	require.True(t, duration > 200*time.Millisecond)
 }
+
+func TestUpdateMessageResponse(t *testing.T) {
+	update := &messageUpdate{modSeq: 7, labelIDs: []string{pmapi.InboxLabel, "work"}}
+	update.Message = imap.NewMessage(1, []imap.FetchItem{imap.FetchFlags, imap.FetchUid})
+	update.Message.Flags = []string{imap.SeenFlag}
+	update.Message.Uid = 42
+
+	clientFlags := func(labelIDs []string) []string {
+		require.Equal(t, update.labelIDs, labelIDs)
+		return []string{"Work"}
+	}
+
+	for _, tc := range []struct {
+		condstore   bool
+		clientFlags func([]string) []string
+		want        string
+	}{
+		{false, nil, "* 1 FETCH (FLAGS (\\Seen) UID 42)\r\n"},
+		{true, nil, "* 1 FETCH (FLAGS (\\Seen) UID 42 MODSEQ (7))\r\n"},
+		{false, clientFlags, "* 1 FETCH (FLAGS (\\Seen Work) UID 42)\r\n"},
+		{true, clientFlags, "* 1 FETCH (FLAGS (\\Seen Work) UID 42 MODSEQ (7))\r\n"},
+	} {
+		var b bytes.Buffer
+		res := getUpdateResponse(update, tc.condstore, false, tc.clientFlags)
+		require.NoError(t, res.WriteTo(imap.NewWriter(&b)))
+		require.Equal(t, tc.want, b.String())
+	}
+
+	// The original update is shared by all connections and must not change.
+	require.Equal(t, []string{imap.SeenFlag}, update.Message.Flags)
+}
@@ -54,6 +54,10 @@ type imapUser struct {
 	// not cause huge slow down as EXPUNGE is implicitly called also after
 	// UNSELECT, CLOSE, or LOGOUT.
 	appendExpungeLock sync.Mutex
+
+	// outboxUIDs are the UIDs in the Outbox the clients were told about.
+	outboxUIDs []uint32
+	outboxLock sync.Mutex
 }
 
 // newIMAPUser returns struct implementing go-imap/user interface.
@@ -119,29 +123,47 @@ func (iu *imapUser) Username() string {
 // ListMailboxes returns a list of mailboxes belonging to this user.
 // If subscribed is set to true, returns only subscribed mailboxes.
 func (iu *imapUser) ListMailboxes(showOnlySubcribed bool) ([]goIMAPBackend.Mailbox, error) {
+	return iu.listMailboxes(showOnlySubcribed, nil)
+}
+
+// listMailboxes returns the mailboxes following the profile of the client.
+func (iu *imapUser) listMailboxes(showOnlySubcribed bool, client *imapClient) ([]goIMAPBackend.Mailbox, error) {
 	mailboxes := []goIMAPBackend.Mailbox{}
 	for _, storeMailbox := range iu.storeAddress.ListMailboxes() {
-		if storeMailbox.LabelID() == pmapi.AllMailLabel && !iu.backend.isAllMailVisible {
+		if storeMailbox.LabelID() == pmapi.AllMailLabel && !iu.backend.isAllMailShown() {
 			continue
 		}
 
 		if showOnlySubcribed && !iu.isSubscribed(storeMailbox.LabelID()) {
 			continue
 		}
-		mailbox := newIMAPMailbox(iu, storeMailbox)
+		mailbox := newIMAPMailbox(iu, client, storeMailbox)
 		mailboxes = append(mailboxes, mailbox)
 	}
 
 	mailboxes = append(mailboxes, newLabelsRootMailbox())
 	mailboxes = append(mailboxes, newFoldersRootMailbox())
 
+	if iu.backend.outbox != nil {
+		mailboxes = append(mailboxes, newOutboxMailbox(iu))
+	}
+
 	log.WithField("mailboxes", mailboxes).Trace("Listing mailboxes")
 
 	return mailboxes, nil
 }
 
 // GetMailbox returns a mailbox.
-func (iu *imapUser) GetMailbox(name string) (mb goIMAPBackend.Mailbox, err error) {
+func (iu *imapUser) GetMailbox(name string) (goIMAPBackend.Mailbox, error) {
+	return iu.getMailbox(name, nil)
+}
+
+// getMailbox returns the mailbox following the profile of the client.
+func (iu *imapUser) getMailbox(name string, client *imapClient) (mb goIMAPBackend.Mailbox, err error) {
+	if name == outboxMailboxName && iu.backend.outbox != nil {
+		return newOutboxMailbox(iu), nil
+	}
+
 	storeMailbox, err := iu.storeAddress.GetMailbox(name)
 	if err != nil {
 		logMsg := log.WithField("name", name).WithError(err)
@@ -157,7 +179,7 @@ func (iu *imapUser) GetMailbox(name string) (mb goIMAPBackend.Mailbox, err error
 		return
 	}
 
-	return newIMAPMailbox(iu, storeMailbox), nil
+	return newIMAPMailbox(iu, client, storeMailbox), nil
 }
 
 // CreateMailbox creates a new mailbox.
@@ -195,6 +217,7 @@ func (iu *imapUser) Logout() (err error) {
 	log.Debug("IMAP client logged out address ", iu.storeAddress.AddressID())
 
 	iu.backend.deleteUser(iu.currentAddressLowercase)
+	connections.Dec(iu.storeUser.UserID())
 
 	return nil
 }
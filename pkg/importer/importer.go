@@ -0,0 +1,409 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package importer imports the messages of mbox files and Maildir trees to the
+// account of a user, in batches as large as the import API accepts.
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/mail"
+	"strings"
+	"sync"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-message/textproto"
+	"github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultWorkers is the number of the batches imported in parallel.
+	DefaultWorkers = 4
+
+	journalSuffix = ".import-journal"
+	forwardedFlag = "$Forwarded"
+
+	// The messages grow when they are encrypted, so the batches are made
+	// smaller and split again if needed once the messages are encrypted.
+	maxBatchSourceSize = pmapi.MaxImportMessageRequestSize / 2
+)
+
+var log = logrus.WithField("pkg", "importer") //nolint:gochecknoglobals
+
+var errMessageTooBig = errors.New("message is too big to be imported")
+
+// systemFolders are the folders of the usual mail clients and providers which
+// are imported to the system folders.
+var systemFolders = map[string]string{ //nolint:gochecknoglobals
+	"inbox":             pmapi.InboxLabel,
+	"sent":              pmapi.SentLabel,
+	"sent items":        pmapi.SentLabel,
+	"sent messages":     pmapi.SentLabel,
+	"[gmail]/sent mail": pmapi.SentLabel,
+	"drafts":            pmapi.DraftLabel,
+	"[gmail]/drafts":    pmapi.DraftLabel,
+	"trash":             pmapi.TrashLabel,
+	"deleted items":     pmapi.TrashLabel,
+	"deleted messages":  pmapi.TrashLabel,
+	"[gmail]/trash":     pmapi.TrashLabel,
+	"spam":              pmapi.SpamLabel,
+	"junk":              pmapi.SpamLabel,
+	"junk e-mail":       pmapi.SpamLabel,
+	"[gmail]/spam":      pmapi.SpamLabel,
+	"archive":           pmapi.ArchiveLabel,
+	"archives":          pmapi.ArchiveLabel,
+	"[gmail]/all mail":  pmapi.ArchiveLabel,
+}
+
+// Progress tells how many messages of the source were imported, skipped
+// because the journal says they were imported before, and failed.
+type Progress struct {
+	Imported int
+	Skipped  int
+	Failed   int
+}
+
+// Importer imports the messages to one address of the user. The other
+// folders than the system ones are imported to the custom folders, created
+// when missing.
+type Importer struct {
+	client    pmapi.Client
+	addressID string
+	workers   int
+	journal   *journal
+
+	labels     map[string]string
+	labelsLock sync.Mutex
+
+	progress     Progress
+	progressLock sync.Mutex
+}
+
+// GetJournalPath returns the default path of the journal of the source.
+func GetJournalPath(source string) string {
+	return strings.TrimRight(source, "/") + journalSuffix
+}
+
+// New returns the importer to the address, or to the primary address if
+// empty, which records the imported messages in the journal at journalPath.
+func New(client pmapi.Client, address, journalPath string, workers int) (*Importer, error) {
+	if workers < 1 {
+		workers = DefaultWorkers
+	}
+
+	addr := client.Addresses().Main()
+	if address != "" {
+		addr = client.Addresses().ByEmail(address)
+	}
+	if addr == nil {
+		return nil, errors.Errorf("address %v not found", address)
+	}
+
+	journal, err := openJournal(journalPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open the import journal")
+	}
+
+	return &Importer{
+		client:    client,
+		addressID: addr.ID,
+		workers:   workers,
+		journal:   journal,
+	}, nil
+}
+
+// Close closes the journal.
+func (im *Importer) Close() error {
+	return im.journal.close()
+}
+
+// GetProgress returns how far the import got.
+func (im *Importer) GetProgress() Progress {
+	im.progressLock.Lock()
+	defer im.progressLock.Unlock()
+
+	return im.progress
+}
+
+func (im *Importer) updateProgress(imported, skipped, failed int) {
+	im.progressLock.Lock()
+	defer im.progressLock.Unlock()
+
+	im.progress.Imported += imported
+	im.progress.Skipped += skipped
+	im.progress.Failed += failed
+}
+
+// Import imports the messages of the source which are not in the journal yet.
+// The source is streamed and the batches are imported by the parallel
+// workers. When the context is cancelled, the batches in progress are
+// finished and the import can be continued later with the same journal.
+func (im *Importer) Import(ctx context.Context, source string) error {
+	kr, err := im.client.KeyRingForAddressID(im.addressID)
+	if err != nil {
+		return err
+	}
+
+	batches := make(chan []*sourceMessage)
+	wg := &sync.WaitGroup{}
+
+	wg.Add(im.workers)
+	for i := 0; i < im.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				im.importBatch(ctx, kr, batch)
+			}
+		}()
+	}
+
+	batch := []*sourceMessage{}
+	batchSize := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		batch, batchSize = []*sourceMessage{}, 0
+		return nil
+	}
+
+	err = walkSource(source, func(msg *sourceMessage) error {
+		if im.journal.isDone(msg.key) {
+			im.updateProgress(0, 1, 0)
+			return nil
+		}
+
+		if len(batch) == pmapi.MaxImportMessageRequestLength || batchSize+len(msg.literal) > maxBatchSourceSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, msg)
+		batchSize += len(msg.literal)
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	close(batches)
+	wg.Wait()
+
+	return err
+}
+
+// importBatch imports the messages of the batch, splitting it if it is too
+// big once encrypted, and records the imported ones in the journal.
+func (im *Importer) importBatch(ctx context.Context, kr *crypto.KeyRing, batch []*sourceMessage) {
+	msgs := []*sourceMessage{}
+	reqs := pmapi.ImportMsgReqs{}
+	size := 0
+
+	flush := func() {
+		if len(reqs) > 0 {
+			im.importRequests(ctx, msgs, reqs)
+		}
+		msgs, reqs, size = []*sourceMessage{}, pmapi.ImportMsgReqs{}, 0
+	}
+
+	for _, msg := range batch {
+		req, err := im.newImportRequest(ctx, kr, msg)
+		if err != nil {
+			im.fail(msg, err)
+			continue
+		}
+
+		if size+len(req.Message) > pmapi.MaxImportMessageRequestSize {
+			flush()
+		}
+
+		msgs = append(msgs, msg)
+		reqs = append(reqs, req)
+		size += len(req.Message)
+	}
+
+	flush()
+}
+
+func (im *Importer) importRequests(ctx context.Context, msgs []*sourceMessage, reqs pmapi.ImportMsgReqs) {
+	res, err := im.client.Import(ctx, reqs)
+	if err == nil && len(res) != len(reqs) {
+		err = errors.New("unexpected number of import responses")
+	}
+	if err != nil {
+		for _, msg := range msgs {
+			im.fail(msg, err)
+		}
+		return
+	}
+
+	keys, messageIDs := []string{}, []string{}
+	for i, r := range res {
+		if r.Error != nil {
+			im.fail(msgs[i], r.Error)
+			continue
+		}
+		keys = append(keys, msgs[i].key)
+		messageIDs = append(messageIDs, r.MessageID)
+	}
+
+	if err := im.journal.record(keys, messageIDs); err != nil {
+		log.WithError(err).Error("Cannot record imported messages in the journal")
+	}
+
+	im.updateProgress(len(keys), 0, 0)
+}
+
+func (im *Importer) fail(msg *sourceMessage, err error) {
+	log.WithError(err).WithField("key", msg.key).Warn("Cannot import message")
+	im.updateProgress(0, 0, 1)
+}
+
+// newImportRequest encrypts the message and maps its folder and flags to
+// the labels and metadata of the import, the same way as APPEND does.
+func (im *Importer) newImportRequest(ctx context.Context, kr *crypto.KeyRing, msg *sourceMessage) (*pmapi.ImportMsgReq, error) {
+	labelID, err := im.getLabelID(ctx, msg.folder)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg.literal)))
+	if err != nil {
+		return nil, err
+	}
+
+	flags := pmapi.FlagReceived
+	if header.Get("Received") == "" {
+		flags = pmapi.FlagSent
+	}
+
+	switch labelID {
+	case pmapi.SentLabel:
+		flags = pmapi.FlagSent
+	case pmapi.DraftLabel:
+		flags = 0
+	}
+
+	labelIDs := []string{labelID}
+	for _, flag := range msg.flags {
+		switch flag {
+		case imap.DraftFlag:
+			flags &= ^(pmapi.FlagSent | pmapi.FlagReceived)
+		case imap.FlaggedFlag:
+			labelIDs = append(labelIDs, pmapi.StarredLabel)
+		case imap.AnsweredFlag:
+			flags |= pmapi.FlagReplied
+		case forwardedFlag:
+			flags |= pmapi.FlagForwarded
+		}
+	}
+
+	date := msg.time
+	if date.IsZero() {
+		date, _ = mail.ParseDate(header.Get("Date"))
+	}
+
+	var time int64
+	if !date.IsZero() {
+		time = date.Unix()
+	}
+
+	enc, err := message.EncryptRFC822(kr, bytes.NewReader(msg.literal))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(enc) > pmapi.MaxImportMessageRequestSize {
+		return nil, errMessageTooBig
+	}
+
+	return &pmapi.ImportMsgReq{
+		Metadata: &pmapi.ImportMetadata{
+			AddressID: im.addressID,
+			Unread:    pmapi.Boolean(!msg.hasFlag(imap.SeenFlag)),
+			Flags:     flags,
+			Time:      time,
+			LabelIDs:  labelIDs,
+		},
+		Message: append(enc, "\r\n"...),
+	}, nil
+}
+
+// getLabelID returns the label of the folder, creating the custom folder if
+// it does not exist yet.
+func (im *Importer) getLabelID(ctx context.Context, folder string) (string, error) {
+	if labelID, ok := systemFolders[strings.ToLower(folder)]; ok {
+		return labelID, nil
+	}
+
+	im.labelsLock.Lock()
+	defer im.labelsLock.Unlock()
+
+	if im.labels == nil {
+		labels, err := im.client.ListLabels(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		im.labels = map[string]string{}
+		for _, label := range labels {
+			if label.Exclusive {
+				im.labels[getLabelPath(label)] = label.ID
+			}
+		}
+	}
+
+	if labelID, ok := im.labels[folder]; ok {
+		return labelID, nil
+	}
+
+	label, err := im.client.CreateLabel(ctx, &pmapi.Label{
+		Name:      folder,
+		Color:     pmapi.LabelColors[len(im.labels)%len(pmapi.LabelColors)],
+		Exclusive: true,
+		Type:      pmapi.LabelTypeMailBox,
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot create folder %v", folder)
+	}
+
+	log.WithField("folder", folder).Info("Created folder")
+	im.labels[getLabelPath(label)] = label.ID
+	im.labels[folder] = label.ID
+
+	return label.ID, nil
+}
+
+func getLabelPath(label *pmapi.Label) string {
+	if label.Path != "" {
+		return label.Path
+	}
+	return label.Name
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/ljanyst/peroxide/pkg/pmapi/mocks"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T) *mocks.MockClient {
+	client := mocks.NewMockClient(gomock.NewController(t))
+
+	key, err := crypto.GenerateKey("user", "user@pm.me", "x25519", 0)
+	require.NoError(t, err)
+	kr, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	client.EXPECT().Addresses().Return(pmapi.AddressList{{ID: "addressID", Email: "user@pm.me", Receive: true, Order: 1}}).AnyTimes()
+	client.EXPECT().KeyRingForAddressID("addressID").Return(kr, nil).AnyTimes()
+
+	return client
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "mail")
+
+	writeTestFile(t, filepath.Join(source, "Inbox.mbox"), testMbox)
+	writeTestFile(t, filepath.Join(source, "Maildir", "cur", "1500000000.1.host:2,DS"), "Subject: draft\r\n\r\n")
+	writeTestFile(t, filepath.Join(source, "Maildir", "new", "1500000001.1.host"), "Received: by mx\r\nSubject: new\r\n\r\n")
+
+	client := newTestClient(t)
+	client.EXPECT().ListLabels(gomock.Any()).Return([]*pmapi.Label{}, nil)
+	client.EXPECT().CreateLabel(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, label *pmapi.Label) (*pmapi.Label, error) {
+		require.Equal(t, "Maildir", label.Name)
+		require.Equal(t, pmapi.Boolean(true), label.Exclusive)
+		return &pmapi.Label{ID: "folderID", Name: label.Name, Exclusive: true}, nil
+	})
+
+	metadata := map[string]*pmapi.ImportMetadata{}
+	client.EXPECT().Import(gomock.Any(), gomock.Any()).DoAndReturn(func(_ context.Context, reqs pmapi.ImportMsgReqs) ([]*pmapi.ImportMsgRes, error) {
+		res := []*pmapi.ImportMsgRes{}
+		for _, req := range reqs {
+			require.Contains(t, string(req.Message), "-----BEGIN PGP MESSAGE-----")
+			id := "msg" + strconv.Itoa(len(metadata))
+			metadata[id] = req.Metadata
+			res = append(res, &pmapi.ImportMsgRes{MessageID: id})
+		}
+		return res, nil
+	}).MinTimes(1)
+
+	im, err := New(client, "", filepath.Join(dir, "journal"), 1)
+	require.NoError(t, err)
+	require.NoError(t, im.Import(context.Background(), source))
+	require.NoError(t, im.Close())
+	require.Equal(t, Progress{Imported: 4}, im.GetProgress())
+
+	// The mbox with the Status and X-Status headers.
+	require.Equal(t, []string{pmapi.InboxLabel, pmapi.StarredLabel}, metadata["msg0"].LabelIDs)
+	require.Equal(t, pmapi.Boolean(false), metadata["msg0"].Unread)
+	require.Equal(t, pmapi.FlagSent|pmapi.FlagReplied, metadata["msg0"].Flags)
+	require.Equal(t, pmapi.Boolean(true), metadata["msg1"].Unread)
+
+	// The seen draft and the new received message of the Maildir.
+	require.Equal(t, []string{"folderID"}, metadata["msg2"].LabelIDs)
+	require.Equal(t, int64(0), metadata["msg2"].Flags)
+	require.Equal(t, int64(1500000000), metadata["msg2"].Time)
+	require.Equal(t, pmapi.FlagReceived, metadata["msg3"].Flags)
+	require.Equal(t, pmapi.Boolean(true), metadata["msg3"].Unread)
+
+	// Resuming with the same journal imports only the new messages.
+	client.EXPECT().ListLabels(gomock.Any()).Return([]*pmapi.Label{{ID: "folderID", Name: "Maildir", Exclusive: true}}, nil)
+	writeTestFile(t, filepath.Join(source, "Maildir", "new", "1500000002.1.host"), "Subject: newer\r\n\r\n")
+
+	im, err = New(client, "", filepath.Join(dir, "journal"), 1)
+	require.NoError(t, err)
+	require.NoError(t, im.Import(context.Background(), source))
+	require.NoError(t, im.Close())
+	require.Equal(t, Progress{Imported: 1, Skipped: 4}, im.GetProgress())
+}
+
+func TestImportFailures(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "Inbox.mbox")
+	writeTestFile(t, source, testMbox)
+
+	client := newTestClient(t)
+	client.EXPECT().Import(gomock.Any(), gomock.Any()).Return([]*pmapi.ImportMsgRes{
+		{Error: errors.New("invalid message")},
+		{MessageID: "msg"},
+	}, nil)
+
+	im, err := New(client, "user@pm.me", filepath.Join(dir, "journal"), 2)
+	require.NoError(t, err)
+	require.NoError(t, im.Import(context.Background(), source))
+	require.Equal(t, Progress{Imported: 1, Failed: 1}, im.GetProgress())
+	require.False(t, im.journal.isDone("Inbox.mbox#0"))
+	require.True(t, im.journal.isDone("Inbox.mbox#1"))
+	require.NoError(t, im.Close())
+
+	_, err = New(client, "other@pm.me", filepath.Join(dir, "journal"), 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journal records the keys of the imported messages, one quoted key and the
+// ID of the new message per line, so that an interrupted import can continue
+// where it stopped.
+type journal struct {
+	lock sync.Mutex
+	file *os.File
+	done map[string]bool
+}
+
+func openJournal(path string) (*journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{file: file, done: map[string]bool{}}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.LastIndexByte(line, ' '); i >= 0 {
+			line = line[:i]
+		}
+
+		// A line cut by a crash is ignored, the message is imported again.
+		key, err := strconv.Unquote(line)
+		if err != nil {
+			continue
+		}
+		j.done[key] = true
+	}
+	if err := scanner.Err(); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	if err := terminateLastLine(file); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// terminateLastLine makes the records start on a new line after a crash.
+func terminateLastLine(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return err
+	}
+	if last[0] == '\n' {
+		return nil
+	}
+
+	_, err = file.WriteString("\n")
+	return err
+}
+
+func (j *journal) isDone(key string) bool {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	return j.done[key]
+}
+
+// record writes the imported messages to the disk.
+func (j *journal) record(keys, messageIDs []string) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	var b strings.Builder
+	for i, key := range keys {
+		fmt.Fprintf(&b, "%s %s\n", strconv.Quote(key), messageIDs[i])
+	}
+
+	if _, err := j.file.WriteString(b.String()); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		j.done[key] = true
+	}
+
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
@@ -0,0 +1,352 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+)
+
+// sourceMessage is a message found in an mbox file or a Maildir.
+type sourceMessage struct {
+	// key identifies the message in the journal. It is the path of the file
+	// relative to the source, followed by the position of the message in the
+	// mbox file.
+	key string
+
+	// folder is the path of the source folder, e.g. "INBOX" or "Work/2019".
+	folder string
+
+	// flags are the IMAP flags of the message.
+	flags []string
+
+	// time is when the message was delivered; zero if not known.
+	time time.Time
+
+	literal []byte
+}
+
+func (msg *sourceMessage) hasFlag(flag string) bool {
+	for _, f := range msg.flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+var mboxFromLine = regexp.MustCompile(`^>+From `) //nolint:gochecknoglobals
+
+// walkSource calls fn for every message of the source, which is either an
+// mbox file, a Maildir or a directory tree containing them, in a stable order.
+func walkSource(source string, fn func(*sourceMessage) error) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return readMbox(source, filepath.Base(source), getMboxFolder(filepath.Base(source)), fn)
+	}
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			switch info.Name() {
+			case "cur", "new", "tmp":
+				if isMaildir(filepath.Dir(path)) {
+					return filepath.SkipDir
+				}
+			}
+			if isMaildir(path) {
+				// The Maildir++ subfolders are next to cur, new and tmp, so
+				// the walk goes on.
+				return readMaildir(path, rel, getMaildirFolder(rel), fn)
+			}
+			return nil
+		}
+
+		if !isMbox(path) {
+			return nil
+		}
+		return readMbox(path, rel, getMboxFolder(rel), fn)
+	})
+}
+
+// isMaildir returns whether the directory has the cur and new subdirectories.
+func isMaildir(path string) bool {
+	for _, sub := range []string{"cur", "new"} {
+		if info, err := os.Stat(filepath.Join(path, sub)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// isMbox returns whether the file starts with the "From " line.
+func isMbox(path string) bool {
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return false
+	}
+	defer f.Close() //nolint:errcheck
+
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(f, b); err != nil {
+		return false
+	}
+	return string(b) == "From "
+}
+
+// getMboxFolder returns the folder of the mbox file without the extensions
+// used by the mail clients, e.g. "Work.sbd/2019.mbox" is "Work/2019".
+func getMboxFolder(rel string) string {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i, part := range parts {
+		part = strings.TrimSuffix(part, ".sbd")
+		part = strings.TrimSuffix(part, ".mbox")
+		part = strings.TrimSuffix(part, ".mbx")
+		parts[i] = part
+	}
+	return strings.Join(parts, "/")
+}
+
+// getMaildirFolder returns the folder of the Maildir. The root is the INBOX
+// and the Maildir++ subfolders like ".Work.2019" are "Work/2019", under the
+// folder of their Maildir unless it is the root.
+func getMaildirFolder(rel string) string {
+	if rel == "." {
+		return "INBOX"
+	}
+
+	rel = filepath.ToSlash(rel)
+	dir, base := filepath.Split(rel)
+	if !strings.HasPrefix(base, ".") {
+		return rel
+	}
+	return dir + strings.ReplaceAll(strings.TrimPrefix(base, "."), ".", "/")
+}
+
+// readMbox reads the mboxrd file, which also reads the mboxo files as long as
+// they do not contain the lines starting with ">From ". The flags are taken
+// from the Status and X-Status headers.
+func readMbox(path, rel, folder string, fn func(*sourceMessage) error) error {
+	f, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer f.Close() //nolint:errcheck
+
+	r := bufio.NewReader(f)
+
+	var msg *sourceMessage
+	var buf bytes.Buffer
+	count := 0
+
+	flush := func() error {
+		if msg == nil {
+			return nil
+		}
+		msg.literal = append([]byte{}, buf.Bytes()...)
+		msg.flags = getMboxFlags(msg.literal)
+		buf.Reset()
+		return fn(msg)
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+				msg = &sourceMessage{
+					key:    rel + "#" + strconv.Itoa(count),
+					folder: folder,
+					time:   getMboxTime(line),
+				}
+				count++
+
+			case msg == nil:
+				// Garbage before the first message.
+
+			case mboxFromLine.Match(line):
+				buf.Write(line[1:])
+
+			default:
+				buf.Write(line)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return flush()
+}
+
+// getMboxTime parses the date of the "From sender date" line.
+func getMboxTime(line []byte) time.Time {
+	fields := strings.Fields(string(line))
+	if len(fields) < 7 {
+		return time.Time{}
+	}
+
+	t, err := time.Parse(time.ANSIC, strings.Join(fields[2:7], " "))
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// getMboxFlags returns the flags in the Status and X-Status headers written
+// by mutt, Thunderbird and others.
+func getMboxFlags(literal []byte) []string {
+	flags := []string{}
+
+	header := literal
+	if i := bytes.Index(literal, []byte("\n\n")); i >= 0 {
+		header = literal[:i+1]
+	}
+	if i := bytes.Index(header, []byte("\r\n\r\n")); i >= 0 {
+		header = header[:i+2]
+	}
+
+	for _, line := range strings.Split(string(header), "\n") {
+		name, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case "status":
+			if strings.Contains(value, "R") {
+				flags = append(flags, imap.SeenFlag)
+			}
+		case "x-status":
+			if strings.Contains(value, "A") {
+				flags = append(flags, imap.AnsweredFlag)
+			}
+			if strings.Contains(value, "F") {
+				flags = append(flags, imap.FlaggedFlag)
+			}
+			if strings.Contains(value, "T") {
+				flags = append(flags, imap.DraftFlag)
+			}
+		}
+	}
+
+	return flags
+}
+
+// readMaildir reads the messages in the cur and new subdirectories ordered by
+// their names, which start with the delivery time.
+func readMaildir(path, rel, folder string, fn func(*sourceMessage) error) error {
+	for _, sub := range []string{"cur", "new"} {
+		files, err := ioutil.ReadDir(filepath.Join(path, sub))
+		if err != nil {
+			return err
+		}
+		sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+		for _, file := range files {
+			if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+				continue
+			}
+
+			literal, err := ioutil.ReadFile(filepath.Join(path, sub, file.Name())) //nolint:gosec
+			if err != nil {
+				return err
+			}
+
+			// The flags are after the colon and change when the message is
+			// read, so they are not part of the key.
+			name, info := file.Name(), ""
+			if i := strings.LastIndex(name, ":2,"); i >= 0 {
+				name, info = name[:i], name[i+3:]
+			}
+
+			msg := &sourceMessage{
+				key:     filepath.ToSlash(filepath.Join(rel, name)),
+				folder:  folder,
+				flags:   getMaildirFlags(info),
+				time:    getMaildirTime(name, file.ModTime()),
+				literal: literal,
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// getMaildirFlags returns the flags of the info part of the file name.
+func getMaildirFlags(info string) []string {
+	flags := []string{}
+	for _, c := range info {
+		switch c {
+		case 'D':
+			flags = append(flags, imap.DraftFlag)
+		case 'F':
+			flags = append(flags, imap.FlaggedFlag)
+		case 'P':
+			flags = append(flags, forwardedFlag)
+		case 'R':
+			flags = append(flags, imap.AnsweredFlag)
+		case 'S':
+			flags = append(flags, imap.SeenFlag)
+		}
+	}
+	return flags
+}
+
+// getMaildirTime returns the delivery time at the start of the file name, or
+// the modification time of the file.
+func getMaildirTime(name string, modTime time.Time) time.Time {
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if sec, err := strconv.ParseInt(name[:i], 10, 64); err == nil {
+			return time.Unix(sec, 0)
+		}
+	}
+	return modTime
+}
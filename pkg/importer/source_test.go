@@ -0,0 +1,110 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package importer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/stretchr/testify/require"
+)
+
+const testMbox = "From alice@example.com Mon Jan  2 15:04:05 2006\n" +
+	"From: alice@example.com\n" +
+	"Status: RO\n" +
+	"X-Status: AF\n" +
+	"\n" +
+	">From the start\n" +
+	"Body\n" +
+	"From bob@example.com Tue Jan  3 15:04:05 2006\n" +
+	"From: bob@example.com\n" +
+	"\n" +
+	">>From escaped twice\n"
+
+func writeTestFile(t *testing.T, path, content string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+}
+
+func collectSource(t *testing.T, source string) []*sourceMessage {
+	msgs := []*sourceMessage{}
+	require.NoError(t, walkSource(source, func(msg *sourceMessage) error {
+		msgs = append(msgs, msg)
+		return nil
+	}))
+	return msgs
+}
+
+func TestReadMbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Archive.mbox")
+	writeTestFile(t, path, testMbox)
+
+	msgs := collectSource(t, path)
+	require.Len(t, msgs, 2)
+
+	require.Equal(t, "Archive.mbox#0", msgs[0].key)
+	require.Equal(t, "Archive", msgs[0].folder)
+	require.Equal(t, time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC), msgs[0].time)
+	require.Equal(t, "From: alice@example.com\nStatus: RO\nX-Status: AF\n\nFrom the start\nBody\n", string(msgs[0].literal))
+	require.ElementsMatch(t, []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag}, msgs[0].flags)
+
+	require.Equal(t, "Archive.mbox#1", msgs[1].key)
+	require.Equal(t, "From: bob@example.com\n\n>From escaped twice\n", string(msgs[1].literal))
+	require.Empty(t, msgs[1].flags)
+}
+
+func TestWalkSourceTree(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTestFile(t, filepath.Join(dir, "Maildir", "cur", "1500000000.1.host:2,RS"), "Subject: read\r\n\r\n")
+	writeTestFile(t, filepath.Join(dir, "Maildir", "new", "1500000001.2.host"), "Subject: new\r\n\r\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Maildir", "tmp"), 0700))
+	writeTestFile(t, filepath.Join(dir, "Maildir", ".Work.2019", "cur", "1500000002.3.host:2,FP"), "Subject: work\r\n\r\n")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "Maildir", ".Work.2019", "new"), 0700))
+	writeTestFile(t, filepath.Join(dir, "Local.sbd", "Lists.mbox"), testMbox)
+	writeTestFile(t, filepath.Join(dir, "notes.txt"), "Not a mailbox\n")
+
+	msgs := collectSource(t, dir)
+	require.Len(t, msgs, 5)
+
+	require.Equal(t, "Local.sbd/Lists.mbox#0", msgs[0].key)
+	require.Equal(t, "Local/Lists", msgs[0].folder)
+
+	require.Equal(t, "Maildir/1500000000.1.host", msgs[2].key)
+	require.Equal(t, "Maildir", msgs[2].folder)
+	require.Equal(t, []string{imap.AnsweredFlag, imap.SeenFlag}, msgs[2].flags)
+	require.Equal(t, time.Unix(1500000000, 0), msgs[2].time)
+
+	require.Equal(t, "Maildir/1500000001.2.host", msgs[3].key)
+	require.Empty(t, msgs[3].flags)
+
+	require.Equal(t, "Maildir/.Work.2019/1500000002.3.host", msgs[4].key)
+	require.Equal(t, "Maildir/Work/2019", msgs[4].folder)
+	require.Equal(t, []string{imap.FlaggedFlag, forwardedFlag}, msgs[4].flags)
+}
+
+func TestGetMaildirFolder(t *testing.T) {
+	require.Equal(t, "INBOX", getMaildirFolder("."))
+	require.Equal(t, "Work/2019", getMaildirFolder(".Work.2019"))
+	require.Equal(t, "Archive", getMaildirFolder("Archive"))
+	require.Equal(t, "Mail/Archive", getMaildirFolder("Mail/Archive"))
+}
@@ -24,6 +24,7 @@ import (
 	"sync"
 
 	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/pool"
 	"github.com/pkg/errors"
@@ -40,9 +41,10 @@ const (
 )
 
 type Builder struct {
-	pool *pool.Pool
-	jobs map[string]*Job
-	lock sync.Mutex
+	pool           *pool.Pool
+	attachmentPool *pool.Pool
+	jobs           map[string]*Job
+	lock           sync.Mutex
 }
 
 type Fetcher interface {
@@ -63,12 +65,30 @@ func NewBuilder(fetchWorkers, attachmentWorkers int) *Builder {
 
 	fetcherPool := pool.New(fetchWorkers, newFetcherWorkFunc(attachmentPool))
 
+	metrics.NewGaugeFunc(
+		"peroxide_builder_queue_length",
+		"Number of build jobs waiting for a worker.",
+		func(set func(float64, ...string)) {
+			set(float64(fetcherPool.QueueLength()), "fetch")
+			set(float64(attachmentPool.QueueLength()), "attachment")
+		},
+		"pool",
+	)
+
 	return &Builder{
-		pool: fetcherPool,
-		jobs: make(map[string]*Job),
+		pool:           fetcherPool,
+		attachmentPool: attachmentPool,
+		jobs:           make(map[string]*Job),
 	}
 }
 
+// SetWorkers changes the number of fetch and attachment workers of a running
+// builder.
+func (builder *Builder) SetWorkers(fetchWorkers, attachmentWorkers int) {
+	builder.pool.SetSize(fetchWorkers)
+	builder.attachmentPool.SetSize(attachmentWorkers)
+}
+
 func (builder *Builder) NewJob(ctx context.Context, fetcher Fetcher, messageID string, prio int) (*Job, pool.DoneFunc) {
 	return builder.NewJobWithOptions(ctx, fetcher, messageID, JobOptions{}, prio)
 }
@@ -29,7 +29,8 @@ const (
 	ThunderbirdNonJunkFlag = "NonJunk"
 )
 
-// GetFlags returns imap flags from pmapi message attributes.
+// GetFlags returns imap flags from pmapi message attributes. The junk flags of
+// the clients are not included; the IMAP server adds the ones the client uses.
 func GetFlags(m *pmapi.Message) (flags []string) {
 	if !m.Unread {
 		flags = append(flags, imap.SeenFlag)
@@ -41,20 +42,10 @@ func GetFlags(m *pmapi.Message) (flags []string) {
 		flags = append(flags, imap.AnsweredFlag)
 	}
 
-	hasSpam := false
-
 	for _, l := range m.LabelIDs {
 		if l == pmapi.StarredLabel {
 			flags = append(flags, imap.FlaggedFlag)
 		}
-		if l == pmapi.SpamLabel {
-			flags = append(flags, AppleMailJunkFlag, ThunderbirdJunkFlag)
-			hasSpam = true
-		}
-	}
-
-	if !hasSpam {
-		flags = append(flags, ThunderbirdNonJunkFlag)
 	}
 
 	return
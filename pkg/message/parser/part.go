@@ -166,7 +166,7 @@ func selectSuitableDecoder(p *Part, t string, params map[string]string) *encodin
 
 func (p *Part) is7BitClean() bool {
 	for _, b := range p.Body {
-		if b > 1<<7 {
+		if b >= 1<<7 {
 			return false
 		}
 	}
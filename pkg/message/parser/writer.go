@@ -19,7 +19,10 @@ package parser
 
 import (
 	"io"
+	"mime"
+	"strings"
 
+	"github.com/ProtonMail/go-rfc5322"
 	"github.com/emersion/go-message"
 )
 
@@ -37,6 +40,7 @@ func (w *Writer) Write(ww io.Writer) error {
 	if !w.root.is7BitClean() {
 		w.root.Header.Set("Content-Transfer-Encoding", "base64")
 	}
+	w.root.Header = encodeHeader(w.root.Header)
 
 	msgWriter, err := message.CreateWriter(ww, w.root.Header)
 	if err != nil {
@@ -70,6 +74,7 @@ func (w *Writer) writeAsChild(writer *message.Writer, p *Part) error {
 	if !p.is7BitClean() {
 		p.Header.Set("Content-Transfer-Encoding", "base64")
 	}
+	p.Header = encodeHeader(p.Header)
 
 	childWriter, err := writer.CreatePart(p.Header)
 	if err != nil {
@@ -82,3 +87,90 @@ func (w *Writer) writeAsChild(writer *message.Writer, p *Part) error {
 
 	return childWriter.Close()
 }
+
+// encodeHeader returns the header with the raw UTF-8 values (RFC 6532)
+// encoded, so that the message can be relayed to the servers which do not
+// support SMTPUTF8. The fields without UTF-8 are kept as they are.
+func encodeHeader(h message.Header) message.Header {
+	type field struct {
+		key, value string
+		raw        []byte
+	}
+
+	var fields []field
+	hasUTF8 := false
+
+	for fs := h.Fields(); fs.Next(); {
+		f := field{key: fs.Key(), value: fs.Value()}
+		if isASCII(f.value) {
+			if raw, err := fs.Raw(); err == nil {
+				f.raw = raw
+			}
+		} else {
+			f.value = encodeHeaderValue(f.key, f.value)
+			hasUTF8 = true
+		}
+		fields = append(fields, f)
+	}
+
+	if !hasUTF8 {
+		return h
+	}
+
+	// The fields added last are written first.
+	var encoded message.Header
+	for i := len(fields) - 1; i >= 0; i-- {
+		if fields[i].raw != nil {
+			encoded.AddRaw(fields[i].raw)
+		} else {
+			encoded.Add(fields[i].key, fields[i].value)
+		}
+	}
+
+	return encoded
+}
+
+// encodeHeaderValue encodes the UTF-8 value of the header field. The display
+// names of the addresses are encoded as RFC 2047 words, but the addresses
+// themselves cannot be encoded and keep their UTF-8 local parts and domains.
+// The parameters of the content headers are encoded as in RFC 2231. The
+// message IDs are kept as they are.
+func encodeHeaderValue(key, value string) string {
+	switch strings.ToLower(key) {
+	case "from", "sender", "reply-to", "to", "cc", "bcc",
+		"resent-from", "resent-sender", "resent-to", "resent-cc", "resent-bcc":
+		addrs, err := rfc5322.ParseAddressList(value)
+		if err != nil {
+			return value
+		}
+
+		list := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			list = append(list, addr.String())
+		}
+		return strings.Join(list, ", ")
+
+	case "content-type", "content-disposition":
+		mediaType, params, err := mime.ParseMediaType(value)
+		if err != nil {
+			return value
+		}
+		return mime.FormatMediaType(mediaType, params)
+
+	case "message-id", "in-reply-to", "references", "content-id":
+		return value
+
+	default:
+		return mime.QEncoding.Encode("utf-8", value)
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 1<<7 {
+			return false
+		}
+	}
+
+	return true
+}
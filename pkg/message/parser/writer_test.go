@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParserWrite(t *testing.T) {
@@ -39,3 +40,25 @@ func TestParserWrite(t *testing.T) {
 func crlf(s string) string {
 	return strings.ReplaceAll(s, "\r\n", "\n")
 }
+
+func TestParserWriteUTF8Header(t *testing.T) {
+	p, err := New(strings.NewReader("From: Jiří <jiří@příklad.cz>\r\n" +
+		"To: user@example.com\r\n" +
+		"Subject: Žluťoučký kůň\r\n" +
+		"Message-Id: <kůň@příklad.cz>\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n" +
+		"\r\n" +
+		"Úpěl ďábelské ódy\r\n"))
+	require.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, p.NewWriter().Write(buf))
+
+	header := buf.String()[:strings.Index(buf.String(), "\r\n\r\n")]
+	assert.Contains(t, header, "From: =?utf-8?q?Ji=C5=99=C3=AD?= <jiří@příklad.cz>\r\n")
+	assert.Contains(t, header, "To: user@example.com\r\n")
+	assert.Contains(t, header, "Subject: =?utf-8?q?=C5=BDlu=C5=A5ou=C4=8Dk=C3=BD_k=C5=AF=C5=88?=\r\n")
+	assert.Contains(t, header, "Message-Id: <kůň@příklad.cz>\r\n")
+	assert.Contains(t, header, "Content-Transfer-Encoding: base64\r\n")
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ljanyst/peroxide/pkg/message/parser"
+	pmmime "github.com/ljanyst/peroxide/pkg/mime"
+	"github.com/pkg/errors"
+)
+
+// ExtractText returns the searchable text of the given RFC822 literal: the
+// decoded header fields of the top-level header and the plain text of all the
+// body parts, with html converted to plain text. Attachments are skipped.
+func ExtractText(r io.Reader) (header, body string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while extracting text: %v", r)
+		}
+	}()
+
+	p, err := parser.New(r)
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to create new parser")
+	}
+
+	if err = convertEncodedTransferEncoding(p); err != nil {
+		return "", "", errors.Wrap(err, "failed to convert encoded transfer encodings")
+	}
+
+	if err = convertForeignEncodings(p); err != nil {
+		return "", "", errors.Wrap(err, "failed to convert foreign encodings")
+	}
+
+	headerBuilder := strings.Builder{}
+	fields := p.Root().Header.Fields()
+	for fields.Next() {
+		value, err := pmmime.DecodeHeader(fields.Value())
+		if err != nil {
+			value = fields.Value()
+		}
+		_, _ = headerBuilder.WriteString(fields.Key() + ": " + value + "\n")
+	}
+
+	parts, err := collectBodyParts(p, "text/plain")
+	if err != nil {
+		return "", "", errors.Wrap(err, "failed to collect body parts")
+	}
+
+	bodyBuilder := strings.Builder{}
+	for _, part := range parts {
+		_, _ = bodyBuilder.Write(getPlainBody(part))
+		_, _ = bodyBuilder.WriteString("\n")
+	}
+
+	return headerBuilder.String(), bodyBuilder.String(), nil
+}
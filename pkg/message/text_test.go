@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package message
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractTextHTMLWithAttachment(t *testing.T) {
+	header, body, err := ExtractText(getFileReader("text_html_plain_attachment.eml"))
+	require.NoError(t, err)
+
+	assert.Contains(t, header, "From: Sender <sender@pm.me>\n")
+	assert.Contains(t, body, "This is body of *HTML mail* with attachment")
+	assert.NotContains(t, body, "<html>")
+	assert.NotContains(t, body, "attachment\n\n")
+}
+
+func TestExtractTextMultipartAlternative(t *testing.T) {
+	_, body, err := ExtractText(getFileReader("multipart_alternative_latin1.eml"))
+	require.NoError(t, err)
+
+	// Only the plain text alternative is used.
+	assert.Equal(t, 1, strings.Count(body, "aoeuaoeu"))
+}
+
+func TestExtractTextEncodedHeader(t *testing.T) {
+	const literal = "Subject: =?UTF-8?B?xb5sdcWlb3XEjWvDvQ==?=\r\nContent-Type: text/plain; charset=utf-8\r\n\r\nk\xc5\xaf\xc5\x88\r\n"
+
+	header, body, err := ExtractText(strings.NewReader(literal))
+	require.NoError(t, err)
+
+	assert.Contains(t, header, "Subject: žluťoučký\n")
+	assert.Contains(t, body, "kůň")
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics collects the state of the running server and exposes it in
+// the Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var log = logrus.WithField("pkg", "metrics") //nolint[gochecknoglobals]
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// DefaultBuckets are the histogram buckets suitable for request latencies in
+// seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10} //nolint[gochecknoglobals]
+
+type metric interface {
+	getName() string
+	write(w *bufio.Writer)
+}
+
+var registry = struct { //nolint[gochecknoglobals]
+	metrics map[string]metric
+	lock    sync.Mutex
+}{metrics: map[string]metric{}}
+
+// register adds the metric to the registry. A metric registered under the
+// same name is replaced.
+func register(m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	registry.metrics[m.getName()] = m
+}
+
+// Write writes all the registered metrics sorted by name.
+func Write(w io.Writer) error {
+	registry.lock.Lock()
+	metrics := make([]metric, 0, len(registry.metrics))
+	for _, m := range registry.metrics {
+		metrics = append(metrics, m)
+	}
+	registry.lock.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].getName() < metrics[j].getName()
+	})
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler returns a handler serving the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Write(w); err != nil {
+			log.WithError(err).Warn("Cannot write metrics")
+		}
+	})
+}
+
+// series is a single combination of label values of a metric.
+type series struct {
+	labelValues []string
+	value       float64
+
+	// Only used by histograms.
+	buckets []uint64
+	count   uint64
+}
+
+// vec is the common part of all metrics, holding the series by their label
+// values.
+type vec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	series map[string]*series
+	lock   sync.Mutex
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: map[string]*series{},
+	}
+}
+
+func (v *vec) getName() string {
+	return v.name
+}
+
+// with calls fn with the series of the given label values under the lock.
+func (v *vec) with(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{
+			labelValues: append([]string{}, labelValues...),
+			buckets:     make([]uint64, len(v.buckets)),
+		}
+		v.series[key] = s
+	}
+
+	fn(s)
+}
+
+func (v *vec) delete(labelValues []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.series, strings.Join(labelValues, "\xff"))
+}
+
+func (v *vec) write(w *bufio.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escape(v.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.kind)
+
+	keys := make([]string, 0, len(v.series))
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.series[key]
+
+		if v.kind != kindHistogram {
+			writeSample(w, v.name, v.labels, s.labelValues, s.value)
+			continue
+		}
+
+		labels := append(append([]string{}, v.labels...), "le")
+		for i, bound := range v.buckets {
+			le := append(append([]string{}, s.labelValues...), formatValue(bound))
+			writeSample(w, v.name+"_bucket", labels, le, float64(s.buckets[i]))
+		}
+		le := append(append([]string{}, s.labelValues...), "+Inf")
+		writeSample(w, v.name+"_bucket", labels, le, float64(s.count))
+		writeSample(w, v.name+"_sum", v.labels, s.labelValues, s.value)
+		writeSample(w, v.name+"_count", v.labels, s.labelValues, float64(s.count))
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, value float64) {
+	w.WriteString(name) //nolint:errcheck
+
+	if len(labels) != 0 {
+		pairs := make([]string, len(labels))
+		for i, label := range labels {
+			pairs[i] = label + `="` + escape(labelValues[i], true) + `"`
+		}
+		w.WriteString("{" + strings.Join(pairs, ",") + "}") //nolint:errcheck
+	}
+
+	w.WriteString(" " + formatValue(value) + "\n") //nolint:errcheck
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
+
+func escape(value string, quoted bool) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	if quoted {
+		value = strings.ReplaceAll(value, `"`, `\"`)
+	}
+	return value
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Requests.", "code")
+	counter.Inc("200")
+	counter.Add(2, "500")
+	counter.Inc("200")
+	counter.Inc("404")
+	counter.Delete("404")
+
+	gauge := NewGaugeVec("test_connections", "Open connections.", "user")
+	gauge.Inc(`a"b`)
+	gauge.Inc("c")
+	gauge.Dec("c")
+	gauge.Set(5, "d")
+	gauge.Delete("d")
+
+	histogram := NewHistogramVec("test_duration_seconds", "Duration.", []float64{0.1, 1})
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+
+	NewGaugeFunc("test_queue_length", "Queue length.", func(set func(float64, ...string)) {
+		set(3, "fetch")
+	}, "pool")
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf))
+	require.Equal(t, `# HELP test_connections Open connections.
+# TYPE test_connections gauge
+test_connections{user="a\"b"} 1
+test_connections{user="c"} 0
+# HELP test_duration_seconds Duration.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="1"} 2
+test_duration_seconds_bucket{le="+Inf"} 3
+test_duration_seconds_sum 2.55
+test_duration_seconds_count 3
+# HELP test_queue_length Queue length.
+# TYPE test_queue_length gauge
+test_queue_length{pool="fetch"} 3
+# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 2
+test_requests_total{code="500"} 2
+`, buf.String())
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"bufio"
+	"time"
+)
+
+// CounterVec is a metric which only goes up, partitioned by labels.
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec registers a new counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{newVec(name, help, kindCounter, labels)}
+	register(c)
+	return c
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter of the given label values by value.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	c.with(labelValues, func(s *series) { s.value += value })
+}
+
+// Delete removes the series of the given label values.
+func (c *CounterVec) Delete(labelValues ...string) {
+	c.delete(labelValues)
+}
+
+// GaugeVec is a metric which can go up and down, partitioned by labels.
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec registers a new gauge with the given label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{newVec(name, help, kindGauge, labels)}
+	register(g)
+	return g
+}
+
+// Set sets the gauge of the given label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.with(labelValues, func(s *series) { s.value = value })
+}
+
+// SetToCurrentTime sets the gauge of the given label values to the current
+// Unix time in seconds.
+func (g *GaugeVec) SetToCurrentTime(labelValues ...string) {
+	g.Set(float64(time.Now().UnixNano())/1e9, labelValues...)
+}
+
+// Add changes the gauge of the given label values by value.
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.with(labelValues, func(s *series) { s.value += value })
+}
+
+// Inc increments the gauge of the given label values by one.
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge of the given label values by one.
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Delete removes the series of the given label values.
+func (g *GaugeVec) Delete(labelValues ...string) {
+	g.delete(labelValues)
+}
+
+// HistogramVec counts observations in buckets, partitioned by labels.
+type HistogramVec struct {
+	*vec
+}
+
+// NewHistogramVec registers a new histogram with the given upper bounds of
+// the buckets, sorted in increasing order, and label names.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := newVec(name, help, kindHistogram, labels)
+	v.buckets = buckets
+
+	h := &HistogramVec{v}
+	register(h)
+	return h
+}
+
+// Observe adds a single observation to the histogram of the given label
+// values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.with(labelValues, func(s *series) {
+		for i, bound := range h.buckets {
+			if value <= bound {
+				s.buckets[i]++
+			}
+		}
+		s.count++
+		s.value += value
+	})
+}
+
+// gaugeFunc is a gauge whose values are collected at every scrape.
+type gaugeFunc struct {
+	name, help string
+	labels     []string
+	collect    func(set func(value float64, labelValues ...string))
+}
+
+// NewGaugeFunc registers a gauge whose series are reported by collect at
+// every scrape. The collect function calls set once for every series.
+func NewGaugeFunc(name, help string, collect func(set func(value float64, labelValues ...string)), labels ...string) {
+	register(&gaugeFunc{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		collect: collect,
+	})
+}
+
+func (g *gaugeFunc) getName() string {
+	return g.name
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	v := newVec(g.name, g.help, kindGauge, g.labels)
+	g.collect(func(value float64, labelValues ...string) {
+		v.with(labelValues, func(s *series) { s.value = value })
+	})
+	v.write(w)
+}
@@ -82,6 +82,14 @@ func (ch *PChan) Pop() (interface{}, int, bool) {
 	}
 }
 
+// Len returns the number of items waiting to be popped.
+func (ch *PChan) Len() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+
+	return len(ch.items)
+}
+
 func (ch *PChan) Close() {
 	ch.once.Do(func() { close(ch.done) })
 }
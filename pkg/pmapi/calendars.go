@@ -0,0 +1,502 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package pmapi
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/go-resty/resty/v2"
+)
+
+// Calendar event types as used by the event listing.
+const (
+	CalendarEventPartDay = 0
+	CalendarEventFullDay = 1
+)
+
+type Calendar struct {
+	ID          string
+	Name        string
+	Description string
+	Color       string
+	Display     Boolean
+	Type        int
+	Flags       int
+}
+
+type CalendarKey struct {
+	ID           string
+	CalendarID   string
+	PassphraseID string
+	PrivateKey   string
+	Flags        int
+}
+
+type CalendarMember struct {
+	ID          string
+	CalendarID  string
+	AddressID   string
+	Email       string
+	Permissions int
+}
+
+type CalendarMemberPassphrase struct {
+	MemberID   string
+	Passphrase string
+	Signature  string
+}
+
+type CalendarPassphrase struct {
+	ID                string
+	Flags             int
+	MemberPassphrases []CalendarMemberPassphrase
+}
+
+// CalendarBootstrap holds everything needed to unlock the calendar keys.
+type CalendarBootstrap struct {
+	Keys       []CalendarKey
+	Passphrase CalendarPassphrase
+	Members    []CalendarMember
+}
+
+// CalendarAttendee is the attendee status the server keeps outside of the
+// encrypted event parts.
+type CalendarAttendee struct {
+	ID     string
+	Token  string
+	Status int
+}
+
+// CalendarEvent is a calendar event as stored by the server. The event is
+// split into parts with the same types as the contact cards. The data of the
+// encrypted parts is the base64 encoded data packet; the session keys are in
+// the key packets which are encrypted with the calendar key.
+type CalendarEvent struct {
+	ID            string
+	UID           string
+	CalendarID    string
+	SharedEventID string
+	CreateTime    int64
+	ModifyTime    int64
+	Permissions   int
+	IsOrganizer   Boolean
+	Author        string
+
+	SharedKeyPacket   string
+	CalendarKeyPacket string
+
+	SharedEvents    []Card
+	CalendarEvents  []Card
+	PersonalEvents  []Card
+	AttendeesEvents []Card
+	Attendees       []CalendarAttendee
+}
+
+// CalendarEventFilter selects the events returned by ListCalendarEvents. The
+// times are unix timestamps.
+type CalendarEventFilter struct {
+	Start    int64
+	End      int64
+	Timezone string
+	Type     int
+	Page     int
+	PageSize int
+}
+
+// CalendarEventContent is the encrypted and signed content of a calendar
+// event sent to the server when creating or updating the event.
+type CalendarEventContent struct {
+	Permissions int
+	IsOrganizer Boolean
+
+	SharedKeyPacket   string `json:",omitempty"`
+	CalendarKeyPacket string `json:",omitempty"`
+
+	SharedEventContent   []Card
+	CalendarEventContent []Card `json:",omitempty"`
+	PersonalEventContent *Card  `json:",omitempty"`
+}
+
+// ListCalendars returns all calendars of the user.
+func (c *client) ListCalendars(ctx context.Context) ([]Calendar, error) {
+	var res struct {
+		Calendars []Calendar
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetResult(&res).Get("/calendar/v1")
+	}); err != nil {
+		return nil, err
+	}
+
+	return res.Calendars, nil
+}
+
+// GetCalendarBootstrap returns the keys, the passphrase and the members of the
+// calendar specified by calendar ID.
+func (c *client) GetCalendarBootstrap(ctx context.Context, calendarID string) (*CalendarBootstrap, error) {
+	var res CalendarBootstrap
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetResult(&res).Get("/calendar/v1/" + calendarID + "/bootstrap")
+	}); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// ListCalendarEvents returns the events of the calendar selected by the filter.
+func (c *client) ListCalendarEvents(ctx context.Context, calendarID string, filter *CalendarEventFilter) ([]CalendarEvent, error) {
+	var res struct {
+		Events []CalendarEvent
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		r = r.SetQueryParams(map[string]string{
+			"Start": strconv.FormatInt(filter.Start, 10),
+			"End":   strconv.FormatInt(filter.End, 10),
+			"Type":  strconv.Itoa(filter.Type),
+			"Page":  strconv.Itoa(filter.Page),
+		})
+		if filter.Timezone != "" {
+			r.SetQueryParam("Timezone", filter.Timezone)
+		}
+		if filter.PageSize != 0 {
+			r.SetQueryParam("PageSize", strconv.Itoa(filter.PageSize))
+		}
+		return r.SetResult(&res).Get("/calendar/v1/" + calendarID + "/events")
+	}); err != nil {
+		return nil, err
+	}
+
+	return res.Events, nil
+}
+
+// GetCalendarEvent returns the event specified by calendar and event ID.
+func (c *client) GetCalendarEvent(ctx context.Context, calendarID, eventID string) (CalendarEvent, error) {
+	var res struct {
+		Event CalendarEvent
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetResult(&res).Get("/calendar/v1/" + calendarID + "/events/" + eventID)
+	}); err != nil {
+		return CalendarEvent{}, err
+	}
+
+	return res.Event, nil
+}
+
+// CreateCalendarEvent creates a new event in the calendar on behalf of the
+// calendar member.
+func (c *client) CreateCalendarEvent(ctx context.Context, calendarID, memberID string, content *CalendarEventContent) (CalendarEvent, error) {
+	return c.syncCalendarEvent(ctx, calendarID, memberID, calendarSyncEvent{Event: content})
+}
+
+// UpdateCalendarEvent replaces the content of the event specified by event ID.
+func (c *client) UpdateCalendarEvent(ctx context.Context, calendarID, memberID, eventID string, content *CalendarEventContent) (CalendarEvent, error) {
+	return c.syncCalendarEvent(ctx, calendarID, memberID, calendarSyncEvent{ID: eventID, Event: content})
+}
+
+// DeleteCalendarEvent deletes the event specified by event ID.
+func (c *client) DeleteCalendarEvent(ctx context.Context, calendarID, memberID, eventID string) error {
+	_, err := c.syncCalendarEvent(ctx, calendarID, memberID, calendarSyncEvent{ID: eventID})
+	return err
+}
+
+type calendarSyncEvent struct {
+	ID    string                `json:",omitempty"`
+	Event *CalendarEventContent `json:",omitempty"`
+}
+
+func (c *client) syncCalendarEvent(ctx context.Context, calendarID, memberID string, event calendarSyncEvent) (CalendarEvent, error) {
+	req := struct {
+		MemberID string
+		Events   []calendarSyncEvent
+	}{
+		MemberID: memberID,
+		Events:   []calendarSyncEvent{event},
+	}
+
+	var res struct {
+		Responses []struct {
+			Index    int
+			Response struct {
+				Error
+				Event CalendarEvent
+			}
+		}
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetBody(req).SetResult(&res).Put("/calendar/v1/" + calendarID + "/events/sync")
+	}); err != nil {
+		return CalendarEvent{}, err
+	}
+
+	if len(res.Responses) != 1 {
+		return CalendarEvent{}, errors.New("unexpected number of responses")
+	}
+
+	if resp := res.Responses[0].Response; resp.Code != 1000 {
+		return CalendarEvent{}, resp.Error
+	}
+
+	return res.Responses[0].Response.Event, nil
+}
+
+// UnlockCalendarKeys unlocks the calendar keys with the passphrase of the
+// calendar member belonging to one of the user's addresses. It returns the
+// calendar keyring and the member.
+func (c *client) UnlockCalendarKeys(bootstrap *CalendarBootstrap) (*crypto.KeyRing, *CalendarMember, error) {
+	for i := range bootstrap.Members {
+		member := &bootstrap.Members[i]
+
+		addrKR, err := c.KeyRingForAddressID(member.AddressID)
+		if err != nil {
+			continue
+		}
+
+		for _, memberPassphrase := range bootstrap.Passphrase.MemberPassphrases {
+			if memberPassphrase.MemberID != member.ID {
+				continue
+			}
+
+			passphrase, err := decrypt(addrKR, memberPassphrase.Passphrase)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			kr, err := unlockCalendarKeys(bootstrap.Keys, bootstrap.Passphrase.ID, passphrase)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			return kr, member, nil
+		}
+	}
+
+	return nil, nil, ErrNoKeyringAvailable
+}
+
+func unlockCalendarKeys(keys []CalendarKey, passphraseID string, passphrase []byte) (*crypto.KeyRing, error) {
+	kr, err := crypto.NewKeyRing(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if key.PassphraseID != passphraseID {
+			continue
+		}
+
+		locked, err := crypto.NewKeyFromArmored(key.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+
+		unlocked, err := locked.Unlock(passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := kr.AddKey(unlocked); err != nil {
+			return nil, err
+		}
+	}
+
+	if kr.CountEntities() == 0 {
+		return nil, ErrNoKeyringAvailable
+	}
+
+	return kr, nil
+}
+
+// DecryptAndVerifyCalendarEvent returns the decrypted parts of the event: the
+// shared parts followed by the calendar and personal parts. The signatures
+// are verified with the keys of the given address; the decrypted parts are
+// returned even if the verification fails.
+func (c *client) DecryptAndVerifyCalendarEvent(calendarKR *crypto.KeyRing, addressID string, event *CalendarEvent) ([]Card, error) {
+	var sharedKey, calendarKey *crypto.SessionKey
+	var err error
+
+	if event.SharedKeyPacket != "" {
+		if sharedKey, err = decryptSessionKey(calendarKR, event.SharedKeyPacket); err != nil {
+			return nil, err
+		}
+	}
+
+	calendarKey = sharedKey
+	if event.CalendarKeyPacket != "" {
+		if calendarKey, err = decryptSessionKey(calendarKR, event.CalendarKeyPacket); err != nil {
+			return nil, err
+		}
+	}
+
+	addrKR, err := c.KeyRingForAddressID(addressID)
+	if err != nil {
+		addrKR = nil
+	}
+
+	var cards []Card
+	var verifyErr error
+
+	for _, part := range []struct {
+		cards []Card
+		key   *crypto.SessionKey
+	}{
+		{event.SharedEvents, sharedKey},
+		{event.CalendarEvents, calendarKey},
+		{event.PersonalEvents, nil},
+	} {
+		for _, card := range part.cards {
+			if isEncryptedCardType(card.Type) {
+				if card.Data, err = decryptCalendarData(part.key, card.Data); err != nil {
+					return nil, err
+				}
+			}
+			if isSignedCardType(card.Type) {
+				if addrKR == nil || verifyDetached(addrKR, card.Data, card.Signature) != nil {
+					verifyErr = errVerificationFailed
+				}
+			}
+			cards = append(cards, card)
+		}
+	}
+
+	return cards, verifyErr
+}
+
+// EncryptAndSignCalendarEvent encrypts and signs the shared and calendar parts
+// of an event with a new session key and signs the personal part. The
+// signatures are made with the keys of the given address.
+func (c *client) EncryptAndSignCalendarEvent(
+	calendarKR *crypto.KeyRing,
+	addressID string,
+	shared, calendar []Card,
+	personal *Card,
+) (*CalendarEventContent, error) {
+	addrKR, err := c.KeyRingForAddressID(addressID)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionKey, err := crypto.GenerateSessionKey()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPacket, err := calendarKR.EncryptSessionKey(sessionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &CalendarEventContent{
+		SharedKeyPacket: base64.StdEncoding.EncodeToString(keyPacket),
+	}
+
+	if content.SharedEventContent, err = encryptAndSignCalendarCards(addrKR, sessionKey, shared); err != nil {
+		return nil, err
+	}
+
+	if content.CalendarEventContent, err = encryptAndSignCalendarCards(addrKR, sessionKey, calendar); err != nil {
+		return nil, err
+	}
+
+	if len(content.CalendarEventContent) != 0 {
+		content.CalendarKeyPacket = content.SharedKeyPacket
+	}
+
+	if personal != nil {
+		signed, err := encryptAndSignCalendarCards(addrKR, nil, []Card{*personal})
+		if err != nil {
+			return nil, err
+		}
+		content.PersonalEventContent = &signed[0]
+	}
+
+	return content, nil
+}
+
+func encryptAndSignCalendarCards(signer *crypto.KeyRing, key *crypto.SessionKey, cards []Card) ([]Card, error) {
+	var result []Card
+
+	for _, card := range cards {
+		if isSignedCardType(card.Type) {
+			signature, err := signer.SignDetached(crypto.NewPlainMessageFromString(card.Data))
+			if err != nil {
+				return nil, err
+			}
+			if card.Signature, err = signature.GetArmored(); err != nil {
+				return nil, err
+			}
+		}
+		if isEncryptedCardType(card.Type) {
+			if key == nil {
+				return nil, ErrNoKeyringAvailable
+			}
+			data, err := key.Encrypt(crypto.NewPlainMessageFromString(card.Data))
+			if err != nil {
+				return nil, err
+			}
+			card.Data = base64.StdEncoding.EncodeToString(data)
+		}
+		result = append(result, card)
+	}
+
+	return result, nil
+}
+
+func decryptSessionKey(kr *crypto.KeyRing, keyPacket string) (*crypto.SessionKey, error) {
+	packet, err := base64.StdEncoding.DecodeString(keyPacket)
+	if err != nil {
+		return nil, err
+	}
+	return kr.DecryptSessionKey(packet)
+}
+
+func decryptCalendarData(key *crypto.SessionKey, data string) (string, error) {
+	if key == nil {
+		return "", ErrNoKeyringAvailable
+	}
+
+	packet, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := key.Decrypt(packet)
+	if err != nil {
+		return "", err
+	}
+
+	return plain.GetString(), nil
+}
+
+func verifyDetached(kr *crypto.KeyRing, plain, armoredSignature string) error {
+	signature, err := crypto.NewPGPSignatureFromArmored(armoredSignature)
+	if err != nil {
+		return err
+	}
+	return kr.VerifyDetached(crypto.NewPlainMessageFromString(plain), signature, 0)
+}
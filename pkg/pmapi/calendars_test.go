@@ -0,0 +1,143 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package pmapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	r "github.com/stretchr/testify/require"
+)
+
+func TestCalendar_ListCalendars(t *testing.T) {
+	s, c := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.NoError(t, checkMethodAndPath(req, "GET", "/calendar/v1"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code": 1000, "Calendars": [{"ID": "calID", "Name": "Work", "Display": 1}]}`)
+	}))
+	defer s.Close()
+
+	calendars, err := c.ListCalendars(context.Background())
+	r.NoError(t, err)
+	r.Equal(t, []Calendar{{ID: "calID", Name: "Work", Display: true}}, calendars)
+}
+
+func TestCalendar_ListCalendarEvents(t *testing.T) {
+	s, c := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.NoError(t, checkMethodAndPath(req, "GET", "/calendar/v1/calID/events?End=200&Page=1&PageSize=10&Start=100&Type=1"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code": 1000, "Events": [{"ID": "eventID", "UID": "uid"}]}`)
+	}))
+	defer s.Close()
+
+	events, err := c.ListCalendarEvents(context.Background(), "calID", &CalendarEventFilter{
+		Start: 100, End: 200, Type: CalendarEventFullDay, Page: 1, PageSize: 10,
+	})
+	r.NoError(t, err)
+	r.Len(t, events, 1)
+	r.Equal(t, "eventID", events[0].ID)
+}
+
+func TestCalendar_DeleteCalendarEventFailed(t *testing.T) {
+	s, c := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.NoError(t, checkMethodAndPath(req, "PUT", "/calendar/v1/calID/events/sync"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code": 1001, "Responses": [{"Index": 0, "Response": {"Code": 2501, "Error": "Event does not exist"}}]}`)
+	}))
+	defer s.Close()
+
+	err := c.DeleteCalendarEvent(context.Background(), "calID", "memberID", "eventID")
+	r.EqualError(t, err, "Event does not exist")
+}
+
+func newTestCalendarBootstrap(t *testing.T) *CalendarBootstrap {
+	passphrase := []byte("calendar passphrase")
+
+	key, err := crypto.GenerateKey("calendar", "calendar@pm.me", "x25519", 0)
+	r.NoError(t, err)
+
+	locked, err := key.Lock(passphrase)
+	r.NoError(t, err)
+
+	armoredKey, err := locked.Armor()
+	r.NoError(t, err)
+
+	encryptedPassphrase, err := encrypt(testPrivateKeyRing, string(passphrase), nil)
+	r.NoError(t, err)
+
+	return &CalendarBootstrap{
+		Keys: []CalendarKey{{ID: "keyID", PassphraseID: "passphraseID", PrivateKey: armoredKey}},
+		Passphrase: CalendarPassphrase{
+			ID:                "passphraseID",
+			MemberPassphrases: []CalendarMemberPassphrase{{MemberID: "memberID", Passphrase: encryptedPassphrase}},
+		},
+		Members: []CalendarMember{
+			{ID: "otherMemberID", AddressID: "otherAddressID"},
+			{ID: "memberID", AddressID: "addressID"},
+		},
+	}
+}
+
+func TestClient_CalendarEventRoundTrip(t *testing.T) {
+	c := newClient(newManager(Config{}), "")
+	c.addrKeyRing["addressID"] = testPrivateKeyRing
+
+	calendarKR, member, err := c.UnlockCalendarKeys(newTestCalendarBootstrap(t))
+	r.NoError(t, err)
+	r.Equal(t, "memberID", member.ID)
+
+	content, err := c.EncryptAndSignCalendarEvent(
+		calendarKR,
+		member.AddressID,
+		[]Card{{Type: SignedCard, Data: "shared cleartext"}, {Type: EncryptedSignedCard, Data: "shared secret"}},
+		[]Card{{Type: EncryptedSignedCard, Data: "calendar secret"}},
+		&Card{Type: SignedCard, Data: "alarms"},
+	)
+	r.NoError(t, err)
+	r.NotContains(t, content.SharedEventContent[1].Data, "secret")
+	r.Equal(t, content.SharedKeyPacket, content.CalendarKeyPacket)
+
+	event := &CalendarEvent{
+		SharedKeyPacket:   content.SharedKeyPacket,
+		CalendarKeyPacket: content.CalendarKeyPacket,
+		SharedEvents:      content.SharedEventContent,
+		CalendarEvents:    content.CalendarEventContent,
+		PersonalEvents:    []Card{*content.PersonalEventContent},
+	}
+
+	cards, err := c.DecryptAndVerifyCalendarEvent(calendarKR, member.AddressID, event)
+	r.NoError(t, err)
+	r.Len(t, cards, 4)
+	r.Equal(t, "shared cleartext", cards[0].Data)
+	r.Equal(t, "shared secret", cards[1].Data)
+	r.Equal(t, "calendar secret", cards[2].Data)
+	r.Equal(t, "alarms", cards[3].Data)
+}
+
+func TestClient_UnlockCalendarKeysNoMember(t *testing.T) {
+	c := newClient(newManager(Config{}), "")
+
+	_, _, err := c.UnlockCalendarKeys(newTestCalendarBootstrap(t))
+	r.Equal(t, ErrNoKeyringAvailable, err)
+}
@@ -74,7 +74,23 @@ type Client interface {
 	GetMailSettings(ctx context.Context) (MailSettings, error)
 	GetContactEmailByEmail(context.Context, string, int, int) ([]ContactEmail, error)
 	GetContactByID(context.Context, string) (Contact, error)
+	GetContactsForExport(context.Context, int, int) ([]Contact, error)
+	CreateContact(context.Context, []Card) (Contact, error)
+	UpdateContact(context.Context, string, []Card) (Contact, error)
+	DeleteContacts(context.Context, []string) error
 	DecryptAndVerifyCards([]Card) ([]Card, error)
+	EncryptAndSignCards([]Card) ([]Card, error)
+
+	ListCalendars(ctx context.Context) ([]Calendar, error)
+	GetCalendarBootstrap(ctx context.Context, calendarID string) (*CalendarBootstrap, error)
+	ListCalendarEvents(ctx context.Context, calendarID string, filter *CalendarEventFilter) ([]CalendarEvent, error)
+	GetCalendarEvent(ctx context.Context, calendarID, eventID string) (CalendarEvent, error)
+	CreateCalendarEvent(ctx context.Context, calendarID, memberID string, content *CalendarEventContent) (CalendarEvent, error)
+	UpdateCalendarEvent(ctx context.Context, calendarID, memberID, eventID string, content *CalendarEventContent) (CalendarEvent, error)
+	DeleteCalendarEvent(ctx context.Context, calendarID, memberID, eventID string) error
+	UnlockCalendarKeys(*CalendarBootstrap) (*crypto.KeyRing, *CalendarMember, error)
+	DecryptAndVerifyCalendarEvent(calendarKR *crypto.KeyRing, addressID string, event *CalendarEvent) ([]Card, error)
+	EncryptAndSignCalendarEvent(calendarKR *crypto.KeyRing, addressID string, shared, calendar []Card, personal *Card) (*CalendarEventContent, error)
 
 	GetAttachment(ctx context.Context, id string) (att io.ReadCloser, err error)
 	CreateAttachment(ctx context.Context, att *Attachment, r io.Reader, sig io.Reader) (created *Attachment, err error)
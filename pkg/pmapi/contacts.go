@@ -84,6 +84,24 @@ func (c *client) DecryptAndVerifyCards(cards []Card) ([]Card, error) {
 	return cards, nil
 }
 
+func (c *client) EncryptAndSignCards(cards []Card) ([]Card, error) {
+	var err error
+	for i := range cards {
+		card := &cards[i]
+		if isSignedCardType(card.Type) {
+			if card.Signature, err = c.sign(card.Data); err != nil {
+				return nil, err
+			}
+		}
+		if isEncryptedCardType(card.Type) {
+			if card.Data, err = c.encrypt(card.Data, nil); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return cards, nil
+}
+
 // GetContactByID gets contact details specified by contact ID.
 func (c *client) GetContactByID(ctx context.Context, contactID string) (contactDetail Contact, err error) {
 	var res struct {
@@ -99,6 +117,106 @@ func (c *client) GetContactByID(ctx context.Context, contactID string) (contactD
 	return res.Contact, nil
 }
 
+// GetContactsForExport gets a page of contacts together with their cards.
+func (c *client) GetContactsForExport(ctx context.Context, page int, pageSize int) (contacts []Contact, err error) {
+	var res struct {
+		Contacts []Contact
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		r = r.SetQueryParam("Page", strconv.Itoa(page))
+		if pageSize != 0 {
+			r.SetQueryParam("PageSize", strconv.Itoa(pageSize))
+		}
+		return r.SetResult(&res).Get("/contacts/v4/export")
+	}); err != nil {
+		return nil, err
+	}
+
+	return res.Contacts, nil
+}
+
+// CreateContact creates a new contact from the given cards. The cards must be
+// already encrypted and signed.
+func (c *client) CreateContact(ctx context.Context, cards []Card) (Contact, error) {
+	type contactCards struct {
+		Cards []Card
+	}
+
+	req := struct {
+		Contacts  []contactCards
+		Overwrite int
+		Labels    int
+	}{
+		Contacts: []contactCards{{Cards: cards}},
+	}
+
+	var res struct {
+		Responses []struct {
+			Index    int
+			Response struct {
+				Error
+				Contact Contact
+			}
+		}
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetBody(req).SetResult(&res).Post("/contacts/v4")
+	}); err != nil {
+		return Contact{}, err
+	}
+
+	if len(res.Responses) != 1 {
+		return Contact{}, errors.New("unexpected number of responses")
+	}
+
+	if resp := res.Responses[0].Response; resp.Code != 1000 {
+		return Contact{}, resp.Error
+	}
+
+	return res.Responses[0].Response.Contact, nil
+}
+
+// UpdateContact replaces the cards of the contact specified by contact ID.
+// The cards must be already encrypted and signed.
+func (c *client) UpdateContact(ctx context.Context, contactID string, cards []Card) (Contact, error) {
+	req := struct {
+		Cards []Card
+	}{
+		Cards: cards,
+	}
+
+	var res struct {
+		Contact Contact
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetBody(req).SetResult(&res).Put("/contacts/v4/" + contactID)
+	}); err != nil {
+		return Contact{}, err
+	}
+
+	return res.Contact, nil
+}
+
+// DeleteContacts deletes the contacts specified by contact IDs.
+func (c *client) DeleteContacts(ctx context.Context, contactIDs []string) error {
+	req := struct {
+		IDs []string
+	}{
+		IDs: contactIDs,
+	}
+
+	if _, err := c.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetBody(req).Put("/contacts/v4/delete")
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
 // GetContactEmailByEmail gets all emails from all contacts matching a specified email string.
 func (c *client) GetContactEmailByEmail(ctx context.Context, email string, page int, pageSize int) (contactEmails []ContactEmail, err error) {
 	var res struct {
@@ -217,3 +217,48 @@ func TestClient_Decrypt(t *testing.T) {
 	r.Nil(t, err)
 	r.Equal(t, testCardsCleartext[0].Data, cardCleartext[0].Data)
 }
+
+func TestContact_CreateContact(t *testing.T) {
+	s, c := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.NoError(t, checkMethodAndPath(req, "POST", "/contacts/v4"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code": 1001, "Responses": [{"Index": 0, "Response": {"Code": 1000, "Contact": {"ID": "newID", "Name": "Alice"}}}]}`)
+	}))
+	defer s.Close()
+
+	contact, err := c.CreateContact(context.Background(), []Card{{Type: SignedCard, Data: "data"}})
+	r.NoError(t, err)
+	r.Equal(t, "newID", contact.ID)
+}
+
+func TestContact_CreateContactFailed(t *testing.T) {
+	s, c := newTestClient(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.NoError(t, checkMethodAndPath(req, "POST", "/contacts/v4"))
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"Code": 1001, "Responses": [{"Index": 0, "Response": {"Code": 2001, "Error": "Invalid vCard"}}]}`)
+	}))
+	defer s.Close()
+
+	_, err := c.CreateContact(context.Background(), []Card{{Type: SignedCard, Data: "data"}})
+	r.EqualError(t, err, "Invalid vCard")
+}
+
+func TestClient_EncryptAndSignCards(t *testing.T) {
+	c := newClient(newManager(Config{}), "")
+	c.userKeyRing = testPrivateKeyRing
+
+	cards, err := c.EncryptAndSignCards([]Card{
+		{Type: SignedCard, Data: "cleartext"},
+		{Type: EncryptedSignedCard, Data: "secret"},
+	})
+	r.NoError(t, err)
+	r.Equal(t, "cleartext", cards[0].Data)
+	r.NotEmpty(t, cards[0].Signature)
+	r.NotContains(t, cards[1].Data, "secret")
+
+	cards, err = c.DecryptAndVerifyCards(cards)
+	r.NoError(t, err)
+	r.Equal(t, "secret", cards[1].Data)
+}
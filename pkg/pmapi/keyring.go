@@ -192,6 +192,10 @@ func encrypt(encrypter *crypto.KeyRing, plain string, signer *crypto.KeyRing) (a
 	return pgpMessage.GetArmored()
 }
 
+func (c *client) encrypt(plain string, signer *crypto.KeyRing) (armored string, err error) {
+	return encrypt(c.userKeyRing, plain, signer)
+}
+
 func (c *client) decrypt(armored string) (plain []byte, err error) {
 	return decrypt(c.userKeyRing, armored)
 }
@@ -221,6 +225,18 @@ func (c *client) verify(plain, amroredSignature string) (err error) {
 	return c.userKeyRing.VerifyDetached(plainMessage, pgpSignature, verifyTime)
 }
 
+func (c *client) sign(plain string) (armoredSignature string, err error) {
+	if c.userKeyRing == nil {
+		return "", ErrNoKeyringAvailable
+	}
+	plainMessage := crypto.NewPlainMessageFromString(plain)
+	pgpSignature, err := c.userKeyRing.SignDetached(plainMessage)
+	if err != nil {
+		return
+	}
+	return pgpSignature.GetArmored()
+}
+
 func encryptAttachment(kr *crypto.KeyRing, data io.Reader, filename string) (encrypted io.Reader, err error) {
 	if kr == nil {
 		return nil, ErrNoKeyringAvailable
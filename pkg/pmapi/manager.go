@@ -68,9 +68,11 @@ func newManager(cfg Config) *manager {
 	m.rc.SetError(&Error{})
 	m.rc.OnAfterResponse(logConnReuse)
 	m.rc.OnAfterResponse(updateTime)
+	m.rc.OnAfterResponse(observeResponse)
 	m.rc.OnAfterResponse(m.catchAPIError)
 	m.rc.OnAfterResponse(m.handleRequestSuccess)
 	m.rc.OnError(m.handleRequestFailure)
+	m.rc.OnError(observeFailure)
 
 	// Configure retry mechanism.
 	//
@@ -0,0 +1,35 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package pmapi
+
+import "github.com/ljanyst/peroxide/pkg/metrics"
+
+//nolint:gochecknoglobals
+var (
+	apiRequests = metrics.NewCounterVec(
+		"peroxide_api_requests_total",
+		"Number of requests to the ProtonMail API by status code; \"none\" when no response was received.",
+		"method", "code",
+	)
+	apiRequestDuration = metrics.NewHistogramVec(
+		"peroxide_api_request_duration_seconds",
+		"Latency of the requests to the ProtonMail API.",
+		metrics.DefaultBuckets,
+		"method",
+	)
+)
@@ -139,6 +139,36 @@ func (mr *MockClientMockRecorder) CreateAttachment(arg0, arg1, arg2, arg3 interf
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateAttachment", reflect.TypeOf((*MockClient)(nil).CreateAttachment), arg0, arg1, arg2, arg3)
 }
 
+// CreateCalendarEvent mocks base method.
+func (m *MockClient) CreateCalendarEvent(arg0 context.Context, arg1, arg2 string, arg3 *pmapi.CalendarEventContent) (pmapi.CalendarEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateCalendarEvent", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(pmapi.CalendarEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateCalendarEvent indicates an expected call of CreateCalendarEvent.
+func (mr *MockClientMockRecorder) CreateCalendarEvent(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateCalendarEvent", reflect.TypeOf((*MockClient)(nil).CreateCalendarEvent), arg0, arg1, arg2, arg3)
+}
+
+// CreateContact mocks base method.
+func (m *MockClient) CreateContact(arg0 context.Context, arg1 []pmapi.Card) (pmapi.Contact, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "CreateContact", arg0, arg1)
+	ret0, _ := ret[0].(pmapi.Contact)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// CreateContact indicates an expected call of CreateContact.
+func (mr *MockClientMockRecorder) CreateContact(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CreateContact", reflect.TypeOf((*MockClient)(nil).CreateContact), arg0, arg1)
+}
+
 // CreateDraft mocks base method.
 func (m *MockClient) CreateDraft(arg0 context.Context, arg1 *pmapi.Message, arg2 string, arg3 int) (*pmapi.Message, error) {
 	m.ctrl.T.Helper()
@@ -199,6 +229,21 @@ func (mr *MockClientMockRecorder) CurrentUser(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "CurrentUser", reflect.TypeOf((*MockClient)(nil).CurrentUser), arg0)
 }
 
+// DecryptAndVerifyCalendarEvent mocks base method.
+func (m *MockClient) DecryptAndVerifyCalendarEvent(arg0 *crypto.KeyRing, arg1 string, arg2 *pmapi.CalendarEvent) ([]pmapi.Card, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DecryptAndVerifyCalendarEvent", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]pmapi.Card)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// DecryptAndVerifyCalendarEvent indicates an expected call of DecryptAndVerifyCalendarEvent.
+func (mr *MockClientMockRecorder) DecryptAndVerifyCalendarEvent(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptAndVerifyCalendarEvent", reflect.TypeOf((*MockClient)(nil).DecryptAndVerifyCalendarEvent), arg0, arg1, arg2)
+}
+
 // DecryptAndVerifyCards mocks base method.
 func (m *MockClient) DecryptAndVerifyCards(arg0 []pmapi.Card) ([]pmapi.Card, error) {
 	m.ctrl.T.Helper()
@@ -214,6 +259,34 @@ func (mr *MockClientMockRecorder) DecryptAndVerifyCards(arg0 interface{}) *gomoc
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DecryptAndVerifyCards", reflect.TypeOf((*MockClient)(nil).DecryptAndVerifyCards), arg0)
 }
 
+// DeleteCalendarEvent mocks base method.
+func (m *MockClient) DeleteCalendarEvent(arg0 context.Context, arg1, arg2, arg3 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteCalendarEvent", arg0, arg1, arg2, arg3)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteCalendarEvent indicates an expected call of DeleteCalendarEvent.
+func (mr *MockClientMockRecorder) DeleteCalendarEvent(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteCalendarEvent", reflect.TypeOf((*MockClient)(nil).DeleteCalendarEvent), arg0, arg1, arg2, arg3)
+}
+
+// DeleteContacts mocks base method.
+func (m *MockClient) DeleteContacts(arg0 context.Context, arg1 []string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "DeleteContacts", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// DeleteContacts indicates an expected call of DeleteContacts.
+func (mr *MockClientMockRecorder) DeleteContacts(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteContacts", reflect.TypeOf((*MockClient)(nil).DeleteContacts), arg0, arg1)
+}
+
 // DeleteLabel mocks base method.
 func (m *MockClient) DeleteLabel(arg0 context.Context, arg1 string) error {
 	m.ctrl.T.Helper()
@@ -271,6 +344,36 @@ func (mr *MockClientMockRecorder) EmptyFolder(arg0, arg1, arg2 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EmptyFolder", reflect.TypeOf((*MockClient)(nil).EmptyFolder), arg0, arg1, arg2)
 }
 
+// EncryptAndSignCalendarEvent mocks base method.
+func (m *MockClient) EncryptAndSignCalendarEvent(arg0 *crypto.KeyRing, arg1 string, arg2, arg3 []pmapi.Card, arg4 *pmapi.Card) (*pmapi.CalendarEventContent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EncryptAndSignCalendarEvent", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(*pmapi.CalendarEventContent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EncryptAndSignCalendarEvent indicates an expected call of EncryptAndSignCalendarEvent.
+func (mr *MockClientMockRecorder) EncryptAndSignCalendarEvent(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptAndSignCalendarEvent", reflect.TypeOf((*MockClient)(nil).EncryptAndSignCalendarEvent), arg0, arg1, arg2, arg3, arg4)
+}
+
+// EncryptAndSignCards mocks base method.
+func (m *MockClient) EncryptAndSignCards(arg0 []pmapi.Card) ([]pmapi.Card, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "EncryptAndSignCards", arg0)
+	ret0, _ := ret[0].([]pmapi.Card)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// EncryptAndSignCards indicates an expected call of EncryptAndSignCards.
+func (mr *MockClientMockRecorder) EncryptAndSignCards(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EncryptAndSignCards", reflect.TypeOf((*MockClient)(nil).EncryptAndSignCards), arg0)
+}
+
 // GetAddresses mocks base method.
 func (m *MockClient) GetAddresses(arg0 context.Context) (pmapi.AddressList, error) {
 	m.ctrl.T.Helper()
@@ -301,6 +404,36 @@ func (mr *MockClientMockRecorder) GetAttachment(arg0, arg1 interface{}) *gomock.
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetAttachment", reflect.TypeOf((*MockClient)(nil).GetAttachment), arg0, arg1)
 }
 
+// GetCalendarBootstrap mocks base method.
+func (m *MockClient) GetCalendarBootstrap(arg0 context.Context, arg1 string) (*pmapi.CalendarBootstrap, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCalendarBootstrap", arg0, arg1)
+	ret0, _ := ret[0].(*pmapi.CalendarBootstrap)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCalendarBootstrap indicates an expected call of GetCalendarBootstrap.
+func (mr *MockClientMockRecorder) GetCalendarBootstrap(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCalendarBootstrap", reflect.TypeOf((*MockClient)(nil).GetCalendarBootstrap), arg0, arg1)
+}
+
+// GetCalendarEvent mocks base method.
+func (m *MockClient) GetCalendarEvent(arg0 context.Context, arg1, arg2 string) (pmapi.CalendarEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetCalendarEvent", arg0, arg1, arg2)
+	ret0, _ := ret[0].(pmapi.CalendarEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetCalendarEvent indicates an expected call of GetCalendarEvent.
+func (mr *MockClientMockRecorder) GetCalendarEvent(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetCalendarEvent", reflect.TypeOf((*MockClient)(nil).GetCalendarEvent), arg0, arg1, arg2)
+}
+
 // GetContactByID mocks base method.
 func (m *MockClient) GetContactByID(arg0 context.Context, arg1 string) (pmapi.Contact, error) {
 	m.ctrl.T.Helper()
@@ -331,6 +464,21 @@ func (mr *MockClientMockRecorder) GetContactEmailByEmail(arg0, arg1, arg2, arg3
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetContactEmailByEmail", reflect.TypeOf((*MockClient)(nil).GetContactEmailByEmail), arg0, arg1, arg2, arg3)
 }
 
+// GetContactsForExport mocks base method.
+func (m *MockClient) GetContactsForExport(arg0 context.Context, arg1, arg2 int) ([]pmapi.Contact, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetContactsForExport", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]pmapi.Contact)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetContactsForExport indicates an expected call of GetContactsForExport.
+func (mr *MockClientMockRecorder) GetContactsForExport(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetContactsForExport", reflect.TypeOf((*MockClient)(nil).GetContactsForExport), arg0, arg1, arg2)
+}
+
 // GetEvent mocks base method.
 func (m *MockClient) GetEvent(arg0 context.Context, arg1 string) (*pmapi.Event, error) {
 	m.ctrl.T.Helper()
@@ -480,6 +628,36 @@ func (mr *MockClientMockRecorder) LabelMessages(arg0, arg1, arg2 interface{}) *g
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LabelMessages", reflect.TypeOf((*MockClient)(nil).LabelMessages), arg0, arg1, arg2)
 }
 
+// ListCalendarEvents mocks base method.
+func (m *MockClient) ListCalendarEvents(arg0 context.Context, arg1 string, arg2 *pmapi.CalendarEventFilter) ([]pmapi.CalendarEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListCalendarEvents", arg0, arg1, arg2)
+	ret0, _ := ret[0].([]pmapi.CalendarEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListCalendarEvents indicates an expected call of ListCalendarEvents.
+func (mr *MockClientMockRecorder) ListCalendarEvents(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListCalendarEvents", reflect.TypeOf((*MockClient)(nil).ListCalendarEvents), arg0, arg1, arg2)
+}
+
+// ListCalendars mocks base method.
+func (m *MockClient) ListCalendars(arg0 context.Context) ([]pmapi.Calendar, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListCalendars", arg0)
+	ret0, _ := ret[0].([]pmapi.Calendar)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListCalendars indicates an expected call of ListCalendars.
+func (mr *MockClientMockRecorder) ListCalendars(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListCalendars", reflect.TypeOf((*MockClient)(nil).ListCalendars), arg0)
+}
+
 // ListLabels mocks base method.
 func (m *MockClient) ListLabels(arg0 context.Context) ([]*pmapi.Label, error) {
 	m.ctrl.T.Helper()
@@ -641,6 +819,52 @@ func (mr *MockClientMockRecorder) Unlock(arg0, arg1 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unlock", reflect.TypeOf((*MockClient)(nil).Unlock), arg0, arg1)
 }
 
+// UnlockCalendarKeys mocks base method.
+func (m *MockClient) UnlockCalendarKeys(arg0 *pmapi.CalendarBootstrap) (*crypto.KeyRing, *pmapi.CalendarMember, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UnlockCalendarKeys", arg0)
+	ret0, _ := ret[0].(*crypto.KeyRing)
+	ret1, _ := ret[1].(*pmapi.CalendarMember)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// UnlockCalendarKeys indicates an expected call of UnlockCalendarKeys.
+func (mr *MockClientMockRecorder) UnlockCalendarKeys(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UnlockCalendarKeys", reflect.TypeOf((*MockClient)(nil).UnlockCalendarKeys), arg0)
+}
+
+// UpdateCalendarEvent mocks base method.
+func (m *MockClient) UpdateCalendarEvent(arg0 context.Context, arg1, arg2, arg3 string, arg4 *pmapi.CalendarEventContent) (pmapi.CalendarEvent, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateCalendarEvent", arg0, arg1, arg2, arg3, arg4)
+	ret0, _ := ret[0].(pmapi.CalendarEvent)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateCalendarEvent indicates an expected call of UpdateCalendarEvent.
+func (mr *MockClientMockRecorder) UpdateCalendarEvent(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateCalendarEvent", reflect.TypeOf((*MockClient)(nil).UpdateCalendarEvent), arg0, arg1, arg2, arg3, arg4)
+}
+
+// UpdateContact mocks base method.
+func (m *MockClient) UpdateContact(arg0 context.Context, arg1 string, arg2 []pmapi.Card) (pmapi.Contact, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "UpdateContact", arg0, arg1, arg2)
+	ret0, _ := ret[0].(pmapi.Contact)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// UpdateContact indicates an expected call of UpdateContact.
+func (mr *MockClientMockRecorder) UpdateContact(arg0, arg1, arg2 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateContact", reflect.TypeOf((*MockClient)(nil).UpdateContact), arg0, arg1, arg2)
+}
+
 // UpdateLabel mocks base method.
 func (m *MockClient) UpdateLabel(arg0 context.Context, arg1 *pmapi.Label) (*pmapi.Label, error) {
 	m.ctrl.T.Helper()
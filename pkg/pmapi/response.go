@@ -102,6 +102,25 @@ func logConnReuse(_ *resty.Client, res *resty.Response) error {
 	return nil
 }
 
+// observeResponse records the latency and the status code of every response.
+func observeResponse(_ *resty.Client, res *resty.Response) error {
+	method := res.Request.Method
+
+	apiRequestDuration.Observe(res.Time().Seconds(), method)
+	apiRequests.Inc(method, strconv.Itoa(res.StatusCode()))
+
+	return nil
+}
+
+// observeFailure records the requests which did not get any response.
+func observeFailure(req *resty.Request, err error) {
+	if res, ok := err.(*resty.ResponseError); ok && res.Response.RawResponse != nil {
+		return
+	}
+
+	apiRequests.Inc(req.Method, "none")
+}
+
 func catchRetryAfter(_ *resty.Client, res *resty.Response) (time.Duration, error) {
 	if res.StatusCode() == http.StatusTooManyRequests {
 		if after := res.Header().Get("Retry-After"); after != "" {
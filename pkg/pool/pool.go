@@ -29,37 +29,76 @@ type DoneFunc func()
 
 type Pool struct {
 	jobCh *pchan.PChan
+	work  WorkFunc
+
+	size, workers int
+	lock          sync.Mutex
 }
 
 func New(size int, work WorkFunc) *Pool {
-	jobCh := pchan.New()
-
-	for i := 0; i < size; i++ {
-		go func() {
-			for {
-				val, prio, ok := jobCh.Pop()
-				if !ok {
-					return
-				}
-
-				job, ok := val.(*Job)
-				if !ok {
-					panic("bad result type")
-				}
-
-				res, err := work(job.req, prio)
-				if err != nil {
-					job.postFailure(err)
-				} else {
-					job.postSuccess(res)
-				}
-
-				job.waitDone()
-			}
-		}()
+	pool := &Pool{
+		jobCh: pchan.New(),
+		work:  work,
 	}
 
-	return &Pool{jobCh: jobCh}
+	pool.SetSize(size)
+
+	return pool
+}
+
+// SetSize changes the number of workers of the pool. When shrinking, the
+// excess workers stop after finishing their current job.
+func (pool *Pool) SetSize(size int) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.size = size
+
+	for ; pool.workers < size; pool.workers++ {
+		go pool.worker()
+	}
+}
+
+func (pool *Pool) worker() {
+	for !pool.shouldStop() {
+		val, prio, ok := pool.jobCh.Pop()
+		if !ok {
+			return
+		}
+
+		job, ok := val.(*Job)
+		if !ok {
+			panic("bad result type")
+		}
+
+		res, err := pool.work(job.req, prio)
+		if err != nil {
+			job.postFailure(err)
+		} else {
+			job.postSuccess(res)
+		}
+
+		job.waitDone()
+	}
+}
+
+// shouldStop reports whether the calling worker exceeds the size of the pool
+// and should stop.
+func (pool *Pool) shouldStop() bool {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.workers > pool.size {
+		pool.workers--
+		return true
+	}
+
+	return false
+}
+
+// QueueLength returns the number of jobs waiting for a worker.
+func (pool *Pool) QueueLength() int {
+	return pool.jobCh.Len()
 }
 
 func (pool *Pool) NewJob(req interface{}, prio int) (*Job, DoneFunc) {
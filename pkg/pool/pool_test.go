@@ -43,3 +43,37 @@ func TestPool(t *testing.T) {
 	assert.Equal(t, "echo", res1)
 	assert.Equal(t, "this", res2)
 }
+
+func TestPoolSetSize(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	pool := pool.New(1, func(req interface{}, prio int) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return req, nil
+	})
+
+	job1, done1 := pool.NewJob("echo", 1)
+	defer done1()
+
+	job2, done2 := pool.NewJob("this", 1)
+	defer done2()
+
+	<-started
+
+	// The second job can only start once the pool grows.
+	pool.SetSize(2)
+	<-started
+
+	close(release)
+
+	res1, err := job1.GetResult()
+	require.NoError(t, err)
+
+	res2, err := job2.GetResult()
+	require.NoError(t, err)
+
+	assert.Equal(t, "echo", res1)
+	assert.Equal(t, "this", res2)
+}
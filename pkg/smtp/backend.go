@@ -18,38 +18,91 @@
 package smtp
 
 import (
+	"bytes"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
 	goSMTPBackend "github.com/emersion/go-smtp"
 	"github.com/ljanyst/peroxide/pkg/listener"
 	"github.com/ljanyst/peroxide/pkg/users"
-	"github.com/pkg/errors"
 )
 
 type smtpBackend struct {
 	eventListener listener.Listener
 	users         *users.Users
 	bccSelf       bool
+	bccSelfLock   sync.RWMutex
 	sendRecorder  *sendRecorder
+	queue         *OutboundQueue
+
+	sessions     map[*smtpSession]struct{}
+	sessionsLock sync.Mutex
 }
 
 // NewSMTPBackend returns struct implementing go-smtp/backend interface.
+// The messages which cannot be sent while the API is unreachable are put to
+// the queue, if set.
 func NewSMTPBackend(
 	eventListener listener.Listener,
 	users *users.Users,
 	bccSelf bool,
+	queue *OutboundQueue,
 ) *smtpBackend { //nolint[golint]
-	return &smtpBackend{
+	sb := &smtpBackend{
 		eventListener: eventListener,
 		users:         users,
 		bccSelf:       bccSelf,
 		sendRecorder:  newSendRecorder(),
+		queue:         queue,
+	}
+
+	if queue != nil {
+		queue.start(sb.deliverQueued, sb.bounceQueued)
+	}
+
+	return sb
+}
+
+// NewSession returns the session of a new connection. The connection is
+// anonymous until it logs in.
+func (sb *smtpBackend) NewSession(conn *goSMTPBackend.Conn) (goSMTPBackend.Session, error) {
+	session := &smtpSession{backend: sb, conn: conn}
+
+	sb.sessionsLock.Lock()
+	defer sb.sessionsLock.Unlock()
+
+	if sb.sessions == nil {
+		sb.sessions = map[*smtpSession]struct{}{}
+	}
+	sb.sessions[session] = struct{}{}
+
+	return session, nil
+}
+
+func (sb *smtpBackend) removeSession(session *smtpSession) {
+	sb.sessionsLock.Lock()
+	defer sb.sessionsLock.Unlock()
+
+	delete(sb.sessions, session)
+}
+
+// getSessions returns a snapshot of the open sessions, so that they can be
+// closed without holding the lock.
+func (sb *smtpBackend) getSessions() []*smtpSession {
+	sb.sessionsLock.Lock()
+	defer sb.sessionsLock.Unlock()
+
+	sessions := make([]*smtpSession, 0, len(sb.sessions))
+	for session := range sb.sessions {
+		sessions = append(sessions, session)
 	}
+	return sessions
 }
 
-// Login authenticates a user.
-func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, password string) (goSMTPBackend.Session, error) {
+// login authenticates a user.
+func (sb *smtpBackend) login(username, password string) (*smtpUser, error) {
 	username = strings.ToLower(username)
 	username, slot := users.DecodeLogin(username)
 
@@ -74,9 +127,99 @@ func (sb *smtpBackend) Login(_ *goSMTPBackend.ConnectionState, username, passwor
 	// AddressID is only for split mode--it has to be empty for combined mode.
 	addressID := ""
 
-	return newSMTPUser(sb.eventListener, sb, user, username, addressID, sb.bccSelf)
+	return newSMTPUser(sb.eventListener, sb, user, username, addressID, sb.isBCCSelf())
+}
+
+// SetBCCSelf changes the BCC self mode of a running backend. Sessions
+// already logged in keep the previous mode.
+func (sb *smtpBackend) SetBCCSelf(bccSelf bool) {
+	sb.bccSelfLock.Lock()
+	defer sb.bccSelfLock.Unlock()
+
+	sb.bccSelf = bccSelf
+}
+
+func (sb *smtpBackend) isBCCSelf() bool {
+	sb.bccSelfLock.RLock()
+	defer sb.bccSelfLock.RUnlock()
+
+	return sb.bccSelf
 }
 
-func (sb *smtpBackend) AnonymousLogin(_ *goSMTPBackend.ConnectionState) (goSMTPBackend.Session, error) {
-	return nil, errors.New("anonymous login not supported")
+// openQueued returns the session sending the queued message on behalf of its
+// user, the key ring of the address and the decrypted envelope. The user has
+// to be online to have the keys unlocked.
+func (sb *smtpBackend) openQueued(entry *queueEntry) (*smtpUser, *crypto.KeyRing, *queuedEnvelope, error) {
+	user, err := sb.users.GetUser(entry.UserID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !user.IsOnline() {
+		return nil, nil, nil, errUserOffline
+	}
+
+	su, err := newSMTPUser(sb.eventListener, sb, user, user.Username(), "", false)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	kr, err := su.client().KeyRingForAddressID(entry.AddressID)
+	if err != nil {
+		_ = su.Logout()
+		return nil, nil, nil, err
+	}
+
+	env, err := entry.open(kr)
+	if err != nil {
+		_ = su.Logout()
+		return nil, nil, nil, err
+	}
+
+	return su, kr, env, nil
+}
+
+// deliverQueued sends the queued message. The drafts left behind by the
+// failed attempts are removed once the message is sent.
+func (sb *smtpBackend) deliverQueued(entry *queueEntry) error {
+	su, _, env, err := sb.openQueued(entry)
+	if err != nil {
+		return err
+	}
+	defer su.Logout() //nolint[errcheck]
+
+	su.Reset()
+	su.envelopeID = env.EnvelopeID
+	su.returnFull = env.ReturnFull
+	for _, rcpt := range env.getRcpts() {
+		su.rcpts[normalizeAddress(rcpt.address)] = rcpt
+	}
+
+	err = su.Send(env.ReturnPath, env.getTo(), bytes.NewReader(env.Message))
+	if su.failedDraftID != "" {
+		entry.DraftIDs = append(entry.DraftIDs, su.failedDraftID)
+	}
+	if err != nil {
+		return err
+	}
+
+	su.deleteStaleDrafts(entry.DraftIDs)
+	return nil
+}
+
+// bounceQueued drops the report of the failure of all the recipients of the
+// queued message into the Inbox of the sender.
+func (sb *smtpBackend) bounceQueued(entry *queueEntry, status string, reason error) error {
+	su, kr, env, err := sb.openQueued(entry)
+	if err != nil {
+		return err
+	}
+	defer su.Logout() //nolint[errcheck]
+
+	report := &deliveryReport{envelopeID: env.EnvelopeID, returnFull: env.ReturnFull}
+	for _, rcpt := range env.getRcpts() {
+		report.failed(rcpt, status, reason)
+	}
+
+	return su.importDeliveryReport(kr, entry.AddressID, env.ReturnPath, report, env.Message, entry.Queued)
 }
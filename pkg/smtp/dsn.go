@@ -0,0 +1,262 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	goSMTP "github.com/emersion/go-smtp"
+	"github.com/pkg/errors"
+)
+
+// NOTIFY values of the delivery status notifications (RFC 3461).
+const (
+	notifyNever   = "NEVER"
+	notifySuccess = "SUCCESS"
+	notifyFailure = "FAILURE"
+	notifyDelay   = "DELAY"
+)
+
+// Status codes (RFC 3463) of the recipients in the delivery reports.
+const (
+	statusRelayed        = "2.0.0"
+	statusFailed         = "5.0.0"
+	statusInvalidAddress = "5.1.3"
+)
+
+// dsnRecipient is a recipient of the envelope with its DSN parameters.
+type dsnRecipient struct {
+	address string
+
+	// notify is nil when the client did not ask for anything, which means
+	// only the failures are reported.
+	notify []string
+
+	// originalRecipient is the ORCPT parameter, e.g. "rfc822;user@example.com".
+	originalRecipient string
+}
+
+// newDSNRecipient returns the recipient with the DSN parameters of its RCPT TO
+// command, as parsed by go-smtp.
+func newDSNRecipient(address string, opts *goSMTP.RcptOptions) *dsnRecipient {
+	rcpt := &dsnRecipient{address: address}
+	if opts == nil {
+		return rcpt
+	}
+
+	for _, n := range opts.Notify {
+		rcpt.notify = append(rcpt.notify, string(n))
+	}
+
+	if opts.OriginalRecipient != "" {
+		rcpt.originalRecipient = strings.ToLower(string(opts.OriginalRecipientType)) + ";" + opts.OriginalRecipient
+	}
+
+	return rcpt
+}
+
+// wants returns whether the recipient asked to be notified about the outcome.
+func (rcpt *dsnRecipient) wants(outcome string) bool {
+	if rcpt == nil || rcpt.notify == nil {
+		return outcome == notifyFailure
+	}
+
+	for _, n := range rcpt.notify {
+		if n == outcome {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientStatus is the outcome of the sending to a single recipient.
+type recipientStatus struct {
+	rcpt   *dsnRecipient
+	status string
+	err    error
+}
+
+func (s *recipientStatus) isFailed() bool {
+	return s.err != nil
+}
+
+// deliveryReport collects the outcomes of the sending to the recipients. The
+// message is handed over to Proton, which does not tell about the final
+// delivery, so the recipients it accepted are reported as relayed.
+type deliveryReport struct {
+	statuses []*recipientStatus
+
+	// envelopeID is the ENVID parameter of MAIL FROM.
+	envelopeID string
+
+	// returnFull is set by RET=FULL; the report then carries the whole
+	// original message instead of its header only.
+	returnFull bool
+}
+
+func (r *deliveryReport) relayed(rcpt *dsnRecipient) {
+	r.statuses = append(r.statuses, &recipientStatus{rcpt: rcpt, status: statusRelayed})
+}
+
+func (r *deliveryReport) failed(rcpt *dsnRecipient, status string, err error) {
+	log.WithError(err).WithField("recipient", rcpt.address).Warn("Cannot send to recipient")
+	r.statuses = append(r.statuses, &recipientStatus{rcpt: rcpt, status: status, err: err})
+}
+
+// hasRelayed returns whether the message can be sent to anyone at all.
+func (r *deliveryReport) hasRelayed() bool {
+	for _, s := range r.statuses {
+		if !s.isFailed() {
+			return true
+		}
+	}
+	return false
+}
+
+// err returns the error describing all the failures.
+func (r *deliveryReport) err() error {
+	reasons := []string{}
+	for _, s := range r.statuses {
+		if s.isFailed() {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", s.rcpt.address, s.err))
+		}
+	}
+	return errors.New("cannot send to " + strings.Join(reasons, "; "))
+}
+
+// getNotified returns the outcomes the recipients asked to be notified about.
+func (r *deliveryReport) getNotified() []*recipientStatus {
+	notified := []*recipientStatus{}
+	for _, s := range r.statuses {
+		if (s.isFailed() && s.rcpt.wants(notifyFailure)) || (!s.isFailed() && s.rcpt.wants(notifySuccess)) {
+			notified = append(notified, s)
+		}
+	}
+	return notified
+}
+
+// build writes the multipart/report message (RFC 6522) with the delivery
+// status (RFC 3464) of the notified recipients and the original message or
+// its header. It returns nil when there is nothing to notify about.
+func (r *deliveryReport) build(sender string, original []byte, arrival time.Time) ([]byte, error) {
+	notified := r.getNotified()
+	if len(notified) == 0 {
+		return nil, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	domain := "localhost"
+	if i := strings.LastIndexByte(sender, '@'); i >= 0 {
+		domain = sender[i+1:]
+	}
+
+	subject := "Delivery Status Notification (Relay)"
+	for _, s := range notified {
+		if s.isFailed() {
+			subject = "Undelivered Mail Returned to Sender"
+			break
+		}
+	}
+
+	b := new(bytes.Buffer)
+	w := multipart.NewWriter(b)
+
+	header := []string{
+		"From: Mail Delivery System <MAILER-DAEMON@" + domain + ">",
+		"To: <" + sender + ">",
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/report; report-type=delivery-status; boundary="` + w.Boundary() + `"`,
+	}
+	b.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	text, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range notified {
+		if s.isFailed() {
+			fmt.Fprintf(text, "Your message could not be sent to %s: %v\r\n", s.rcpt.address, s.err)
+		} else {
+			fmt.Fprintf(text, "Your message was handed over to Proton for %s.\r\n", s.rcpt.address)
+		}
+	}
+
+	status, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return nil, err
+	}
+	if r.envelopeID != "" {
+		fmt.Fprintf(status, "Original-Envelope-Id: %s\r\n", r.envelopeID)
+	}
+	fmt.Fprintf(status, "Reporting-MTA: dns; %s\r\nArrival-Date: %s\r\n", hostname, arrival.Format(time.RFC1123Z))
+	for _, s := range notified {
+		fmt.Fprintf(status, "\r\n")
+		if s.rcpt.originalRecipient != "" {
+			fmt.Fprintf(status, "Original-Recipient: %s\r\n", s.rcpt.originalRecipient)
+		}
+		fmt.Fprintf(status, "Final-Recipient: rfc822; %s\r\n", s.rcpt.address)
+		if s.isFailed() {
+			fmt.Fprintf(status, "Action: failed\r\nStatus: %s\r\n", s.status)
+			fmt.Fprintf(status, "Diagnostic-Code: smtp; 550 %s %s\r\n", s.status, strings.ReplaceAll(s.err.Error(), "\n", " "))
+		} else {
+			fmt.Fprintf(status, "Action: relayed\r\nStatus: %s\r\n", s.status)
+		}
+	}
+
+	returned, contentType := getHeader(original), "text/rfc822-headers"
+	if r.returnFull {
+		returned, contentType = original, "message/rfc822"
+	}
+
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(returned); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
+
+// getHeader returns the header section of the raw message.
+func getHeader(raw []byte) []byte {
+	for _, sep := range []string{"\r\n\r\n", "\n\n"} {
+		if i := bytes.Index(raw, []byte(sep)); i >= 0 {
+			return raw[:i+len(sep)/2]
+		}
+	}
+	return raw
+}
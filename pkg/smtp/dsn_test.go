@@ -0,0 +1,142 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message"
+	goSMTP "github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDSNRecipient(t *testing.T) {
+	require.Equal(t, &dsnRecipient{address: "user@example.com"}, newDSNRecipient("user@example.com", nil))
+	require.Equal(t, &dsnRecipient{address: "user@example.com"}, newDSNRecipient("user@example.com", &goSMTP.RcptOptions{}))
+
+	rcpt := newDSNRecipient("user@example.com", &goSMTP.RcptOptions{
+		Notify:                []goSMTP.DSNNotify{goSMTP.DSNNotifySuccess, goSMTP.DSNNotifyFailure},
+		OriginalRecipientType: goSMTP.DSNAddressTypeRFC822,
+		OriginalRecipient:     "user+tag@example.com",
+	})
+	require.Equal(t, &dsnRecipient{
+		address:           "user@example.com",
+		notify:            []string{notifySuccess, notifyFailure},
+		originalRecipient: "rfc822;user+tag@example.com",
+	}, rcpt)
+}
+
+func TestDSNRecipientWants(t *testing.T) {
+	var unknown *dsnRecipient
+	require.True(t, unknown.wants(notifyFailure))
+	require.False(t, unknown.wants(notifySuccess))
+
+	never := &dsnRecipient{notify: []string{notifyNever}}
+	require.False(t, never.wants(notifyFailure))
+
+	success := &dsnRecipient{notify: []string{notifySuccess}}
+	require.True(t, success.wants(notifySuccess))
+	require.False(t, success.wants(notifyFailure))
+}
+
+func TestDeliveryReport(t *testing.T) {
+	report := &deliveryReport{}
+	report.relayed(&dsnRecipient{address: "ok@example.com"})
+	report.failed(&dsnRecipient{address: "bad@example.com", originalRecipient: "rfc822;bad@example.com"},
+		statusFailed, errors.New("no valid key"))
+	report.failed(&dsnRecipient{address: "quiet@example.com", notify: []string{notifyNever}},
+		statusFailed, errors.New("no valid key"))
+
+	require.True(t, report.hasRelayed())
+	require.Len(t, report.getNotified(), 1)
+
+	original := []byte("Subject: Hello\r\nTo: ok@example.com\r\n\r\nBody\r\n")
+	require.Equal(t, "Subject: Hello\r\nTo: ok@example.com\r\n", string(getHeader(original)))
+
+	body, err := report.build("me@example.org", original, time.Now())
+	require.NoError(t, err)
+
+	entity, err := message.Read(strings.NewReader(string(body)))
+	require.NoError(t, err)
+	require.Equal(t, "Mail Delivery System <MAILER-DAEMON@example.org>", entity.Header.Get("From"))
+
+	mediaType, params, err := entity.Header.ContentType()
+	require.NoError(t, err)
+	require.Equal(t, "multipart/report", mediaType)
+	require.Equal(t, "delivery-status", params["report-type"])
+
+	parts := readReportParts(t, body)
+	require.Equal(t, []string{"text/plain", "message/delivery-status", "text/rfc822-headers"}, parts.types)
+	require.Equal(t, "Subject: Hello\r\nTo: ok@example.com\r\n", parts.bodies["text/rfc822-headers"])
+
+	status := parts.bodies["message/delivery-status"]
+	require.NotContains(t, status, "Original-Envelope-Id")
+	require.Contains(t, status, "Original-Recipient: rfc822;bad@example.com\r\nFinal-Recipient: rfc822; bad@example.com\r\nAction: failed\r\nStatus: 5.0.0\r\n")
+	require.NotContains(t, status, "ok@example.com")
+	require.NotContains(t, status, "quiet@example.com")
+
+	full := &deliveryReport{envelopeID: "QQ314159", returnFull: true}
+	full.failed(&dsnRecipient{address: "bad@example.com"}, statusFailed, errors.New("no valid key"))
+	body, err = full.build("me@example.org", original, time.Now())
+	require.NoError(t, err)
+
+	parts = readReportParts(t, body)
+	require.Equal(t, []string{"text/plain", "message/delivery-status", "message/rfc822"}, parts.types)
+	require.Equal(t, string(original), parts.bodies["message/rfc822"])
+	require.Contains(t, parts.bodies["message/delivery-status"], "Original-Envelope-Id: QQ314159\r\n")
+
+	quiet := &deliveryReport{}
+	quiet.relayed(&dsnRecipient{address: "ok@example.com"})
+	body, err = quiet.build("me@example.org", original, time.Now())
+	require.NoError(t, err)
+	require.Nil(t, body)
+
+	failed := &deliveryReport{}
+	failed.failed(&dsnRecipient{address: "bad"}, statusInvalidAddress, errors.New("not valid"))
+	require.False(t, failed.hasRelayed())
+	require.EqualError(t, failed.err(), "cannot send to bad: not valid")
+}
+
+type reportParts struct {
+	types  []string
+	bodies map[string]string
+}
+
+func readReportParts(t *testing.T, body []byte) reportParts {
+	entity, err := message.Read(strings.NewReader(string(body)))
+	require.NoError(t, err)
+
+	parts := reportParts{bodies: map[string]string{}}
+	mr := entity.MultipartReader()
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		mediaType, _, _ := part.Header.ContentType()
+		b, err := ioutil.ReadAll(part.Body)
+		require.NoError(t, err)
+		parts.types = append(parts.types, mediaType)
+		parts.bodies[mediaType] = string(b)
+	}
+	return parts
+}
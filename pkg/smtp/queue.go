@@ -0,0 +1,545 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/events"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/pkg/errors"
+)
+
+const (
+	queueStateFile  = "state.json"
+	queueEntryExt   = ".entry"
+	statusExpired   = "4.4.7"
+	queueMaxBackoff = time.Hour
+)
+
+// queueRetrySleeps defines how long to wait before the next attempt to send a
+// queued message. The client manager also tells when the API is reachable
+// again, so these matter only when the API goes down without us noticing.
+var queueRetrySleeps = []time.Duration{ //nolint:gochecknoglobals
+	time.Minute, 5 * time.Minute, 15 * time.Minute, 30 * time.Minute, queueMaxBackoff,
+}
+
+var (
+	errUserOffline  = errors.New("user is not online")
+	errStillSending = errors.New("original message is still being sent")
+)
+
+// isTemporary returns whether sending may succeed later without any change
+// of the message.
+func isTemporary(err error) bool {
+	switch errors.Cause(err) {
+	case pmapi.ErrNoConnection, errUserOffline, errStillSending:
+		return true
+	}
+	return false
+}
+
+// queueState is the part of the queue shared by all the users. UIDs are
+// never reused, so that the Outbox mailbox keeps a single UID validity.
+type queueState struct {
+	UIDValidity uint32
+	UIDNext     uint32
+}
+
+// queueEntry is a message waiting in the queue. Only the data needed to
+// schedule the attempts are stored in the clear; the envelope and the
+// message are encrypted with the key of the sending address.
+type queueEntry struct {
+	ID          string
+	UID         uint32
+	UserID      string
+	AddressID   string
+	Queued      time.Time
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string   `json:",omitempty"`
+	DraftIDs    []string `json:",omitempty"`
+	Envelope    []byte
+}
+
+type queuedEnvelope struct {
+	ReturnPath string
+	EnvelopeID string `json:",omitempty"`
+	ReturnFull bool   `json:",omitempty"`
+	Rcpts      []queuedRecipient
+	Message    []byte
+}
+
+type queuedRecipient struct {
+	Address           string
+	Notify            []string `json:",omitempty"`
+	OriginalRecipient string   `json:",omitempty"`
+}
+
+func (env *queuedEnvelope) addRcpt(rcpt *dsnRecipient) {
+	env.Rcpts = append(env.Rcpts, queuedRecipient{
+		Address:           rcpt.address,
+		Notify:            rcpt.notify,
+		OriginalRecipient: rcpt.originalRecipient,
+	})
+}
+
+func (env *queuedEnvelope) getTo() []string {
+	to := []string{}
+	for _, rcpt := range env.Rcpts {
+		to = append(to, rcpt.Address)
+	}
+	return to
+}
+
+func (env *queuedEnvelope) getRcpts() []*dsnRecipient {
+	rcpts := []*dsnRecipient{}
+	for _, rcpt := range env.Rcpts {
+		rcpts = append(rcpts, &dsnRecipient{
+			address:           rcpt.Address,
+			notify:            rcpt.Notify,
+			originalRecipient: rcpt.OriginalRecipient,
+		})
+	}
+	return rcpts
+}
+
+func (entry *queueEntry) seal(kr *crypto.KeyRing, env *queuedEnvelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	enc, err := kr.Encrypt(crypto.NewPlainMessage(b), kr)
+	if err != nil {
+		return errors.Wrap(err, "cannot encrypt queued message")
+	}
+
+	entry.Envelope = enc.GetBinary()
+	return nil
+}
+
+func (entry *queueEntry) open(kr *crypto.KeyRing) (*queuedEnvelope, error) {
+	dec, err := kr.Decrypt(crypto.NewPGPMessage(entry.Envelope), kr, crypto.GetUnixTime())
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decrypt queued message")
+	}
+
+	env := &queuedEnvelope{}
+	if err := json.Unmarshal(dec.GetBinary(), env); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// QueuedMessage is a message waiting in the outbound queue, as shown in the
+// Outbox mailbox.
+type QueuedMessage struct {
+	UID     uint32
+	Queued  time.Time
+	Literal []byte
+}
+
+// OutboundQueue keeps the messages which could not be sent because the
+// ProtonMail API was unreachable and sends them in the background. It
+// observes the connection state of the client manager, so that the queue is
+// retried as soon as the API is reachable again. The messages which cannot be
+// sent before they expire are bounced back to the sender.
+type OutboundQueue struct {
+	eventListener listener.Listener
+	dir           string
+	expiry        time.Duration
+
+	lock     sync.Mutex
+	state    queueState
+	down     bool
+	retryAll bool
+	wake     chan struct{}
+
+	deliver func(*queueEntry) error
+	bounce  func(entry *queueEntry, status string, reason error) error
+}
+
+// NewOutboundQueue returns the queue stored in dir. The messages expire
+// after the given time.
+func NewOutboundQueue(eventListener listener.Listener, dir string, expiry time.Duration) (*OutboundQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	q := &OutboundQueue{
+		eventListener: eventListener,
+		dir:           dir,
+		expiry:        expiry,
+		wake:          make(chan struct{}, 1),
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, queueStateFile))
+	switch {
+	case os.IsNotExist(err):
+		q.state = queueState{UIDValidity: uint32(time.Now().Unix()), UIDNext: 1}
+		if err := q.saveState(); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &q.state); err != nil {
+			return nil, errors.Wrap(err, "malformed queue state")
+		}
+	}
+
+	return q, nil
+}
+
+// OnDown pauses the sending until the API is reachable again.
+func (q *OutboundQueue) OnDown() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.down = true
+}
+
+// OnUp retries all the queued messages.
+func (q *OutboundQueue) OnUp() {
+	q.lock.Lock()
+	q.down = false
+	q.retryAll = true
+	q.lock.Unlock()
+
+	q.notify()
+}
+
+// UIDValidity returns the UID validity of the Outbox mailbox.
+func (q *OutboundQueue) UIDValidity() uint32 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.state.UIDValidity
+}
+
+// UIDNext returns the UID the next queued message will get.
+func (q *OutboundQueue) UIDNext() uint32 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.state.UIDNext
+}
+
+// UIDs returns the UIDs of the messages queued by the user. If addressID is
+// not empty, only the messages sent from the address are returned.
+func (q *OutboundQueue) UIDs(userID, addressID string) ([]uint32, error) {
+	entries, err := q.getEntries(userID, addressID)
+	if err != nil {
+		return nil, err
+	}
+
+	uids := []uint32{}
+	for _, entry := range entries {
+		uids = append(uids, entry.UID)
+	}
+	return uids, nil
+}
+
+// List returns the messages queued by the user decrypted with the keys
+// of their addresses. If addressID is not empty, only the messages sent from
+// the address are returned.
+func (q *OutboundQueue) List(
+	userID, addressID string,
+	keyRingForAddressID func(string) (*crypto.KeyRing, error),
+) ([]*QueuedMessage, error) {
+	entries, err := q.getEntries(userID, addressID)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := []*QueuedMessage{}
+	for _, entry := range entries {
+		kr, err := keyRingForAddressID(entry.AddressID)
+		if err != nil {
+			return nil, err
+		}
+
+		env, err := entry.open(kr)
+		if err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, &QueuedMessage{UID: entry.UID, Queued: entry.Queued, Literal: env.Message})
+	}
+	return msgs, nil
+}
+
+// start sends the queued messages in the background using the given
+// functions of the SMTP backend.
+func (q *OutboundQueue) start(
+	deliver func(*queueEntry) error,
+	bounce func(entry *queueEntry, status string, reason error) error,
+) {
+	q.deliver = deliver
+	q.bounce = bounce
+
+	go q.run()
+}
+
+// add queues the message which could not be sent because of sendErr.
+func (q *OutboundQueue) add(
+	userID, addressID string,
+	kr *crypto.KeyRing,
+	env *queuedEnvelope,
+	draftIDs []string,
+	sendErr error,
+) error {
+	now := time.Now()
+	entry := &queueEntry{
+		ID:          newQueueEntryID(),
+		UserID:      userID,
+		AddressID:   addressID,
+		Queued:      now,
+		Attempts:    1,
+		NextAttempt: now.Add(getQueueRetrySleep(0)),
+		LastError:   sendErr.Error(),
+		DraftIDs:    draftIDs,
+	}
+
+	if err := entry.seal(kr, env); err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	entry.UID = q.state.UIDNext
+	q.state.UIDNext++
+	err := q.saveState()
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := q.save(entry); err != nil {
+		return err
+	}
+
+	log.WithField("userID", userID).WithField("uid", entry.UID).Info("Message queued")
+	q.eventListener.Emit(events.OutboxChangedEvent, userID)
+	q.notify()
+	return nil
+}
+
+func (q *OutboundQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *OutboundQueue) run() {
+	for {
+		wait := q.process()
+
+		select {
+		case <-q.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// process goes through the queue once and returns how long to wait before
+// the next message is due.
+func (q *OutboundQueue) process() time.Duration {
+	entries, err := q.getEntries("", "")
+	if err != nil {
+		log.WithError(err).Error("Cannot read the outbound queue")
+		return getQueueRetrySleep(0)
+	}
+
+	q.lock.Lock()
+	down, retryAll := q.down, q.retryAll
+	q.retryAll = false
+	q.lock.Unlock()
+
+	wait := queueMaxBackoff
+	for _, entry := range entries {
+		if time.Since(entry.Queued) >= q.expiry {
+			q.expire(entry)
+			continue
+		}
+
+		if !down && (retryAll || !time.Now().Before(entry.NextAttempt)) && q.attempt(entry) {
+			continue
+		}
+
+		// While the API is down, the due messages wait for OnUp to wake the
+		// queue, only the expiry is still timed.
+		if d := time.Until(entry.NextAttempt); !down && d < wait {
+			wait = d
+		}
+		if d := time.Until(entry.Queued.Add(q.expiry)); d < wait {
+			wait = d
+		}
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// attempt tries to send the queued message and returns whether it left the
+// queue.
+func (q *OutboundQueue) attempt(entry *queueEntry) bool {
+	log := log.WithField("userID", entry.UserID).WithField("uid", entry.UID)
+
+	err := q.deliver(entry)
+	if err == nil {
+		log.Info("Queued message sent")
+		q.remove(entry)
+		return true
+	}
+
+	if !isTemporary(err) {
+		log.WithError(err).Warn("Queued message cannot be sent")
+		q.bounceAndRemove(entry, statusFailed, err)
+		return true
+	}
+
+	log.WithError(err).WithField("attempts", entry.Attempts).Debug("Queued message not sent yet")
+	entry.NextAttempt = time.Now().Add(getQueueRetrySleep(entry.Attempts))
+	entry.Attempts++
+	entry.LastError = err.Error()
+	if err := q.save(entry); err != nil {
+		log.WithError(err).Error("Cannot update queued message")
+	}
+	return false
+}
+
+func (q *OutboundQueue) expire(entry *queueEntry) {
+	log.WithField("userID", entry.UserID).WithField("uid", entry.UID).Warn("Queued message expired")
+
+	reason := errors.Errorf("the message could not be sent within %d hours", int(q.expiry.Hours()))
+	if entry.LastError != "" {
+		reason = errors.Errorf("%v: %s", reason, entry.LastError)
+	}
+	q.bounceAndRemove(entry, statusExpired, reason)
+}
+
+// bounceAndRemove reports the failure to the sender and drops the message.
+// The message is kept if the report cannot be delivered yet.
+func (q *OutboundQueue) bounceAndRemove(entry *queueEntry, status string, reason error) {
+	if err := q.bounce(entry, status, reason); err != nil {
+		if isTemporary(err) {
+			log.WithError(err).Debug("Cannot bounce queued message yet")
+			return
+		}
+		log.WithError(err).Error("Cannot bounce queued message, dropping it")
+	}
+	q.remove(entry)
+}
+
+// getEntries returns the queued messages ordered by UID. The empty userID or
+// addressID matches all of them.
+func (q *OutboundQueue) getEntries(userID, addressID string) ([]*queueEntry, error) {
+	files, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*queueEntry{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), queueEntryExt) {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(q.dir, file.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &queueEntry{}
+		if err := json.Unmarshal(b, entry); err != nil {
+			log.WithError(err).WithField("file", file.Name()).Error("Malformed queued message")
+			continue
+		}
+
+		if (userID == "" || entry.UserID == userID) && (addressID == "" || entry.AddressID == addressID) {
+			entries = append(entries, entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].UID < entries[j].UID })
+	return entries, nil
+}
+
+func (q *OutboundQueue) save(entry *queueEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(q.dir, entry.ID+queueEntryExt), b)
+}
+
+func (q *OutboundQueue) remove(entry *queueEntry) {
+	if err := os.Remove(filepath.Join(q.dir, entry.ID+queueEntryExt)); err != nil {
+		log.WithError(err).Error("Cannot remove queued message")
+		return
+	}
+	q.eventListener.Emit(events.OutboxChangedEvent, entry.UserID)
+}
+
+// saveState has to be called with the lock held.
+func (q *OutboundQueue) saveState() error {
+	b, err := json.Marshal(q.state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(q.dir, queueStateFile), b)
+}
+
+func writeFileAtomic(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newQueueEntryID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func getQueueRetrySleep(idx int) time.Duration {
+	if idx >= len(queueRetrySleeps) {
+		idx = len(queueRetrySleeps) - 1
+	}
+	return queueRetrySleeps[idx]
+}
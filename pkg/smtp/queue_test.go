@@ -0,0 +1,186 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ProtonMail/gopenpgp/v2/crypto"
+	"github.com/ljanyst/peroxide/pkg/listener"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+const testQueuedMessage = "From: sender@pm.me\r\nTo: rcpt@example.com\r\nSubject: Hello\r\n\r\nHello\r\n"
+
+func newTestQueue(t *testing.T, dir string) (*OutboundQueue, *crypto.KeyRing) {
+	q, err := NewOutboundQueue(listener.New(), dir, 24*time.Hour)
+	require.NoError(t, err)
+
+	key, err := crypto.GenerateKey("sender", "sender@pm.me", "x25519", 0)
+	require.NoError(t, err)
+	kr, err := crypto.NewKeyRing(key)
+	require.NoError(t, err)
+
+	return q, kr
+}
+
+func addTestMessage(t *testing.T, q *OutboundQueue, kr *crypto.KeyRing, addressID string) {
+	env := &queuedEnvelope{ReturnPath: "sender@pm.me", Message: []byte(testQueuedMessage)}
+	env.addRcpt(&dsnRecipient{address: "rcpt@example.com", notify: []string{notifySuccess}})
+
+	require.NoError(t, q.add("userID", addressID, kr, env, nil, pmapi.ErrNoConnection))
+}
+
+func TestOutboundQueueList(t *testing.T) {
+	dir := t.TempDir()
+	q, kr := newTestQueue(t, dir)
+
+	addTestMessage(t, q, kr, "addressID")
+	addTestMessage(t, q, kr, "otherAddressID")
+
+	keyRing := func(string) (*crypto.KeyRing, error) { return kr, nil }
+
+	msgs, err := q.List("userID", "", keyRing)
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	require.Equal(t, uint32(1), msgs[0].UID)
+	require.Equal(t, uint32(2), msgs[1].UID)
+	require.Equal(t, testQueuedMessage, string(msgs[0].Literal))
+
+	uids, err := q.UIDs("userID", "otherAddressID")
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2}, uids)
+
+	uids, err = q.UIDs("otherUserID", "")
+	require.NoError(t, err)
+	require.Empty(t, uids)
+
+	entries, err := q.getEntries("", "addressID")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.NotContains(t, string(entries[0].Envelope), "Hello")
+
+	env, err := entries[0].open(kr)
+	require.NoError(t, err)
+	require.Equal(t, []string{"rcpt@example.com"}, env.getTo())
+	require.Equal(t, []*dsnRecipient{{address: "rcpt@example.com", notify: []string{notifySuccess}}}, env.getRcpts())
+
+	// The UIDs are never reused, not even after a restart.
+	reopened, _ := newTestQueue(t, dir)
+	require.Equal(t, q.UIDValidity(), reopened.UIDValidity())
+	require.Equal(t, uint32(3), reopened.UIDNext())
+}
+
+func TestOutboundQueueProcess(t *testing.T) {
+	q, kr := newTestQueue(t, t.TempDir())
+	addTestMessage(t, q, kr, "addressID")
+
+	var deliverErr, bounceErr error
+	delivered, bounced := 0, []string{}
+	q.deliver = func(*queueEntry) error {
+		delivered++
+		return deliverErr
+	}
+	q.bounce = func(_ *queueEntry, status string, _ error) error {
+		bounced = append(bounced, status)
+		return bounceErr
+	}
+
+	getEntries := func() []*queueEntry {
+		entries, err := q.getEntries("", "")
+		require.NoError(t, err)
+		return entries
+	}
+
+	// The first retry is not due yet.
+	require.Equal(t, time.Minute, q.process().Round(time.Minute))
+	require.Equal(t, 0, delivered)
+
+	// The API is back, but still failing.
+	deliverErr = pmapi.ErrNoConnection
+	q.OnUp()
+	q.process()
+	require.Equal(t, 1, delivered)
+	entries := getEntries()
+	require.Len(t, entries, 1)
+	require.Equal(t, 2, entries[0].Attempts)
+	require.Equal(t, pmapi.ErrNoConnection.Error(), entries[0].LastError)
+	require.True(t, entries[0].NextAttempt.After(time.Now().Add(4*time.Minute)))
+
+	// Nothing is attempted while the API is down.
+	q.OnUp()
+	q.OnDown()
+	q.process()
+	require.Equal(t, 1, delivered)
+
+	q.OnUp()
+	deliverErr = nil
+	q.process()
+	require.Equal(t, 2, delivered)
+	require.Empty(t, getEntries())
+	require.Empty(t, bounced)
+
+	// The permanent failures are bounced.
+	addTestMessage(t, q, kr, "addressID")
+	deliverErr = errors.New("invalid recipient")
+	q.OnUp()
+	q.process()
+	require.Equal(t, []string{statusFailed}, bounced)
+	require.Empty(t, getEntries())
+
+	// The expired messages are bounced once the report can be imported.
+	addTestMessage(t, q, kr, "addressID")
+	entries = getEntries()
+	entries[0].Queued = time.Now().Add(-25 * time.Hour)
+	require.NoError(t, q.save(entries[0]))
+
+	bounceErr = errUserOffline
+	q.process()
+	require.Equal(t, []string{statusFailed, statusExpired}, bounced)
+	require.Len(t, getEntries(), 1)
+
+	bounceErr = nil
+	q.process()
+	require.Equal(t, []string{statusFailed, statusExpired, statusExpired}, bounced)
+	require.Empty(t, getEntries())
+}
+
+func TestOutboundQueueWaitWhileDown(t *testing.T) {
+	q, kr := newTestQueue(t, t.TempDir())
+	addTestMessage(t, q, kr, "addressID")
+
+	delivered := 0
+	q.deliver = func(*queueEntry) error {
+		delivered++
+		return nil
+	}
+
+	entries, err := q.getEntries("", "")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	entries[0].NextAttempt = time.Now().Add(-time.Minute)
+	require.NoError(t, q.save(entries[0]))
+
+	// The due message does not make the queue spin while the API is down.
+	q.OnDown()
+	require.Equal(t, queueMaxBackoff, q.process().Round(time.Minute))
+	require.Equal(t, 0, delivered)
+}
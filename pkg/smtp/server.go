@@ -31,34 +31,40 @@ import (
 
 // Server is Bridge SMTP server implementation.
 type Server struct {
-	backend goSMTP.Backend
-	debug   bool
-	useSSL  bool
-	address string
-	port    int
-	tls     *tls.Config
+	backend           *smtpBackend
+	debug             bool
+	useSSL            bool
+	allowInsecureAuth bool
+	address           string
+	port              int
+	tls               *tls.Config
 
 	server     *goSMTP.Server
 	controller serverutil.Controller
 }
 
 // NewSMTPServer returns an SMTP server configured with the given options.
+// With useSSL, the server speaks TLS from the start (SMTPS), otherwise it
+// offers STARTTLS. Unless allowInsecureAuth is set, clients must switch to TLS
+// before they can log in.
 func NewSMTPServer(
 	debug bool,
 	address string,
 	port int,
 	useSSL bool,
+	allowInsecureAuth bool,
 	tls *tls.Config,
-	smtpBackend goSMTP.Backend,
+	smtpBackend *smtpBackend,
 	eventListener listener.Listener,
 ) *Server {
 	server := &Server{
-		backend: smtpBackend,
-		debug:   debug,
-		useSSL:  useSSL,
-		address: address,
-		port:    port,
-		tls:     tls,
+		backend:           smtpBackend,
+		debug:             debug,
+		useSSL:            useSSL,
+		allowInsecureAuth: allowInsecureAuth,
+		address:           address,
+		port:              port,
+		tls:               tls,
 	}
 
 	server.server = newGoSMTPServer(server)
@@ -72,18 +78,18 @@ func newGoSMTPServer(s *Server) *goSMTP.Server {
 	newSMTP.TLSConfig = s.tls
 	newSMTP.Domain = "127.0.0.1"
 	newSMTP.ErrorLog = serverutil.NewServerErrorLogger(serverutil.SMTP)
-	newSMTP.AllowInsecureAuth = true
+	newSMTP.AllowInsecureAuth = s.allowInsecureAuth
 	newSMTP.MaxLineLength = 1 << 16
+	// 8BITMIME is always announced; with SMTPUTF8 the clients can also use
+	// the internationalised addresses and the UTF-8 headers.
+	newSMTP.EnableSMTPUTF8 = true
+	// The DSN parameters (RFC 3461) of MAIL FROM and RCPT TO are used for
+	// the delivery reports.
+	newSMTP.EnableDSN = true
 
 	newSMTP.EnableAuth(sasl.Login, func(conn *goSMTP.Conn) sasl.Server {
 		return sasl.NewLoginServer(func(address, password string) error {
-			user, err := conn.Server().Backend.Login(nil, address, password)
-			if err != nil {
-				return err
-			}
-
-			conn.SetSession(user)
-			return nil
+			return conn.Session().AuthPlain(address, password)
 		})
 	})
 	return newSMTP
@@ -109,14 +115,13 @@ func (s *Server) SetLoggers(localDebug, remoteDebug io.Writer) { s.server.Debug
 
 func (s *Server) DisconnectUser(address string) {
 	log.Info("Disconnecting all open SMTP connections for ", address)
-	s.server.ForEachConn(func(conn *goSMTP.Conn) {
-		connUser := conn.Session()
-		if connUser != nil {
-			if err := conn.Close(); err != nil {
+	for _, session := range s.backend.getSessions() {
+		if session.getUser() != nil {
+			if err := session.conn.Close(); err != nil {
 				log.WithError(err).Error("Failed to close the connection")
 			}
 		}
-	})
+	}
 }
 
 func (s *Server) Serve(l net.Listener) error { return s.server.Serve(l) }
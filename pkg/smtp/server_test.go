@@ -0,0 +1,128 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	netSMTP "net/smtp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// serveTestSMTP starts the server and returns a client connected to it.
+func serveTestSMTP(t *testing.T, useSSL, allowInsecureAuth bool) *netSMTP.Client {
+	tlsConfig := newTestTLSConfig(t)
+	server := NewSMTPServer(false, "127.0.0.1", 0, useSSL, allowInsecureAuth, tlsConfig, &smtpBackend{}, nil)
+
+	var l net.Listener
+	var err error
+	if useSSL {
+		l, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	require.NoError(t, err)
+
+	go server.Serve(l) //nolint:errcheck
+	t.Cleanup(func() { _ = server.StopServe() })
+
+	var conn net.Conn
+	if useSSL {
+		conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true}) //nolint:gosec
+	} else {
+		conn, err = net.Dial("tcp", l.Addr().String())
+	}
+	require.NoError(t, err)
+
+	client, err := netSMTP.NewClient(conn, "127.0.0.1")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
+
+func TestSMTPServerAuthBeforeTLS(t *testing.T) {
+	client := serveTestSMTP(t, false, false)
+
+	ok, _ := client.Extension("AUTH")
+	require.False(t, ok)
+
+	ok, _ = client.Extension("STARTTLS")
+	require.True(t, ok)
+
+	client = serveTestSMTP(t, false, true)
+
+	ok, _ = client.Extension("AUTH")
+	require.True(t, ok)
+}
+
+func TestSMTPServerImplicitTLS(t *testing.T) {
+	client := serveTestSMTP(t, true, false)
+
+	ok, _ := client.Extension("AUTH")
+	require.True(t, ok)
+
+	ok, _ = client.Extension("STARTTLS")
+	require.False(t, ok)
+}
+
+func TestSMTPServerUTF8(t *testing.T) {
+	client := serveTestSMTP(t, false, true)
+
+	ok, _ := client.Extension("SMTPUTF8")
+	require.True(t, ok)
+
+	ok, _ = client.Extension("8BITMIME")
+	require.True(t, ok)
+}
+
+func TestSMTPServerDSN(t *testing.T) {
+	client := serveTestSMTP(t, false, true)
+
+	ok, _ := client.Extension("DSN")
+	require.True(t, ok)
+
+	// The transaction needs a logged in user.
+	err := client.Mail("me@example.org")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "authenticate")
+}
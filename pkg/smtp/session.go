@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Proton Technologies AG
+//
+// This file is part of ProtonMail Bridge.
+//
+// ProtonMail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// ProtonMail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with ProtonMail Bridge.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"io"
+	"sync"
+
+	goSMTP "github.com/emersion/go-smtp"
+)
+
+// smtpSession is the session of one SMTP connection. The commands of the
+// transaction are handed over to the user once the connection logs in.
+type smtpSession struct {
+	backend *smtpBackend
+	conn    *goSMTP.Conn
+
+	user     *smtpUser
+	userLock sync.RWMutex
+}
+
+func (s *smtpSession) AuthPlain(username, password string) error {
+	user, err := s.backend.login(username, password)
+	if err != nil {
+		return err
+	}
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	if s.user != nil {
+		_ = s.user.Logout()
+	}
+	s.user = user
+	return nil
+}
+
+func (s *smtpSession) getUser() *smtpUser {
+	s.userLock.RLock()
+	defer s.userLock.RUnlock()
+
+	return s.user
+}
+
+func (s *smtpSession) Reset() {
+	if user := s.getUser(); user != nil {
+		user.Reset()
+	}
+}
+
+func (s *smtpSession) Mail(from string, opts *goSMTP.MailOptions) error {
+	user := s.getUser()
+	if user == nil {
+		return goSMTP.ErrAuthRequired
+	}
+	return user.Mail(from, opts)
+}
+
+func (s *smtpSession) Rcpt(to string, opts *goSMTP.RcptOptions) error {
+	user := s.getUser()
+	if user == nil {
+		return goSMTP.ErrAuthRequired
+	}
+	return user.Rcpt(to, opts)
+}
+
+func (s *smtpSession) Data(r io.Reader) error {
+	user := s.getUser()
+	if user == nil {
+		return goSMTP.ErrAuthRequired
+	}
+	return user.Data(r)
+}
+
+func (s *smtpSession) Logout() error {
+	s.backend.removeSession(s)
+
+	s.userLock.Lock()
+	defer s.userLock.Unlock()
+
+	if s.user == nil {
+		return nil
+	}
+
+	err := s.user.Logout()
+	s.user = nil
+	return err
+}
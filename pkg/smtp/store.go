@@ -33,5 +33,6 @@ type storeUserProvider interface {
 		attachedPublicKeyName string,
 		parentID string) (*pmapi.Message, []*pmapi.Attachment, error)
 	SendMessage(messageID string, req *pmapi.SendMessageReq) error
+	ImportMessage(addressID, labelID string, enc []byte, flags, time int64) (string, error)
 	GetMaxUpload() (int64, error)
 }
@@ -25,6 +25,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/mail"
 	"strings"
@@ -35,11 +36,19 @@ import (
 	"github.com/ljanyst/peroxide/pkg/listener"
 	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/message/parser"
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/users"
 	"github.com/pkg/errors"
 )
 
+//nolint:gochecknoglobals
+var connections = metrics.NewGaugeVec(
+	"peroxide_smtp_connections",
+	"Number of logged in SMTP connections.",
+	"user",
+)
+
 type smtpUser struct {
 	eventListener listener.Listener
 	backend       *smtpBackend
@@ -51,6 +60,20 @@ type smtpUser struct {
 
 	returnPath string
 	to         []string
+	utf8       bool
+
+	// envelopeID and returnFull are the ENVID and RET parameters of MAIL
+	// FROM used in the delivery report.
+	envelopeID string
+	returnFull bool
+
+	// rcpts are the DSN parameters of the recipients, by the normalized
+	// address.
+	rcpts map[string]*dsnRecipient
+
+	// failedDraftID is the draft created by Send before the message failed
+	// to be sent.
+	failedDraftID string
 }
 
 // newSMTPUser returns struct implementing go-smtp/session interface.
@@ -61,12 +84,14 @@ func newSMTPUser(
 	username string,
 	addressID string,
 	bccSelf bool,
-) (goSMTPBackend.Session, error) {
+) (*smtpUser, error) {
 	storeUser := user.GetStore()
 	if storeUser == nil {
 		return nil, errors.New("user database is not initialized")
 	}
 
+	connections.Inc(user.ID())
+
 	return &smtpUser{
 		eventListener: eventListener,
 		backend:       smtpBackend,
@@ -158,19 +183,29 @@ func (su *smtpUser) Reset() {
 	log.Trace("Resetting the session")
 	su.returnPath = ""
 	su.to = []string{}
+	su.utf8 = false
+	su.envelopeID = ""
+	su.returnFull = false
+	su.rcpts = map[string]*dsnRecipient{}
+	su.failedDraftID = ""
 }
 
 // Set return path for currently processed message.
-func (su *smtpUser) Mail(returnPath string, opts goSMTPBackend.MailOptions) error {
+func (su *smtpUser) Mail(returnPath string, opts *goSMTPBackend.MailOptions) error {
 	log.WithField("returnPath", returnPath).WithField("opts", opts).Trace("Setting mail from")
 
-	// REQUIRETLS and SMTPUTF8 have to be announced to be used by client.
-	// Bridge does not use those extensions so this should not happen.
+	if opts == nil {
+		opts = &goSMTPBackend.MailOptions{}
+	}
+
+	// REQUIRETLS has to be announced to be used by client.
+	// Bridge does not use this extension so this should not happen.
 	if opts.RequireTLS {
 		return errors.New("REQUIRETLS extension is not supported")
 	}
-	if opts.UTF8 {
-		return errors.New("SMTPUTF8 extension is not supported")
+
+	if err := checkEnvelopeAddress(returnPath, opts.UTF8); err != nil {
+		return err
 	}
 
 	if opts.Auth != nil && *opts.Auth != "" && *opts.Auth != su.username {
@@ -185,14 +220,25 @@ func (su *smtpUser) Mail(returnPath string, opts goSMTPBackend.MailOptions) erro
 	}
 
 	su.returnPath = returnPath
+	su.utf8 = opts.UTF8
+	su.envelopeID = opts.EnvelopeID
+	su.returnFull = opts.Return == goSMTPBackend.DSNReturnFull
 	return nil
 }
 
 // Add recipient for currently processed message.
-func (su *smtpUser) Rcpt(to string) error {
+func (su *smtpUser) Rcpt(to string, opts *goSMTPBackend.RcptOptions) error {
 	log.WithField("to", to).Trace("Adding recipient")
-	if to != "" {
-		su.to = append(su.to, to)
+	rcpt := newDSNRecipient(to, opts)
+	if err := checkEnvelopeAddress(rcpt.address, su.utf8); err != nil {
+		return err
+	}
+	if rcpt.address != "" {
+		su.to = append(su.to, rcpt.address)
+		if su.rcpts == nil {
+			su.rcpts = map[string]*dsnRecipient{}
+		}
+		su.rcpts[normalizeAddress(rcpt.address)] = rcpt
 	}
 	return nil
 }
@@ -219,11 +265,85 @@ func (su *smtpUser) Data(r io.Reader) error {
 		su.to = append(su.to, su.returnPath)
 	}
 
-	return su.Send(su.returnPath, su.to, r)
+	if su.backend.queue == nil {
+		return su.Send(su.returnPath, su.to, r)
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	err = su.Send(su.returnPath, su.to, bytes.NewReader(raw))
+	if errors.Cause(err) == pmapi.ErrNoConnection {
+		return su.enqueue(raw, err)
+	}
+	return err
+}
+
+// enqueue puts the message which could not be sent because of sendErr to the
+// outbound queue. The message is accepted only if it was queued.
+func (su *smtpUser) enqueue(raw []byte, sendErr error) error {
+	addr := su.client().Addresses().ByEmail(su.returnPath)
+	if addr == nil {
+		return sendErr
+	}
+
+	kr, err := su.client().KeyRingForAddressID(addr.ID)
+	if err != nil {
+		return sendErr
+	}
+
+	env := &queuedEnvelope{
+		ReturnPath: su.returnPath,
+		EnvelopeID: su.envelopeID,
+		ReturnFull: su.returnFull,
+		Message:    raw,
+	}
+	for _, to := range su.to {
+		rcpt := su.rcpts[normalizeAddress(to)]
+		if rcpt == nil {
+			rcpt = &dsnRecipient{address: to}
+		}
+		env.addRcpt(rcpt)
+	}
+
+	draftIDs := []string{}
+	if su.failedDraftID != "" {
+		draftIDs = append(draftIDs, su.failedDraftID)
+	}
+
+	if err := su.backend.queue.add(su.user.ID(), addr.ID, kr, env, draftIDs, sendErr); err != nil {
+		log.WithError(err).Error("Cannot queue message")
+		return sendErr
+	}
+	return nil
+}
+
+// deleteStaleDrafts removes the drafts created by the failed attempts to send
+// a message, unless they were sent after all.
+func (su *smtpUser) deleteStaleDrafts(draftIDs []string) {
+	stale := []string{}
+	for _, draftID := range draftIDs {
+		draft, err := su.client().GetMessage(context.TODO(), draftID)
+		if err != nil || !draft.IsDraft() {
+			continue
+		}
+		stale = append(stale, draftID)
+	}
+
+	if len(stale) == 0 {
+		return
+	}
+
+	if err := su.client().DeleteMessages(context.TODO(), stale); err != nil {
+		log.WithError(err).WithField("draftIDs", stale).Warn("Stale drafts cannot be deleted")
+	}
 }
 
 // Send sends an email from the given address to the given addresses with the given body.
 func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader) (err error) { //nolint[funlen]
+	arrival := time.Now()
 	b := new(bytes.Buffer)
 
 	messageReader = io.TeeReader(messageReader, b)
@@ -327,7 +447,7 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 	}
 	if isSending {
 		log.Warn("Message is still in send queue, returning error to prevent client from adding it to the sent folder prematurely")
-		return errors.New("original message is still being sent")
+		return errStillSending
 	}
 	if wasSent {
 		log.Warn("Message was already sent")
@@ -371,18 +491,32 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 	req := pmapi.NewSendMessageReq(kr, mimeBody, plainBody, richBody, attkeys)
 	containsUnencryptedRecipients := false
 
+	// The recipients which cannot be sent to are left out and reported back
+	// to the sender, so that one bad address or key does not fail the rest.
+	report := &deliveryReport{envelopeID: su.envelopeID, returnFull: su.returnFull}
+
 	for _, recipient := range message.Recipients() {
 		email := recipient.Address
+		rcpt := su.rcpts[normalizeAddress(email)]
+		if rcpt == nil {
+			rcpt = &dsnRecipient{address: email}
+		}
+
 		if !looksLikeEmail(email) {
-			return errors.New(`"` + email + `" is not a valid recipient.`)
+			report.failed(rcpt, statusInvalidAddress, errors.New(`"`+email+`" is not a valid recipient.`))
+			continue
 		}
 
 		sendPreferences, err := su.getSendPreferences(email, message.MIMEType, mailSettings)
-		if !sendPreferences.Encrypt {
-			containsUnencryptedRecipients = true
+		if errors.Cause(err) == pmapi.ErrNoConnection {
+			return err
 		}
 		if err != nil {
-			return err
+			report.failed(rcpt, statusFailed, err)
+			continue
+		}
+		if !sendPreferences.Encrypt {
+			containsUnencryptedRecipients = true
 		}
 
 		var signature pmapi.SignatureFlag
@@ -393,8 +527,15 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 		}
 
 		if err := req.AddRecipient(email, sendPreferences.Scheme, sendPreferences.PublicKey, signature, sendPreferences.MIMEType, sendPreferences.Encrypt); err != nil {
-			return errors.Wrap(err, "failed to add recipient")
+			report.failed(rcpt, statusFailed, errors.Wrap(err, "failed to add recipient"))
+			continue
 		}
+
+		report.relayed(rcpt)
+	}
+
+	if !report.hasRelayed() {
+		return report.err()
 	}
 
 	if containsUnencryptedRecipients {
@@ -409,7 +550,41 @@ func (su *smtpUser) Send(returnPath string, to []string, messageReader io.Reader
 
 	dumpMessageData(b.Bytes(), message.Subject)
 
-	return su.storeUser.SendMessage(message.ID, req)
+	if err := su.storeUser.SendMessage(message.ID, req); err != nil {
+		su.failedDraftID = message.ID
+		return err
+	}
+
+	// The message is already sent, so the failures are only logged.
+	if err := su.importDeliveryReport(kr, addr.ID, returnPath, report, b.Bytes(), arrival); err != nil {
+		log.WithError(err).Error("Failed to import delivery report")
+	}
+	return nil
+}
+
+// importDeliveryReport drops the delivery report into the Inbox of the sender.
+func (su *smtpUser) importDeliveryReport(
+	kr *crypto.KeyRing,
+	addressID, sender string,
+	report *deliveryReport,
+	original []byte,
+	arrival time.Time,
+) error {
+	body, err := report.build(sender, original, arrival)
+	if err != nil {
+		return errors.Wrap(err, "failed to build delivery report")
+	}
+	if body == nil {
+		return nil
+	}
+
+	enc, err := pkgMsg.EncryptRFC822(kr, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed to encrypt delivery report")
+	}
+
+	_, err = su.storeUser.ImportMessage(addressID, pmapi.InboxLabel, enc, pmapi.FlagReceived, time.Now().Unix())
+	return err
 }
 
 func (su *smtpUser) handleReferencesHeader(m *pmapi.Message) (draftID, parentID string) {
@@ -475,11 +650,13 @@ func (su *smtpUser) handleSenderAndRecipients(m *pmapi.Message, returnPathAddr *
 	}
 
 	// Sanitize ToList because some clients add *Sender* in the *ToList* when only Bcc is filled.
+	// The internationalised addresses are compared in the same normalization form, as the
+	// envelope and the header may be composed differently.
 	i := 0
 	for _, keep := range m.ToList {
 		keepThis := false
 		for _, addr := range to {
-			if addr == keep.Address {
+			if normalizeAddress(addr) == normalizeAddress(keep.Address) {
 				keepThis = true
 				break
 			}
@@ -500,11 +677,11 @@ func (su *smtpUser) handleSenderAndRecipients(m *pmapi.Message, returnPathAddr *
 
 	rm := map[string]bool{}
 	for _, r := range recipients {
-		rm[r.Address] = true
+		rm[normalizeAddress(r.Address)] = true
 	}
 
 	for _, r := range to {
-		if !rm[r] {
+		if !rm[normalizeAddress(r)] {
 			// Recipient is not known, add it to Bcc.
 			m.BCCList = append(m.BCCList, &mail.Address{Address: r})
 		}
@@ -516,5 +693,6 @@ func (su *smtpUser) handleSenderAndRecipients(m *pmapi.Message, returnPathAddr *
 // Logout is called when this User will no longer be used.
 func (su *smtpUser) Logout() error {
 	log.Debug("SMTP client logged out user ", su.addressID)
+	connections.Dec(su.user.ID())
 	return nil
 }
@@ -19,6 +19,10 @@ package smtp
 
 import (
 	"regexp"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
 )
 
 //nolint:gochecknoglobals // Used like a constant
@@ -31,3 +35,37 @@ var mailFormat = regexp.MustCompile(`.+@.+\..+`)
 func looksLikeEmail(e string) bool {
 	return mailFormat.MatchString(e)
 }
+
+// checkEnvelopeAddress validates the address of MAIL FROM or RCPT TO. The
+// addresses with UTF-8 local parts or domains (RFC 6531) can be used only by
+// the clients which asked for SMTPUTF8.
+func checkEnvelopeAddress(address string, utf8Enabled bool) error {
+	if isASCII(address) {
+		return nil
+	}
+	if !utf8Enabled {
+		return errors.New("SMTPUTF8 is required for address " + address)
+	}
+	if !utf8.ValidString(address) {
+		return errors.New("address is not valid UTF-8")
+	}
+	if !looksLikeEmail(address) {
+		return errors.New(`"` + address + `" is not a valid address`)
+	}
+	return nil
+}
+
+// normalizeAddress returns the address in the normalization form C, so that
+// the same internationalised address composed differently matches.
+func normalizeAddress(address string) string {
+	return norm.NFC.String(address)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"net/mail"
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckEnvelopeAddress(t *testing.T) {
+	require.NoError(t, checkEnvelopeAddress("user@example.com", false))
+	require.NoError(t, checkEnvelopeAddress("", false))
+	require.Error(t, checkEnvelopeAddress("jiří@příklad.cz", false))
+	require.NoError(t, checkEnvelopeAddress("jiří@příklad.cz", true))
+	require.NoError(t, checkEnvelopeAddress("用户@例子.广告", true))
+	require.Error(t, checkEnvelopeAddress("jiř\xff@příklad.cz", true))
+	require.Error(t, checkEnvelopeAddress("jiří", true))
+}
+
+func TestHandleSenderAndRecipientsUTF8(t *testing.T) {
+	su := &smtpUser{}
+	m := &pmapi.Message{
+		ToList: []*mail.Address{
+			{Address: "jir\u030ci\u0301@pr\u030ci\u0301klad.cz"}, // Decomposed "jiří@příklad.cz".
+			{Address: "user@example.com"},
+		},
+	}
+
+	err := su.handleSenderAndRecipients(m, &pmapi.Address{Email: "user@example.com"}, "user@example.com",
+		[]string{"ji\u0159\u00ed@p\u0159\u00edklad.cz", "用户@例子.广告"})
+	require.NoError(t, err)
+
+	require.Len(t, m.ToList, 1)
+	require.Equal(t, "ji\u0159\u00ed@p\u0159\u00edklad.cz", normalizeAddress(m.ToList[0].Address))
+	require.Len(t, m.BCCList, 1)
+	require.Equal(t, "用户@例子.广告", m.BCCList[0].Address)
+	require.Equal(t, "user@example.com", m.Sender.Address)
+}
@@ -55,6 +55,20 @@ func (storeAddress *Address) CreateMailbox(name string) error {
 	return storeAddress.store.createMailbox(name)
 }
 
+// CreateLabel creates the label by calling an API and returns its mailbox.
+// Unlike CreateMailbox, the mailbox is available immediately.
+func (storeAddress *Address) CreateLabel(name string) (*Mailbox, error) {
+	labelID, err := storeAddress.store.createLabel(name)
+	if err != nil {
+		return nil, err
+	}
+
+	storeAddress.store.lock.RLock()
+	defer storeAddress.store.lock.RUnlock()
+
+	return storeAddress.getMailboxByID(labelID)
+}
+
 // updateMailbox updates the mailbox by calling an API.
 // Mailbox is updated in the structure by processing event.
 func (storeAddress *Address) updateMailbox(labelID, newName, color string) error {
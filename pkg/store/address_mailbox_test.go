@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateLabel(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+
+	m.client.EXPECT().CreateLabel(gomock.Any(), gomock.Any()).DoAndReturn(func(_ interface{}, label *pmapi.Label) (*pmapi.Label, error) {
+		require.Equal(t, "work", label.Name)
+		require.False(t, bool(label.Exclusive))
+		return &pmapi.Label{ID: "labelID", Name: "work", Type: pmapi.LabelTypeMailBox}, nil
+	})
+	m.client.EXPECT().GetEvent(gomock.Any(), "latestEventID").Return(&pmapi.Event{EventID: "latestEventID"}, nil).AnyTimes()
+
+	storeAddress := m.store.addresses[addrID1]
+
+	storeMailbox, err := storeAddress.CreateLabel("work")
+	require.NoError(t, err)
+	require.Equal(t, "labelID", storeMailbox.LabelID())
+	require.Equal(t, UserLabelsPrefix+"work", storeMailbox.Name())
+	require.True(t, storeMailbox.IsLabel())
+
+	sameMailbox, err := storeAddress.GetMailbox(UserLabelsPrefix + "work")
+	require.NoError(t, err)
+	require.Equal(t, storeMailbox, sameMailbox)
+
+	_, err = storeAddress.CreateLabel("work")
+	require.Error(t, err)
+}
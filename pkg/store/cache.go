@@ -24,11 +24,15 @@ import (
 	"github.com/ljanyst/peroxide/pkg/message"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/ljanyst/peroxide/pkg/store/cache"
+	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
 )
 
 const passphraseKey = "passphrase"
 
+// ErrCacheKeyRotating is returned when the cache key is already being rotated.
+var ErrCacheKeyRotating = errors.New("cache key rotation is already running") //nolint[gochecknoglobals]
+
 // UnlockCache unlocks the cache for the user with the given keyring.
 func (store *Store) UnlockCache(kr *crypto.KeyRing) error {
 	passphrase, err := store.getCachePassphrase()
@@ -62,11 +66,118 @@ func (store *Store) UnlockCache(kr *crypto.KeyRing) error {
 		return err
 	}
 
+	if err := store.unlockSearchIndex(passphrase); err != nil {
+		return err
+	}
+
 	store.msgCachePool.start()
 
 	return nil
 }
 
+// ClearCache removes the cached messages and the search index and starts
+// filling a new cache unlocked with the given keyring.
+func (store *Store) ClearCache(kr *crypto.KeyRing) error {
+	if err := store.RemoveCache(); err != nil {
+		return err
+	}
+
+	if err := store.UnlockCache(kr); err != nil {
+		return err
+	}
+
+	store.StartWatcher()
+
+	return nil
+}
+
+// RotateCacheKey replaces the cache passphrase with a new one, encrypted with
+// the given keyring. The search index and the cached messages are re-encrypted
+// in the background; they stay available meanwhile.
+func (store *Store) RotateCacheKey(kr *crypto.KeyRing) error {
+	store.rotationLock.Lock()
+	defer store.rotationLock.Unlock()
+
+	if store.rotationDone != nil {
+		select {
+		case <-store.rotationDone:
+		default:
+			return ErrCacheKeyRotating
+		}
+	}
+
+	encPassphrase, err := store.getCachePassphrase()
+	if err != nil {
+		return err
+	}
+
+	// Nothing was encrypted yet.
+	if encPassphrase == nil {
+		return store.UnlockCache(kr)
+	}
+
+	dec, err := kr.Decrypt(crypto.NewPGPMessage(encPassphrase), nil, crypto.GetUnixTime())
+	if err != nil {
+		return err
+	}
+
+	oldPassphrase := dec.GetBinary()
+
+	newPassphrase, err := crypto.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	enc, err := kr.Encrypt(crypto.NewPlainMessage(newPassphrase), nil)
+	if err != nil {
+		return err
+	}
+
+	if err := store.setCachePassphrase(enc.GetBinary()); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	store.rotationCancel = cancel
+	store.rotationDone = done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		// The cached messages are re-encrypted even if the search index
+		// fails, the new passphrase is in place already.
+		if err := store.rotateSearchIndexKey(ctx, oldPassphrase, newPassphrase); err != nil {
+			store.log.WithError(err).Error("Failed to re-encrypt the search index")
+		}
+
+		if err := cache.RotateKey(ctx, store.cache, store.user.ID(), oldPassphrase, newPassphrase); err != nil {
+			store.log.WithError(err).Error("Failed to re-encrypt the cached messages")
+			return
+		}
+
+		store.log.Info("Cache key rotated")
+	}()
+
+	return nil
+}
+
+// stopCacheKeyRotation stops the rotation of the cache key, if it runs, and
+// waits for it to finish.
+func (store *Store) stopCacheKeyRotation() {
+	store.rotationLock.Lock()
+	defer store.rotationLock.Unlock()
+
+	if store.rotationCancel == nil {
+		return
+	}
+
+	store.rotationCancel()
+	<-store.rotationDone
+}
+
 func (store *Store) getCachePassphrase() ([]byte, error) {
 	var passphrase []byte
 
@@ -114,6 +225,7 @@ func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
 	if store.IsCached(messageID) {
 		literal, err := store.cache.Get(store.user.ID(), messageID)
 		if err == nil {
+			cacheRequests.Inc("hit")
 			return literal, nil
 		}
 		store.log.
@@ -122,6 +234,8 @@ func (store *Store) getCachedMessage(messageID string) ([]byte, error) {
 			Warn("Message is cached but cannot be retrieved")
 	}
 
+	cacheRequests.Inc("miss")
+
 	job, done := store.newBuildJob(context.Background(), messageID, message.ForegroundPriority)
 	defer done()
 
@@ -177,7 +291,7 @@ func (store *Store) BuildAndCacheMessage(ctx context.Context, messageID string)
 	buildAndCacheJobs <- struct{}{}
 	defer func() { <-buildAndCacheJobs }()
 
-	if store.isMessageADraft(messageID) {
+	if store.isMessageADraft(messageID) || cache.IsFull(store.cache, store.user.ID()) {
 		return nil
 	}
 
@@ -190,6 +304,10 @@ func (store *Store) BuildAndCacheMessage(ctx context.Context, messageID string)
 		return err
 	}
 
+	if _, err := store.indexMessage(messageID, literal); err != nil {
+		store.log.WithField("msgID", messageID).WithError(err).Warn("Failed to index message")
+	}
+
 	return store.cache.Set(store.user.ID(), messageID, literal)
 }
 
@@ -18,8 +18,13 @@
 package cache
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -39,6 +44,38 @@ func TestOnDiskCacheGZipCompression(t *testing.T) {
 	testCache(t, cache)
 }
 
+func TestOnDiskCacheZstdCompression(t *testing.T) {
+	cmp, err := NewZstdCompressor()
+	require.NoError(t, err)
+
+	cache, err := NewOnDiskCache(t.TempDir(), cmp, Options{ConcurrentRead: runtime.NumCPU(), ConcurrentWrite: runtime.NumCPU()})
+	require.NoError(t, err)
+
+	testCache(t, cache)
+}
+
+func TestZstdCompressorReadsGZip(t *testing.T) {
+	literal := []byte("To: user@example.com\r\n\r\nSome body")
+
+	gz, err := GZipCompressor{}.Compress(literal)
+	require.NoError(t, err)
+
+	cmp, err := NewZstdCompressor()
+	require.NoError(t, err)
+
+	dec, err := cmp.Decompress(gz)
+	require.NoError(t, err)
+	require.Equal(t, literal, dec)
+
+	zst, err := cmp.Compress(literal)
+	require.NoError(t, err)
+	require.NotEqual(t, gz, zst)
+
+	dec, err = cmp.Decompress(zst)
+	require.NoError(t, err)
+	require.Equal(t, literal, dec)
+}
+
 func TestInMemoryCache(t *testing.T) {
 	testCache(t, NewInMemoryCache(1<<20))
 }
@@ -71,3 +108,128 @@ func getSetCachedMessage(t *testing.T, cache Cache, userID, messageID, secret st
 
 	assert.Equal(t, []byte(secret), data)
 }
+
+func TestOnDiskCacheEviction(t *testing.T) {
+	// The encrypted messages are 28 bytes bigger: the nonce and the tag.
+	const size = 100 + 28
+
+	c, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{
+		MaxSize:         4 * size,
+		MaxUserSize:     3 * size,
+		ConcurrentRead:  runtime.NumCPU(),
+		ConcurrentWrite: runtime.NumCPU(),
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Unlock("userID1", []byte("my secret passphrase")))
+	require.NoError(t, c.Unlock("userID2", []byte("my other passphrase")))
+
+	literal := make([]byte, 100)
+
+	for _, messageID := range []string{"messageID1", "messageID2", "messageID3"} {
+		require.NoError(t, c.Set("userID1", messageID, literal))
+	}
+	require.True(t, IsFull(c, "userID1"))
+	require.False(t, IsFull(c, "userID2"))
+
+	// The read message is kept, the least recently used one is evicted.
+	_, err = c.Get("userID1", "messageID1")
+	require.NoError(t, err)
+
+	require.NoError(t, c.Set("userID1", "messageID4", literal))
+	require.True(t, c.Has("userID1", "messageID1"))
+	require.False(t, c.Has("userID1", "messageID2"))
+	require.True(t, c.Has("userID1", "messageID3"))
+
+	// Over the global limit, the least recently used message of any user is
+	// evicted.
+	require.NoError(t, c.Set("userID2", "messageID5", literal))
+	require.NoError(t, c.Set("userID2", "messageID6", literal))
+	require.False(t, c.Has("userID1", "messageID3"))
+	require.True(t, c.Has("userID2", "messageID5"))
+
+	// The messages bigger than the limits are not cached.
+	require.NoError(t, c.Set("userID2", "messageID7", make([]byte, 4*size)))
+	require.False(t, c.Has("userID2", "messageID7"))
+}
+
+func TestOnDiskCacheRotateKey(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{ConcurrentRead: runtime.NumCPU(), ConcurrentWrite: runtime.NumCPU()}
+	oldPassphrase, newPassphrase := []byte("my old passphrase"), []byte("my new passphrase")
+
+	c, err := NewOnDiskCache(dir, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Unlock("userID1", oldPassphrase))
+	require.NoError(t, c.Unlock("userID2", oldPassphrase))
+	require.NoError(t, c.Set("userID1", "messageID1", []byte("some secret")))
+	require.NoError(t, c.Set("userID1", "messageID2", []byte("some other secret")))
+	require.NoError(t, c.Set("userID2", "messageID3", []byte("not rotated")))
+
+	require.NoError(t, RotateKey(context.Background(), c, "userID1", oldPassphrase, newPassphrase))
+
+	// Only the messages of the user are re-encrypted with the new passphrase.
+	c, err = NewOnDiskCache(dir, &NoopCompressor{}, opts)
+	require.NoError(t, err)
+
+	require.NoError(t, c.Unlock("userID1", newPassphrase))
+	require.NoError(t, c.Unlock("userID2", oldPassphrase))
+
+	getCachedMessage(t, c, "userID1", "messageID1", "some secret")
+	getCachedMessage(t, c, "userID1", "messageID2", "some other secret")
+	getCachedMessage(t, c, "userID2", "messageID3", "not rotated")
+
+	require.NoError(t, c.Unlock("userID1", oldPassphrase))
+	_, err = c.Get("userID1", "messageID1")
+	require.Error(t, err)
+}
+
+func TestOnDiskCacheReadDuringRotation(t *testing.T) {
+	c, err := NewOnDiskCache(t.TempDir(), &NoopCompressor{}, Options{ConcurrentRead: runtime.NumCPU(), ConcurrentWrite: runtime.NumCPU()})
+	require.NoError(t, err)
+
+	require.NoError(t, c.Unlock("userID1", []byte("my old passphrase")))
+	require.NoError(t, c.Set("userID1", "messageID1", []byte("some secret")))
+
+	// The rotation has started but the message was not re-encrypted yet.
+	require.NoError(t, c.Unlock("userID1", []byte("my new passphrase")))
+
+	onDisk := c.(*onDiskCache)
+	onDisk.oldGCM["userID1"], err = newGCM([]byte("my old passphrase"))
+	require.NoError(t, err)
+
+	getCachedMessage(t, c, "userID1", "messageID1", "some secret")
+	getSetCachedMessage(t, c, "userID1", "messageID2", "new secret")
+}
+
+func getCachedMessage(t *testing.T, cache Cache, userID, messageID, secret string) {
+	data, err := cache.Get(userID, messageID)
+	require.NoError(t, err)
+	require.Equal(t, []byte(secret), data)
+}
+
+func TestLoadLRU(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	for i, name := range []string{"b", "a", "c"} {
+		path := filepath.Join(dir, "user"+name, "message")
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(name), 0600))
+		require.NoError(t, os.Chtimes(path, now, now.Add(time.Duration(i)*time.Minute)))
+	}
+
+	l, err := loadLRU(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), l.getSize(""))
+	require.Equal(t, uint64(1), l.getSize("usera"))
+	require.Equal(t, filepath.Join(dir, "userb", "message"), l.oldest("").path)
+
+	l.touch(filepath.Join(dir, "userb", "message"))
+	require.Equal(t, filepath.Join(dir, "usera", "message"), l.oldest("").path)
+
+	l.removeUser("usera")
+	require.Equal(t, filepath.Join(dir, "userc", "message"), l.oldest("").path)
+	require.Nil(t, l.oldest("usera"))
+}
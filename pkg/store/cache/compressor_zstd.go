@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"bytes"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// gzipMagic starts every gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b} //nolint:gochecknoglobals
+
+// ZstdCompressor compresses the messages with Zstandard, which decompresses
+// several times faster than gzip. It also reads the messages compressed by
+// GZipCompressor, so the cache does not need to be cleared when switching.
+type ZstdCompressor struct {
+	enc *zstd.Encoder
+	dec *zstd.Decoder
+}
+
+func NewZstdCompressor() (*ZstdCompressor, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZstdCompressor{enc: enc, dec: dec}, nil
+}
+
+func (c *ZstdCompressor) Compress(dec []byte) ([]byte, error) {
+	return c.enc.EncodeAll(dec, nil), nil
+}
+
+func (c *ZstdCompressor) Decompress(cmp []byte) ([]byte, error) {
+	if bytes.HasPrefix(cmp, gzipMagic) {
+		return GZipCompressor{}.Decompress(cmp)
+	}
+
+	return c.dec.DecodeAll(cmp, nil)
+}
@@ -18,6 +18,7 @@
 package cache
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -28,33 +29,81 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/semaphore"
 	"github.com/ricochet2200/go-disk-usage/du"
+	"github.com/sirupsen/logrus"
 )
 
+var log = logrus.WithField("pkg", "store/cache") //nolint:gochecknoglobals
+
 var ErrMsgCorrupted = errors.New("ecrypted file was corrupted")
 var ErrLowSpace = errors.New("not enough free space left on device")
 
+//nolint:gochecknoglobals
+var (
+	diskSizeBytes = metrics.NewGaugeVec(
+		"peroxide_cache_disk_size_bytes",
+		"Size of the file system holding the message cache.",
+	)
+	diskFreeBytes = metrics.NewGaugeVec(
+		"peroxide_cache_disk_free_bytes",
+		"Space available on the file system holding the message cache.",
+	)
+	cacheSizeBytes = metrics.NewGaugeVec(
+		"peroxide_cache_size_bytes",
+		"Size of the messages in the cache.",
+	)
+	cacheEvictions = metrics.NewCounterVec(
+		"peroxide_cache_evictions_total",
+		"Number of the messages evicted from the cache.",
+	)
+)
+
+// prefetchRatio is the part of the size limits up to which the cache is
+// filled in advance. The rest is left for the messages being read, so that
+// the prefetch does not evict them.
+const prefetchRatio = 0.9
+
+// prefetchReserve is the free space, above the free space limits, below which
+// the cache is not filled in advance anymore.
+const prefetchReserve = 100 << 20
+
 // IsOnDiskCache will return true if Cache is type of onDiskCache.
 func IsOnDiskCache(c Cache) bool {
 	_, ok := c.(*onDiskCache)
 	return ok
 }
 
+// IsFull returns whether the cache of the user is close to its size or free
+// space limits, so that the messages should only be cached when read.
+func IsFull(c Cache, userID string) bool {
+	onDisk, ok := c.(*onDiskCache)
+	return ok && onDisk.isFull(userID)
+}
+
 type onDiskCache struct {
 	path string
 	opts Options
 
 	gcm        map[string]cipher.AEAD
+	oldGCM     map[string]cipher.AEAD
+	gcmLock    sync.RWMutex
 	cmp        Compressor
-	rsem, wsem semaphore.Semaphore
+	rsem, wsem *semaphore.Semaphore
 	pending    *pending
 
 	diskSize uint64
 	diskFree uint64
 	once     *sync.Once
 	lock     sync.Mutex
+
+	// The access order of the messages, to evict the least recently used
+	// ones. It is locked before lock when both are needed.
+	lru     *lru
+	lruLock sync.Mutex
 }
 
 func NewOnDiskCache(path string, cmp Compressor, opts Options) (Cache, error) {
@@ -74,7 +123,17 @@ func NewOnDiskCache(path string, cmp Compressor, opts Options) (Cache, error) {
 		return nil, fmt.Errorf("cannot write to target: %w", err)
 	}
 
+	lru, err := loadLRU(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the cached messages: %w", err)
+	}
+	cacheSizeBytes.Set(float64(lru.getSize("")))
+
 	usage := du.NewDiskUsage(path)
+	diskSizeBytes.Set(float64(usage.Size()))
+	diskFreeBytes.Set(float64(usage.Available()))
+
+	rsem, wsem := semaphore.New(opts.ConcurrentRead), semaphore.New(opts.ConcurrentWrite)
 
 	// NOTE(GODT-1158): use Available() or Free()?
 	return &onDiskCache{
@@ -82,34 +141,30 @@ func NewOnDiskCache(path string, cmp Compressor, opts Options) (Cache, error) {
 		opts: opts,
 
 		gcm:     make(map[string]cipher.AEAD),
+		oldGCM:  make(map[string]cipher.AEAD),
 		cmp:     cmp,
-		rsem:    semaphore.New(opts.ConcurrentRead),
-		wsem:    semaphore.New(opts.ConcurrentWrite),
+		rsem:    &rsem,
+		wsem:    &wsem,
 		pending: newPending(),
 
 		diskSize: usage.Size(),
 		diskFree: usage.Available(),
 		once:     &sync.Once{},
+
+		lru: lru,
 	}, nil
 }
 
 func (c *onDiskCache) Lock(userID string) {
+	c.gcmLock.Lock()
+	defer c.gcmLock.Unlock()
+
 	delete(c.gcm, userID)
+	delete(c.oldGCM, userID)
 }
 
 func (c *onDiskCache) Unlock(userID string, passphrase []byte) error {
-	hash := sha256.New()
-
-	if _, err := hash.Write(passphrase); err != nil {
-		return err
-	}
-
-	aes, err := aes.NewCipher(hash.Sum(nil))
-	if err != nil {
-		return err
-	}
-
-	gcm, err := cipher.NewGCM(aes)
+	gcm, err := newGCM(passphrase)
 	if err != nil {
 		return err
 	}
@@ -118,14 +173,38 @@ func (c *onDiskCache) Unlock(userID string, passphrase []byte) error {
 		return err
 	}
 
+	c.gcmLock.Lock()
+	defer c.gcmLock.Unlock()
+
 	c.gcm[userID] = gcm
 
 	return nil
 }
 
+// RotateKey re-encrypts the cached messages of the user, encrypted with the
+// old passphrase, with the new one. The messages stay readable meanwhile:
+// the new messages are encrypted with the new passphrase and the messages not
+// re-encrypted yet are decrypted with the old one. If the rotation stops
+// early, the remaining messages cannot be read anymore and are built again
+// when requested.
+func RotateKey(ctx context.Context, c Cache, userID string, oldPassphrase, newPassphrase []byte) error {
+	onDisk, ok := c.(*onDiskCache)
+	if !ok {
+		// The messages are kept in memory in plain text.
+		return nil
+	}
+
+	return onDisk.rotateKey(ctx, userID, oldPassphrase, newPassphrase)
+}
+
 func (c *onDiskCache) Delete(userID string) error {
 	defer c.update()
 
+	c.lruLock.Lock()
+	c.lru.removeUser(getHash(userID))
+	cacheSizeBytes.Set(float64(c.lru.getSize("")))
+	c.lruLock.Unlock()
+
 	return os.RemoveAll(c.getUserPath(userID))
 }
 
@@ -133,8 +212,9 @@ func (c *onDiskCache) Delete(userID string) error {
 func (c *onDiskCache) Has(userID, messageID string) bool {
 	c.pending.wait(c.getMessagePath(userID, messageID))
 
-	c.rsem.Lock()
-	defer c.rsem.Unlock()
+	rsem, _ := c.semaphores()
+	rsem.Lock()
+	defer rsem.Unlock()
 
 	_, err := os.Stat(c.getMessagePath(userID, messageID))
 
@@ -153,22 +233,30 @@ func (c *onDiskCache) Has(userID, messageID string) bool {
 }
 
 func (c *onDiskCache) Get(userID, messageID string) ([]byte, error) {
-	gcm, ok := c.gcm[userID]
-	if !ok || gcm == nil {
+	gcm, oldGCM := c.getGCM(userID)
+	if gcm == nil {
 		return nil, ErrCacheNeedsUnlock
 	}
 
-	enc, err := c.readFile(c.getMessagePath(userID, messageID))
+	path := c.getMessagePath(userID, messageID)
+
+	enc, err := c.readFile(path)
 	if err != nil {
 		return nil, err
 	}
 
+	c.touch(path)
+
 	// Data stored in file must larger than NonceSize.
 	if len(enc) <= gcm.NonceSize() {
 		return nil, ErrMsgCorrupted
 	}
 
 	cmp, err := gcm.Open(nil, enc[:gcm.NonceSize()], enc[gcm.NonceSize():], nil)
+	if err != nil && oldGCM != nil {
+		// The message was not re-encrypted with the new passphrase yet.
+		cmp, err = oldGCM.Open(nil, enc[:oldGCM.NonceSize()], enc[oldGCM.NonceSize():], nil)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -177,8 +265,8 @@ func (c *onDiskCache) Get(userID, messageID string) ([]byte, error) {
 }
 
 func (c *onDiskCache) Set(userID, messageID string, literal []byte) error {
-	gcm, ok := c.gcm[userID]
-	if !ok {
+	gcm, _ := c.getGCM(userID)
+	if gcm == nil {
 		return ErrCacheNeedsUnlock
 	}
 	nonce := make([]byte, gcm.NonceSize())
@@ -192,24 +280,297 @@ func (c *onDiskCache) Set(userID, messageID string, literal []byte) error {
 		return err
 	}
 
-	// NOTE(GODT-1158, GODT-1488): Need to properly handle low space. Don't
-	// return error, that's bad. Send event and clean least used message.
-	if !c.hasSpace(len(cmp)) {
+	enc := gcm.Seal(nonce, nonce, cmp, nil)
+	path := c.getMessagePath(userID, messageID)
+
+	// The messages which do not fit are not cached; it is not an error.
+	if !c.makeSpace(uint64(len(enc))) {
 		return nil
 	}
 
-	return c.writeFile(c.getMessagePath(userID, messageID), gcm.Seal(nonce, nonce, cmp, nil))
+	if err := c.writeFile(path, enc); err != nil {
+		return err
+	}
+
+	c.add(getHash(userID), path, uint64(len(enc)))
+
+	return nil
 }
 
 func (c *onDiskCache) Rem(userID, messageID string) error {
+	return c.remove(c.getMessagePath(userID, messageID))
+}
+
+func (c *onDiskCache) remove(path string) error {
 	defer c.update()
 
-	return os.Remove(c.getMessagePath(userID, messageID))
+	c.lruLock.Lock()
+	c.lru.remove(path)
+	cacheSizeBytes.Set(float64(c.lru.getSize("")))
+	c.lruLock.Unlock()
+
+	return os.Remove(path)
+}
+
+// getGCM returns the cipher of the user and, while the key is being rotated,
+// the cipher of the old passphrase.
+func (c *onDiskCache) getGCM(userID string) (gcm, oldGCM cipher.AEAD) {
+	c.gcmLock.RLock()
+	defer c.gcmLock.RUnlock()
+
+	return c.gcm[userID], c.oldGCM[userID]
+}
+
+func (c *onDiskCache) rotateKey(ctx context.Context, userID string, oldPassphrase, newPassphrase []byte) error {
+	oldGCM, err := newGCM(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newGCM(newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(c.getUserPath(userID), 0700); err != nil {
+		return err
+	}
+
+	c.gcmLock.Lock()
+	c.gcm[userID] = gcm
+	c.oldGCM[userID] = oldGCM
+	c.gcmLock.Unlock()
+
+	defer func() {
+		c.gcmLock.Lock()
+		defer c.gcmLock.Unlock()
+
+		if c.oldGCM[userID] == oldGCM {
+			delete(c.oldGCM, userID)
+		}
+	}()
+
+	files, err := ioutil.ReadDir(c.getUserPath(userID))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		path := filepath.Join(c.getUserPath(userID), file.Name())
+
+		if err := c.reencrypt(path, oldGCM, gcm); err != nil {
+			log.WithError(err).Warn("Cannot re-encrypt a cached message, removing it")
+
+			if err := c.remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// reencrypt encrypts the cached message with the new cipher. The modification
+// time is kept, so that the order of the least recently used messages does
+// not change.
+func (c *onDiskCache) reencrypt(path string, oldGCM, gcm cipher.AEAD) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	enc, err := c.readFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(enc) <= gcm.NonceSize() {
+		return ErrMsgCorrupted
+	}
+
+	// The message was written since the rotation started.
+	if _, err := gcm.Open(nil, enc[:gcm.NonceSize()], enc[gcm.NonceSize():], nil); err == nil {
+		return nil
+	}
+
+	cmp, err := oldGCM.Open(nil, enc[:oldGCM.NonceSize()], enc[oldGCM.NonceSize():], nil)
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	// Hold the LRU lock so that the message is not evicted meanwhile.
+	c.lruLock.Lock()
+	defer c.lruLock.Unlock()
+
+	if _, ok := c.lru.entries[path]; !ok {
+		return nil
+	}
+
+	if err := c.writeFile(path, gcm.Seal(nonce, nonce, cmp, nil)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, info.ModTime(), info.ModTime())
+}
+
+// touch marks the message as the most recently used one. The modification
+// time of the file keeps the access time over restarts, as the file systems
+// are often mounted without updating the access times.
+func (c *onDiskCache) touch(path string) {
+	c.lruLock.Lock()
+	defer c.lruLock.Unlock()
+
+	if _, ok := c.lru.entries[path]; !ok {
+		return
+	}
+
+	c.lru.touch(path)
+
+	now := time.Now()
+	if err := os.Chtimes(path, now, now); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Debug("Cannot update the access time of a cached message")
+	}
+}
+
+// makeSpace evicts the least recently used messages until the message fits
+// within the free space limits. It returns false if the message does not fit
+// at all.
+func (c *onDiskCache) makeSpace(size uint64) bool {
+	opts := c.getOptions()
+	if (opts.MaxSize > 0 && size > opts.MaxSize) || (opts.MaxUserSize > 0 && size > opts.MaxUserSize) {
+		return false
+	}
+
+	c.lruLock.Lock()
+	defer c.lruLock.Unlock()
+
+	for !c.hasSpace(int(size)) {
+		if !c.evict("") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// add records the written message and evicts the least recently used
+// messages, of the user first, until the cache is within its size limits.
+func (c *onDiskCache) add(user, path string, size uint64) {
+	opts := c.getOptions()
+
+	c.lruLock.Lock()
+	defer c.lruLock.Unlock()
+
+	c.lru.add(user, path, size)
+
+	for opts.MaxUserSize > 0 && c.lru.getSize(user) > opts.MaxUserSize {
+		if !c.evict(user) {
+			break
+		}
+	}
+
+	for opts.MaxSize > 0 && c.lru.getSize("") > opts.MaxSize {
+		if !c.evict("") {
+			break
+		}
+	}
+
+	cacheSizeBytes.Set(float64(c.lru.getSize("")))
+}
+
+// evict removes the least recently used message of the user, or of all users
+// if user is empty. It is called with lruLock.
+func (c *onDiskCache) evict(user string) bool {
+	entry := c.lru.oldest(user)
+	if entry == nil {
+		return false
+	}
+
+	c.lru.remove(entry.path)
+
+	if err := os.Remove(entry.path); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).Warn("Cannot evict a cached message")
+		return true
+	}
+
+	cacheEvictions.Inc()
+
+	c.lock.Lock()
+	c.diskFree += entry.size
+	c.lock.Unlock()
+
+	return true
+}
+
+// isFull returns whether the cache of the user is close to its limits.
+func (c *onDiskCache) isFull(userID string) bool {
+	opts := c.getOptions()
+
+	c.lruLock.Lock()
+	defer c.lruLock.Unlock()
+
+	if opts.MaxSize > 0 && float64(c.lru.getSize("")) >= prefetchRatio*float64(opts.MaxSize) {
+		return true
+	}
+
+	if opts.MaxUserSize > 0 && float64(c.lru.getSize(getHash(userID))) >= prefetchRatio*float64(opts.MaxUserSize) {
+		return true
+	}
+
+	return !c.hasSpace(prefetchReserve)
+}
+
+func (c *onDiskCache) getOptions() Options {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.opts
+}
+
+// setOptions changes the free space limits and the concurrency of a running
+// cache. Reads and writes in progress finish under the old limits.
+func (c *onDiskCache) setOptions(opts Options) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if opts.ConcurrentRead != c.opts.ConcurrentRead {
+		rsem := semaphore.New(opts.ConcurrentRead)
+		c.rsem = &rsem
+	}
+
+	if opts.ConcurrentWrite != c.opts.ConcurrentWrite {
+		wsem := semaphore.New(opts.ConcurrentWrite)
+		c.wsem = &wsem
+	}
+
+	c.opts = opts
+}
+
+func (c *onDiskCache) semaphores() (rsem, wsem *semaphore.Semaphore) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.rsem, c.wsem
 }
 
 func (c *onDiskCache) readFile(path string) ([]byte, error) {
-	c.rsem.Lock()
-	defer c.rsem.Unlock()
+	rsem, _ := c.semaphores()
+	rsem.Lock()
+	defer rsem.Unlock()
 
 	// Wait before reading in case the file is currently being written.
 	c.pending.wait(path)
@@ -218,8 +579,9 @@ func (c *onDiskCache) readFile(path string) ([]byte, error) {
 }
 
 func (c *onDiskCache) writeFile(path string, b []byte) error {
-	c.wsem.Lock()
-	defer c.wsem.Unlock()
+	_, wsem := c.semaphores()
+	wsem.Lock()
+	defer wsem.Unlock()
 
 	// Mark the file as currently being written.
 	// If it's already being written, wait for it to be done and return nil.
@@ -246,6 +608,10 @@ func (c *onDiskCache) hasSpace(size int) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	if uint64(size) > c.diskFree {
+		return false
+	}
+
 	if c.opts.MinFreeAbs > 0 {
 		if c.diskFree-uint64(size) < c.opts.MinFreeAbs {
 			return false
@@ -269,6 +635,7 @@ func (c *onDiskCache) update() {
 
 			// Update the free space.
 			c.diskFree = du.NewDiskUsage(c.path).Available()
+			diskFreeBytes.Set(float64(c.diskFree))
 
 			// Reset the Once object (so we can update again).
 			c.once = &sync.Once{}
@@ -276,6 +643,21 @@ func (c *onDiskCache) update() {
 	}()
 }
 
+func newGCM(passphrase []byte) (cipher.AEAD, error) {
+	hash := sha256.New()
+
+	if _, err := hash.Write(passphrase); err != nil {
+		return nil, err
+	}
+
+	aes, err := aes.NewCipher(hash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(aes)
+}
+
 func (c *onDiskCache) getUserPath(userID string) string {
 	return filepath.Join(c.path, getHash(userID))
 }
@@ -0,0 +1,198 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package cache
+
+import (
+	"container/list"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// lruEntry is a message file of the on-disk cache.
+type lruEntry struct {
+	user, path string
+	size       uint64
+
+	elem, userElem *list.Element
+}
+
+type lruUser struct {
+	list *list.List
+	size uint64
+}
+
+// lru orders the message files of the on-disk cache by their last access,
+// both over all users and per user, so that the least recently used ones can
+// be evicted when the cache grows too big. The users are identified by the
+// names of their cache directories.
+type lru struct {
+	all     *list.List
+	users   map[string]*lruUser
+	entries map[string]*lruEntry
+	size    uint64
+}
+
+func newLRU() *lru {
+	return &lru{
+		all:     list.New(),
+		users:   make(map[string]*lruUser),
+		entries: make(map[string]*lruEntry),
+	}
+}
+
+// loadLRU builds the LRU lists of the cache at path. The files are touched
+// whenever they are read, so their modification times are their last access
+// times.
+func loadLRU(path string) (*lru, error) {
+	dirs, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	type file struct {
+		user, path string
+		size       uint64
+		modTime    time.Time
+	}
+
+	files := []file{}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		infos, err := ioutil.ReadDir(filepath.Join(path, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				files = append(files, file{
+					user:    dir.Name(),
+					path:    filepath.Join(path, dir.Name(), info.Name()),
+					size:    uint64(info.Size()),
+					modTime: info.ModTime(),
+				})
+			}
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	l := newLRU()
+	for _, f := range files {
+		l.add(f.user, f.path, f.size)
+	}
+	return l, nil
+}
+
+// add adds the file, or replaces it, as the most recently used one.
+func (l *lru) add(user, path string, size uint64) {
+	l.remove(path)
+
+	u, ok := l.users[user]
+	if !ok {
+		u = &lruUser{list: list.New()}
+		l.users[user] = u
+	}
+
+	entry := &lruEntry{user: user, path: path, size: size}
+	entry.elem = l.all.PushFront(entry)
+	entry.userElem = u.list.PushFront(entry)
+	l.entries[path] = entry
+
+	u.size += size
+	l.size += size
+}
+
+// touch makes the file the most recently used one.
+func (l *lru) touch(path string) {
+	entry, ok := l.entries[path]
+	if !ok {
+		return
+	}
+
+	l.all.MoveToFront(entry.elem)
+	l.users[entry.user].list.MoveToFront(entry.userElem)
+}
+
+func (l *lru) remove(path string) {
+	entry, ok := l.entries[path]
+	if !ok {
+		return
+	}
+
+	u := l.users[entry.user]
+	u.list.Remove(entry.userElem)
+	u.size -= entry.size
+	if u.list.Len() == 0 {
+		delete(l.users, entry.user)
+	}
+
+	l.all.Remove(entry.elem)
+	l.size -= entry.size
+	delete(l.entries, path)
+}
+
+func (l *lru) removeUser(user string) {
+	u, ok := l.users[user]
+	if !ok {
+		return
+	}
+
+	for elem := u.list.Front(); elem != nil; elem = elem.Next() {
+		entry := elem.Value.(*lruEntry) //nolint:forcetypeassert
+		l.all.Remove(entry.elem)
+		l.size -= entry.size
+		delete(l.entries, entry.path)
+	}
+
+	delete(l.users, user)
+}
+
+// oldest returns the least recently used file of the user, or of all users
+// if user is empty.
+func (l *lru) oldest(user string) *lruEntry {
+	var elem *list.Element
+
+	if user == "" {
+		elem = l.all.Back()
+	} else if u, ok := l.users[user]; ok {
+		elem = u.list.Back()
+	}
+
+	if elem == nil {
+		return nil
+	}
+	return elem.Value.(*lruEntry) //nolint:forcetypeassert
+}
+
+// getSize returns the size of the files of the user, or of all users if user
+// is empty.
+func (l *lru) getSize(user string) uint64 {
+	if user == "" {
+		return l.size
+	}
+	if u, ok := l.users[user]; ok {
+		return u.size
+	}
+	return 0
+}
@@ -20,6 +20,8 @@ package cache
 type Options struct {
 	MinFreeAbs      uint64
 	MinFreeRat      float64
+	MaxSize         uint64
+	MaxUserSize     uint64
 	ConcurrentRead  int
 	ConcurrentWrite int
 }
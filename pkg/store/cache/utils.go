@@ -18,6 +18,7 @@
 package cache
 
 import (
+	"fmt"
 	"path/filepath"
 
 	"github.com/ljanyst/peroxide/pkg/config/settings"
@@ -39,11 +40,24 @@ func LoadMessageCache(s *settings.Settings) (Cache, error) {
 
 	// NOTE(GODT-1158): Changing compression is not an option currently
 	// available for user but, if user changes compression setting we have
-	// to nuke the cache.
-	if s.GetBool(settings.CacheCompressionKey) {
-		compressor = &GZipCompressor{}
-	} else {
+	// to nuke the cache. The exception is switching from gzip to zstd, as the
+	// zstd compressor reads the messages compressed with gzip too.
+	switch {
+	case !s.GetBool(settings.CacheCompressionKey):
 		compressor = &NoopCompressor{}
+
+	case s.Get(settings.CacheCompressorKey) == "gzip":
+		compressor = &GZipCompressor{}
+
+	case s.Get(settings.CacheCompressorKey) == "zstd":
+		zstd, err := NewZstdCompressor()
+		if err != nil {
+			return NewInMemoryCache(inMemoryCacheLimnit), err
+		}
+		compressor = zstd
+
+	default:
+		return NewInMemoryCache(inMemoryCacheLimnit), fmt.Errorf("unknown cache compressor %q", s.Get(settings.CacheCompressorKey))
 	}
 
 	path := filepath.Join(s.Get(settings.CacheDir), "messages")
@@ -52,12 +66,7 @@ func LoadMessageCache(s *settings.Settings) (Cache, error) {
 	// build jobs.
 	//	store.SetBuildAndCacheJobLimit(s.GetInt(settings.CacheConcurrencyWrite))
 
-	messageCache, err := NewOnDiskCache(path, compressor, Options{
-		MinFreeAbs:      uint64(s.GetInt(settings.CacheMinFreeAbsKey)),
-		MinFreeRat:      s.GetFloat64(settings.CacheMinFreeRatKey),
-		ConcurrentRead:  s.GetInt(settings.CacheConcurrencyRead),
-		ConcurrentWrite: s.GetInt(settings.CacheConcurrencyWrite),
-	})
+	messageCache, err := NewOnDiskCache(path, compressor, loadOptions(s))
 
 	if err != nil {
 		return NewInMemoryCache(inMemoryCacheLimnit), err
@@ -65,3 +74,26 @@ func LoadMessageCache(s *settings.Settings) (Cache, error) {
 
 	return messageCache, nil
 }
+
+// UpdateMessageCache applies the cache options from the settings to a running
+// cache. It returns false if the cache does not support changing them.
+func UpdateMessageCache(c Cache, s *settings.Settings) bool {
+	onDisk, ok := c.(*onDiskCache)
+	if !ok {
+		return false
+	}
+
+	onDisk.setOptions(loadOptions(s))
+	return true
+}
+
+func loadOptions(s *settings.Settings) Options {
+	return Options{
+		MinFreeAbs:      uint64(s.GetInt(settings.CacheMinFreeAbsKey)),
+		MinFreeRat:      s.GetFloat64(settings.CacheMinFreeRatKey),
+		MaxSize:         uint64(s.GetInt(settings.CacheMaxSizeKey)),
+		MaxUserSize:     uint64(s.GetInt(settings.CacheMaxUserSizeKey)),
+		ConcurrentRead:  s.GetInt(settings.CacheConcurrencyRead),
+		ConcurrentWrite: s.GetInt(settings.CacheConcurrencyWrite),
+	}
+}
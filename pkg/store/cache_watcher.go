@@ -29,7 +29,10 @@ func (store *Store) StartWatcher() {
 		return
 	}
 
-	store.done = make(chan struct{})
+	// The goroutine keeps its own channel, as a restarted watcher replaces
+	// store.done.
+	done := make(chan struct{})
+	store.done = done
 
 	ctx, cancel := context.WithCancel(context.Background())
 	store.msgCachePool.ctx = ctx
@@ -41,19 +44,24 @@ func (store *Store) StartWatcher() {
 
 		for {
 			// NOTE(GODT-1158): Race condition here? What if DB was already closed?
-			messageIDs, err := store.getAllMessageIDs()
+			messageIDs, err := store.getPrefetchMessageIDs(store.getPrefetchPolicy())
 			if err != nil {
 				return
 			}
 
+			// Once the cache is close to its limits, the messages are
+			// cached only when read, evicting the least recently used ones.
 			for _, messageID := range messageIDs {
+				if cache.IsFull(store.cache, store.user.ID()) {
+					break
+				}
 				if !store.IsCached(messageID) {
 					store.msgCachePool.newJob(messageID)
 				}
 			}
 
 			select {
-			case <-store.done:
+			case <-done:
 				return
 			case <-ticker.C:
 				continue
@@ -30,3 +30,15 @@ func itob(v uint32) []byte {
 func btoi(b []byte) uint32 {
 	return binary.BigEndian.Uint32(b)
 }
+
+// itob64 returns an 8-byte big endian representation of v.
+func itob64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// btoi64 returns the uint64 represented by b.
+func btoi64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
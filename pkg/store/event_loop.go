@@ -20,6 +20,7 @@ package store
 import (
 	"context"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/ljanyst/peroxide/pkg/listener"
@@ -41,10 +42,14 @@ type eventLoop struct {
 	stopCh         chan struct{}
 	notifyStopCh   chan struct{}
 	isRunning      bool // The whole event loop is running.
+	isRunningLock  sync.RWMutex
 
 	pollCounter int
 	errCounter  int
 
+	lastPoll     time.Time
+	lastPollLock sync.RWMutex
+
 	log *logrus.Entry
 
 	store    *Store
@@ -97,7 +102,7 @@ func (loop *eventLoop) setFirstEventID() (err error) {
 // processed so we are sure updates are propagated to the database.
 func (loop *eventLoop) pollNow() {
 	// When event loop is not running, it would cause infinite wait.
-	if !loop.isRunning {
+	if !loop.getIsRunning() {
 		return
 	}
 
@@ -107,9 +112,27 @@ func (loop *eventLoop) pollNow() {
 	close(eventProcessedCh)
 }
 
+// getIsRunning returns whether the event loop is running.
+func (loop *eventLoop) getIsRunning() bool {
+	loop.isRunningLock.RLock()
+	defer loop.isRunningLock.RUnlock()
+
+	return loop.isRunning
+}
+
+// setIsRunning marks the event loop as running or stopped and returns whether
+// it was running before.
+func (loop *eventLoop) setIsRunning(isRunning bool) bool {
+	loop.isRunningLock.Lock()
+	defer loop.isRunningLock.Unlock()
+
+	wasRunning := loop.isRunning
+	loop.isRunning = isRunning
+	return wasRunning
+}
+
 func (loop *eventLoop) stop() {
-	if loop.isRunning {
-		loop.isRunning = false
+	if loop.setIsRunning(false) {
 		close(loop.stopCh)
 
 		select {
@@ -122,15 +145,13 @@ func (loop *eventLoop) stop() {
 }
 
 func (loop *eventLoop) start() {
-	if loop.isRunning {
+	if loop.getIsRunning() {
 		return
 	}
-	defer func() {
-		loop.isRunning = false
-	}()
+	defer loop.setIsRunning(false)
 	loop.stopCh = make(chan struct{})
 	loop.notifyStopCh = make(chan struct{})
-	loop.isRunning = true
+	loop.setIsRunning(true)
 
 	events := make(chan *pmapi.Event)
 	defer close(events)
@@ -202,6 +223,21 @@ func (loop *eventLoop) loop() {
 	}
 }
 
+func (loop *eventLoop) setLastPoll(t time.Time) {
+	loop.lastPollLock.Lock()
+	defer loop.lastPollLock.Unlock()
+
+	loop.lastPoll = t
+}
+
+// getLastPoll returns the time of the last successful poll.
+func (loop *eventLoop) getLastPoll() time.Time {
+	loop.lastPollLock.RLock()
+	defer loop.lastPollLock.RUnlock()
+
+	return loop.lastPoll
+}
+
 // isBeforeFirstStart returns whether the initial event ID was already set or not.
 func (loop *eventLoop) isBeforeFirstStart() bool {
 	return loop.currentEventID == ""
@@ -218,6 +254,14 @@ func (loop *eventLoop) processNextEvent() (more bool, err error) { // nolint[fun
 	// We only want to consider invalid tokens as real errors because all other errors might fix themselves eventually
 	// (e.g. no internet, ulimit reached etc.)
 	defer func() {
+		eventPolls.Inc(loop.user.ID())
+		if err != nil {
+			eventPollErrors.Inc(loop.user.ID())
+		} else {
+			eventLastPoll.SetToCurrentTime(loop.user.ID())
+			loop.setLastPoll(time.Now())
+		}
+
 		if errors.Cause(err) == pmapi.ErrNoConnection {
 			l.Warn("Internet unavailable")
 			err = nil
@@ -428,6 +472,8 @@ func (loop *eventLoop) processMessages(eventLog *logrus.Entry, messages []*pmapi
 				return errors.Wrap(err, "failed to put message into DB")
 			}
 
+			loop.store.indexCreatedMessage(message.ID)
+
 		case pmapi.EventUpdate, pmapi.EventUpdateFlags:
 			msgLog.Debug("Processing EventUpdate(Flags) for message")
 
@@ -51,9 +51,11 @@ func NewStoreFactory(
 	}
 }
 
-// New creates new store for given user.
+// New creates new store for given user. The store reads the prefetch policy
+// from the settings whenever it looks for the messages to cache, so that the
+// changes of the settings take effect without a restart.
 func (f *StoreFactory) New(user BridgeUser, connected bool) (*Store, error) {
-	return New(
+	store, err := New(
 		user,
 		f.listener,
 		f.cache,
@@ -62,6 +64,13 @@ func (f *StoreFactory) New(user BridgeUser, connected bool) (*Store, error) {
 		f.events,
 		connected,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	store.prefetchPolicy = func() PrefetchPolicy { return LoadPrefetchPolicy(f.settings) }
+
+	return store, nil
 }
 
 // Remove removes all store files for given user.
@@ -149,6 +149,12 @@ func initMailboxBucket(tx *bolt.Tx, bucketName []byte) error {
 	if _, err := bucket.CreateBucketIfNotExists(deletedIDsBucket); err != nil {
 		return err
 	}
+	if err := initModSeqsBucket(bucket); err != nil {
+		return err
+	}
+	if _, err := bucket.CreateBucketIfNotExists(vanishedIDsBucket); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -259,6 +265,16 @@ func (storeMailbox *Mailbox) txGetDeletedIDsBucket(tx *bolt.Tx) *bolt.Bucket {
 	return storeMailbox.txGetBucket(tx).Bucket(deletedIDsBucket)
 }
 
+// txGetModSeqsBucket returns the bucket mapping IMAP ID to mod-sequence.
+func (storeMailbox *Mailbox) txGetModSeqsBucket(tx *bolt.Tx) *bolt.Bucket {
+	return storeMailbox.txGetBucket(tx).Bucket(modSeqsBucket)
+}
+
+// txGetVanishedIDsBucket returns the bucket with IMAP IDs of expunged messages.
+func (storeMailbox *Mailbox) txGetVanishedIDsBucket(tx *bolt.Tx) *bolt.Bucket {
+	return storeMailbox.txGetBucket(tx).Bucket(vanishedIDsBucket)
+}
+
 // txGetBucket returns the bucket of mailbox containing mapping buckets.
 func (storeMailbox *Mailbox) txGetBucket(tx *bolt.Tx) *bolt.Bucket {
 	return tx.Bucket(mailboxesBucket).Bucket(storeMailbox.getBucketName())
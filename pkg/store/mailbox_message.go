@@ -385,12 +385,17 @@ func (storeMailbox *Mailbox) txCreateOrUpdateMessages(tx *bolt.Tx, msgs []*pmapi
 					deletedBucket = storeMailbox.txGetDeletedIDsBucket(tx)
 				}
 				isMarkedAsDeleted := deletedBucket.Get([]byte(msg.ID)) != nil
+				modSeq, err := storeMailbox.txBumpModSeq(tx, uidb)
+				if err != nil {
+					return errors.Wrap(err, "cannot bump mod-sequence")
+				}
 				if seqErr == nil {
 					storeMailbox.store.notifyUpdateMessage(
 						storeMailbox.storeAddress.address,
 						storeMailbox.labelName,
 						btoi(uidb),
 						seqNum,
+						modSeq,
 						msg,
 						isMarkedAsDeleted,
 					)
@@ -415,6 +420,10 @@ func (storeMailbox *Mailbox) txCreateOrUpdateMessages(tx *bolt.Tx, msgs []*pmapi
 		if err = apiBucket.Put([]byte(msg.ID), uidb); err != nil {
 			return errors.Wrap(err, "cannot add to API bucket")
 		}
+		modSeq, err := storeMailbox.txBumpModSeq(tx, uidb)
+		if err != nil {
+			return errors.Wrap(err, "cannot bump mod-sequence")
+		}
 
 		seqNum, err := storeMailbox.txGetSequenceNumberOfUID(imapBucket, uidb)
 		if err != nil {
@@ -427,6 +436,7 @@ func (storeMailbox *Mailbox) txCreateOrUpdateMessages(tx *bolt.Tx, msgs []*pmapi
 				storeMailbox.labelName,
 				uid,
 				seqNum,
+				modSeq,
 				msg,
 				false, // new message is never marked as deleted
 			)
@@ -478,10 +488,15 @@ func (storeMailbox *Mailbox) txDeleteMessage(tx *bolt.Tx, apiID string) error {
 		return errors.Wrap(err, "cannot delete from mark-as-deleted bucket")
 	}
 
+	if err := storeMailbox.txMarkVanished(tx, uidb); err != nil {
+		return errors.Wrap(err, "cannot add to vanished bucket")
+	}
+
 	if seqNumErr == nil {
 		storeMailbox.store.notifyDeleteMessage(
 			storeMailbox.storeAddress.address,
 			storeMailbox.labelName,
+			btoi(uidb),
 			seqNum,
 		)
 		// Outlook for Mac has problems with sending an EXISTS after deleting
@@ -539,6 +554,11 @@ func (storeMailbox *Mailbox) txMarkMessagesAsDeleted(tx *bolt.Tx, apiIDs []strin
 			return err
 		}
 
+		modSeq, err := storeMailbox.txBumpModSeq(tx, itob(uid))
+		if err != nil {
+			return err
+		}
+
 		// In order to send flags in format
 		// S: * 2 FETCH (FLAGS (\Deleted \Seen))
 		storeMailbox.store.notifyUpdateMessage(
@@ -546,6 +566,7 @@ func (storeMailbox *Mailbox) txMarkMessagesAsDeleted(tx *bolt.Tx, apiIDs []strin
 			storeMailbox.labelName,
 			uid,
 			seqNum,
+			modSeq,
 			msg,
 			markAsDeleted,
 		)
@@ -0,0 +1,129 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+// initModSeqsBucket creates the bucket with the mod-sequences of the mailbox.
+// The messages stored before the bucket existed have no mod-sequence, so they
+// are given the lowest one: 1. The first change gets 2.
+func initModSeqsBucket(mailboxBucket *bolt.Bucket) error {
+	b, err := mailboxBucket.CreateBucketIfNotExists(modSeqsBucket)
+	if err != nil {
+		return err
+	}
+	if b.Sequence() == 0 {
+		return b.SetSequence(1)
+	}
+	return nil
+}
+
+// GetHighestModSeq returns the mod-sequence of the latest change in the
+// mailbox, see RFC 7162.
+func (storeMailbox *Mailbox) GetHighestModSeq() (modSeq uint64, err error) {
+	err = storeMailbox.db().View(func(tx *bolt.Tx) error {
+		modSeq = storeMailbox.txGetModSeqsBucket(tx).Sequence()
+		return nil
+	})
+	return
+}
+
+// getModSeq returns the mod-sequence of the message with the given API ID.
+func (storeMailbox *Mailbox) getModSeq(apiID string) (modSeq uint64, err error) {
+	err = storeMailbox.db().View(func(tx *bolt.Tx) error {
+		uid, err := storeMailbox.txGetUID(tx, apiID)
+		if err != nil {
+			return err
+		}
+		modSeq = txGetModSeqOfUID(storeMailbox.txGetModSeqsBucket(tx), itob(uid))
+		return nil
+	})
+	return
+}
+
+func txGetModSeqOfUID(modSeqsBucket *bolt.Bucket, uidb []byte) uint64 {
+	if v := modSeqsBucket.Get(uidb); v != nil {
+		return btoi64(v)
+	}
+	return 1
+}
+
+// txBumpModSeq gives a new mod-sequence to the message with the given IMAP
+// UID bytes `uidb`. It has to be called for every change of the message
+// visible to the IMAP clients.
+func (storeMailbox *Mailbox) txBumpModSeq(tx *bolt.Tx, uidb []byte) (uint64, error) {
+	b := storeMailbox.txGetModSeqsBucket(tx)
+	modSeq, err := b.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	return modSeq, b.Put(uidb, itob64(modSeq))
+}
+
+// txMarkVanished remembers the expunge of the message with the given IMAP UID
+// bytes `uidb` so that the QRESYNC clients can learn about it later.
+//
+// NOTE: The vanished IDs are kept until the UIDVALIDITY changes. UIDs are
+// never reused, so the bucket grows by one small entry per expunge.
+func (storeMailbox *Mailbox) txMarkVanished(tx *bolt.Tx, uidb []byte) error {
+	modSeqs := storeMailbox.txGetModSeqsBucket(tx)
+	modSeq, err := modSeqs.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err := modSeqs.Delete(uidb); err != nil {
+		return err
+	}
+	return storeMailbox.txGetVanishedIDsBucket(tx).Put(uidb, itob64(modSeq))
+}
+
+// GetAPIIDsChangedSince returns the API IDs of those of the given messages
+// which changed after the mod-sequence `modSeq`. The order is kept.
+func (storeMailbox *Mailbox) GetAPIIDsChangedSince(apiIDs []string, modSeq uint64) (changedAPIIDs []string, err error) {
+	err = storeMailbox.db().View(func(tx *bolt.Tx) error {
+		apiBucket := storeMailbox.txGetAPIIDsBucket(tx)
+		modSeqs := storeMailbox.txGetModSeqsBucket(tx)
+		for _, apiID := range apiIDs {
+			uidb := apiBucket.Get([]byte(apiID))
+			if uidb == nil {
+				continue
+			}
+			if txGetModSeqOfUID(modSeqs, uidb) > modSeq {
+				changedAPIIDs = append(changedAPIIDs, apiID)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// GetUIDsVanishedSince returns the IMAP UIDs of the messages expunged from
+// the mailbox after the mod-sequence `modSeq`, in ascending order.
+func (storeMailbox *Mailbox) GetUIDsVanishedSince(modSeq uint64) (uids []uint32, err error) {
+	err = storeMailbox.db().View(func(tx *bolt.Tx) error {
+		return storeMailbox.txGetVanishedIDsBucket(tx).ForEach(func(k, v []byte) error {
+			if btoi64(v) > modSeq {
+				uids = append(uids, btoi(k))
+			}
+			return nil
+		})
+	})
+	return
+}
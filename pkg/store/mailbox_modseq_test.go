@@ -0,0 +1,75 @@
+// Copyright (c) 2022 Proton AG
+//
+// This file is part of Proton Mail Bridge.
+//
+// Proton Mail Bridge is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Proton Mail Bridge is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Proton Mail Bridge. If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"testing"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestModSeqs(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+
+	storeMailbox := m.store.addresses[addrID1].mailboxes[pmapi.InboxLabel]
+
+	checkHighestModSeq(t, storeMailbox, 1)
+
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, false, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+	insertMessage(t, m, "msg2", "Test message 2", addrID1, false, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+	insertMessage(t, m, "msg3", "Test message 3", addrID1, false, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+	checkHighestModSeq(t, storeMailbox, 4)
+
+	// Updating a message gives it a new mod-sequence.
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, true, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+	checkHighestModSeq(t, storeMailbox, 5)
+
+	modSeq, err := storeMailbox.getModSeq("msg1")
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), modSeq)
+
+	// So does marking it as deleted.
+	require.NoError(t, storeMailbox.MarkMessagesDeleted([]string{"msg3"}))
+	checkHighestModSeq(t, storeMailbox, 6)
+
+	changed, err := storeMailbox.GetAPIIDsChangedSince([]string{"msg1", "msg2", "msg3"}, 3)
+	require.NoError(t, err)
+	require.Equal(t, []string{"msg1", "msg3"}, changed)
+
+	// Expunge is a change of the mailbox as well.
+	require.NoError(t, m.store.deleteMessageEvent("msg2"))
+	checkHighestModSeq(t, storeMailbox, 7)
+
+	vanished, err := storeMailbox.GetUIDsVanishedSince(6)
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2}, vanished)
+
+	vanished, err = storeMailbox.GetUIDsVanishedSince(7)
+	require.NoError(t, err)
+	require.Empty(t, vanished)
+}
+
+func checkHighestModSeq(t *testing.T, storeMailbox *Mailbox, want uint64) {
+	modSeq, err := storeMailbox.GetHighestModSeq()
+	require.NoError(t, err)
+	require.Equal(t, want, modSeq)
+}
@@ -60,6 +60,12 @@ func (message *Message) SequenceNumber() (uint32, error) {
 	return message.storeMailbox.getSequenceNumber(message.ID())
 }
 
+// ModSeq returns the mod-sequence of the last change of the message in used
+// mailbox.
+func (message *Message) ModSeq() (uint64, error) {
+	return message.storeMailbox.getModSeq(message.ID())
+}
+
 // Message returns message struct from pmapi.
 func (message *Message) Message() *pmapi.Message {
 	return message.msg
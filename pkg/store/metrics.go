@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import "github.com/ljanyst/peroxide/pkg/metrics"
+
+//nolint:gochecknoglobals
+var (
+	syncRunning = metrics.NewGaugeVec(
+		"peroxide_sync_running",
+		"Whether the full sync of the user is running.",
+		"user",
+	)
+	syncFailures = metrics.NewCounterVec(
+		"peroxide_sync_failures_total",
+		"Number of failed full syncs.",
+		"user",
+	)
+	syncFinishTime = metrics.NewGaugeVec(
+		"peroxide_sync_last_finish_timestamp_seconds",
+		"Time when the last full sync finished.",
+		"user",
+	)
+	syncIDRanges = metrics.NewGaugeVec(
+		"peroxide_sync_id_ranges",
+		"Number of message ID ranges of the full sync by state.",
+		"user", "state",
+	)
+	syncUnconfirmedMessages = metrics.NewGaugeVec(
+		"peroxide_sync_unconfirmed_messages",
+		"Number of local messages not yet confirmed by the running full sync.",
+		"user",
+	)
+
+	eventPolls = metrics.NewCounterVec(
+		"peroxide_event_loop_polls_total",
+		"Number of event polls.",
+		"user",
+	)
+	eventPollErrors = metrics.NewCounterVec(
+		"peroxide_event_loop_poll_errors_total",
+		"Number of event polls which failed.",
+		"user",
+	)
+	eventLastPoll = metrics.NewGaugeVec(
+		"peroxide_event_loop_last_success_timestamp_seconds",
+		"Time of the last successful event poll; the lag is the time elapsed since.",
+		"user",
+	)
+
+	cacheRequests = metrics.NewCounterVec(
+		"peroxide_cache_requests_total",
+		"Number of message literal requests by whether they were served from the cache.",
+		"result",
+	)
+)
+
+// DeleteMetrics drops the series of the user, so that a logged out user is
+// not reported with the state of its last session.
+func (store *Store) DeleteMetrics() {
+	userID := store.UserID()
+
+	syncRunning.Delete(userID)
+	syncFailures.Delete(userID)
+	syncFinishTime.Delete(userID)
+	syncIDRanges.Delete(userID, "finished")
+	syncIDRanges.Delete(userID, "pending")
+	syncUnconfirmedMessages.Delete(userID)
+
+	eventPolls.Delete(userID)
+	eventPollErrors.Delete(userID)
+	eventLastPoll.Delete(userID)
+}
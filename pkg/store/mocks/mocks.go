@@ -223,15 +223,15 @@ func (mr *MockChangeNotifierMockRecorder) CanDelete(arg0 interface{}) *gomock.Ca
 }
 
 // DeleteMessage mocks base method.
-func (m *MockChangeNotifier) DeleteMessage(arg0, arg1 string, arg2 uint32) {
+func (m *MockChangeNotifier) DeleteMessage(arg0, arg1 string, arg2, arg3 uint32) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "DeleteMessage", arg0, arg1, arg2)
+	m.ctrl.Call(m, "DeleteMessage", arg0, arg1, arg2, arg3)
 }
 
 // DeleteMessage indicates an expected call of DeleteMessage.
-func (mr *MockChangeNotifierMockRecorder) DeleteMessage(arg0, arg1, arg2 interface{}) *gomock.Call {
+func (mr *MockChangeNotifierMockRecorder) DeleteMessage(arg0, arg1, arg2, arg3 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessage", reflect.TypeOf((*MockChangeNotifier)(nil).DeleteMessage), arg0, arg1, arg2)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteMessage", reflect.TypeOf((*MockChangeNotifier)(nil).DeleteMessage), arg0, arg1, arg2, arg3)
 }
 
 // MailboxCreated mocks base method.
@@ -271,15 +271,15 @@ func (mr *MockChangeNotifierMockRecorder) Notice(arg0, arg1 interface{}) *gomock
 }
 
 // UpdateMessage mocks base method.
-func (m *MockChangeNotifier) UpdateMessage(arg0, arg1 string, arg2, arg3 uint32, arg4 *pmapi.Message, arg5 bool) {
+func (m *MockChangeNotifier) UpdateMessage(arg0, arg1 string, arg2, arg3 uint32, arg4 uint64, arg5 *pmapi.Message, arg6 bool) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "UpdateMessage", arg0, arg1, arg2, arg3, arg4, arg5)
+	m.ctrl.Call(m, "UpdateMessage", arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 }
 
 // UpdateMessage indicates an expected call of UpdateMessage.
-func (mr *MockChangeNotifierMockRecorder) UpdateMessage(arg0, arg1, arg2, arg3, arg4, arg5 interface{}) *gomock.Call {
+func (mr *MockChangeNotifierMockRecorder) UpdateMessage(arg0, arg1, arg2, arg3, arg4, arg5, arg6 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMessage", reflect.TypeOf((*MockChangeNotifier)(nil).UpdateMessage), arg0, arg1, arg2, arg3, arg4, arg5)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateMessage", reflect.TypeOf((*MockChangeNotifier)(nil).UpdateMessage), arg0, arg1, arg2, arg3, arg4, arg5, arg6)
 }
 
 // MockStorer is a mock of Storer interface.
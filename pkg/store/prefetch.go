@@ -0,0 +1,161 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/config/settings"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	bolt "go.etcd.io/bbolt"
+)
+
+// PrefetchPolicy selects the messages the watcher caches in advance. The
+// other messages are cached when they are read. The zero policy prefetches
+// all messages.
+type PrefetchPolicy struct {
+	Disabled bool
+	MaxAge   time.Duration
+	Labels   []string
+	MaxSize  int64
+}
+
+// LoadPrefetchPolicy reads the prefetch policy from the settings. The labels
+// are the names of the mailboxes, e.g. INBOX, Sent, Starred or Folders/Work,
+// or the label IDs.
+func LoadPrefetchPolicy(s *settings.Settings) PrefetchPolicy {
+	policy := PrefetchPolicy{
+		Disabled: !s.GetBool(settings.CachePrefetchKey),
+		MaxAge:   time.Duration(s.GetInt(settings.CachePrefetchAgeKey)) * 24 * time.Hour,
+		MaxSize:  int64(s.GetInt(settings.CachePrefetchSizeKey)),
+	}
+
+	for _, label := range strings.Split(s.Get(settings.CachePrefetchLabels), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			policy.Labels = append(policy.Labels, label)
+		}
+	}
+
+	return policy
+}
+
+func (policy PrefetchPolicy) isAll() bool {
+	return !policy.Disabled && policy.MaxAge <= 0 && len(policy.Labels) == 0 && policy.MaxSize <= 0
+}
+
+func (store *Store) getPrefetchPolicy() PrefetchPolicy {
+	if store.prefetchPolicy == nil {
+		return PrefetchPolicy{}
+	}
+	return store.prefetchPolicy()
+}
+
+// getPrefetchMessageIDs returns the API IDs of the messages the policy
+// selects, the newest first.
+func (store *Store) getPrefetchMessageIDs(policy PrefetchPolicy) ([]string, error) {
+	if policy.Disabled {
+		return nil, nil
+	}
+
+	if policy.isAll() {
+		return store.getAllMessageIDs()
+	}
+
+	labelIDs := store.getPrefetchLabelIDs(policy.Labels)
+
+	var minTime int64
+	if policy.MaxAge > 0 {
+		minTime = time.Now().Add(-policy.MaxAge).Unix()
+	}
+
+	msgs := []*pmapi.Message{}
+
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metadataBucket).ForEach(func(k, v []byte) error {
+			msg := &pmapi.Message{}
+			if err := json.Unmarshal(v, msg); err != nil {
+				return err
+			}
+
+			if msg.Time < minTime || (policy.MaxSize > 0 && msg.Size > policy.MaxSize) {
+				return nil
+			}
+
+			if len(labelIDs) > 0 && !hasAnyLabelID(msg, labelIDs) {
+				return nil
+			}
+
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Time > msgs[j].Time })
+
+	apiIDs := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		apiIDs = append(apiIDs, msg.ID)
+	}
+
+	return apiIDs, nil
+}
+
+// getPrefetchLabelIDs returns the IDs of the labels of the policy. The labels
+// which are not the names of any mailbox are taken for the label IDs.
+func (store *Store) getPrefetchLabelIDs(labels []string) map[string]bool {
+	store.lock.RLock()
+	addresses := make([]*Address, 0, len(store.addresses))
+	for _, address := range store.addresses {
+		addresses = append(addresses, address)
+	}
+	store.lock.RUnlock()
+
+	labelIDs := map[string]bool{}
+
+	for _, label := range labels {
+		found := false
+		for _, address := range addresses {
+			for _, mailbox := range address.ListMailboxes() {
+				if strings.EqualFold(mailbox.Name(), label) {
+					labelIDs[mailbox.LabelID()] = true
+					found = true
+				}
+			}
+		}
+		if !found {
+			labelIDs[label] = true
+		}
+	}
+
+	return labelIDs
+}
+
+func hasAnyLabelID(msg *pmapi.Message, labelIDs map[string]bool) bool {
+	for _, labelID := range msg.LabelIDs {
+		if labelIDs[labelID] {
+			return true
+		}
+	}
+	return false
+}
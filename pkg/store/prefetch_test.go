@@ -0,0 +1,68 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetPrefetchMessageIDs(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+
+	now := time.Now()
+	insertPrefetchMessage(t, m, "old", now.Add(-100*24*time.Hour), 1000, pmapi.AllMailLabel, pmapi.InboxLabel)
+	insertPrefetchMessage(t, m, "sent", now.Add(-2*time.Hour), 1000, pmapi.AllMailLabel, pmapi.SentLabel)
+	insertPrefetchMessage(t, m, "big", now.Add(-time.Hour), 1<<20, pmapi.AllMailLabel, pmapi.InboxLabel)
+	insertPrefetchMessage(t, m, "starred", now.Add(-3*time.Hour), 1000, pmapi.AllMailLabel, pmapi.ArchiveLabel, pmapi.StarredLabel)
+
+	tests := []struct {
+		name   string
+		policy PrefetchPolicy
+		want   []string
+	}{
+		{"all", PrefetchPolicy{}, []string{"big", "old", "sent", "starred"}},
+		{"disabled", PrefetchPolicy{Disabled: true}, nil},
+		{"age", PrefetchPolicy{MaxAge: 90 * 24 * time.Hour}, []string{"big", "sent", "starred"}},
+		{"size", PrefetchPolicy{MaxSize: 1 << 10}, []string{"sent", "starred", "old"}},
+		{"labels", PrefetchPolicy{Labels: []string{"inbox", pmapi.StarredLabel}}, []string{"big", "starred", "old"}},
+		{"combined", PrefetchPolicy{MaxAge: 90 * 24 * time.Hour, MaxSize: 1 << 10, Labels: []string{"INBOX", "Sent"}}, []string{"sent"}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ids, err := m.store.getPrefetchMessageIDs(tt.policy)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func insertPrefetchMessage(t *testing.T, m *mocksForStore, id string, received time.Time, size int64, labelIDs ...string) {
+	msg := getTestMessage(id, id, addr1, false, labelIDs)
+	msg.Time = received.Unix()
+	msg.Size = size
+	require.NoError(t, m.store.createOrUpdateMessageEvent(msg))
+}
@@ -0,0 +1,403 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+
+	pkgMsg "github.com/ljanyst/peroxide/pkg/message"
+	"github.com/ljanyst/peroxide/pkg/store/cache"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// searchIndexKeyContext separates the key of the search index from the key
+// of the message cache even though both are derived from the same passphrase.
+const searchIndexKeyContext = "peroxide-search-index"
+
+// searchIndexRotationBatch is the number of entries re-encrypted in a single
+// transaction when the key of the search index is rotated.
+const searchIndexRotationBatch = 100
+
+// ErrSearchIndexLocked is returned when the search index cannot be used
+// because the cache passphrase is not known yet.
+var ErrSearchIndexLocked = errors.New("search index needs to be unlocked") //nolint[gochecknoglobals]
+
+// IndexedText is the searchable text of a message stored in the search index.
+type IndexedText struct {
+	Header string
+	Body   string
+}
+
+// ContainsBody returns whether the body contains the given string, ignoring case.
+func (text *IndexedText) ContainsBody(s string) bool {
+	return strings.Contains(strings.ToLower(text.Body), strings.ToLower(s))
+}
+
+// ContainsText returns whether the header or the body contains the given
+// string, ignoring case.
+func (text *IndexedText) ContainsText(s string) bool {
+	return strings.Contains(strings.ToLower(text.Header), strings.ToLower(s)) || text.ContainsBody(s)
+}
+
+func newSearchIndexCipher(passphrase []byte) (cipher.AEAD, error) {
+	key := sha256.Sum256(append([]byte(searchIndexKeyContext), passphrase...))
+
+	aes, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(aes)
+}
+
+func (store *Store) unlockSearchIndex(passphrase []byte) error {
+	gcm, err := newSearchIndexCipher(passphrase)
+	if err != nil {
+		return err
+	}
+
+	store.indexLock.Lock()
+	defer store.indexLock.Unlock()
+
+	store.indexGCM = gcm
+
+	return nil
+}
+
+// rotateSearchIndexKey re-encrypts the search index, encrypted with the old
+// passphrase, with the new one. New entries are encrypted with the new
+// passphrase right away; the old ones are re-encrypted in batches and can be
+// read with the old passphrase meanwhile. The entries which cannot be
+// decrypted are removed; the messages are indexed again when searched.
+func (store *Store) rotateSearchIndexKey(ctx context.Context, oldPassphrase, newPassphrase []byte) error {
+	oldGCM, err := newSearchIndexCipher(oldPassphrase)
+	if err != nil {
+		return err
+	}
+
+	gcm, err := newSearchIndexCipher(newPassphrase)
+	if err != nil {
+		return err
+	}
+
+	store.indexLock.Lock()
+	store.indexGCM = gcm
+	store.indexOldGCM = oldGCM
+	store.indexLock.Unlock()
+
+	defer func() {
+		store.indexLock.Lock()
+		defer store.indexLock.Unlock()
+
+		if store.indexOldGCM == oldGCM {
+			store.indexOldGCM = nil
+		}
+	}()
+
+	var next []byte
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if next, err = store.reencryptSearchIndexBatch(next, oldGCM, gcm); err != nil {
+			return err
+		}
+
+		if next == nil {
+			return nil
+		}
+	}
+}
+
+// reencryptSearchIndexBatch re-encrypts at most searchIndexRotationBatch
+// entries starting with the given message ID. It returns the message ID the
+// next batch starts with or nil when there are no more entries.
+func (store *Store) reencryptSearchIndexBatch(start []byte, oldGCM, gcm cipher.AEAD) (next []byte, err error) {
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(searchIndexBucket)
+		entries := map[string][]byte{}
+		next = nil
+
+		c := bucket.Cursor()
+
+		k, v := c.First()
+		if start != nil {
+			k, v = c.Seek(start)
+		}
+
+		for ; k != nil; k, v = c.Next() {
+			if len(entries) == searchIndexRotationBatch {
+				next = append([]byte{}, k...)
+				break
+			}
+
+			enc, err := reencryptSearchIndexEntry(v, oldGCM, gcm)
+			if err != nil {
+				return err
+			}
+
+			entries[string(k)] = enc
+		}
+
+		for messageID, enc := range entries {
+			if enc == nil {
+				if err := bucket.Delete([]byte(messageID)); err != nil {
+					return err
+				}
+			} else if err := bucket.Put([]byte(messageID), enc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return next, err
+}
+
+// reencryptSearchIndexEntry returns the entry encrypted with the new cipher.
+// Entries which are encrypted with the new cipher already are kept and the
+// ones which cannot be decrypted at all are dropped by returning nil.
+func reencryptSearchIndexEntry(enc []byte, oldGCM, gcm cipher.AEAD) ([]byte, error) {
+	if len(enc) <= gcm.NonceSize() {
+		return nil, nil
+	}
+
+	if _, err := gcm.Open(nil, enc[:gcm.NonceSize()], enc[gcm.NonceSize():], nil); err == nil {
+		return append([]byte{}, enc...), nil
+	}
+
+	plain, err := oldGCM.Open(nil, enc[:oldGCM.NonceSize()], enc[oldGCM.NonceSize():], nil)
+	if err != nil {
+		return nil, nil
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (store *Store) lockSearchIndex() {
+	store.indexLock.Lock()
+	defer store.indexLock.Unlock()
+
+	store.indexGCM = nil
+	store.indexOldGCM = nil
+}
+
+// getOldSearchIndexCipher returns the cipher of the previous passphrase while
+// the search index is being re-encrypted or nil otherwise.
+func (store *Store) getOldSearchIndexCipher() cipher.AEAD {
+	store.indexLock.RLock()
+	defer store.indexLock.RUnlock()
+
+	return store.indexOldGCM
+}
+
+// getSearchIndexCipher returns the cipher of the search index. The index is
+// unlocked together with the message cache by UnlockCache.
+func (store *Store) getSearchIndexCipher() (cipher.AEAD, error) {
+	store.indexLock.RLock()
+	defer store.indexLock.RUnlock()
+
+	if store.indexGCM == nil {
+		return nil, ErrSearchIndexLocked
+	}
+
+	return store.indexGCM, nil
+}
+
+// isSearchIndexUnlocked returns whether new messages can be indexed.
+func (store *Store) isSearchIndexUnlocked() bool {
+	store.indexLock.RLock()
+	defer store.indexLock.RUnlock()
+
+	return store.indexGCM != nil
+}
+
+// indexCreatedMessage indexes the message created by an event in the
+// background, so that the first search after it arrives does not have to
+// build it. The messages picked up by the cacher are indexed when they are
+// cached.
+func (store *Store) indexCreatedMessage(messageID string) {
+	if !store.isSearchIndexUnlocked() || store.isMessageADraft(messageID) {
+		return
+	}
+
+	if cache.IsOnDiskCache(store.cache) && !cache.IsFull(store.cache, store.user.ID()) {
+		return
+	}
+
+	go func() {
+		buildAndCacheJobs <- struct{}{}
+		defer func() { <-buildAndCacheJobs }()
+
+		job, done := store.newBuildJob(context.Background(), messageID, pkgMsg.BackgroundPriority)
+		defer done()
+
+		literal, err := job.GetResult()
+		if err != nil {
+			store.log.WithField("msgID", messageID).WithError(err).Warn("Failed to build message for indexing")
+			return
+		}
+
+		if _, err := store.indexMessage(messageID, literal); err != nil {
+			store.log.WithField("msgID", messageID).WithError(err).Warn("Failed to index message")
+		}
+	}()
+}
+
+// indexMessage extracts the text of the given message literal and puts it
+// in the search index. Drafts are not indexed because they can still change.
+func (store *Store) indexMessage(messageID string, literal []byte) (*IndexedText, error) {
+	header, body, err := pkgMsg.ExtractText(bytes.NewReader(literal))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to extract text")
+	}
+
+	text := &IndexedText{Header: header, Body: body}
+
+	if store.isMessageADraft(messageID) {
+		return text, nil
+	}
+
+	gcm, err := store.getSearchIndexCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := json.Marshal(text)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	enc := gcm.Seal(nonce, nonce, plain, nil)
+
+	if err := store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(searchIndexBucket).Put([]byte(messageID), enc)
+	}); err != nil {
+		return nil, err
+	}
+
+	return text, nil
+}
+
+// getIndexedText returns the indexed text of the message or nil if the
+// message was not indexed yet.
+func (store *Store) getIndexedText(messageID string) (*IndexedText, error) {
+	var enc []byte
+
+	if err := store.db.View(func(tx *bolt.Tx) error {
+		if raw := tx.Bucket(searchIndexBucket).Get([]byte(messageID)); raw != nil {
+			enc = append([]byte{}, raw...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if enc == nil {
+		return nil, nil
+	}
+
+	gcm, err := store.getSearchIndexCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(enc) <= gcm.NonceSize() {
+		return nil, nil
+	}
+
+	plain, err := gcm.Open(nil, enc[:gcm.NonceSize()], enc[gcm.NonceSize():], nil)
+	if oldGCM := store.getOldSearchIndexCipher(); err != nil && oldGCM != nil {
+		// The entry was not re-encrypted yet.
+		plain, err = oldGCM.Open(nil, enc[:oldGCM.NonceSize()], enc[oldGCM.NonceSize():], nil)
+	}
+	if err != nil {
+		// The entry was most likely written with an old passphrase.
+		store.log.WithField("msgID", messageID).WithError(err).Warn("Cannot decrypt search index entry")
+		return nil, nil
+	}
+
+	text := &IndexedText{}
+	if err := json.Unmarshal(plain, text); err != nil {
+		return nil, err
+	}
+
+	return text, nil
+}
+
+// txRemoveFromSearchIndex removes the message from the search index.
+func txRemoveFromSearchIndex(tx *bolt.Tx, apiID string) error {
+	return tx.Bucket(searchIndexBucket).Delete([]byte(apiID))
+}
+
+// clearSearchIndex removes all the entries from the search index.
+func (store *Store) clearSearchIndex() error {
+	store.lockSearchIndex()
+
+	return store.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(searchIndexBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err := tx.CreateBucket(searchIndexBucket)
+		return err
+	})
+}
+
+// GetIndexedText returns the searchable text of the message. If the message
+// is not in the search index yet, the message literal is obtained from the
+// message cache (or built) and indexed.
+func (message *Message) GetIndexedText() (*IndexedText, error) {
+	// With the index locked, the message is built from the cache which
+	// unlocks the index along with the cache.
+	text, err := message.store.getIndexedText(message.ID())
+	if err != nil && err != ErrSearchIndexLocked {
+		return nil, err
+	}
+
+	if text != nil && !message.msg.IsDraft() {
+		return text, nil
+	}
+
+	literal, err := message.store.getCachedMessage(message.ID())
+	if err != nil {
+		return nil, err
+	}
+
+	return message.store.indexMessage(message.ID(), literal)
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/pmapi"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+const indexedLiteral = "Subject: Quarterly report\r\nContent-Type: text/plain\r\n\r\nThe numbers look Good this time.\r\n"
+
+func TestSearchIndexAddGetRemove(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "Quarterly report",
+		Flags:   pmapi.FlagReceived,
+	})
+
+	text, err := m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.Nil(text)
+
+	_, err = m.store.indexMessage("msg1", []byte(indexedLiteral))
+	r.NoError(err)
+
+	text, err = m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.NotNil(text)
+	r.True(text.ContainsBody("look good"))
+	r.False(text.ContainsBody("quarterly"))
+	r.True(text.ContainsText("quarterly"))
+
+	// The text must not be stored in plain text.
+	r.NoError(m.store.db.View(func(tx *bolt.Tx) error {
+		r.NotContains(string(tx.Bucket(searchIndexBucket).Get([]byte("msg1"))), "numbers")
+		return nil
+	}))
+
+	r.NoError(m.store.deleteMessageEvent("msg1"))
+
+	text, err = m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.Nil(text)
+}
+
+func TestSearchIndexUnlocksWithKeyRing(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "Quarterly report",
+		Flags:   pmapi.FlagReceived,
+	})
+
+	_, err := m.store.indexMessage("msg1", []byte(indexedLiteral))
+	r.NoError(err)
+
+	m.store.lockSearchIndex()
+
+	_, err = m.store.getIndexedText("msg1")
+	r.Equal(ErrSearchIndexLocked, err)
+
+	kr, err := m.client.GetUserKeyRing()
+	r.NoError(err)
+	r.NoError(m.store.UnlockCache(kr))
+
+	text, err := m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.NotNil(text)
+	r.True(text.ContainsBody("numbers"))
+}
+
+func TestSearchIndexCreatedMessage(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "Quarterly report",
+		Flags:   pmapi.FlagReceived,
+		Body:    "body",
+	})
+
+	m.client.EXPECT().
+		KeyRingForAddressID(gomock.Any()).
+		Return(testPrivateKeyRing, nil).
+		Times(1)
+
+	m.store.indexCreatedMessage("msg1")
+
+	r.Eventually(func() bool {
+		text, err := m.store.getIndexedText("msg1")
+		return err == nil && text != nil && text.ContainsText("quarterly")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSearchIndexRotateKey(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "Quarterly report",
+		Flags:   pmapi.FlagReceived,
+	})
+
+	r.NoError(m.store.unlockSearchIndex([]byte("old")))
+
+	_, err := m.store.indexMessage("msg1", []byte(indexedLiteral))
+	r.NoError(err)
+
+	// More entries than fit in a single batch, some of them broken.
+	oldGCM, err := newSearchIndexCipher([]byte("old"))
+	r.NoError(err)
+
+	r.NoError(m.store.db.Update(func(tx *bolt.Tx) error {
+		for i := 0; i < 2*searchIndexRotationBatch; i++ {
+			enc := []byte("broken")
+			if i%2 == 0 {
+				nonce := make([]byte, oldGCM.NonceSize())
+				enc = oldGCM.Seal(nonce, nonce, []byte(`{"Body":"text"}`), nil)
+			}
+			if err := tx.Bucket(searchIndexBucket).Put([]byte(fmt.Sprintf("entry%03d", i)), enc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	r.NoError(m.store.rotateSearchIndexKey(context.Background(), []byte("old"), []byte("new")))
+	r.Nil(m.store.getOldSearchIndexCipher())
+
+	text, err := m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.True(text.ContainsBody("numbers"))
+
+	// Everything left is encrypted with the new key only.
+	gcm, err := newSearchIndexCipher([]byte("new"))
+	r.NoError(err)
+
+	r.NoError(m.store.db.View(func(tx *bolt.Tx) error {
+		r.Equal(searchIndexRotationBatch+1, tx.Bucket(searchIndexBucket).Stats().KeyN)
+
+		return tx.Bucket(searchIndexBucket).ForEach(func(k, v []byte) error {
+			_, err := gcm.Open(nil, v[:gcm.NonceSize()], v[gcm.NonceSize():], nil)
+			r.NoError(err, string(k))
+			return nil
+		})
+	}))
+}
+
+func TestSearchIndexReadDuringRotation(t *testing.T) {
+	r := require.New(t)
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true, &pmapi.Message{
+		ID:      "msg1",
+		Subject: "Quarterly report",
+		Flags:   pmapi.FlagReceived,
+	})
+
+	r.NoError(m.store.unlockSearchIndex([]byte("old")))
+
+	_, err := m.store.indexMessage("msg1", []byte(indexedLiteral))
+	r.NoError(err)
+
+	// Cancelled rotation switches the keys but re-encrypts nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	r.Error(m.store.rotateSearchIndexKey(ctx, []byte("old"), []byte("new")))
+
+	oldGCM, err := newSearchIndexCipher([]byte("old"))
+	r.NoError(err)
+
+	m.store.indexLock.Lock()
+	m.store.indexOldGCM = oldGCM
+	m.store.indexLock.Unlock()
+
+	text, err := m.store.getIndexedText("msg1")
+	r.NoError(err)
+	r.NotNil(text)
+	r.True(text.ContainsBody("numbers"))
+}
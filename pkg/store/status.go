@@ -0,0 +1,54 @@
+// Copyright (c) 2022 Lukasz Janyst <lukasz@jany.st>
+//
+// This file is part of Peroxide.
+//
+// Peroxide is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// Peroxide is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with Peroxide.  If not, see <https://www.gnu.org/licenses/>.
+
+package store
+
+import "time"
+
+// Status is the state of the synchronization of the store.
+type Status struct {
+	SyncRunning      bool
+	SyncFinished     bool
+	EventLoopRunning bool
+	LastEventPoll    time.Time
+}
+
+// GetStatus returns the current state of the sync and the event loop.
+func (store *Store) GetStatus() Status {
+	store.lock.RLock()
+	syncRunning := store.isSyncRunning
+	store.lock.RUnlock()
+
+	status := Status{
+		SyncRunning:  syncRunning,
+		SyncFinished: store.isSyncFinished(),
+	}
+
+	if store.eventLoop != nil {
+		status.EventLoopRunning = store.eventLoop.getIsRunning()
+		status.LastEventPoll = store.eventLoop.getLastPoll()
+	}
+
+	return status
+}
+
+// GetEventID returns the ID of the last event processed by the store. It
+// changes with every change of the account, so the exports can tell whether
+// there is anything new since the last run.
+func (store *Store) GetEventID() string {
+	return store.currentEvents.getEventID(store.user.ID())
+}
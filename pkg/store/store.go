@@ -20,6 +20,7 @@ package store
 
 import (
 	"context"
+	"crypto/cipher"
 	"fmt"
 	"os"
 	"sync"
@@ -61,6 +62,8 @@ var (
 	//   * {messageID} -> message body structure
 	// * size
 	//   * {messageID} -> uint32 value
+	// * search_index
+	//   * {messageID} -> encrypted text of the message used for BODY and TEXT search
 	// * counts
 	//   * {mailboxID} -> mailboxCounts: totalOnAPI, unreadOnAPI, labelName, labelColor, labelIsExclusive
 	// * address_info
@@ -83,10 +86,15 @@ var (
 	//       * {messageID} -> uint32 imapUID
 	//     * deleted_ids (can be missing or have no keys)
 	//       * {messageID} -> true
+	//     * mod_seqs (its sequence is the highest mod-sequence of the mailbox)
+	//       * {imapUID} -> uint64 mod-sequence of the last change
+	//     * vanished_ids
+	//       * {imapUID} -> uint64 mod-sequence of the expunge
 	metadataBucket        = []byte("metadata")          //nolint[gochecknoglobals]
 	headersBucket         = []byte("headers")           //nolint[gochecknoglobals]
 	bodystructureBucket   = []byte("bodystructure")     //nolint[gochecknoglobals]
 	sizeBucket            = []byte("size")              //nolint[gochecknoglobals]
+	searchIndexBucket     = []byte("search_index")      //nolint[gochecknoglobals]
 	countsBucket          = []byte("counts")            //nolint[gochecknoglobals]
 	addressInfoBucket     = []byte("address_info")      //nolint[gochecknoglobals]
 	addressModeBucket     = []byte("address_mode")      //nolint[gochecknoglobals]
@@ -96,6 +104,8 @@ var (
 	imapIDsBucket         = []byte("imap_ids")          //nolint[gochecknoglobals]
 	apiIDsBucket          = []byte("api_ids")           //nolint[gochecknoglobals]
 	deletedIDsBucket      = []byte("deleted_ids")       //nolint[gochecknoglobals]
+	modSeqsBucket         = []byte("mod_seqs")          //nolint[gochecknoglobals]
+	vanishedIDsBucket     = []byte("vanished_ids")      //nolint[gochecknoglobals]
 	mboxVersionBucket     = []byte("mailboxes_version") //nolint[gochecknoglobals]
 
 	// ErrNoSuchAPIID when mailbox does not have API ID.
@@ -132,10 +142,19 @@ type Store struct {
 	addresses map[string]*Address
 	notifier  ChangeNotifier
 
-	builder      *message.Builder
-	cache        cache.Cache
-	msgCachePool *MsgCachePool
-	done         chan struct{}
+	builder        *message.Builder
+	cache          cache.Cache
+	msgCachePool   *MsgCachePool
+	prefetchPolicy func() PrefetchPolicy
+	done           chan struct{}
+
+	indexGCM    cipher.AEAD
+	indexOldGCM cipher.AEAD
+	indexLock   sync.RWMutex
+
+	rotationCancel context.CancelFunc
+	rotationDone   chan struct{}
+	rotationLock   sync.Mutex
 
 	isSyncRunning bool
 	syncCooldown  cooldown
@@ -231,6 +250,7 @@ func openBoltDatabase(filePath string) (db *bolt.DB, err error) {
 			headersBucket,
 			bodystructureBucket,
 			sizeBucket,
+			searchIndexBucket,
 			countsBucket,
 			addressInfoBucket,
 			addressModeBucket,
@@ -409,6 +429,7 @@ func (store *Store) CloseEventLoopAndCacher() {
 	}
 
 	store.stopWatcher()
+	store.stopCacheKeyRotation()
 
 	store.msgCachePool.stop()
 }
@@ -447,11 +468,16 @@ func (store *Store) Remove() error {
 
 func (store *Store) RemoveCache() error {
 	store.stopWatcher()
+	store.stopCacheKeyRotation()
 
 	if err := store.clearCachePassphrase(); err != nil {
 		logrus.WithError(err).Error("Failed to clear cache passphrase")
 	}
 
+	if err := store.clearSearchIndex(); err != nil {
+		logrus.WithError(err).Error("Failed to clear search index")
+	}
+
 	return store.cache.Delete(store.user.ID())
 }
 
@@ -27,7 +27,7 @@ import (
 )
 
 func (loop *eventLoop) IsRunning() bool {
-	return loop.isRunning
+	return loop.getIsRunning()
 }
 
 // TestSync triggers a sync of the store.
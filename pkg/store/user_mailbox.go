@@ -64,6 +64,37 @@ func (store *Store) createMailbox(name string) error {
 	return err
 }
 
+// createLabel creates the label by calling an API and adds its mailbox to all
+// addresses right away, without waiting for the event loop.
+func (store *Store) createLabel(name string) (string, error) {
+	defer store.eventLoop.pollNow()
+
+	log.WithField("name", name).Debug("Creating label")
+
+	if store.hasMailbox(UserLabelsPrefix + name) {
+		return "", fmt.Errorf("label %v already exists", name)
+	}
+
+	label, err := store.client().CreateLabel(exposeContextForIMAP(), &pmapi.Label{
+		Name:  name,
+		Color: store.leastUsedColor(),
+		Type:  pmapi.LabelTypeMailBox,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if label.Path == "" {
+		label.Path = label.Name
+	}
+
+	if err := store.createOrUpdateMailboxEvent(label); err != nil {
+		return "", err
+	}
+
+	return label.ID, nil
+}
+
 // allAddressesHaveMailbox returns whether each address has a mailbox with the given labelID.
 func (store *Store) allAddressesHaveMailbox(labelID string) bool {
 	store.lock.RLock()
@@ -182,6 +182,23 @@ func (store *Store) SendMessage(messageID string, req *pmapi.SendMessageReq) err
 	return err
 }
 
+// ImportMessage imports the message encrypted for the address to its mailbox
+// with the given label. It is used for the messages peroxide writes to the
+// user itself, such as the delivery reports.
+func (store *Store) ImportMessage(addressID, labelID string, enc []byte, flags, time int64) (string, error) {
+	storeAddress, err := store.GetAddress(addressID)
+	if err != nil {
+		return "", err
+	}
+
+	storeMailbox, err := storeAddress.getMailboxByID(labelID)
+	if err != nil {
+		return "", err
+	}
+
+	return storeMailbox.ImportMessage(enc, false, nil, flags, time)
+}
+
 // getAllMessageIDs returns all API IDs of messages in the local database.
 func (store *Store) getAllMessageIDs() (apiIDs []string, err error) {
 	err = store.db.View(func(tx *bolt.Tx) error {
@@ -377,6 +394,10 @@ func (store *Store) deleteMessagesEvent(apiIDs []string) error {
 				return err
 			}
 
+			if err := txRemoveFromSearchIndex(tx, apiID); err != nil {
+				return err
+			}
+
 			for _, a := range store.addresses {
 				if err := a.txDeleteMessage(tx, apiID); err != nil {
 					return err
@@ -142,11 +142,13 @@ func (store *Store) triggerSync() {
 
 		store.isSyncRunning = true
 		store.lock.Unlock()
+		syncRunning.Set(1, store.UserID())
 
 		defer func() {
 			store.lock.Lock()
 			store.isSyncRunning = false
 			store.lock.Unlock()
+			syncRunning.Set(0, store.UserID())
 		}()
 
 		store.log.WithField("isIncomplete", syncState.isIncomplete()).Info("Store sync started")
@@ -154,6 +156,7 @@ func (store *Store) triggerSync() {
 		err := syncAllMail(store, store.client(), syncState)
 		if err != nil {
 			log.WithError(err).Error("Store sync failed")
+			syncFailures.Inc(store.UserID())
 			store.syncCooldown.increaseWaitTime()
 			return
 		}
@@ -163,6 +166,23 @@ func (store *Store) triggerSync() {
 	}()
 }
 
+// TriggerSync starts a sync on request of the user, skipping the cooldown
+// after failed syncs. The progress of an interrupted sync is dropped as well,
+// so the sync always starts from scratch. A running sync is left alone.
+func (store *Store) TriggerSync() {
+	store.lock.Lock()
+	if store.isSyncRunning {
+		store.lock.Unlock()
+		store.log.Info("Store sync is already ongoing")
+		return
+	}
+	store.syncCooldown.reset()
+	store.saveSyncState(0, nil, nil)
+	store.lock.Unlock()
+
+	store.triggerSync()
+}
+
 // isSyncFinished returns whether the database has finished a sync.
 func (store *Store) isSyncFinished() (isSynced bool) {
 	return store.loadSyncState().isFinished()
@@ -213,6 +233,8 @@ func (store *Store) loadSyncState() *syncState {
 // saveSyncState saves information about sync to database.
 // See `triggerSync` to learn more about possible states.
 func (store *Store) saveSyncState(finishTime int64, idRanges []*syncIDRange, idsToBeDeleted []string) {
+	store.observeSyncState(finishTime, idRanges, idsToBeDeleted)
+
 	idRangesData, err := json.Marshal(idRanges)
 	if err != nil {
 		store.log.WithError(err).Error("Failed to marshall sync IDs ranges")
@@ -254,3 +276,20 @@ func (store *Store) saveSyncState(finishTime int64, idRanges []*syncIDRange, ids
 		store.log.WithError(err).Error("Failed to set sync state")
 	}
 }
+
+func (store *Store) observeSyncState(finishTime int64, idRanges []*syncIDRange, idsToBeDeleted []string) {
+	finished := 0
+	for _, idRange := range idRanges {
+		if idRange.isFinished() {
+			finished++
+		}
+	}
+
+	syncIDRanges.Set(float64(finished), store.UserID(), "finished")
+	syncIDRanges.Set(float64(len(idRanges)-finished), store.UserID(), "pending")
+	syncUnconfirmedMessages.Set(float64(len(idsToBeDeleted)), store.UserID())
+
+	if finishTime != 0 {
+		syncFinishTime.Set(float64(finishTime)/1e9, store.UserID())
+	}
+}
@@ -18,9 +18,11 @@
 package store
 
 import (
+	"bytes"
 	"sort"
 	"testing"
 
+	"github.com/ljanyst/peroxide/pkg/metrics"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -69,6 +71,28 @@ func TestLoadSaveSyncState(t *testing.T) {
 	checkSyncStateAfterLoad(t, syncState, true, false, []string{})
 }
 
+func TestSyncStateMetrics(t *testing.T) {
+	m, clear := initMocks(t)
+	defer clear()
+
+	m.newStoreNoEvents(t, true)
+	insertMessage(t, m, "msg1", "Test message 1", addrID1, false, []string{pmapi.AllMailLabel, pmapi.InboxLabel})
+
+	syncState := m.store.loadSyncState()
+	syncState.initIDRanges()
+	require.Nil(t, syncState.loadMessageIDsToBeDeleted())
+
+	var buf bytes.Buffer
+	require.NoError(t, metrics.Write(&buf))
+	require.Contains(t, buf.String(), `peroxide_sync_unconfirmed_messages{user="userID"} 1`)
+
+	m.store.DeleteMetrics()
+
+	buf.Reset()
+	require.NoError(t, metrics.Write(&buf))
+	require.NotContains(t, buf.String(), `peroxide_sync_unconfirmed_messages{user="userID"}`)
+}
+
 func checkSyncStateAfterLoad(t *testing.T, syncState *syncState, wantIsFinished bool, wantIDRanges bool, wantIDsToBeDeleted []string) {
 	assert.Equal(t, wantIsFinished, syncState.isFinished())
 
@@ -36,6 +36,9 @@ import (
 // ErrLoggedOutUser is sent to IMAP and SMTP if user exists, password is OK but user is logged out from the app.
 var ErrLoggedOutUser = errors.New("account is logged out, use the app to login again")
 
+// ErrOfflineUser is returned by the operations that need the user to be brought online by a client first.
+var ErrOfflineUser = errors.New("account is not online, connect with a client first")
+
 // User is a struct on top of API client and credentials store.
 type User struct {
 	log           *logrus.Entry
@@ -252,6 +255,23 @@ func (u *User) IsConnected() bool {
 	return u.creds.IsConnected()
 }
 
+// IsOnline returns whether the user has been brought online by a client.
+func (u *User) IsOnline() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.client != nil
+}
+
+// IsLocked returns whether the credentials of the user are still encrypted,
+// i.e. no client has logged in since the start.
+func (u *User) IsLocked() bool {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	return u.creds.Locked()
+}
+
 func (u *User) GetClient() pmapi.Client {
 	if err := u.unlockIfNecessary(); err != nil {
 		u.log.WithError(err).Error("Failed to unlock user")
@@ -484,6 +504,10 @@ func (u *User) logout() error {
 	// Do not close whole store, just event loop. Some information might be needed offline (e.g. addressID)
 	u.closeEventLoopAndCacher()
 
+	if u.store != nil {
+		u.store.DeleteMetrics()
+	}
+
 	u.CloseAllConnections()
 
 	runtime.GC()
@@ -512,6 +536,56 @@ func (u *User) AddKeySlot(slot, mainKey string) (string, error) {
 	return u.credStorer.AddKeySlot(u.userID, slot, mainKey)
 }
 
+// ClearCache removes the cached messages and the search index of the user
+// and starts filling the cache again.
+func (u *User) ClearCache() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.client == nil || u.store == nil {
+		return ErrOfflineUser
+	}
+
+	kr, err := u.client.GetUserKeyRing()
+	if err != nil {
+		return err
+	}
+
+	return u.store.ClearCache(kr)
+}
+
+// RotateCacheKey replaces the passphrase of the user's message cache and
+// re-encrypts the cached messages in the background.
+func (u *User) RotateCacheKey() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.client == nil || u.store == nil {
+		return ErrOfflineUser
+	}
+
+	kr, err := u.client.GetUserKeyRing()
+	if err != nil {
+		return err
+	}
+
+	return u.store.RotateCacheKey(kr)
+}
+
+// Resync starts a full sync of the user's messages with the server.
+func (u *User) Resync() error {
+	u.lock.RLock()
+	defer u.lock.RUnlock()
+
+	if u.client == nil || u.store == nil {
+		return ErrOfflineUser
+	}
+
+	u.store.TriggerSync()
+
+	return nil
+}
+
 func (u *User) closeEventLoopAndCacher() {
 	if u.store == nil {
 		return
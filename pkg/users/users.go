@@ -123,7 +123,19 @@ func (u *Users) Login(username string, password []byte) (authClient pmapi.Client
 
 // FinishLogin finishes the login procedure and adds the user into the credentials store.
 // The main key is only required if we're updating an existing user and only returned if we're creating a new one
-func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []byte, mainKey string) (*User, string, error) { //nolint[funlen]
+func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []byte, mainKey string) (*User, string, error) {
+	return u.finishLogin(client, auth, password, mainKey, false)
+}
+
+// FinishRelogin works like FinishLogin but, instead of failing, it replaces
+// the session of an existing user who is still connected. The user is logged
+// out only once the new session and the main key check out, so a failed login
+// leaves the current session alone.
+func (u *Users) FinishRelogin(client pmapi.Client, auth *pmapi.Auth, password []byte, mainKey string) (*User, string, error) {
+	return u.finishLogin(client, auth, password, mainKey, true)
+}
+
+func (u *Users) finishLogin(client pmapi.Client, auth *pmapi.Auth, password []byte, mainKey string, replace bool) (*User, string, error) { //nolint[funlen]
 	apiUser, passphrase, err := getAPIUser(context.Background(), client, password)
 	if err != nil {
 		return nil, "", err
@@ -134,6 +146,12 @@ func (u *Users) FinishLogin(client pmapi.Client, auth *pmapi.Auth, password []by
 			return nil, "", err
 		}
 
+		if user.IsConnected() && replace {
+			if err := user.Logout(); err != nil {
+				return nil, "", errors.Wrap(err, "failed to log out the current session")
+			}
+		}
+
 		if user.IsConnected() {
 			if err := client.AuthDelete(context.Background()); err != nil {
 				logrus.WithError(err).Warn("Failed to delete new auth session")
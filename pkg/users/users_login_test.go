@@ -21,6 +21,7 @@ import (
 	"testing"
 
 	gomock "github.com/golang/mock/gomock"
+	"github.com/ljanyst/peroxide/pkg/events"
 	"github.com/ljanyst/peroxide/pkg/pmapi"
 	"github.com/pkg/errors"
 	r "github.com/stretchr/testify/require"
@@ -107,6 +108,56 @@ func TestUsersFinishLoginConnectedUser(t *testing.T) {
 	r.EqualError(t, err, "user is already connected")
 }
 
+func TestUsersFinishReloginConnectedUser(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Mock loading connected user.
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	// The old session is dropped only after the new one checks out.
+	gomock.InOrder(
+		m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil),
+		m.pmapiClient.EXPECT().Unlock(gomock.Any(), testCredentials.Secret.MailboxPassword).Return(nil),
+		m.pmapiClient.EXPECT().CurrentUser(gomock.Any()).Return(testPMAPIUser, nil),
+		m.pmapiClient.EXPECT().AuthDelete(gomock.Any()).Return(nil),
+		m.credentialsStore.EXPECT().Logout(testCredentials.UserID).Return(testCredentialsDisconnected, nil),
+		m.eventListener.EXPECT().Emit(events.CloseConnectionEvent, "user@pm.me"),
+		m.credentialsStore.EXPECT().UpdateToken(testCredentials.UserID, testAuthRefresh.UID, testAuthRefresh.RefreshToken).Return(testCredentials, nil),
+		m.credentialsStore.EXPECT().UpdatePassword(testCredentials.UserID, testCredentials.Secret.MailboxPassword).Return(testCredentials, nil),
+	)
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	user, _, err := users.FinishRelogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+	r.NoError(t, err)
+	r.Equal(t, testCredentials.UserID, user.ID())
+}
+
+func TestUsersFinishReloginBadMailboxPassword(t *testing.T) {
+	m := initMocks(t)
+	defer m.ctrl.Finish()
+
+	// Mock loading connected user.
+	m.credentialsStore.EXPECT().List().Return([]string{testCredentials.UserID}, nil)
+	mockLoadingConnectedUser(t, m, testCredentials)
+	mockEventLoopNoAction(m)
+
+	// A failed login must not touch the current session.
+	m.pmapiClient.EXPECT().AuthSalt(gomock.Any()).Return("", nil)
+	m.pmapiClient.EXPECT().Unlock(gomock.Any(), testCredentials.Secret.MailboxPassword).Return(errors.New("no keys could be unlocked"))
+
+	users := testNewUsers(t, m)
+	defer cleanUpUsersData(users)
+
+	_, _, err := users.FinishRelogin(m.pmapiClient, testAuthRefresh, testCredentials.Secret.MailboxPassword, testMainKeyString)
+	r.Equal(t, ErrWrongMailboxPassword, err)
+	r.True(t, users.users[0].IsConnected())
+}
+
 func checkUsersFinishLogin(t *testing.T, m mocks, auth *pmapi.Auth, mailboxPassword []byte, expectedUserID string, expectedErr error, expecedKey bool) {
 	users := testNewUsers(t, m)
 	defer cleanUpUsersData(users)